@@ -4,7 +4,6 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -12,26 +11,6 @@ import (
 	"github.com/scriptmaster/openagent/common"
 )
 
-// IsMaintenanceAuthenticated checks if the request has a valid maintenance authentication cookie
-func IsMaintenanceAuthenticated(r *http.Request) bool {
-	// Check for maintenance cookie
-	cookie, err := r.Cookie("maintenance_auth")
-	if err != nil {
-		return false
-	}
-
-	// Expected value with current version salt
-	// Compare against first 8 chars of version for basic check
-	currentVersion := common.GetEnv("APP_VERSION")
-	if len(currentVersion) < 8 {
-		currentVersion = "1.0.0.0_" // Default to avoid panic
-	}
-	expected := "authenticated_" + currentVersion[:8]
-
-	// Validate cookie value matches current version prefix
-	return cookie.Value == expected
-}
-
 // GetBuildNumber extracts the build number from the APP_VERSION env var.
 func GetBuildNumber() int {
 	currentVersion := common.GetEnv("APP_VERSION")
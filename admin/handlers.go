@@ -33,6 +33,7 @@ func HandleAdmin(w http.ResponseWriter, r *http.Request, templates types.Templat
 		User:       user,
 		AdminEmail: common.GetEnv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnv("APP_VERSION"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 		Stats:      &models.AdminStats{}, // Will be populated by the route handler
 	}
 
@@ -61,8 +62,8 @@ func HandleMaintenance(w http.ResponseWriter, r *http.Request, templates types.T
 	}
 }
 
-// HandleMaintenanceAuth processes the maintenance token submission
-func HandleMaintenanceAuth(w http.ResponseWriter, r *http.Request, sessionSalt string) {
+// HandleMaintenanceAuth redeems a break-glass recovery code from `openagent maintenance recovery-code`
+func HandleMaintenanceAuth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -74,22 +75,31 @@ func HandleMaintenanceAuth(w http.ResponseWriter, r *http.Request, sessionSalt s
 		return
 	}
 
-	// Validate token
-	submittedToken := r.FormValue("token")
-	envToken := common.GetEnv("MAINTENANCE_TOKEN")
-
-	if envToken == "" || submittedToken != envToken {
-		http.Redirect(w, r, "/maintenance?error="+url.QueryEscape("Invalid maintenance token"), http.StatusSeeOther)
+	// Redeem the code and open a maintenance session
+	if err := auth.StartMaintenanceSession(w, r, r.FormValue("token")); err != nil {
+		message := "Invalid, expired or already used recovery code"
+		if err != auth.ErrBreakGlassCodeInvalid {
+			log.Printf("ERROR: Failed to start maintenance session: %v", err)
+			message = "Failed to check the recovery code"
+		}
+		http.Redirect(w, r, "/maintenance?error="+url.QueryEscape(message), http.StatusSeeOther)
 		return
 	}
 
-	// Set authentication cookie
-	auth.SetMaintenanceCookie(w, sessionSalt)
-
 	// Redirect to configuration page
 	http.Redirect(w, r, "/maintenance/config", http.StatusSeeOther)
 }
 
+// HandleMaintenanceLogout ends the break-glass maintenance session
+func HandleMaintenanceLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth.EndMaintenanceSession(w, r)
+	http.Redirect(w, r, "/maintenance", http.StatusSeeOther)
+}
+
 // HandleMaintenanceConfig displays the maintenance configuration page
 func HandleMaintenanceConfig(w http.ResponseWriter, r *http.Request, templates types.TemplateEngineInterface, isMaintenanceAuthenticated func(r *http.Request) bool) {
 	// Verify authentication (MaintenanceHandler should handle this, but double-check)
@@ -355,6 +365,7 @@ func HandleAdminCLI(w http.ResponseWriter, r *http.Request, templates types.Temp
 		User:       user,
 		AdminEmail: common.GetEnv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnv("APP_VERSION"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	if err := templates.ExecuteTemplate(w, "admin-cli.html", data); err != nil {
@@ -416,6 +427,7 @@ func HandleAdminConnections(w http.ResponseWriter, r *http.Request, templates ty
 		User:       user,
 		AdminEmail: common.GetEnv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnv("APP_VERSION"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	if err := templates.ExecuteTemplate(w, "admin-connections.html", data); err != nil {
@@ -437,6 +449,7 @@ func HandleAdminTables(w http.ResponseWriter, r *http.Request, templates types.T
 		User:       user,
 		AdminEmail: common.GetEnv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnv("APP_VERSION"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	if err := templates.ExecuteTemplate(w, "admin-tables.html", data); err != nil {
@@ -458,6 +471,7 @@ func HandleAdminSettings(w http.ResponseWriter, r *http.Request, templates types
 		User:       user,
 		AdminEmail: common.GetEnv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnv("APP_VERSION"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	if err := templates.ExecuteTemplate(w, "admin-settings.html", data); err != nil {
@@ -500,6 +514,7 @@ func HandleConnections(w http.ResponseWriter, r *http.Request, templates types.T
 		User:       user,
 		AdminEmail: common.GetEnv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnv("APP_VERSION"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	if err := templates.ExecuteTemplate(w, "connections.html", data); err != nil {
@@ -521,6 +536,7 @@ func HandleTables(w http.ResponseWriter, r *http.Request, templates types.Templa
 		User:       user,
 		AdminEmail: common.GetEnv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnv("APP_VERSION"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	if err := templates.ExecuteTemplate(w, "tables.html", data); err != nil {
@@ -542,6 +558,7 @@ func HandleProfile(w http.ResponseWriter, r *http.Request, templates types.Templ
 		User:       user,
 		AdminEmail: common.GetEnv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnv("APP_VERSION"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	if err := templates.ExecuteTemplate(w, "profile.html", data); err != nil {
@@ -618,6 +635,7 @@ func CreateAdminHandler(templates types.TemplateEngineInterface, getDB func() *s
 			User:           user,
 			AdminEmail:     common.GetEnv("SYSADMIN_EMAIL"),
 			AppVersion:     common.GetEnv("APP_VERSION"),
+			CSRFToken:      auth.CSRFToken(r.Context()),
 			Stats:          stats,
 			RecentActivity: []interface{}{},                             // Empty for now, can be populated later
 			SystemHealth:   map[string]interface{}{"status": "healthy"}, // Basic system health info
@@ -629,13 +647,6 @@ func CreateAdminHandler(templates types.TemplateEngineInterface, getDB func() *s
 	}
 }
 
-// CreateMaintenanceAuthHandler creates a handler for maintenance auth
-func CreateMaintenanceAuthHandler(sessionSalt string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		HandleMaintenanceAuth(w, r, sessionSalt)
-	}
-}
-
 // CreateMaintenanceConfigHandler creates a handler for maintenance config
 func CreateMaintenanceConfigHandler(templates types.TemplateEngineInterface, isMaintenanceAuthenticated func(r *http.Request) bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -11,14 +11,17 @@ import (
 )
 
 // RegisterAdminRoutes registers all admin-related routes
-func RegisterAdminRoutes(router *http.ServeMux, templates types.TemplateEngineInterface, isMaintenanceAuthenticated func(r *http.Request) bool, updateDatabaseConfig func(host, port, user, password, dbname string) error, initDB func() (*sql.DB, error), sessionSalt string, getDB func() *sql.DB, getAdminStats func(*sql.DB) (*models.AdminStats, error)) {
+func RegisterAdminRoutes(router *http.ServeMux, templates types.TemplateEngineInterface, isMaintenanceAuthenticated func(r *http.Request) bool, updateDatabaseConfig func(host, port, user, password, dbname string) error, initDB func() (*sql.DB, error), getDB func() *sql.DB, getAdminStats func(*sql.DB) (*models.AdminStats, error)) {
 	// Admin dashboard - requires admin authentication
 	router.Handle("/admin", auth.AuthMiddleware(auth.IsAdminMiddleware(http.HandlerFunc(CreateAdminHandler(templates, getDB, getAdminStats)))))
 
-	router.HandleFunc("/maintenance/auth", CreateMaintenanceAuthHandler(sessionSalt))
-	router.HandleFunc("/maintenance/config", CreateMaintenanceConfigHandler(templates, isMaintenanceAuthenticated))
-	router.HandleFunc("/maintenance/configure", CreateMaintenanceConfigureHandler(templates, isMaintenanceAuthenticated, updateDatabaseConfig))
-	router.HandleFunc("/maintenance/initialize-schema", CreateInitializeSchemaHandler(isMaintenanceAuthenticated, initDB))
+	// Maintenance - /maintenance/auth redeems a break-glass recovery code, the rest needs its session
+	router.HandleFunc("/maintenance/auth", HandleMaintenanceAuth)
+	router.Handle("/maintenance/config", RequireMaintenanceSession(isMaintenanceAuthenticated, CreateMaintenanceConfigHandler(templates, isMaintenanceAuthenticated)))
+	router.Handle("/maintenance/configure", RequireMaintenanceSession(isMaintenanceAuthenticated, CreateMaintenanceConfigureHandler(templates, isMaintenanceAuthenticated, updateDatabaseConfig)))
+	router.Handle("/maintenance/initialize-schema", RequireMaintenanceSession(isMaintenanceAuthenticated, CreateInitializeSchemaHandler(isMaintenanceAuthenticated, initDB)))
+	router.Handle("/maintenance/logout", RequireMaintenanceSession(isMaintenanceAuthenticated, http.HandlerFunc(HandleMaintenanceLogout)))
+	router.Handle("/maintenance/", RequireMaintenanceSession(isMaintenanceAuthenticated, http.NotFoundHandler()))
 
 	// Admin CLI - requires admin authentication
 	router.Handle("/admin/cli", auth.AuthMiddleware(auth.IsAdminMiddleware(http.HandlerFunc(CreateAdminCLIHandler(templates, getDB)))))
@@ -38,6 +41,17 @@ func RegisterAdminRoutes(router *http.ServeMux, templates types.TemplateEngineIn
 	router.Handle("/profile", auth.AuthMiddleware(http.HandlerFunc(CreateProfileHandler(templates))))
 }
 
+// RequireMaintenanceSession sends requests without a break-glass maintenance session to the maintenance login
+func RequireMaintenanceSession(isMaintenanceAuthenticated func(r *http.Request) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMaintenanceAuthenticated(r) {
+			http.Redirect(w, r, "/maintenance", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // TODO: Check Unused???
 // MaintenanceHandler handles requests when in maintenance mode
 func MaintenanceHandler(next http.Handler, isMaintenanceMode func() bool, isMaintenanceAuthenticated func(r *http.Request) bool) http.Handler {
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Audit log actions for the account lifecycle
+const (
+	AuditUserDeactivate = "user.deactivate"
+	AuditUserReactivate = "user.reactivate"
+	AuditUserDelete     = "user.delete"
+	AuditUserExport     = "user.export"
+)
+
+// ErrAccountInactive is returned when a deactivated or deleted account logs in or uses a session or token
+var ErrAccountInactive = errors.New("this account has been deactivated")
+
+// AccountStatusSource reports whether accounts may log in and use their sessions and API tokens
+type AccountStatusSource interface {
+	// AccountActive reports whether the account may be used. The user may be built from token
+	// claims, so only its ID and ProjectID are reliable.
+	AccountActive(ctx context.Context, user *User) (bool, error)
+}
+
+// allAccountsActive is used without a database, where there is no account status to read
+type allAccountsActive struct{}
+
+func (allAccountsActive) AccountActive(ctx context.Context, user *User) (bool, error) {
+	return true, nil
+}
+
+var (
+	accountStatusSource      AccountStatusSource = allAccountsActive{}
+	accountStatusSourceMutex                     = &sync.Mutex{}
+)
+
+// SetAccountStatusSource replaces where account status is read from
+func SetAccountStatusSource(source AccountStatusSource) {
+	accountStatusSourceMutex.Lock()
+	defer accountStatusSourceMutex.Unlock()
+	accountStatusSource = source
+}
+
+// getAccountStatusSource returns the current account status source
+func getAccountStatusSource() AccountStatusSource {
+	accountStatusSourceMutex.Lock()
+	defer accountStatusSourceMutex.Unlock()
+	return accountStatusSource
+}
+
+// requireActiveAccount returns ErrAccountInactive for accounts that may not be used
+func requireActiveAccount(ctx context.Context, user *User) error {
+	active, err := getAccountStatusSource().AccountActive(ctx, user)
+	if err != nil {
+		return fmt.Errorf("failed to check account status: %w", err)
+	}
+	if !active {
+		return ErrAccountInactive
+	}
+	return nil
+}
+
+// loginFailure returns the /login error code for a failed browser login
+func loginFailure(err error) string {
+	if errors.Is(err, ErrAccountInactive) {
+		return "account_disabled"
+	}
+	return "login_failed"
+}
+
+// DeleteAccountCredentials ends every way an ai.users account can authenticate: its sessions,
+// API tokens, passkeys and two-factor enrolment. It is part of deleting an account.
+func DeleteAccountCredentials(ctx context.Context, userID int) error {
+	if _, err := RevokeUserSessions(ctx, 0, userID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	tokens, err := ListAPITokens(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to list API tokens: %w", err)
+	}
+	for _, token := range tokens {
+		if _, err := RevokeAPIToken(ctx, userID, token.ID); err != nil {
+			return fmt.Errorf("failed to revoke API token %d: %w", token.ID, err)
+		}
+	}
+	store := getWebAuthnStore()
+	passkeys, err := store.ListCredentials(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to list passkeys: %w", err)
+	}
+	for _, passkey := range passkeys {
+		if _, err := store.DeleteCredential(ctx, userID, passkey.ID); err != nil {
+			return fmt.Errorf("failed to remove passkey %d: %w", passkey.ID, err)
+		}
+	}
+	if err := DisableTwoFactor(ctx, userID); err != nil {
+		return fmt.Errorf("failed to remove two-factor enrolment: %w", err)
+	}
+	return nil
+}
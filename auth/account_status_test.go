@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// inactiveAccounts is an account status source that refuses the listed user IDs
+type inactiveAccounts map[int]bool
+
+func (a inactiveAccounts) AccountActive(ctx context.Context, user *User) (bool, error) {
+	return !a[user.ID], nil
+}
+
+// useAccountStatus installs an account status source for the duration of a test
+func useAccountStatus(t *testing.T, source AccountStatusSource) {
+	previous := getAccountStatusSource()
+	SetAccountStatusSource(source)
+	t.Cleanup(func() { SetAccountStatusSource(previous) })
+}
+
+// TestDeactivatedAccountLogin tests that deactivated accounts get neither a session nor a second factor step
+func TestDeactivatedAccountLogin(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryTwoFactorStore(t)
+	previousPolicy := getTwoFactorPolicy()
+	SetTwoFactorPolicy(fixedTwoFactorPolicy(false))
+	t.Cleanup(func() { SetTwoFactorPolicy(previousPolicy) })
+	plain := &User{ID: 61, Email: "deactivated@example.com"}
+	enrolled := &User{ID: 62, Email: "deactivated-2fa@example.com"}
+	enableTwoFactor(t, enrolled)
+	useAccountStatus(t, inactiveAccounts{plain.ID: true, enrolled.ID: true})
+
+	for _, user := range []*User{plain, enrolled} {
+		req := httptest.NewRequest(http.MethodPost, "/auth/password-login", strings.NewReader(`{"email":"`+user.Email+`","password":"secret"}`))
+		rec := httptest.NewRecorder()
+		HandlePasswordLogin(rec, req, passwordUserService{user: user})
+
+		var resp JSONResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Success || !strings.Contains(resp.Message, "deactivated") {
+			t.Errorf("Expected the login of user %d to be refused, got %+v, %v", user.ID, resp, err)
+		}
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Value != "" {
+				t.Errorf("Expected no cookies for user %d, got %s", user.ID, cookie.Name)
+			}
+		}
+		if sessions, _ := ListUserSessions(context.Background(), 0, user.ID); len(sessions) != 0 {
+			t.Errorf("Expected no session for user %d, got %d", user.ID, len(sessions))
+		}
+	}
+
+	// Identity provider callbacks send the browser to /login with the account_disabled code
+	_, err := finishBrowserLogin(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/auth/oidc/callback", nil), plain)
+	if !errors.Is(err, ErrAccountInactive) || loginFailure(err) != "account_disabled" {
+		t.Errorf("Expected a browser login to be refused as account_disabled, got %v", err)
+	}
+}
+
+// TestDeactivatedAccountRequests tests that sessions and API tokens stop working once an account is deactivated
+func TestDeactivatedAccountRequests(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryAPITokenStore(t)
+	ctx := context.Background()
+	user := &User{ID: 63, Email: "suspended@example.com"}
+	statuses := inactiveAccounts{}
+	useAccountStatus(t, statuses)
+
+	tokens, err := CreateSession(ctx, user, newSessionRequest(http.MethodGet, "/"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	_, secret, err := CreateAPIToken(ctx, user, "script", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	sessionRequest := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, newSessionRequest(http.MethodGet, "/dashboard", &http.Cookie{Name: GetSessionCookieName(), Value: tokens.AccessToken}))
+		return rec
+	}
+
+	if rec := sessionRequest(); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected the session to work while the account is active, got %d", rec.Code)
+	}
+	if rec := bearerRequest(http.MethodGet, "/api/projects/", secret); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the token to work while the account is active, got %d", rec.Code)
+	}
+
+	statuses[user.ID] = true
+	if rec := sessionRequest(); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?error=account_disabled" {
+		t.Errorf("Expected a redirect to login with account_disabled, got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := bearerRequest(http.MethodGet, "/api/projects/", secret); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the token of a deactivated account to get 401, got %d", rec.Code)
+	}
+	if rec := bearerRequest(http.MethodGet, "/api/projects/", tokens.AccessToken); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the access token of a deactivated account to get 401 as a bearer token, got %d", rec.Code)
+	}
+}
+
+// TestDeleteAccountCredentials tests that deleting an account ends its sessions, API tokens, passkeys and 2FA
+func TestDeleteAccountCredentials(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryAPITokenStore(t)
+	useMemoryTwoFactorStore(t)
+	passkeys := useMemoryWebAuthnStore(t)
+	ctx := context.Background()
+	user := &User{ID: 64, Email: "leaving@example.com"}
+
+	if _, err := CreateSession(ctx, user, newSessionRequest(http.MethodGet, "/")); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if _, _, err := CreateAPIToken(ctx, user, "script", nil, 0); err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	enableTwoFactor(t, user)
+	if err := passkeys.CreateCredential(ctx, &WebAuthnCredential{UserID: user.ID, RPID: "example.com", CredentialID: []byte{1, 2, 3}}); err != nil {
+		t.Fatalf("Failed to create passkey: %v", err)
+	}
+
+	if err := DeleteAccountCredentials(ctx, user.ID); err != nil {
+		t.Fatalf("Failed to delete credentials: %v", err)
+	}
+	if sessions, _ := ListUserSessions(ctx, 0, user.ID); len(sessions) != 0 {
+		t.Errorf("Expected no sessions, got %d", len(sessions))
+	}
+	if tokens, _ := ListAPITokens(ctx, user.ID); len(tokens) != 0 {
+		t.Errorf("Expected no API tokens, got %d", len(tokens))
+	}
+	if credentials, _ := passkeys.ListCredentials(ctx, user.ID); len(credentials) != 0 {
+		t.Errorf("Expected no passkeys, got %d", len(credentials))
+	}
+	if enrolled, _, _ := twoFactorStatus(ctx, user); enrolled {
+		t.Error("Expected the two-factor enrolment to be removed")
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// CreateAPITokenRequest is the body of a token creation request
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"` // 0 for a token that does not expire
+}
+
+// HandleAPITokensAPI lists the user's API tokens (GET), creates one (POST) or revokes one (DELETE ?id=).
+// The token string is only returned by the POST that creates it.
+func HandleAPITokensAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := ListAPITokens(r.Context(), user.ID)
+		if err != nil {
+			log.Printf("Error listing API tokens for user %d: %v", user.ID, err)
+			common.JSONError(w, "Failed to list tokens", http.StatusInternalServerError)
+			return
+		}
+		if tokens == nil {
+			tokens = []APIToken{}
+		}
+		common.JSONResponse(w, tokens)
+
+	case http.MethodPost:
+		// A leaked token must not be able to mint longer-lived ones
+		if GetAPITokenFromContext(r.Context()) != nil {
+			common.JSONError(w, "API tokens can only be created from a logged-in session", http.StatusForbidden)
+			return
+		}
+		var req CreateAPITokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			common.JSONError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresInDays < 0 {
+			common.JSONError(w, "expires_in_days cannot be negative", http.StatusBadRequest)
+			return
+		}
+		token, secret, err := CreateAPIToken(r.Context(), user, req.Name, req.Scopes, time.Duration(req.ExpiresInDays)*24*time.Hour)
+		if err != nil {
+			common.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("User %d created API token %d (%s) with scopes %v", user.ID, token.ID, token.Name, token.Scopes)
+		common.JSONResponse(w, map[string]interface{}{
+			"message": "Token created. Copy it now, it will not be shown again.",
+			"token":   secret,
+			"info":    token,
+		})
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			common.JSONError(w, "Token ID is required", http.StatusBadRequest)
+			return
+		}
+		found, err := RevokeAPIToken(r.Context(), user.ID, id)
+		if err != nil {
+			log.Printf("Error revoking API token %d for user %d: %v", id, user.ID, err)
+			common.JSONError(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			common.JSONError(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		common.JSONResponse(w, map[string]string{"message": "Token revoked"})
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
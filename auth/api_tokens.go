@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// apiTokenPrefix starts every personal access token, so they can be told apart from session tokens and found by secret scanners
+const apiTokenPrefix = "oat_"
+
+// apiTokenTouchInterval limits how often a token's last-used time is written
+const apiTokenTouchInterval = time.Minute
+
+// API token scopes
+const (
+	ScopeRead  = "read"  // GET, HEAD and OPTIONS requests
+	ScopeWrite = "write" // Requests with any method
+	ScopeAdmin = "admin" // Admin endpoints, for admin users only
+)
+
+var (
+	// ErrInvalidAPIToken is returned for unknown, expired and revoked tokens
+	ErrInvalidAPIToken = errors.New("invalid API token")
+	// ErrTokenScope is returned when a token's scopes do not cover a request
+	ErrTokenScope = errors.New("API token scope does not allow this request")
+)
+
+// APIToken is a personal access token. The token itself is never stored, only its hash.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Email      string     `json:"-"`
+	IsAdmin    bool       `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+// Active reports whether the token can still be used
+func (t *APIToken) Active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+// HasScope reports whether the token was granted a scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the token's scopes cover a request
+func (t *APIToken) Allows(r *http.Request) bool {
+	if isAdminPath(r.URL.Path) && !t.HasScope(ScopeAdmin) {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return t.HasScope(ScopeRead) || t.HasScope(ScopeWrite)
+	default:
+		return t.HasScope(ScopeWrite)
+	}
+}
+
+// ParseScopes validates a list of scopes, defaulting to read-only
+func ParseScopes(scopes []string) ([]string, error) {
+	seen := map[string]bool{}
+	var parsed []string
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope == "" || seen[scope] {
+			continue
+		}
+		if scope != ScopeRead && scope != ScopeWrite && scope != ScopeAdmin {
+			return nil, fmt.Errorf("unknown scope %q (use read, write or admin)", scope)
+		}
+		seen[scope] = true
+		parsed = append(parsed, scope)
+	}
+	if len(parsed) == 0 {
+		parsed = []string{ScopeRead}
+	}
+	sort.Strings(parsed)
+	return parsed, nil
+}
+
+// APITokenStore keeps personal access tokens.
+type APITokenStore interface {
+	// Create stores a new token and fills in its ID and creation time.
+	Create(ctx context.Context, token *APIToken) error
+	// GetByHash returns the token with the given hash, or nil when there is none.
+	GetByHash(ctx context.Context, hash string) (*APIToken, error)
+	// ListByUser returns a user's tokens that have not been revoked, newest first.
+	ListByUser(ctx context.Context, userID int) ([]APIToken, error)
+	// Revoke revokes one of a user's tokens and reports whether it existed.
+	Revoke(ctx context.Context, userID, id int) (bool, error)
+	// Touch records when a token was last used.
+	Touch(ctx context.Context, id int, at time.Time) error
+}
+
+// memoryAPITokenStore keeps tokens in process memory
+type memoryAPITokenStore struct {
+	mu     sync.Mutex
+	nextID int
+	tokens map[int]APIToken
+}
+
+// NewMemoryAPITokenStore creates an in-process API token store
+func NewMemoryAPITokenStore() APITokenStore {
+	return &memoryAPITokenStore{tokens: make(map[int]APIToken)}
+}
+
+func (s *memoryAPITokenStore) Create(ctx context.Context, token *APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	token.ID, token.CreatedAt = s.nextID, time.Now()
+	s.tokens[token.ID] = *token
+	return nil
+}
+
+func (s *memoryAPITokenStore) GetByHash(ctx context.Context, hash string) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		if token.Hash == hash {
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryAPITokenStore) ListByUser(ctx context.Context, userID int) ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []APIToken
+	for _, token := range s.tokens {
+		if token.UserID == userID && token.RevokedAt == nil {
+			list = append(list, token)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list, nil
+}
+
+func (s *memoryAPITokenStore) Revoke(ctx context.Context, userID, id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	if !ok || token.UserID != userID || token.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	token.RevokedAt = &now
+	s.tokens[id] = token
+	return true, nil
+}
+
+func (s *memoryAPITokenStore) Touch(ctx context.Context, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token, ok := s.tokens[id]; ok {
+		token.LastUsedAt = &at
+		s.tokens[id] = token
+	}
+	return nil
+}
+
+// postgresAPITokenStore keeps tokens in ai.api_tokens
+type postgresAPITokenStore struct {
+	db *sql.DB
+}
+
+// NewPostgresAPITokenStore creates an API token store backed by the ai.api_tokens table
+func NewPostgresAPITokenStore(db *sql.DB) APITokenStore {
+	return &postgresAPITokenStore{db: db}
+}
+
+func (s *postgresAPITokenStore) Create(ctx context.Context, token *APIToken) error {
+	return s.db.QueryRowContext(ctx, common.MustGetSQL("api_tokens/create"),
+		token.UserID, token.Name, token.Prefix, token.Hash, strings.Join(token.Scopes, ","), token.ExpiresAt,
+	).Scan(&token.ID, &token.CreatedAt)
+}
+
+func (s *postgresAPITokenStore) GetByHash(ctx context.Context, hash string) (*APIToken, error) {
+	token, err := scanAPIToken(s.db.QueryRowContext(ctx, common.MustGetSQL("api_tokens/get_by_hash"), hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	token.Hash = hash
+	return token, nil
+}
+
+func (s *postgresAPITokenStore) ListByUser(ctx context.Context, userID int) ([]APIToken, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("api_tokens/list_by_user"), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *token)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresAPITokenStore) Revoke(ctx context.Context, userID, id int) (bool, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("api_tokens/revoke"), id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresAPITokenStore) Touch(ctx context.Context, id int, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("api_tokens/touch"), id, at)
+	return err
+}
+
+// scanAPIToken reads a row selected by the api_tokens/get_by_hash and api_tokens/list_by_user queries
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (*APIToken, error) {
+	var token APIToken
+	var scopes string
+	var lastUsedAt, expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Email, &token.IsAdmin, &token.Name, &token.Prefix, &scopes,
+		&token.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Split(scopes, ",")
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+	return &token, nil
+}
+
+var (
+	apiTokenStore      = NewMemoryAPITokenStore() // Replaced with the Postgres store once the database is up
+	apiTokenStoreMutex = &sync.Mutex{}
+)
+
+// SetAPITokenStore replaces the store used for personal access tokens
+func SetAPITokenStore(store APITokenStore) {
+	apiTokenStoreMutex.Lock()
+	defer apiTokenStoreMutex.Unlock()
+	apiTokenStore = store
+}
+
+// getAPITokenStore returns the current API token store
+func getAPITokenStore() APITokenStore {
+	apiTokenStoreMutex.Lock()
+	defer apiTokenStoreMutex.Unlock()
+	return apiTokenStore
+}
+
+// hashAPIToken hashes a token for storage and lookup; tokens are random enough that a fast hash is safe
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateAPIToken issues a token for a user and returns it with the secret token string, which is only available now.
+// A zero ttl creates a token that does not expire.
+func CreateAPIToken(ctx context.Context, user *User, name string, scopes []string, ttl time.Duration) (*APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("token name is required")
+	}
+	scopes, err := ParseScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, scope := range scopes {
+		if scope == ScopeAdmin && !user.IsAdmin {
+			return nil, "", errors.New("only administrators can create tokens with the admin scope")
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	token := &APIToken{
+		UserID:  user.ID,
+		Email:   user.Email,
+		IsAdmin: user.IsAdmin,
+		Name:    name,
+		Prefix:  secret[:len(apiTokenPrefix)+6],
+		Hash:    hashAPIToken(secret),
+		Scopes:  scopes,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := getAPITokenStore().Create(ctx, token); err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// ValidateAPIToken returns the active token for a secret token string and records its use
+func ValidateAPIToken(ctx context.Context, secret string) (*APIToken, error) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, ErrInvalidAPIToken
+	}
+	store := getAPITokenStore()
+	token, err := store.GetByHash(ctx, hashAPIToken(secret))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if token == nil || !token.Active(now) {
+		return nil, ErrInvalidAPIToken
+	}
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= apiTokenTouchInterval {
+		if err := store.Touch(ctx, token.ID, now); err != nil {
+			return nil, err
+		}
+		token.LastUsedAt = &now
+	}
+	return token, nil
+}
+
+// ListAPITokens returns a user's tokens that have not been revoked
+func ListAPITokens(ctx context.Context, userID int) ([]APIToken, error) {
+	return getAPITokenStore().ListByUser(ctx, userID)
+}
+
+// RevokeAPIToken revokes one of a user's tokens and reports whether it existed
+func RevokeAPIToken(ctx context.Context, userID, id int) (bool, error) {
+	return getAPITokenStore().Revoke(ctx, userID, id)
+}
+
+// GetAPITokenFromContext returns the token a request was authenticated with, or nil for session requests
+func GetAPITokenFromContext(ctx context.Context) *APIToken {
+	token, _ := ctx.Value(apiTokenCtxKey{}).(*APIToken)
+	return token
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useMemoryAPITokenStore installs a fresh in-memory API token store for the duration of a test
+func useMemoryAPITokenStore(t *testing.T) APITokenStore {
+	previous := getAPITokenStore()
+	store := NewMemoryAPITokenStore()
+	SetAPITokenStore(store)
+	t.Cleanup(func() { SetAPITokenStore(previous) })
+	return store
+}
+
+// bearerRequest sends a request with a bearer token through AuthMiddleware and returns the response
+func bearerRequest(method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := GetUserFromContext(r.Context()); user != nil {
+			w.Write([]byte(user.Email))
+		}
+	})).ServeHTTP(rec, req)
+	return rec
+}
+
+// TestBearerAPIToken tests authenticating with personal access tokens and their scopes
+func TestBearerAPIToken(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryAPITokenStore(t)
+	ctx := context.Background()
+	user := &User{ID: 51, Email: "script@example.com"}
+
+	readOnly, readSecret, err := CreateAPIToken(ctx, user, "reports", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	if !strings.HasPrefix(readSecret, apiTokenPrefix) || readOnly.Hash == readSecret || strings.Join(readOnly.Scopes, ",") != ScopeRead {
+		t.Fatalf("Expected a hashed read-only token, got %+v", readOnly)
+	}
+
+	if rec := bearerRequest(http.MethodGet, "/api/projects/", readSecret); rec.Code != http.StatusOK || rec.Body.String() != user.Email {
+		t.Fatalf("Expected the token to authenticate a GET, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := bearerRequest(http.MethodPost, "/api/projects/", readSecret); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a read-only token to be refused for POST, got %d", rec.Code)
+	}
+	if rec := bearerRequest(http.MethodGet, "/admin/sessions", readSecret); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a token without the admin scope to be refused on admin paths, got %d", rec.Code)
+	}
+	if rec := bearerRequest(http.MethodGet, "/api/projects/", apiTokenPrefix+"unknown"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown token to get 401, got %d", rec.Code)
+	}
+
+	tokens, _ := ListAPITokens(ctx, user.ID)
+	if len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+		t.Errorf("Expected the token's last use to be recorded, got %+v", tokens)
+	}
+
+	if _, _, err := CreateAPIToken(ctx, user, "escalate", []string{ScopeAdmin}, 0); err == nil {
+		t.Error("Expected non-admins to be refused the admin scope")
+	}
+	if found, _ := RevokeAPIToken(ctx, 99, readOnly.ID); found {
+		t.Error("Expected users not to revoke other users' tokens")
+	}
+	if found, _ := RevokeAPIToken(ctx, user.ID, readOnly.ID); !found {
+		t.Fatal("Expected the token to be revoked")
+	}
+	if rec := bearerRequest(http.MethodGet, "/api/projects/", readSecret); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked token to get 401, got %d", rec.Code)
+	}
+}
+
+// TestAPITokenExpiry tests that expired tokens are refused
+func TestAPITokenExpiry(t *testing.T) {
+	useMemorySessionStore(t)
+	store := useMemoryAPITokenStore(t)
+	user := &User{ID: 52, Email: "expiring@example.com"}
+
+	token, secret, err := CreateAPIToken(context.Background(), user, "short", []string{"write"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	if rec := bearerRequest(http.MethodPost, "/api/projects/", secret); rec.Code != http.StatusOK {
+		t.Fatalf("Expected a write token to be accepted for POST, got %d", rec.Code)
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	token.ExpiresAt = &expired
+	store.(*memoryAPITokenStore).tokens[token.ID] = *token
+	if rec := bearerRequest(http.MethodGet, "/api/projects/", secret); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired token to get 401, got %d", rec.Code)
+	}
+}
+
+// TestAPITokensAPI tests that tokens cannot be used to create more tokens
+func TestAPITokensAPI(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryAPITokenStore(t)
+	_, secret, _ := CreateAPIToken(context.Background(), &User{ID: 53, Email: "api@example.com"}, "ci", []string{"write"}, 0)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/profile/tokens", strings.NewReader(`{"name":"more","scopes":["write"]}`))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	rec := httptest.NewRecorder()
+	AuthMiddleware(http.HandlerFunc(HandleAPITokensAPI)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected token creation with a token to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if _, err := ParseScopes([]string{"read", "delete"}); err == nil {
+		t.Error("Expected unknown scopes to be rejected")
+	}
+}
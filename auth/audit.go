@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// Audit log actions
+const (
+	AuditImpersonationStart   = "impersonation.start"
+	AuditImpersonationStop    = "impersonation.stop"
+	AuditImpersonationRequest = "impersonation.request" // A request made while impersonating
+)
+
+// maxAuditEntries bounds how many entries one listing returns
+const maxAuditEntries = 500
+
+// AuditEntry records an action taken by an actor, possibly as another user
+type AuditEntry struct {
+	ID              int64     `json:"id"`
+	ActorID         int       `json:"actor_id"`
+	ActorEmail      string    `json:"actor_email"`
+	UserID          int       `json:"user_id,omitempty"`
+	UserEmail       string    `json:"user_email,omitempty"`
+	Action          string    `json:"action"`
+	Detail          string    `json:"detail,omitempty"`
+	ImpersonationID string    `json:"impersonation_id,omitempty"`
+	IP              string    `json:"ip,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// AuditFilter selects audit entries; zero fields match everything
+type AuditFilter struct {
+	ActorID         int
+	UserID          int
+	ImpersonationID string
+	Limit           int
+}
+
+// matches reports whether an entry is selected by the filter
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	return (f.ActorID == 0 || entry.ActorID == f.ActorID) &&
+		(f.UserID == 0 || entry.UserID == f.UserID) &&
+		(f.ImpersonationID == "" || entry.ImpersonationID == f.ImpersonationID)
+}
+
+// limit returns how many entries to list
+func (f AuditFilter) limit() int {
+	if f.Limit <= 0 || f.Limit > maxAuditEntries {
+		return maxAuditEntries
+	}
+	return f.Limit
+}
+
+// AuditStore keeps the audit log. Entries are never changed or deleted through it.
+type AuditStore interface {
+	// Record appends an entry and sets its ID and time.
+	Record(ctx context.Context, entry *AuditEntry) error
+	// List returns the entries selected by a filter, newest first.
+	List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+}
+
+// memoryAuditStore keeps the audit log in process memory
+type memoryAuditStore struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// NewMemoryAuditStore creates an in-process audit log
+func NewMemoryAuditStore() AuditStore {
+	return &memoryAuditStore{}
+}
+
+func (s *memoryAuditStore) Record(ctx context.Context, entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.ID = int64(len(s.entries) + 1)
+	entry.CreatedAt = time.Now()
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+func (s *memoryAuditStore) List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []AuditEntry
+	for i := len(s.entries) - 1; i >= 0 && len(list) < filter.limit(); i-- {
+		if filter.matches(s.entries[i]) {
+			list = append(list, s.entries[i])
+		}
+	}
+	return list, nil
+}
+
+// postgresAuditStore keeps the audit log in ai.audit_log
+type postgresAuditStore struct {
+	db *sql.DB
+}
+
+// NewPostgresAuditStore creates an audit log backed by the ai.audit_log table
+func NewPostgresAuditStore(db *sql.DB) AuditStore {
+	return &postgresAuditStore{db: db}
+}
+
+func (s *postgresAuditStore) Record(ctx context.Context, entry *AuditEntry) error {
+	return s.db.QueryRowContext(ctx, common.MustGetSQL("audit_log/create"),
+		entry.ActorID, entry.ActorEmail, entry.UserID, entry.UserEmail, entry.Action, entry.Detail, entry.ImpersonationID, entry.IP,
+	).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+func (s *postgresAuditStore) List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("audit_log/list"),
+		filter.ActorID, filter.UserID, filter.ImpersonationID, filter.limit())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.Scan(&entry.ID, &entry.ActorID, &entry.ActorEmail, &entry.UserID, &entry.UserEmail,
+			&entry.Action, &entry.Detail, &entry.ImpersonationID, &entry.IP, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, entry)
+	}
+	return list, rows.Err()
+}
+
+var (
+	auditStore      = NewMemoryAuditStore() // Replaced with the Postgres store once the database is up
+	auditStoreMutex = &sync.Mutex{}
+)
+
+// SetAuditStore replaces the store used for the audit log
+func SetAuditStore(store AuditStore) {
+	auditStoreMutex.Lock()
+	defer auditStoreMutex.Unlock()
+	auditStore = store
+}
+
+// getAuditStore returns the current audit log store
+func getAuditStore() AuditStore {
+	auditStoreMutex.Lock()
+	defer auditStoreMutex.Unlock()
+	return auditStore
+}
+
+// RecordAudit appends an entry to the audit log. Failures are logged, since the action has already happened.
+func RecordAudit(ctx context.Context, entry AuditEntry) {
+	if err := getAuditStore().Record(ctx, &entry); err != nil {
+		log.Printf("ERROR: Failed to record audit entry %s by user %d: %v", entry.Action, entry.ActorID, err)
+	}
+}
+
+// HandleAdminAudit lists audit entries for admins: GET ?actor_id=&user_id=&impersonation_id=&limit=
+func HandleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter := AuditFilter{ImpersonationID: query.Get("impersonation_id")}
+	for name, value := range map[string]*int{"actor_id": &filter.ActorID, "user_id": &filter.UserID, "limit": &filter.Limit} {
+		if query.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil || n < 0 {
+			common.JSONError(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+		*value = n
+	}
+
+	entries, err := getAuditStore().List(r.Context(), filter)
+	if err != nil {
+		log.Printf("Error listing audit entries: %v", err)
+		common.JSONError(w, "Failed to list audit entries", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	common.JSONResponse(w, entries)
+}
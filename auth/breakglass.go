@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Break-glass access to /maintenance: an operator with shell access on the server runs
+// `openagent maintenance recovery-code` and redeems the printed code on the maintenance page.
+// Codes and the sessions they open are kept in a local file, so they work while the DB is down.
+
+// Audit log actions
+const (
+	AuditBreakGlassUse    = "breakglass.use"
+	AuditBreakGlassReject = "breakglass.reject"
+)
+
+// defaultBreakGlassFile is where codes and sessions are kept unless BREAKGLASS_FILE is set
+const defaultBreakGlassFile = "data/breakglass.json"
+
+// ErrBreakGlassCodeInvalid is returned for unknown, expired and already used recovery codes
+var ErrBreakGlassCodeInvalid = errors.New("invalid, expired or already used recovery code")
+
+// breakGlassCode is an issued recovery code; only its hash is stored
+type breakGlassCode struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"hash"`
+	Note      string     `json:"note,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	UsedFrom  string     `json:"used_from,omitempty"`
+}
+
+// breakGlassSession is a maintenance session opened by redeeming a code
+type breakGlassSession struct {
+	Hash      string    `json:"hash"`
+	CodeID    string    `json:"code_id"`
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// breakGlassState is the content of the break-glass file
+type breakGlassState struct {
+	Codes    []breakGlassCode    `json:"codes"`
+	Sessions []breakGlassSession `json:"sessions"`
+}
+
+// breakGlassMu serializes the read-modify-write cycles of this process on the file
+var breakGlassMu sync.Mutex
+
+// breakGlassFile returns the path of the break-glass file. It is read directly rather than through
+// the env cache so the CLI and the server agree on it even when .env changes.
+func breakGlassFile() string {
+	if path := os.Getenv("BREAKGLASS_FILE"); path != "" {
+		return path
+	}
+	return defaultBreakGlassFile
+}
+
+// breakGlassCodeTTL is how long an issued code can be redeemed
+func breakGlassCodeTTL() time.Duration {
+	return durationFromEnv("BREAKGLASS_CODE_TTL", 15*time.Minute)
+}
+
+// breakGlassSessionTTL is how long a redeemed code gives access to /maintenance
+func breakGlassSessionTTL() time.Duration {
+	return durationFromEnv("BREAKGLASS_SESSION_TTL", time.Hour)
+}
+
+// loadBreakGlassState reads the file without its expired codes and sessions.
+// The caller holds breakGlassMu.
+func loadBreakGlassState() (*breakGlassState, error) {
+	path := breakGlassFile()
+	state := &breakGlassState{}
+	raw, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read break-glass file: %w", err)
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, state); err != nil {
+			return nil, fmt.Errorf("failed to parse break-glass file %s: %w", path, err)
+		}
+	}
+
+	now := time.Now()
+	codes := state.Codes[:0]
+	for _, code := range state.Codes {
+		if now.Before(code.ExpiresAt) {
+			codes = append(codes, code)
+		}
+	}
+	state.Codes = codes
+	sessions := state.Sessions[:0]
+	for _, session := range state.Sessions {
+		if now.Before(session.ExpiresAt) {
+			sessions = append(sessions, session)
+		}
+	}
+	state.Sessions = sessions
+	return state, nil
+}
+
+// updateBreakGlassState applies fn to the loaded state and writes the result back atomically.
+// The file is only written when fn returns nil. The cycle holds breakGlassMu against other requests
+// and a lock file against other processes, such as the command line tool creating codes.
+func updateBreakGlassState(fn func(state *breakGlassState) error) error {
+	breakGlassMu.Lock()
+	defer breakGlassMu.Unlock()
+
+	path := breakGlassFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create break-glass directory: %w", err)
+	}
+	unlock, err := lockBreakGlassFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := loadBreakGlassState()
+	if err != nil {
+		return err
+	}
+	if err := fn(state); err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".breakglass-*")
+	if err != nil {
+		return fmt.Errorf("failed to write break-glass file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write break-glass file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write break-glass file: %w", err)
+	}
+	// CreateTemp already uses 0600, so the codes' hashes stay readable by the server user only
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write break-glass file: %w", err)
+	}
+	return nil
+}
+
+// newRecoveryCode returns a random code in groups of four, easy to read out and type
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 15)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	encoded := base32.StdEncoding.EncodeToString(b)
+	var groups []string
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes in a typed recovery code
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(code)))
+}
+
+// hashBreakGlassSecret hashes a code or session token for storage
+func hashBreakGlassSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueBreakGlassCode creates a single-use recovery code and returns it with its expiry.
+// The note records why or by whom the code was requested.
+func IssueBreakGlassCode(note string) (string, time.Time, error) {
+	code, err := newRecoveryCode()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	id, err := randomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	id = id[:8]
+	now := time.Now()
+	expiresAt := now.Add(breakGlassCodeTTL())
+	err = updateBreakGlassState(func(state *breakGlassState) error {
+		state.Codes = append(state.Codes, breakGlassCode{ID: id, Hash: hashBreakGlassSecret(normalizeRecoveryCode(code)), Note: note, CreatedAt: now, ExpiresAt: expiresAt})
+		return nil
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	log.Printf("AUDIT: Break-glass recovery code %s issued (%q), expires %s", id, note, expiresAt.Format(time.RFC3339))
+	return code, expiresAt, nil
+}
+
+// RedeemBreakGlassCode uses up a recovery code and returns its ID. Every attempt is logged
+// and recorded in the audit log.
+func RedeemBreakGlassCode(ctx context.Context, code, ip string) (string, error) {
+	hash := hashBreakGlassSecret(normalizeRecoveryCode(code))
+	var id string
+	err := updateBreakGlassState(func(state *breakGlassState) error {
+		for i := range state.Codes {
+			if state.Codes[i].Hash != hash {
+				continue
+			}
+			if state.Codes[i].UsedAt != nil {
+				id = state.Codes[i].ID
+				return ErrBreakGlassCodeInvalid
+			}
+			now := time.Now()
+			state.Codes[i].UsedAt, state.Codes[i].UsedFrom = &now, ip
+			id = state.Codes[i].ID
+			return nil
+		}
+		return ErrBreakGlassCodeInvalid
+	})
+	if err != nil {
+		detail := err.Error()
+		if id != "" {
+			detail = "code " + id + " reused"
+		}
+		log.Printf("AUDIT: Break-glass recovery code rejected from %s: %s", ip, detail)
+		RecordAudit(ctx, AuditEntry{ActorEmail: "break-glass", Action: AuditBreakGlassReject, Detail: detail, IP: ip})
+		return "", err
+	}
+	log.Printf("AUDIT: Break-glass recovery code %s used from %s", id, ip)
+	RecordAudit(ctx, AuditEntry{ActorEmail: "break-glass", Action: AuditBreakGlassUse, Detail: "code " + id, IP: ip})
+	return id, nil
+}
+
+// StartMaintenanceSession redeems a recovery code and sets the maintenance session cookie
+func StartMaintenanceSession(w http.ResponseWriter, r *http.Request, code string) error {
+	ip := ClientIP(r)
+	codeID, err := RedeemBreakGlassCode(r.Context(), code, ip)
+	if err != nil {
+		return err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(breakGlassSessionTTL())
+	err = updateBreakGlassState(func(state *breakGlassState) error {
+		state.Sessions = append(state.Sessions, breakGlassSession{Hash: hashBreakGlassSecret(token), CodeID: codeID, IP: ip, ExpiresAt: expiresAt})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	SetMaintenanceCookie(w, token, expiresAt)
+	return nil
+}
+
+// IsMaintenanceAuthenticated checks if the request carries an unexpired maintenance session cookie
+func IsMaintenanceAuthenticated(r *http.Request) bool {
+	cookie, err := r.Cookie(GetMaintenanceCookieName())
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	hash := hashBreakGlassSecret(cookie.Value)
+
+	breakGlassMu.Lock()
+	defer breakGlassMu.Unlock()
+	state, err := loadBreakGlassState()
+	if err != nil {
+		log.Printf("ERROR: Failed to check maintenance session: %v", err)
+		return false
+	}
+	for _, session := range state.Sessions {
+		if session.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// EndMaintenanceSession revokes the request's maintenance session and clears its cookie
+func EndMaintenanceSession(w http.ResponseWriter, r *http.Request) {
+	ClearMaintenanceCookie(w)
+	cookie, err := r.Cookie(GetMaintenanceCookieName())
+	if err != nil {
+		return
+	}
+	hash := hashBreakGlassSecret(cookie.Value)
+	err = updateBreakGlassState(func(state *breakGlassState) error {
+		sessions := state.Sessions[:0]
+		for _, session := range state.Sessions {
+			if session.Hash != hash {
+				sessions = append(sessions, session)
+			}
+		}
+		state.Sessions = sessions
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to end maintenance session: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package auth
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockBreakGlassFile takes an exclusive lock on path+".lock", so the server and the command line
+// tool do not lose each other's changes to the break-glass file. It blocks until the lock is free.
+func lockBreakGlassFile(path string) (unlock func(), err error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open break-glass lock: %w", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock break-glass file: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}, nil
+}
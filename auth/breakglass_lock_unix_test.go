@@ -0,0 +1,46 @@
+//go:build unix
+
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBreakGlassFileLock tests that changes to the break-glass file wait while another process holds its lock
+func TestBreakGlassFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breakglass.json")
+	t.Setenv("BREAKGLASS_FILE", path)
+
+	// A second open of the lock file conflicts like another process would
+	unlock, err := lockBreakGlassFile(path)
+	if err != nil {
+		t.Fatalf("Failed to lock the break-glass file: %v", err)
+	}
+	issued := make(chan error, 1)
+	go func() {
+		_, _, err := IssueBreakGlassCode("locked")
+		issued <- err
+	}()
+
+	select {
+	case err := <-issued:
+		unlock()
+		t.Fatalf("Expected issuing a code to wait for the lock, it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case err := <-issued:
+		if err != nil {
+			t.Fatalf("IssueBreakGlassCode failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected issuing a code to finish once the lock is released")
+	}
+	state, err := loadBreakGlassState()
+	if err != nil || len(state.Codes) != 1 {
+		t.Errorf("Expected the issued code to be stored, got %+v, %v", state, err)
+	}
+}
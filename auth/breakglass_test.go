@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBreakGlassMaintenance tests issuing and redeeming recovery codes and the maintenance sessions they open
+func TestBreakGlassMaintenance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breakglass.json")
+	t.Setenv("BREAKGLASS_FILE", path)
+	audit := useMemoryAuditStore(t)
+
+	code, expiresAt, err := IssueBreakGlassCode("test")
+	if err != nil {
+		t.Fatalf("IssueBreakGlassCode failed: %v", err)
+	}
+	if time.Until(expiresAt) <= 0 || time.Until(expiresAt) > 15*time.Minute {
+		t.Errorf("Expected the code to expire within 15 minutes, got %s", expiresAt)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the break-glass file to be written: %v", err)
+	}
+	if strings.Contains(string(raw), normalizeRecoveryCode(code)) {
+		t.Error("Expected the break-glass file to hold the code's hash only")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the break-glass file to be private, got %v", info.Mode().Perm())
+	}
+
+	login := func(code string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		if err := StartMaintenanceSession(rec, httptest.NewRequest(http.MethodPost, "/maintenance/auth", nil), code); err != nil && err != ErrBreakGlassCodeInvalid {
+			t.Fatalf("StartMaintenanceSession failed: %v", err)
+		}
+		return rec
+	}
+	request := func(cookies ...*http.Cookie) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/maintenance/config", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	if IsMaintenanceAuthenticated(request(&http.Cookie{Name: GetMaintenanceCookieName(), Value: "authenticated_12345678"})) {
+		t.Error("Expected a forged maintenance cookie to be refused")
+	}
+	if cookies := login("AAAA-BBBB-CCCC-DDDD-EEEE-FFFF").Result().Cookies(); len(cookies) != 0 {
+		t.Error("Expected an unknown code to be refused")
+	}
+
+	// Codes are case and dash insensitive
+	cookies := login(strings.ToLower(strings.ReplaceAll(code, "-", " "))).Result().Cookies()
+	if len(cookies) != 1 || !IsMaintenanceAuthenticated(request(cookies...)) {
+		t.Fatal("Expected the code to open a maintenance session")
+	}
+	if again := login(code).Result().Cookies(); len(again) != 0 {
+		t.Error("Expected a used code to be refused")
+	}
+
+	entries, _ := audit.List(context.Background(), AuditFilter{})
+	actions := map[string]int{}
+	for _, entry := range entries {
+		actions[entry.Action]++
+	}
+	if actions[AuditBreakGlassUse] != 1 || actions[AuditBreakGlassReject] != 2 {
+		t.Errorf("Expected one use and two rejections in the audit log, got %v", actions)
+	}
+
+	rec := httptest.NewRecorder()
+	EndMaintenanceSession(rec, request(cookies...))
+	if IsMaintenanceAuthenticated(request(cookies...)) {
+		t.Error("Expected the maintenance session to end")
+	}
+
+	// Expired codes are refused and dropped from the file
+	expired, _, err := IssueBreakGlassCode("expired")
+	if err != nil {
+		t.Fatalf("IssueBreakGlassCode failed: %v", err)
+	}
+	updateBreakGlassState(func(state *breakGlassState) error {
+		for i := range state.Codes {
+			state.Codes[i].ExpiresAt = time.Now().Add(-time.Second)
+		}
+		return nil
+	})
+	if _, err := RedeemBreakGlassCode(context.Background(), expired, "127.0.0.1"); err != ErrBreakGlassCodeInvalid {
+		t.Errorf("Expected an expired code to be refused, got %v", err)
+	}
+}
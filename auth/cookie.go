@@ -19,11 +19,65 @@ func SetSessionCookie(w http.ResponseWriter, jwtString string, expiryDuration ti
 	})
 }
 
-// ClearSessionCookie clears the session cookie
+// GetRefreshCookieName returns the name of the cookie holding the refresh token
+func GetRefreshCookieName() string {
+	return GetSessionCookieName() + "_refresh"
+}
+
+// SetSessionCookies sets the access token cookie and, when it was rotated, the refresh token cookie
+func SetSessionCookies(w http.ResponseWriter, tokens *SessionTokens) {
+	SetSessionCookie(w, tokens.AccessToken, time.Until(tokens.AccessExpiresAt))
+	if tokens.RefreshToken == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetRefreshCookieName(),
+		Value:    tokens.RefreshToken,
+		Path:     "/",
+		Expires:  tokens.RefreshExpiresAt,
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearSessionCookie clears the access and refresh token cookies, and ends any impersonation
 func ClearSessionCookie(w http.ResponseWriter) {
-	cookieName := GetSessionCookieName()
+	for _, cookieName := range []string{GetSessionCookieName(), GetRefreshCookieName(), GetImpersonationCookieName()} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    "",
+			Path:     "/",
+			Expires:  time.Unix(0, 0),
+			HttpOnly: true,
+			Secure:   false, // Set to true in production with HTTPS
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// GetTwoFactorCookieName returns the name of the cookie carrying a login to its second factor step
+func GetTwoFactorCookieName() string {
+	return GetSessionCookieName() + "_2fa"
+}
+
+// SetTwoFactorCookie sets the cookie carrying a login to its second factor step
+func SetTwoFactorCookie(w http.ResponseWriter, token string) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     cookieName,
+		Name:     GetTwoFactorCookieName(),
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(twoFactorPendingTTL),
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearTwoFactorCookie clears the second factor step cookie
+func ClearTwoFactorCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetTwoFactorCookieName(),
 		Value:    "",
 		Path:     "/",
 		Expires:  time.Unix(0, 0),
@@ -33,13 +87,129 @@ func ClearSessionCookie(w http.ResponseWriter) {
 	})
 }
 
-// SetMaintenanceCookie sets a maintenance authentication cookie
-func SetMaintenanceCookie(w http.ResponseWriter, sessionSalt string) {
+// GetOIDCCookieName returns the name of the cookie carrying an identity provider login's state
+func GetOIDCCookieName() string {
+	return GetSessionCookieName() + "_oidc"
+}
+
+// SetOIDCCookie sets the cookie carrying an identity provider login's state to the callback
+func SetOIDCCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetOIDCCookieName(),
+		Value:    token,
+		Path:     "/auth/oidc/",
+		Expires:  time.Now().Add(oidcStateTTL),
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearOIDCCookie clears the identity provider login state cookie
+func ClearOIDCCookie(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "maintenance_auth",
-		Value:    "authenticated_" + sessionSalt[:8], // Add partial version salt to invalidate on restart
+		Name:     GetOIDCCookieName(),
+		Value:    "",
+		Path:     "/auth/oidc/",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// GetMagicLinkCookieName returns the name of the cookie binding magic login links to the browser that requested them
+func GetMagicLinkCookieName() string {
+	return GetSessionCookieName() + "_magic"
+}
+
+// SetMagicLinkCookie sets the nonce cookie that magic login links are checked against
+func SetMagicLinkCookie(w http.ResponseWriter, nonce string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetMagicLinkCookieName(),
+		Value:    nonce,
+		Path:     "/auth/magic",
+		Expires:  time.Now().Add(otpTTL),
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearMagicLinkCookie clears the magic login link nonce cookie
+func ClearMagicLinkCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetMagicLinkCookieName(),
+		Value:    "",
+		Path:     "/auth/magic",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// GetImpersonationCookieName returns the name of the cookie carrying an admin's impersonation of a user
+func GetImpersonationCookieName() string {
+	return GetSessionCookieName() + "_as"
+}
+
+// SetImpersonationCookie sets the cookie carrying an impersonation next to the admin's own session cookies
+func SetImpersonationCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetImpersonationCookieName(),
+		Value:    token,
 		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour), // 24 hour expiry for maintenance
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearImpersonationCookie clears the impersonation cookie, returning the admin to their own account
+func ClearImpersonationCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetImpersonationCookieName(),
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// GetCSRFCookieName returns the name of the cookie holding the CSRF token. It is not versioned,
+// so page scripts can find it.
+func GetCSRFCookieName() string {
+	return "csrf_token"
+}
+
+// SetCSRFCookie sets the CSRF token cookie. Page scripts read it, so it is not HttpOnly.
+func SetCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetCSRFCookieName(),
+		Value:    token,
+		Path:     "/",
+		HttpOnly: false,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// GetMaintenanceCookieName returns the name of the break-glass maintenance session cookie
+func GetMaintenanceCookieName() string {
+	return "maintenance_auth"
+}
+
+// SetMaintenanceCookie sets the break-glass maintenance session cookie
+func SetMaintenanceCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     GetMaintenanceCookieName(),
+		Value:    token,
+		Path:     "/maintenance",
+		Expires:  expiresAt,
 		HttpOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
 		SameSite: http.SameSiteLaxMode,
@@ -49,9 +219,9 @@ func SetMaintenanceCookie(w http.ResponseWriter, sessionSalt string) {
 // ClearMaintenanceCookie clears the maintenance authentication cookie
 func ClearMaintenanceCookie(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "maintenance_auth",
+		Name:     GetMaintenanceCookieName(),
 		Value:    "",
-		Path:     "/",
+		Path:     "/maintenance",
 		Expires:  time.Unix(0, 0),
 		HttpOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
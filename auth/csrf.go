@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+const (
+	// CSRFHeaderName is the header page scripts send the CSRF token in
+	CSRFHeaderName = "X-CSRF-Token"
+	// CSRFFormField is the form field HTML forms send the CSRF token in
+	CSRFFormField = "csrf_token"
+)
+
+var (
+	errCSRFCrossOrigin = errors.New("cross-origin request")
+	errCSRFToken       = errors.New("missing or invalid CSRF token")
+)
+
+// csrfCtxKey is the key used for storing the request's CSRF token in request context
+type csrfCtxKey struct{}
+
+// CSRFMiddleware refuses state-changing requests that a browser made on behalf of another site.
+// Requests that Sec-Fetch-Site or Origin show to come from this host pass; other browser requests,
+// and requests carrying neither header, must send the token of the CSRF cookie in the X-CSRF-Token
+// header or csrf_token form field (double submit). Requests with an Authorization: Bearer header
+// carry no ambient credentials and are not checked.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(GetCSRFCookieName()); err == nil {
+			token = cookie.Value
+		}
+
+		if csrfSafeMethod(r.Method) {
+			if token == "" && !strings.HasPrefix(r.URL.Path, "/static/") {
+				var err error
+				if token, err = randomToken(); err != nil {
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				SetCSRFCookie(w, token)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfCtxKey{}, token)))
+			return
+		}
+
+		if err := checkCSRF(r, token); err != nil {
+			log.Printf("WARN: CSRF check failed for %s %s from %s: %v", r.Method, r.URL.Path, ClientIP(r), err)
+			common.JSONError(w, "Forbidden: request could not be verified, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfCtxKey{}, token)))
+	})
+}
+
+// CSRFToken returns the CSRF token to embed in a page rendered for the request, see CSRFMiddleware
+func CSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfCtxKey{}).(string)
+	return token
+}
+
+// csrfSafeMethod reports whether a method must not change state, so it needs no CSRF check
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// checkCSRF checks a state-changing request against the CSRF cookie's token
+func checkCSRF(r *http.Request, token string) error {
+	if _, ok := bearerToken(r); ok {
+		return nil
+	}
+	site, origin := r.Header.Get("Sec-Fetch-Site"), r.Header.Get("Origin")
+	// "none" is a request the user started, such as opening a bookmark
+	if site == "same-origin" || site == "none" || csrfTrustedOrigin(r, origin) {
+		return nil
+	}
+	if csrfTokenMatches(r, token) {
+		return nil
+	}
+	if site != "" || origin != "" {
+		return errCSRFCrossOrigin
+	}
+	return errCSRFToken
+}
+
+// csrfTrustedOrigin reports whether an Origin header names the request's host or one of
+// CSRF_TRUSTED_ORIGINS (comma separated, e.g. https://app.example.com)
+func csrfTrustedOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, trusted := range strings.Split(getEnv("CSRF_TRUSTED_ORIGINS"), ",") {
+		if trusted = strings.TrimSpace(trusted); trusted != "" && strings.EqualFold(strings.TrimSuffix(trusted, "/"), u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfTokenMatches reports whether the request sends the cookie's token in the header or, for
+// urlencoded forms, in the csrf_token field
+func csrfTokenMatches(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	sent := r.Header.Get(CSRFHeaderName)
+	if sent == "" {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+			sent = r.PostFormValue(CSRFFormField)
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
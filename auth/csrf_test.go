@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestCSRFMiddleware tests the origin checks, the double-submit token and the bearer exemption
+func TestCSRFMiddleware(t *testing.T) {
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(httptest.NewRequest(http.MethodGet, "http://app.example.com/dashboard", nil))
+	var token string
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == GetCSRFCookieName() {
+			token = cookie.Value
+		}
+	}
+	if rec.Code != http.StatusNoContent || token == "" {
+		t.Fatalf("Expected a page load to pass and set the CSRF cookie, got %d", rec.Code)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		cookie  bool
+		form    string
+		want    int
+	}{
+		{"same origin fetch", map[string]string{"Sec-Fetch-Site": "same-origin"}, false, "", http.StatusNoContent},
+		{"cross-site form", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example"}, true, "", http.StatusForbidden},
+		{"sibling subdomain", map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "http://other.example.com"}, true, "", http.StatusForbidden},
+		{"cross-site with token header", map[string]string{"Sec-Fetch-Site": "cross-site", CSRFHeaderName: token}, true, "", http.StatusNoContent},
+		{"matching origin", map[string]string{"Origin": "http://app.example.com"}, false, "", http.StatusNoContent},
+		{"foreign origin", map[string]string{"Origin": "https://evil.example"}, true, "", http.StatusForbidden},
+		{"no headers or token", nil, true, "", http.StatusForbidden},
+		{"token without cookie", map[string]string{CSRFHeaderName: token}, false, "", http.StatusForbidden},
+		{"wrong token", map[string]string{CSRFHeaderName: "guess"}, true, "", http.StatusForbidden},
+		{"form field token", nil, true, url.Values{CSRFFormField: {token}}.Encode(), http.StatusNoContent},
+		{"bearer token", map[string]string{"Authorization": "Bearer oat_token", "Origin": "https://evil.example"}, false, "", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "http://app.example.com/api/projects/1", strings.NewReader(test.form))
+		if test.form != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		if test.cookie {
+			req.AddCookie(&http.Cookie{Name: GetCSRFCookieName(), Value: token})
+		}
+		if rec := serve(req); rec.Code != test.want {
+			t.Errorf("%s: expected %d, got %d", test.name, test.want, rec.Code)
+		}
+	}
+}
+
+// pageRecorder is a template engine that keeps the data of the last rendered page
+type pageRecorder struct {
+	data interface{}
+}
+
+func (p *pageRecorder) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	p.data = data
+	return nil
+}
+
+// TestPageCSRFToken tests that rendered pages get the token of the CSRF cookie for their head
+func TestPageCSRFToken(t *testing.T) {
+	pages := &pageRecorder{}
+	previous := authTemplates
+	InitAuthTemplates(pages)
+	t.Cleanup(func() { InitAuthTemplates(previous) })
+
+	rec := httptest.NewRecorder()
+	CSRFMiddleware(http.HandlerFunc(HandleLogin)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	var cookie string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == GetCSRFCookieName() {
+			cookie = c.Value
+		}
+	}
+	if pages.data == nil {
+		t.Fatalf("Expected the login page to be rendered, got %d", rec.Code)
+	}
+	if token := reflect.ValueOf(pages.data).FieldByName("CSRFToken").String(); cookie == "" || token != cookie {
+		t.Errorf("Expected the page to get the cookie's token %q, got %q", cookie, token)
+	}
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/mailer"
+)
+
+// versionPattern matches version numbers, so browser updates do not look like new devices
+var versionPattern = regexp.MustCompile(`[0-9][0-9._]*`)
+
+// browsers and platforms are checked in order; more specific names come first
+var (
+	browsers = []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"},
+		{"Safari/", "Safari"}, {"curl/", "curl"},
+	}
+	platforms = []struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+)
+
+// DescribeDevice summarises a user agent as "<browser> on <platform>"
+func DescribeDevice(userAgent string) string {
+	browser, platform := "Unknown browser", ""
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, p := range platforms {
+		if strings.Contains(userAgent, p.token) {
+			platform = p.name
+			break
+		}
+	}
+	if platform == "" {
+		return browser
+	}
+	return browser + " on " + platform
+}
+
+// deviceHash identifies a device by its user agent without version numbers
+func deviceHash(userAgent string) string {
+	hash := sha256.Sum256([]byte(versionPattern.ReplaceAllString(userAgent, "")))
+	return hex.EncodeToString(hash[:])
+}
+
+// NewDeviceAlert is the data of the new_device mail template
+type NewDeviceAlert struct {
+	AppName     string
+	Device      string
+	IP          string
+	Time        string
+	SessionsURL string
+}
+
+// checkNewDevice records the device of a new session and emails the user when they have not
+// logged in from it before. Disabled with AUTH_NEW_DEVICE_ALERTS=0.
+func checkNewDevice(ctx context.Context, session *Session, r *http.Request) {
+	if session.ProjectID != 0 {
+		return // Devices are recorded per ai.users account
+	}
+	status, err := getSessionStore().RememberDevice(ctx, session.UserID, deviceHash(session.UserAgent), DescribeDevice(session.UserAgent))
+	if err != nil {
+		log.Printf("Failed to record device for user %d: %v", session.UserID, err)
+		return
+	}
+	if status != DeviceNew || getEnv("AUTH_NEW_DEVICE_ALERTS") == "0" {
+		return
+	}
+
+	alert := NewDeviceAlert{
+		AppName: common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
+		Device:  DescribeDevice(session.UserAgent),
+		IP:      session.IP,
+		Time:    session.CreatedAt.UTC().Format(time.RFC1123),
+	}
+	// The alert is still worth sending without the link
+	if baseURL, err := RequestBaseURL(r); err == nil {
+		alert.SessionsURL = baseURL + "/profile/sessions"
+	} else {
+		log.Printf("New device alert for user %d sent without a link: %v", session.UserID, err)
+	}
+	go func() {
+		if err := mailer.Send(context.Background(), session.Email, "new_device", alert); err != nil {
+			log.Printf("Failed to send new device alert to %s: %v", session.Email, err)
+		}
+	}()
+}
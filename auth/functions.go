@@ -1,19 +1,22 @@
 package auth
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
-	"net/smtp"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/mailer"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -23,31 +26,57 @@ import (
 // Session moved to types.go
 // userCtxKey moved to types.go
 
+const (
+	otpLength      = 6
+	otpTTL         = 5 * time.Minute
+	maxOTPAttempts = 3
+)
+
 var (
-	otpStore = make(map[string]OTPData) // Uses OTPData from types.go
+	otpStore = NewMemoryOTPStore() // Replaced with the Postgres store once the database is up
 	otpMutex = &sync.Mutex{}
 )
 
-// SendOTP generates and sends an OTP to the specified email
-func SendOTP(email string) error {
+// SendOTP generates an OTP for the email, stores its hash and sends the code by email.
+// ip is the address of the client requesting the code.
+func SendOTP(email, ip string) error {
+	return sendOTP(email, ip, nil)
+}
+
+// sendOTP stores and sends a new code. When magicLink is set, the email also carries the link
+// it returns for the stored code's hash.
+func sendOTP(email, ip string, magicLink func(email, codeHash string) (string, error)) error {
+	email = normalizeEmail(email)
+
 	// Generate a random 6-digit OTP
-	otp, err := generateOTP(6)
+	otp, err := generateOTP(otpLength)
 	if err != nil {
 		return err
 	}
 
-	// Store OTP with expiration time
-	otpMutex.Lock()
-	otpStore[email] = OTPData{ // Uses OTPData from types.go
+	codeHash := hashOTP(email, otp)
+	var link string
+	if magicLink != nil {
+		if link, err = magicLink(email, codeHash); err != nil {
+			return err
+		}
+	}
+
+	// Store the hashed OTP with expiration time, replacing any pending code
+	err = getOTPStore().Save(context.Background(), OTPData{
 		Email:     email,
-		OTP:       otp,
-		ExpiresAt: time.Now().Add(5 * time.Minute),
+		CodeHash:  codeHash,
+		ExpiresAt: time.Now().Add(otpTTL),
 		Attempts:  0,
+		IP:        ip,
+	})
+	if err != nil {
+		log.Printf("Error storing OTP: %v", err)
+		return err
 	}
-	otpMutex.Unlock()
 
 	// Send email with OTP
-	err = sendOTPEmail(email, otp)
+	err = sendOTPEmail(email, otp, link)
 	if err != nil {
 		log.Printf("Error sending OTP email: %v", err)
 		return err
@@ -56,42 +85,72 @@ func SendOTP(email string) error {
 	return nil
 }
 
-// VerifyOTP checks if the provided OTP is valid
+// VerifyOTP checks if the provided OTP is valid. A valid code can only be used once.
 func VerifyOTP(email, otp string) (bool, error) {
-	otpMutex.Lock()
-	defer otpMutex.Unlock()
+	ctx := context.Background()
+	store := getOTPStore()
+	email = normalizeEmail(email)
 
-	data, exists := otpStore[email]
-	if !exists {
+	data, err := store.Get(ctx, email)
+	if err != nil {
+		return false, err
+	}
+	if data == nil {
 		return false, errors.New("no OTP request found")
 	}
 
 	// Check if OTP has expired
 	if time.Now().After(data.ExpiresAt) {
-		delete(otpStore, email)
+		store.Delete(ctx, email)
 		return false, errors.New("OTP has expired")
 	}
 
 	// Increment attempt counter
-	data.Attempts++
-	otpStore[email] = data
+	attempts, err := store.IncrementAttempts(ctx, email)
+	if err != nil {
+		return false, err
+	}
 
 	// Check for too many attempts
-	if data.Attempts > 3 {
-		delete(otpStore, email)
+	if attempts > maxOTPAttempts {
+		store.Delete(ctx, email)
 		return false, errors.New("too many incorrect attempts")
 	}
 
 	// Validate OTP
-	if data.OTP != otp {
+	codeHash := hashOTP(email, strings.TrimSpace(otp))
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(data.CodeHash)) != 1 {
 		return false, errors.New("invalid OTP")
 	}
 
-	// OTP is valid, remove it from store
-	delete(otpStore, email)
+	// OTP is valid, remove it from store (fails if another request used it first)
+	consumed, err := store.Consume(ctx, email, codeHash)
+	if err != nil {
+		return false, err
+	}
+	if !consumed {
+		return false, errors.New("no OTP request found")
+	}
 	return true, nil
 }
 
+// hashOTP hashes a code for storage. The email and OTP_HASH_KEY (default SESSION_SALT) are mixed in
+// so equal codes for different users do not share a hash.
+func hashOTP(email, otp string) string {
+	key := getEnv("OTP_HASH_KEY")
+	if key == "" {
+		key = getEnv("SESSION_SALT")
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(email + ":" + otp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeEmail lower-cases and trims an email so codes match however it was typed
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 // GetSession and ClearSession are no longer needed with JWT
 /*
 func GetSession(token string) (Session, bool) { ... }
@@ -113,36 +172,14 @@ func generateOTP(length int) (string, error) {
 	return string(b), nil
 }
 
-// sendOTPEmail sends an email with the OTP
-func sendOTPEmail(to, otp string) error {
-	// Load environment variables
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Error loading .env file: %v", err)
-	}
-	// Get SMTP settings from environment
-	host := getEnv("SMTP_HOST")
-	portStr := getEnv("SMTP_PORT")
-	password := getEnv("SMTP_PASSWORD")
-	from := getEnv("SMTP_FROM")
-	appName := getEnv("APP_NAME")
-
-	port, _ := strconv.Atoi(portStr)
-
-	// Create message
-	subject := fmt.Sprintf("Your %s login code", appName)
-	body := fmt.Sprintf("Your verification code is: %s\nThis code will expire in 5 minutes.", otp)
-	message := []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s", from, to, subject, body))
-
-	// For Resend, the username is 'resend' and the password is the API key
-	auth := smtp.PlainAuth("", "resend", password, host)
-
-	// Send email
-	err := smtp.SendMail(fmt.Sprintf("%s:%d", host, port), auth, from, []string{to}, message)
-	if err != nil {
-		return err
-	}
-
-	return nil
+// sendOTPEmail sends an email with the OTP and, when link is set, a magic login link
+func sendOTPEmail(to, otp, link string) error {
+	return mailer.Send(context.Background(), to, "otp", map[string]string{
+		"AppName":   common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
+		"Code":      otp,
+		"Link":      link,
+		"ExpiresIn": "5 minutes",
+	})
 }
 
 func getEnv(key string) string {
@@ -177,6 +214,9 @@ func isPublicPath(path string) bool {
 		"/login",
 		"/auth/request-otp", // Changed from /api/request-otp
 		"/auth/verify-otp",  // Changed from /api/verify-otp
+		"/auth/refresh",
+		"/auth/2fa/",
+		"/auth/oidc/",
 		"/static/",
 		"/favicon.ico",
 	}
@@ -2,10 +2,10 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
-	"time"
 
 	"github.com/scriptmaster/openagent/common" // Updated import path
 	"github.com/scriptmaster/openagent/types"
@@ -64,6 +64,8 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		errorMessage = "Your session has expired. Please login again."
 	case "unauthorized":
 		errorMessage = "Please login before to proceed."
+	case "account_disabled":
+		errorMessage = "This account has been deactivated. Contact your administrator."
 	default:
 		errorMessage = errorCode // Keep original if not a known code
 	}
@@ -73,6 +75,7 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		PageTitle  string
 		AdminEmail string
 		AppVersion string
+		CSRFToken  string
 		Error      string
 		User       *User
 	}{
@@ -80,6 +83,7 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		PageTitle:  "Login - " + common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
 		AdminEmail: os.Getenv("SYSADMIN_EMAIL"),
 		AppVersion: common.GetEnvOrDefault("APP_VERSION", "1.0.0.0"),
+		CSRFToken:  CSRFToken(r.Context()),
 		Error:      errorMessage,
 		User:       nil,
 	}
@@ -88,9 +92,15 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// HandleLogout clears session cookies and redirects to login
+// HandleLogout ends the current session, clears session cookies and redirects to login
 func HandleLogout(w http.ResponseWriter, r *http.Request) {
-	// Clear the versioned JWT session cookie
+	if sessionID := currentSessionID(r); sessionID != "" {
+		if err := RevokeSession(r.Context(), sessionID); err != nil {
+			log.Printf("Failed to revoke session on logout: %v", err)
+		}
+	}
+
+	// Clear the versioned JWT session cookies
 	ClearSessionCookie(w)
 
 	// No need to clear the old "session" cookie anymore if unused
@@ -127,6 +137,13 @@ func HandleRequestOTP(w http.ResponseWriter, r *http.Request, userService UserSe
 		return
 	}
 
+	// Limit OTP emails per client, per address and overall
+	if ok, wait := getAuthLimits().AllowOTPRequest(normalizeEmail(req.Email), ClientIP(r)); !ok {
+		log.Printf("OTP request for %s from %s rate limited", req.Email, ClientIP(r))
+		SendRateLimited(w, wait)
+		return
+	}
+
 	// Check if user exists
 	user, err := userService.GetUserByEmail(r.Context(), req.Email)
 	if err != nil {
@@ -159,13 +176,22 @@ func HandleRequestOTP(w http.ResponseWriter, r *http.Request, userService UserSe
 		log.Printf("Created first user: %s (Admin: %v)", user.Email, user.IsAdmin)
 	}
 
-	// Send OTP
-	if err := SendOTP(req.Email); err != nil {
+	// Send OTP with a magic link that only works in this browser
+	nonce, err := randomToken()
+	var baseURL string
+	if err == nil {
+		baseURL, err = RequestBaseURL(r)
+	}
+	if err == nil {
+		err = SendOTPWithMagicLink(req.Email, ClientIP(r), baseURL, nonce)
+	}
+	if err != nil {
 		log.Printf("Failed to send OTP for user %s: %v", user.Email, err)
 		// Send a specific response indicating OTP failure
 		SendJSONResponse(w, false, "Failed to send OTP. You can try logging in with your password.", map[string]bool{"otp_error": true}, "")
 		return
 	}
+	SetMagicLinkCookie(w, nonce)
 
 	log.Printf("OTP sent successfully to user: %s", user.Email)
 	SendJSONResponse(w, true, "OTP sent successfully", nil, "")
@@ -192,6 +218,12 @@ func HandleVerifyOTP(w http.ResponseWriter, r *http.Request, userService UserSer
 		return
 	}
 
+	if ok, wait := getAuthLimits().AllowOTPVerify(ClientIP(r)); !ok {
+		log.Printf("OTP verification from %s rate limited", ClientIP(r))
+		SendRateLimited(w, wait)
+		return
+	}
+
 	// Verify OTP
 	valid, err := VerifyOTP(req.Email, req.OTP)
 	if err != nil {
@@ -219,26 +251,7 @@ func HandleVerifyOTP(w http.ResponseWriter, r *http.Request, userService UserSer
 		// Don't fail the login for this, just log it
 	}
 
-	// Create session JWT
-	jwtString, err := CreateSession(user, r.Host) // Returns JWT string
-	if err != nil {
-		log.Printf("Failed to create session JWT: %v", err)
-		SendJSONResponse(w, false, "Failed to create session", nil, "")
-		return
-	}
-
-	// Set session cookie with JWT
-	expiryDuration := 168 * time.Hour // Match JWT expiry (7 days)
-	SetSessionCookie(w, jwtString, expiryDuration)
-	// No need for backward compatible "session" cookie with JWT
-
-	// Determine redirect based on admin status
-	redirectURL := "/" // Default for non-admins
-	if user.IsAdmin {
-		redirectURL = "/dashboard"
-	}
-
-	SendJSONResponse(w, true, "OTP verified successfully", nil, redirectURL)
+	completeLogin(w, r, user, "OTP verified successfully")
 }
 
 // PasswordLoginRequest represents the request body for password login
@@ -268,14 +281,25 @@ func HandlePasswordLogin(w http.ResponseWriter, r *http.Request, userService Use
 		return
 	}
 
-	// Verify password
-	user, err := userService.VerifyPassword(r.Context(), req.Email, req.Password)
+	// Throttle repeated failures and lock out after too many
+	limits := getAuthLimits()
+	email, ip := normalizeEmail(req.Email), ClientIP(r)
+	if ok, wait := limits.AllowPasswordLogin(email, ip); !ok {
+		log.Printf("Password login for %s from %s rate limited", req.Email, ip)
+		SendRateLimited(w, wait)
+		return
+	}
+
+	// Verify password, against the LDAP directory when the host has one
+	user, err := verifyPassword(r, userService, req.Email, req.Password)
 	if err != nil {
 		// Log the specific error for debugging, but send a generic message to the client
 		log.Printf("Password verification failed for %s: %v", req.Email, err)
+		limits.PasswordLoginFailed(email, ip)
 		SendJSONResponse(w, false, "Invalid email or password", nil, "")
 		return
 	}
+	limits.PasswordLoginSucceeded(email, ip)
 
 	// Update last login
 	if err := userService.UpdateUserLastLogin(r.Context(), user.ID); err != nil {
@@ -283,26 +307,101 @@ func HandlePasswordLogin(w http.ResponseWriter, r *http.Request, userService Use
 		// Don't fail the login for this, just log it
 	}
 
-	// Create session JWT
-	jwtString, err := CreateSession(user, r.Host)
+	completeLogin(w, r, user, "Login successful")
+}
+
+// completeLogin starts a session for a user who passed the first login step, or hands over to the
+// second factor step when the user has enabled 2FA or policy requires them to set it up
+func completeLogin(w http.ResponseWriter, r *http.Request, user *User, message string) {
+	enrolled, required, err := twoFactorStatus(r.Context(), user)
+	if err != nil {
+		log.Printf("Failed to check two-factor status for user %d: %v", user.ID, err)
+		SendJSONResponse(w, false, "Failed to create session", nil, "")
+		return
+	}
+	if !enrolled && !required {
+		startSession(w, r, user, message, nil)
+		return
+	}
+	if !allowLogin(w, r, user) {
+		return
+	}
+
+	token, err := signTwoFactorToken(user, !enrolled)
 	if err != nil {
-		log.Printf("Failed to create session JWT: %v", err)
+		log.Printf("Failed to create two-factor token: %v", err)
 		SendJSONResponse(w, false, "Failed to create session", nil, "")
 		return
 	}
+	SetTwoFactorCookie(w, token)
+	SendJSONResponse(w, true, "Two-factor authentication required",
+		map[string]bool{"two_factor_required": true, "enroll": !enrolled}, "/login/2fa")
+}
 
-	// Set session cookie with JWT
-	expiryDuration := 168 * time.Hour // Match JWT expiry (7 days)
-	SetSessionCookie(w, jwtString, expiryDuration)
-	// No need for backward compatible "session" cookie with JWT
+// startSession creates a session for a fully authenticated user and responds with where to go next
+func startSession(w http.ResponseWriter, r *http.Request, user *User, message string, data interface{}) {
+	if !allowLogin(w, r, user) {
+		return
+	}
+	// Create a session with a short-lived access JWT and a refresh token
+	tokens, err := CreateSession(r.Context(), user, r)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		SendJSONResponse(w, false, "Failed to create session", nil, "")
+		return
+	}
+	SetSessionCookies(w, tokens)
+	SendJSONResponse(w, true, message, data, homePath(user))
+}
 
-	// Determine redirect based on admin status
-	redirectURL := "/" // Default for non-admins
-	if user.IsAdmin {
-		redirectURL = "/dashboard"
+// finishBrowserLogin is completeLogin for logins that end in a browser redirect, such as identity
+// provider callbacks. It sets the cookies and returns where to send the browser.
+func finishBrowserLogin(w http.ResponseWriter, r *http.Request, user *User) (string, error) {
+	if err := requireActiveAccount(r.Context(), user); err != nil {
+		return "", err
+	}
+	enrolled, required, err := twoFactorStatus(r.Context(), user)
+	if err != nil {
+		return "", err
+	}
+	if enrolled || required {
+		token, err := signTwoFactorToken(user, !enrolled)
+		if err != nil {
+			return "", err
+		}
+		SetTwoFactorCookie(w, token)
+		return "/login/2fa", nil
 	}
 
-	SendJSONResponse(w, true, "Login successful", nil, redirectURL)
+	tokens, err := CreateSession(r.Context(), user, r)
+	if err != nil {
+		return "", err
+	}
+	SetSessionCookies(w, tokens)
+	return homePath(user), nil
+}
+
+// allowLogin refuses logins of deactivated and deleted accounts and writes the error response
+func allowLogin(w http.ResponseWriter, r *http.Request, user *User) bool {
+	err := requireActiveAccount(r.Context(), user)
+	if err == nil {
+		return true
+	}
+	log.Printf("Login refused for user %d: %v", user.ID, err)
+	if errors.Is(err, ErrAccountInactive) {
+		SendJSONResponse(w, false, "This account has been deactivated. Contact your administrator.", nil, "")
+	} else {
+		SendJSONResponse(w, false, "Failed to create session", nil, "")
+	}
+	return false
+}
+
+// homePath returns where a user lands after logging in
+func homePath(user *User) string {
+	if user.IsAdmin {
+		return "/dashboard"
+	}
+	return "/"
 }
 
 // SendJSONResponse sends a JSON response
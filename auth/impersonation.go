@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/scriptmaster/openagent/common"
+)
+
+// impersonationSubject marks tokens that let an admin act as another user
+const impersonationSubject = "impersonation"
+
+// impersonationTTL is how long an impersonation lasts (AUTH_IMPERSONATION_TTL, default 1h). It is never extended.
+func impersonationTTL() time.Duration {
+	return durationFromEnv("AUTH_IMPERSONATION_TTL", time.Hour)
+}
+
+// impersonationActor is the admin behind an impersonation, bound to the session that started it
+type impersonationActor struct {
+	UserID    int    `json:"user_id"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`
+}
+
+// impersonationClaims carry both identities of an impersonation: the user acted as and the admin acting (act).
+// The token ID identifies the impersonation in the audit log.
+type impersonationClaims struct {
+	UserID int                `json:"user_id"`
+	Email  string             `json:"email"`
+	Actor  impersonationActor `json:"act"`
+	jwt.RegisteredClaims
+}
+
+// ImpersonateRequest selects the user an admin impersonates, by ID or email
+type ImpersonateRequest struct {
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// signImpersonationToken issues the token for an admin session to act as a user
+func signImpersonationToken(admin *User, sessionID string, target *User) (*impersonationClaims, string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	claims := &impersonationClaims{
+		UserID: target.ID,
+		Email:  target.Email,
+		Actor:  impersonationActor{UserID: admin.ID, Email: admin.Email, SessionID: sessionID},
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Subject:   impersonationSubject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(impersonationTTL())),
+		},
+	}
+	token, err := signToken(claims)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, token, nil
+}
+
+// validateImpersonation checks an impersonation token against the admin session it is presented with.
+// The token is only accepted with the session that started it, so it ends with that session.
+func validateImpersonation(tokenString string, session *UserClaims) (*impersonationClaims, error) {
+	claims := &impersonationClaims{}
+	if _, err := parseToken(tokenString, claims, jwt.WithSubject(impersonationSubject)); err != nil {
+		return nil, err
+	}
+	if !session.IsAdmin || claims.Actor.UserID != session.UserID || claims.Actor.SessionID != session.ID {
+		return nil, errors.New("impersonation belongs to another session")
+	}
+	return claims, nil
+}
+
+// serveImpersonated serves a request as the impersonated user and records it in the audit log.
+// An impersonation ends when the user is deactivated or deleted, like their own sessions do.
+func serveImpersonated(w http.ResponseWriter, r *http.Request, next http.Handler, session *UserClaims, impersonation *impersonationClaims) {
+	user := &User{ID: impersonation.UserID, Email: impersonation.Email, Impersonator: session.User()}
+	if err := requireActiveAccount(r.Context(), user); err != nil {
+		log.Printf("Ending impersonation of user %d by %s: %v", user.ID, session.Email, err)
+		ClearImpersonationCookie(w)
+		common.JSONError(w, "The impersonated account can no longer be used", http.StatusForbidden)
+		return
+	}
+	ctx := SetUserContext(r.Context(), user)
+	ctx = context.WithValue(ctx, sessionCtxKey{}, session.ID)
+	ctx = context.WithValue(ctx, impersonationCtxKey{}, impersonation.ID)
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rec, r.WithContext(ctx))
+
+	RecordAudit(r.Context(), AuditEntry{
+		ActorID:         session.UserID,
+		ActorEmail:      session.Email,
+		UserID:          impersonation.UserID,
+		UserEmail:       impersonation.Email,
+		Action:          AuditImpersonationRequest,
+		Detail:          fmt.Sprintf("%s %s -> %d", r.Method, r.URL.Path, rec.status),
+		ImpersonationID: impersonation.ID,
+		IP:              ClientIP(r),
+	})
+}
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// GetImpersonationIDFromContext returns the impersonation a request is made in, or "" when the user is not impersonated
+func GetImpersonationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(impersonationCtxKey{}).(string)
+	return id
+}
+
+// NoImpersonationMiddleware refuses requests made while impersonating, for endpoints that manage
+// credentials and sessions. Assumes AuthMiddleware has already run.
+func NoImpersonationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetImpersonationIDFromContext(r.Context()) != "" {
+			common.JSONError(w, "Not available while impersonating a user", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CreateImpersonateHandler creates the handler for admins to start acting as a user (POST {user_id} or {email}).
+// Other admins and project directory accounts cannot be impersonated.
+func CreateImpersonateHandler(userService UserServicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		admin := GetUserFromContext(r.Context())
+		sessionID := GetSessionIDFromContext(r.Context())
+		if admin == nil || sessionID == "" || GetAPITokenFromContext(r.Context()) != nil {
+			common.JSONError(w, "Impersonation requires a browser session", http.StatusForbidden)
+			return
+		}
+
+		var req ImpersonateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			common.JSONError(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		var target *User
+		var err error
+		switch email := strings.ToLower(strings.TrimSpace(req.Email)); {
+		case req.UserID > 0:
+			target, err = userService.GetUserByID(r.Context(), req.UserID)
+		case email != "":
+			target, err = userService.GetUserByEmail(r.Context(), email)
+		default:
+			common.JSONError(w, "user_id or email is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil || target == nil {
+			common.JSONError(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case target.ID == admin.ID:
+			common.JSONError(w, "You cannot impersonate yourself", http.StatusBadRequest)
+			return
+		case target.IsAdmin:
+			log.Printf("WARN: Admin %s tried to impersonate admin %s", admin.Email, target.Email)
+			common.JSONError(w, "Administrators cannot be impersonated", http.StatusForbidden)
+			return
+		case target.ProjectID != 0:
+			common.JSONError(w, "Project directory accounts cannot be impersonated", http.StatusForbidden)
+			return
+		}
+		if err := requireActiveAccount(r.Context(), target); err != nil {
+			log.Printf("Admin %s could not impersonate %s: %v", admin.Email, target.Email, err)
+			common.JSONError(w, "Deactivated accounts cannot be impersonated", http.StatusForbidden)
+			return
+		}
+
+		claims, token, err := signImpersonationToken(admin, sessionID, target)
+		if err != nil {
+			log.Printf("Failed to sign impersonation token: %v", err)
+			common.JSONError(w, "Failed to start impersonation", http.StatusInternalServerError)
+			return
+		}
+		SetImpersonationCookie(w, token, claims.ExpiresAt.Time)
+
+		RecordAudit(r.Context(), AuditEntry{
+			ActorID:         admin.ID,
+			ActorEmail:      admin.Email,
+			UserID:          target.ID,
+			UserEmail:       target.Email,
+			Action:          AuditImpersonationStart,
+			ImpersonationID: claims.ID,
+			IP:              ClientIP(r),
+		})
+		log.Printf("Admin %s started impersonating %s", admin.Email, target.Email)
+		SendJSONResponse(w, true, "Impersonating "+target.Email, map[string]string{"impersonation_id": claims.ID}, "/")
+	}
+}
+
+// HandleStopImpersonation ends the current impersonation and returns the admin to the admin pages
+func HandleStopImpersonation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ClearImpersonationCookie(w)
+
+	user := GetUserFromContext(r.Context())
+	if user == nil || user.Impersonator == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	RecordAudit(r.Context(), AuditEntry{
+		ActorID:         user.Impersonator.ID,
+		ActorEmail:      user.Impersonator.Email,
+		UserID:          user.ID,
+		UserEmail:       user.Email,
+		Action:          AuditImpersonationStop,
+		ImpersonationID: GetImpersonationIDFromContext(r.Context()),
+		IP:              ClientIP(r),
+	})
+	log.Printf("Admin %s stopped impersonating %s", user.Impersonator.Email, user.Email)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// impersonationUserService looks users up in a fixed list
+type impersonationUserService struct {
+	UserServicer
+	users []*User
+}
+
+func (s *impersonationUserService) GetUserByID(ctx context.Context, userID int) (*User, error) {
+	for _, user := range s.users {
+		if user.ID == userID {
+			return user, nil
+		}
+	}
+	return nil, errors.New("user not found")
+}
+
+func (s *impersonationUserService) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, errors.New("user not found")
+}
+
+// useMemoryAuditStore installs a fresh in-memory audit log for the duration of a test
+func useMemoryAuditStore(t *testing.T) AuditStore {
+	previous := getAuditStore()
+	store := NewMemoryAuditStore()
+	SetAuditStore(store)
+	t.Cleanup(func() { SetAuditStore(previous) })
+	return store
+}
+
+// TestImpersonation tests starting an impersonation, acting as the user, the audit trail and exiting
+func TestImpersonation(t *testing.T) {
+	useMemorySessionStore(t)
+	audit := useMemoryAuditStore(t)
+	admin := &User{ID: 1, Email: "admin@example.com", IsAdmin: true}
+	users := &impersonationUserService{users: []*User{
+		admin,
+		{ID: 2, Email: "user@example.com"},
+		{ID: 3, Email: "other-admin@example.com", IsAdmin: true},
+	}}
+	ctx := context.Background()
+	tokens, err := CreateSession(ctx, admin, newSessionRequest(http.MethodGet, "/"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	session := &http.Cookie{Name: GetSessionCookieName(), Value: tokens.AccessToken}
+
+	impersonate := AuthMiddleware(IsAdminMiddleware(CreateImpersonateHandler(users)))
+	start := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/impersonate", strings.NewReader(body))
+		req.AddCookie(session)
+		rec := httptest.NewRecorder()
+		impersonate.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := start(`{"user_id":3}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected impersonating an admin to be refused, got %d", rec.Code)
+	}
+	if rec := start(`{"user_id":1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected impersonating yourself to be refused, got %d", rec.Code)
+	}
+	rec := start(`{"email":"User@Example.com"}`)
+	var impersonation *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == GetImpersonationCookieName() {
+			impersonation = cookie
+		}
+	}
+	if rec.Code != http.StatusOK || impersonation == nil {
+		t.Fatalf("Expected the impersonation to start, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var seen *User
+	whoami := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = GetUserFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	whoami.ServeHTTP(httptest.NewRecorder(), newSessionRequest(http.MethodGet, "/projects", session, impersonation))
+	if seen == nil || seen.ID != 2 || seen.IsAdmin || seen.Impersonator == nil || seen.Impersonator.ID != admin.ID {
+		t.Fatalf("Expected to act as the user with the admin as impersonator, got %+v", seen)
+	}
+
+	rec = httptest.NewRecorder()
+	AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleAPITokensAPI))).ServeHTTP(rec, newSessionRequest(http.MethodGet, "/api/profile/tokens", session, impersonation))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected API tokens to be refused while impersonating, got %d", rec.Code)
+	}
+
+	// The impersonation is bound to the admin session that started it
+	other, err := CreateSession(ctx, admin, newSessionRequest(http.MethodGet, "/"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	whoami.ServeHTTP(httptest.NewRecorder(), newSessionRequest(http.MethodGet, "/projects", &http.Cookie{Name: GetSessionCookieName(), Value: other.AccessToken}, impersonation))
+	if seen.ID != admin.ID || seen.Impersonator != nil {
+		t.Errorf("Expected another session to ignore the impersonation, got %+v", seen)
+	}
+
+	rec = httptest.NewRecorder()
+	AuthMiddleware(http.HandlerFunc(HandleStopImpersonation)).ServeHTTP(rec, newSessionRequest(http.MethodPost, "/auth/impersonation/stop", session, impersonation))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/admin" {
+		t.Errorf("Expected to return to the admin pages, got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	entries, _ := audit.List(ctx, AuditFilter{ActorID: admin.ID})
+	var actions []string
+	for _, entry := range entries {
+		if entry.UserID != 2 || entry.ImpersonationID == "" {
+			t.Errorf("Expected entries about the impersonated user, got %+v", entry)
+		}
+		actions = append(actions, entry.Action)
+	}
+	want := []string{AuditImpersonationRequest, AuditImpersonationStop, AuditImpersonationRequest, AuditImpersonationRequest, AuditImpersonationStart}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected audit entries %v, got %v", want, actions)
+	}
+	if entries[2].Detail != "GET /api/profile/tokens -> 403" {
+		t.Errorf("Expected the refused request to be recorded with its status, got %q", entries[2].Detail)
+	}
+
+	// Deactivating or deleting the user ends the impersonation and prevents new ones
+	useAccountStatus(t, inactiveAccounts{2: true})
+	seen = nil
+	rec = httptest.NewRecorder()
+	whoami.ServeHTTP(rec, newSessionRequest(http.MethodGet, "/projects", session, impersonation))
+	if rec.Code != http.StatusForbidden || seen != nil {
+		t.Errorf("Expected acting as a deactivated user to be refused, got %d as %+v", rec.Code, seen)
+	}
+	if rec := start(`{"user_id":2}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected impersonating a deactivated user to be refused, got %d", rec.Code)
+	}
+}
@@ -8,57 +8,40 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"sync"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/scriptmaster/openagent/common"
 )
 
+// refreshReuseGrace is how long a rotated refresh token is still accepted, so parallel requests
+// that all found an expired access token do not look like token theft
+var refreshReuseGrace = 30 * time.Second
+
 var (
-	sessions     = make(map[string]Session) // Uses Session from types.go
-	sessionMutex = &sync.RWMutex{}
+	// ErrSessionInvalid is returned for unknown, expired or revoked sessions
+	ErrSessionInvalid = errors.New("session expired or revoked")
+	// ErrRefreshReused is returned when a rotated refresh token is used again; the session is revoked
+	ErrRefreshReused = errors.New("refresh token reused")
+	// ErrSessionProject is returned when a session is used on a host whose logins use a different user directory
+	ErrSessionProject = errors.New("session belongs to another project")
 )
 
-var jwtSecret []byte
-
 // JWT custom claims structure
 type UserClaims struct {
 	UserID  int    `json:"user_id"`
 	Email   string `json:"email"`
 	IsAdmin bool   `json:"is_admin"`
+	// ProjectID is the project whose user directory holds the account, 0 for ai.users accounts.
+	// The token is only accepted on hosts served by that directory.
+	ProjectID int64 `json:"project_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// InitializeJWTSecret loads the secret key
-func InitializeJWTSecret(host string) error {
-	if jwtSecret != nil {
-		return nil
-	}
-
-	// Initialize JWT secret if not already done (important for middleware)
-	secretKey := common.GetEnv("JWT_SECRET_KEY")
-	if secretKey == "" {
-		log.Println("** WARNING: JWT_SECRET_KEY environment variable not set. Generating a default key.")
-		// Generate a default key using SESSION_SALT, host, APP_NAME, and APP_VERSION
-		sessionSalt := common.GetEnv("SESSION_SALT")
-		appName := common.GetEnv("APP_NAME")
-		appVersion := common.GetEnv("APP_VERSION")
-
-		if sessionSalt == "" {
-			return errors.New("SESSION_SALT environment variable is required")
-		}
-
-		// Create a composite key from multiple sources
-		compositeKey := fmt.Sprintf("%s:%s:%s:%s", sessionSalt, host, appName, appVersion)
-		hash := sha256.Sum256([]byte(compositeKey))
-		secretKey = hex.EncodeToString(hash[:])
-
-		log.Printf("** Generated default JWT secret from SESSION_SALT, host, APP_NAME, and APP_VERSION")
-	}
-
-	jwtSecret = []byte(secretKey)
-	return nil
+// User returns the user the claims were issued for
+func (c *UserClaims) User() *User {
+	return &User{ID: c.UserID, Email: c.Email, IsAdmin: c.IsAdmin, ProjectID: c.ProjectID}
 }
 
 // GenerateSessionToken generates a secure session token
@@ -71,85 +54,233 @@ func GenerateSessionToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// CreateSession creates a new session for a user
-func CreateSession(user *User, host string) (string, error) {
-	// Initialize JWT secret if not already done
-	if err := InitializeJWTSecret(host); err != nil {
-		return "", err
+// accessTokenTTL is the lifetime of access JWTs (AUTH_ACCESS_TTL, default 15m)
+func accessTokenTTL() time.Duration {
+	return durationFromEnv("AUTH_ACCESS_TTL", 15*time.Minute)
+}
+
+// sessionTTL is how long a session lasts without being refreshed (AUTH_SESSION_TTL, default 7 days)
+func sessionTTL() time.Duration {
+	return durationFromEnv("AUTH_SESSION_TTL", 168*time.Hour)
+}
+
+// SessionTokens are the credentials issued when a session is created or refreshed
+type SessionTokens struct {
+	SessionID        string
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string // Empty when the refresh token was not rotated
+	RefreshExpiresAt time.Time
+}
+
+// CreateSession stores a new session for a user on the requesting device and issues its tokens
+func CreateSession(ctx context.Context, user *User, r *http.Request) (*SessionTokens, error) {
+	id, err := GenerateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := GenerateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:          id[:32],
+		UserID:      user.ID,
+		Email:       user.Email,
+		IsAdmin:     user.IsAdmin && user.ProjectID == 0,
+		ProjectID:   user.ProjectID,
+		RefreshHash: hashRefreshSecret(secret),
+		IP:          ClientIP(r),
+		UserAgent:   r.UserAgent(),
+		CreatedAt:   now,
+		LastSeenAt:  now,
+		ExpiresAt:   now.Add(sessionTTL()),
+	}
+	if err := getSessionStore().Create(ctx, *session); err != nil {
+		return nil, fmt.Errorf("failed to store session: %w", err)
+	}
+	checkNewDevice(ctx, session, r)
+
+	tokens := &SessionTokens{
+		SessionID:        session.ID,
+		RefreshToken:     session.ID + "." + secret,
+		RefreshExpiresAt: session.ExpiresAt,
+	}
+	if tokens.AccessToken, tokens.AccessExpiresAt, err = signAccessToken(session); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a rotated refresh token.
+// Presenting a refresh token that was already rotated revokes the session, since either the
+// client or an attacker holds a stolen copy.
+func RefreshSession(ctx context.Context, refreshToken string, r *http.Request) (*SessionTokens, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, ErrSessionInvalid
+	}
+
+	store := getSessionStore()
+	session, err := store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !session.Active(now) {
+		return nil, ErrSessionInvalid
+	}
+	if session.ProjectID != AccountProjectID(r.Context()) {
+		return nil, ErrSessionProject
+	}
+
+	tokens := &SessionTokens{SessionID: id}
+	presented := hashRefreshSecret(secret)
+	if presented == session.RefreshHash {
+		newSecret, err := GenerateSessionToken()
+		if err != nil {
+			return nil, err
+		}
+		expiresAt := now.Add(sessionTTL())
+		rotated, err := store.Rotate(ctx, id, presented, hashRefreshSecret(newSecret), expiresAt, ClientIP(r))
+		if err != nil {
+			return nil, err
+		}
+		if rotated {
+			tokens.RefreshToken = id + "." + newSecret
+			tokens.RefreshExpiresAt = expiresAt
+			if tokens.AccessToken, tokens.AccessExpiresAt, err = signAccessToken(session); err != nil {
+				return nil, err
+			}
+			return tokens, nil
+		}
+		// A concurrent refresh rotated the token first; check it against the new state
+		if session, err = store.Get(ctx, id); err != nil {
+			return nil, err
+		}
+		if !session.Active(now) {
+			return nil, ErrSessionInvalid
+		}
+	}
+
+	if presented == session.PrevRefreshHash && now.Sub(session.RotatedAt) < refreshReuseGrace {
+		// The response to the request that rotated the token carries the new refresh token
+		if tokens.AccessToken, tokens.AccessExpiresAt, err = signAccessToken(session); err != nil {
+			return nil, err
+		}
+		return tokens, nil
 	}
 
-	// Create JWT claims
+	log.Printf("WARN: Refresh token reuse for session %s of user %d, revoking the session", id, session.UserID)
+	if err := store.Revoke(ctx, id); err != nil {
+		log.Printf("Failed to revoke session %s: %v", id, err)
+	}
+	return nil, ErrRefreshReused
+}
+
+// signAccessToken issues a short-lived JWT for a session, with the session ID as jti
+func signAccessToken(session *Session) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL())
 	claims := &UserClaims{
-		UserID:  user.ID,
-		Email:   user.Email,
-		IsAdmin: user.IsAdmin,
+		UserID:    session.UserID,
+		Email:     session.Email,
+		IsAdmin:   session.IsAdmin,
+		ProjectID: session.ProjectID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(168 * time.Hour)), // 7 days
+			ID:        session.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 		},
 	}
 
-	// Create JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	jwtString, err := token.SignedString(jwtSecret)
+	jwtString, err := signToken(claims)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
+	return jwtString, expiresAt, nil
+}
 
-	// Store session
-	sessionMutex.Lock()
-	sessions[jwtString] = Session{
-		Token:     jwtString,
-		User:      user,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(168 * time.Hour),
+// hashRefreshSecret hashes the secret part of a refresh token for storage
+func hashRefreshSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// ValidateAccessToken validates an access JWT, checks that its session has not ended and that it
+// was issued by the user directory serving the request's host
+func ValidateAccessToken(ctx context.Context, tokenString string) (*UserClaims, error) {
+	claims, err := ValidateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ProjectID != AccountProjectID(ctx) {
+		return nil, ErrSessionProject
+	}
+	if claims.ID == "" {
+		return nil, ErrSessionInvalid // Issued before sessions were tracked
 	}
-	sessionMutex.Unlock()
+	session, err := getSessionStore().Get(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !session.Active(time.Now()) {
+		return nil, ErrSessionInvalid
+	}
+	return claims, nil
+}
 
-	return jwtString, nil
+// RevokeSession ends a single session
+func RevokeSession(ctx context.Context, sessionID string) error {
+	return getSessionStore().Revoke(ctx, sessionID)
 }
 
-// ValidateJWT validates a JWT token and returns the claims
-func ValidateJWT(tokenString string) (*UserClaims, error) {
-	if jwtSecret == nil {
-		return nil, errors.New("JWT secret not initialized")
+// RevokeUserSessions ends all sessions of a user and returns how many were ended.
+// projectID is the user's directory (User.ProjectID), 0 for ai.users accounts.
+func RevokeUserSessions(ctx context.Context, projectID int64, userID int) (int64, error) {
+	return getSessionStore().RevokeUser(ctx, projectID, userID)
+}
+
+// RevokeUserSession ends one session of a user and reports whether it belonged to them
+func RevokeUserSession(ctx context.Context, user *User, sessionID string) (bool, error) {
+	session, err := getSessionStore().Get(ctx, sessionID)
+	if err != nil {
+		return false, err
+	}
+	if session == nil || session.UserID != user.ID || session.ProjectID != user.ProjectID {
+		return false, nil
 	}
+	return true, getSessionStore().Revoke(ctx, sessionID)
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+// ListUserSessions returns the active sessions of a user, most recently used first.
+// projectID is the user's directory (User.ProjectID), 0 for ai.users accounts.
+func ListUserSessions(ctx context.Context, projectID int64, userID int) ([]Session, error) {
+	return getSessionStore().ListByUser(ctx, projectID, userID)
+}
 
+// ValidateJWT validates a JWT token and returns the claims
+func ValidateJWT(tokenString string) (*UserClaims, error) {
+	token, err := parseToken(tokenString, &UserClaims{})
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*UserClaims); ok && token.Valid {
+	// Access tokens have no subject; pending second factor and login state tokens do
+	if claims, ok := token.Claims.(*UserClaims); ok && token.Valid && claims.Subject == "" {
 		return claims, nil
 	}
 
 	return nil, errors.New("invalid token")
 }
 
-// GetSession retrieves a session by token
-func GetSession(token string) (Session, bool) {
-	sessionMutex.RLock()
-	defer sessionMutex.RUnlock()
-	session, exists := sessions[token]
-	return session, exists
-}
-
-// ClearSession removes a session
-func ClearSession(token string) {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
-	delete(sessions, token)
-}
-
 // SetUserContext adds user information to the request context
 func SetUserContext(ctx context.Context, user *User) context.Context {
+	if user != nil && user.AvatarURL == "" {
+		user.AvatarURL = AvatarURL(user)
+	}
 	return context.WithValue(ctx, userCtxKey{}, user)
 }
 
@@ -161,15 +292,20 @@ func GetUserFromContext(ctx context.Context) *User {
 	return nil
 }
 
-// CleanupSessions removes expired sessions
-func CleanupSessions() {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
+// SetAccountProjectID records that logins on the request's host use the user directory of the
+// given project. Hosts without a directory (ID 0) use ai.users.
+func SetAccountProjectID(ctx context.Context, projectID int64) context.Context {
+	return context.WithValue(ctx, accountProjectCtxKey{}, projectID)
+}
 
-	now := time.Now()
-	for token, session := range sessions {
-		if session.ExpiresAt.Before(now) {
-			delete(sessions, token)
-		}
-	}
+// AccountProjectID returns the project whose user directory serves the request's host, or 0 for ai.users
+func AccountProjectID(ctx context.Context) int64 {
+	id, _ := ctx.Value(accountProjectCtxKey{}).(int64)
+	return id
+}
+
+// GetSessionIDFromContext returns the ID of the session the request was authenticated with
+func GetSessionIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionCtxKey{}).(string)
+	return id
 }
@@ -0,0 +1,488 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ldapTimeout bounds each LDAP login, from connecting to the last search result
+const ldapTimeout = 10 * time.Second
+
+// ldapRoleAdmin is the group role that makes an ai.users account an instance admin
+const ldapRoleAdmin = "admin"
+
+var (
+	// ErrLDAPUserNotFound is returned when no directory entry matches the login email
+	ErrLDAPUserNotFound = errors.New("no directory entry for the email")
+	// ErrLDAPInvalidCredentials is returned when the directory rejects the password
+	ErrLDAPInvalidCredentials = errors.New("directory rejected the credentials")
+	// ErrLDAPGroupDenied is returned when the user is in none of the required groups
+	ErrLDAPGroupDenied = errors.New("not a member of a group allowed to log in")
+	// ErrLDAPEmailMismatch is returned when the entry found has another email than the login email
+	ErrLDAPEmailMismatch = errors.New("directory entry has another email")
+)
+
+// LDAPConfig describes an LDAP or Active Directory server that password logins are checked against.
+// Logins bind with the service account, search BaseDN for the email and bind again as the entry found.
+type LDAPConfig struct {
+	URL                string            `json:"url"`                            // ldaps://host:636, or ldap://host:389 with start_tls
+	StartTLS           bool              `json:"start_tls,omitempty"`            // Upgrade ldap:// connections with StartTLS
+	AllowPlaintext     bool              `json:"allow_plaintext,omitempty"`      // Allow ldap:// without StartTLS, which sends passwords in the clear
+	InsecureSkipVerify bool              `json:"insecure_skip_verify,omitempty"` // Do not verify the server certificate
+	CACert             string            `json:"ca_cert,omitempty"`              // PEM certificates to trust instead of the system roots
+	BindDN             string            `json:"bind_dn,omitempty"`              // Service account for the search; anonymous when empty
+	BindPassword       string            `json:"bind_password,omitempty"`
+	BaseDN             string            `json:"base_dn"`
+	UserFilter         string            `json:"user_filter,omitempty"`     // {email} is replaced by the escaped login email; default (mail={email})
+	EmailAttribute     string            `json:"email_attribute,omitempty"` // Default mail
+	GroupAttribute     string            `json:"group_attribute,omitempty"` // Default memberOf
+	RequiredGroups     []string          `json:"required_groups,omitempty"` // Group DNs allowed to log in; everyone when empty
+	GroupRoles         map[string]string `json:"group_roles,omitempty"`     // Group DN to role, see LDAPSource.ApplyLDAPRoles
+	LocalFallback      bool              `json:"local_fallback,omitempty"`  // Check local passwords for emails the directory does not know
+}
+
+// LDAPIdentity is a user the directory authenticated
+type LDAPIdentity struct {
+	DN     string
+	Email  string
+	Groups []string
+	Roles  []string // Roles mapped from Groups by GroupRoles
+}
+
+// LDAPSource selects the directory for password logins on a request's host and applies group roles
+type LDAPSource interface {
+	// LDAPConfig returns the directory for the request, or nil when logins use local passwords.
+	LDAPConfig(r *http.Request) (*LDAPConfig, error)
+	// ApplyLDAPRoles grants a user who logged in through the directory the roles of their groups.
+	ApplyLDAPRoles(r *http.Request, userService UserServicer, user *User, roles []string) error
+}
+
+// envLDAPSource reads the instance directory from LDAP_CONFIG
+type envLDAPSource struct{}
+
+func (envLDAPSource) LDAPConfig(r *http.Request) (*LDAPConfig, error) {
+	return InstanceLDAPConfig()
+}
+
+func (envLDAPSource) ApplyLDAPRoles(r *http.Request, userService UserServicer, user *User, roles []string) error {
+	return ApplyInstanceLDAPRoles(r.Context(), userService, user, roles)
+}
+
+// InstanceLDAPConfig returns the directory configured for the whole instance in LDAP_CONFIG, a JSON LDAPConfig
+func InstanceLDAPConfig() (*LDAPConfig, error) {
+	raw := strings.TrimSpace(getEnv("LDAP_CONFIG"))
+	if raw == "" {
+		return nil, nil
+	}
+	var config LDAPConfig
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil, fmt.Errorf("invalid LDAP_CONFIG: %w", err)
+	}
+	return &config, nil
+}
+
+// ApplyInstanceLDAPRoles makes ai.users accounts with the admin group role instance admins.
+// Roles are only granted, never revoked, so admins can still be made by hand.
+func ApplyInstanceLDAPRoles(ctx context.Context, userService UserServicer, user *User, roles []string) error {
+	if user.IsAdmin || user.ProjectID != 0 || !containsString(roles, ldapRoleAdmin) {
+		return nil
+	}
+	if err := userService.MakeUserAdmin(ctx, user.ID); err != nil {
+		return err
+	}
+	log.Printf("User %s made admin by directory group", user.Email)
+	user.IsAdmin = true
+	return nil
+}
+
+var (
+	ldapSource      LDAPSource = envLDAPSource{}
+	ldapSourceMutex            = &sync.Mutex{}
+)
+
+// SetLDAPSource replaces where the LDAP directory of a request is read from
+func SetLDAPSource(source LDAPSource) {
+	ldapSourceMutex.Lock()
+	defer ldapSourceMutex.Unlock()
+	ldapSource = source
+}
+
+// getLDAPSource returns the current LDAP source
+func getLDAPSource() LDAPSource {
+	ldapSourceMutex.Lock()
+	defer ldapSourceMutex.Unlock()
+	return ldapSource
+}
+
+// verifyPassword checks a password login against the request's directory when one is configured,
+// provisioning the account on first login, and against the local password otherwise
+func verifyPassword(r *http.Request, userService UserServicer, email, password string) (*User, error) {
+	source := getLDAPSource()
+	config, err := source.LDAPConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return userService.VerifyPassword(r.Context(), email, password)
+	}
+
+	identity, err := config.Authenticate(r.Context(), email, password)
+	if errors.Is(err, ErrLDAPUserNotFound) && config.LocalFallback {
+		return userService.VerifyPassword(r.Context(), email, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := userService.GetUserByEmail(r.Context(), identity.Email)
+	if err != nil || user == nil {
+		if user, err = userService.CreateUser(r.Context(), identity.Email); err != nil {
+			return nil, fmt.Errorf("provisioning %s from the directory: %w", identity.Email, err)
+		}
+		log.Printf("Created user %s from directory entry %s", user.Email, identity.DN)
+	}
+	if err := source.ApplyLDAPRoles(r, userService, user, identity.Roles); err != nil {
+		log.Printf("Failed to apply directory roles %v to user %s: %v", identity.Roles, user.Email, err)
+	}
+	return user, nil
+}
+
+// Authenticate checks an email and password against the directory
+func (c *LDAPConfig) Authenticate(ctx context.Context, email, password string) (*LDAPIdentity, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" || password == "" {
+		return nil, ErrLDAPInvalidCredentials // An empty password would be an unauthenticated bind
+	}
+	ctx, cancel := context.WithTimeout(ctx, ldapTimeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	if err := conn.bind(c.BindDN, c.BindPassword); err != nil {
+		return nil, fmt.Errorf("service account bind: %w", err)
+	}
+	emailAttr, groupAttr := c.emailAttribute(), c.groupAttribute()
+	filter := c.UserFilter
+	if filter == "" {
+		filter = "(mail={email})"
+	}
+	entries, err := conn.search(c.BaseDN, strings.ReplaceAll(filter, "{email}", escapeLDAPFilter(email)), []string{emailAttr, groupAttr})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrLDAPUserNotFound
+	}
+	if len(entries) > 1 {
+		return nil, fmt.Errorf("%d directory entries match %s", len(entries), email)
+	}
+	entry := entries[0]
+	if err := conn.bind(entry.DN, password); err != nil {
+		return nil, err
+	}
+
+	// The login email picks the account, so an entry whose email attribute names another address
+	// must not log in as it; a loose user_filter could otherwise match someone else's account
+	identity := &LDAPIdentity{DN: entry.DN, Email: email, Groups: entry.values(groupAttr)}
+	if mail := entry.values(emailAttr); len(mail) > 0 && mail[0] != "" && !strings.EqualFold(mail[0], email) {
+		return nil, fmt.Errorf("%w: %s is %s", ErrLDAPEmailMismatch, entry.DN, mail[0])
+	}
+	if len(c.RequiredGroups) > 0 && !anyGroup(identity.Groups, c.RequiredGroups) {
+		return nil, ErrLDAPGroupDenied
+	}
+	for group, role := range c.GroupRoles {
+		if anyGroup(identity.Groups, []string{group}) && !containsString(identity.Roles, role) {
+			identity.Roles = append(identity.Roles, role)
+		}
+	}
+	return identity, nil
+}
+
+func (c *LDAPConfig) emailAttribute() string {
+	if c.EmailAttribute == "" {
+		return "mail"
+	}
+	return c.EmailAttribute
+}
+
+func (c *LDAPConfig) groupAttribute() string {
+	if c.GroupAttribute == "" {
+		return "memberOf"
+	}
+	return c.GroupAttribute
+}
+
+// tlsConfig returns the TLS settings for connecting to a host
+func (c *LDAPConfig) tlsConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: c.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if c.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.CACert)) {
+			return nil, errors.New("ca_cert holds no PEM certificates")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// dial connects to the directory, with TLS from the start for ldaps:// or through StartTLS
+func (c *LDAPConfig) dial(ctx context.Context) (*ldapConn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP url: %w", err)
+	}
+	host, port := u.Hostname(), u.Port()
+	switch {
+	case u.Scheme == "ldaps" && port == "":
+		port = "636"
+	case u.Scheme == "ldap" && port == "":
+		port = "389"
+	case u.Scheme != "ldap" && u.Scheme != "ldaps":
+		return nil, fmt.Errorf("LDAP url must start with ldap:// or ldaps://, got %q", c.URL)
+	}
+	if u.Scheme == "ldap" && !c.StartTLS && !c.AllowPlaintext {
+		return nil, errors.New("refusing to send passwords over ldap:// without start_tls")
+	}
+	tlsConfig, err := c.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{}
+	raw, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		raw.SetDeadline(deadline)
+	}
+	conn := newLDAPConn(raw)
+	if u.Scheme == "ldaps" {
+		conn = newLDAPConn(tls.Client(raw, tlsConfig))
+	} else if c.StartTLS {
+		if err := conn.startTLS(tlsConfig); err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// LDAP protocol operations (RFC 4511 section 4.2 to 4.14)
+const (
+	ldapBindRequest      = berApplication | berConstructed | 0
+	ldapBindResponse     = berApplication | berConstructed | 1
+	ldapUnbindRequest    = berApplication | 2
+	ldapSearchRequest    = berApplication | berConstructed | 3
+	ldapSearchEntry      = berApplication | berConstructed | 4
+	ldapSearchDone       = berApplication | berConstructed | 5
+	ldapSearchReference  = berApplication | berConstructed | 19
+	ldapExtendedRequest  = berApplication | berConstructed | 23
+	ldapExtendedResponse = berApplication | berConstructed | 24
+
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+// ldapConn is a connection to a directory server that runs one operation at a time
+type ldapConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID int64
+}
+
+func newLDAPConn(conn net.Conn) *ldapConn {
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// ldapEntry is a search result with attribute names in lower case
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// values returns the values of an attribute
+func (e *ldapEntry) values(attr string) []string {
+	return e.Attributes[strings.ToLower(attr)]
+}
+
+// send writes a request and returns its message ID
+func (c *ldapConn) send(op []byte) (int64, error) {
+	c.nextID++
+	_, err := c.conn.Write(berTLV(berSequence, berInt(berInteger, c.nextID), op))
+	return c.nextID, err
+}
+
+// receive reads the next response to a request
+func (c *ldapConn) receive(id int64) (*berPacket, error) {
+	for {
+		message, err := readBERPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if message.tag != berSequence || len(message.children) < 2 {
+			return nil, errBERMalformed
+		}
+		if message.child(0).int() == id {
+			return message.child(1), nil
+		}
+	}
+}
+
+// ldapResultError turns an LDAPResult into an error
+func ldapResultError(result *berPacket) error {
+	switch code := result.child(0).int(); code {
+	case ldapResultSuccess:
+		return nil
+	case ldapResultInvalidCredentials:
+		return ErrLDAPInvalidCredentials
+	default:
+		return fmt.Errorf("LDAP error %d: %s", code, result.child(2).str())
+	}
+}
+
+// bind authenticates the connection with a simple bind; an empty DN binds anonymously
+func (c *ldapConn) bind(dn, password string) error {
+	id, err := c.send(berTLV(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(berContext|0, password),
+	))
+	if err != nil {
+		return err
+	}
+	response, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if response.tag != ldapBindResponse {
+		return errBERMalformed
+	}
+	return ldapResultError(response)
+}
+
+// startTLS upgrades the connection to TLS
+func (c *ldapConn) startTLS(config *tls.Config) error {
+	id, err := c.send(berTLV(ldapExtendedRequest, berString(berContext|0, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	response, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if response.tag != ldapExtendedResponse {
+		return errBERMalformed
+	}
+	if err := ldapResultError(response); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+// search runs a subtree search for at most two entries, enough to tell a unique match
+func (c *ldapConn) search(baseDN, filter string, attrs []string) ([]ldapEntry, error) {
+	compiled, err := compileLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrList := make([][]byte, len(attrs))
+	for i, attr := range attrs {
+		attrList[i] = berString(berOctetString, attr)
+	}
+	id, err := c.send(berTLV(ldapSearchRequest,
+		berString(berOctetString, baseDN),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 2),    // sizeLimit
+		berInt(berInteger, int64(ldapTimeout/time.Second)),
+		berBool(false),
+		compiled,
+		berTLV(berSequence, attrList...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		response, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch response.tag {
+		case ldapSearchEntry:
+			entry := ldapEntry{DN: response.child(0).str(), Attributes: map[string][]string{}}
+			for _, attr := range response.child(1).children {
+				name := strings.ToLower(attr.child(0).str())
+				for _, value := range attr.child(1).children {
+					entry.Attributes[name] = append(entry.Attributes[name], value.str())
+				}
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			// Referrals to other servers are not followed
+		case ldapSearchDone:
+			if code := response.child(0).int(); code == 4 && len(entries) > 0 {
+				return entries, nil // sizeLimitExceeded: more than one match
+			}
+			if err := ldapResultError(response); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, errBERMalformed
+		}
+	}
+}
+
+// close unbinds and closes the connection
+func (c *ldapConn) close() {
+	c.send(berTLV(ldapUnbindRequest))
+	c.conn.Close()
+}
+
+// anyGroup reports whether any of groups is one of wanted, comparing DNs without case
+func anyGroup(groups, wanted []string) bool {
+	for _, group := range groups {
+		for _, w := range wanted {
+			if strings.EqualFold(strings.TrimSpace(group), strings.TrimSpace(w)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
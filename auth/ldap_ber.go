@@ -0,0 +1,348 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The subset of BER (X.690) that LDAP messages use: single-byte tags and definite lengths
+
+// BER tags
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	berConstructed = 0x20
+	berApplication = 0x40
+	berContext     = 0x80
+)
+
+// maxBERMessage bounds the size of one LDAP message read from a server
+const maxBERMessage = 16 << 20
+
+var errBERMalformed = errors.New("malformed BER data")
+
+// berPacket is a decoded BER element; constructed elements have children instead of a value
+type berPacket struct {
+	tag      byte
+	value    []byte
+	children []*berPacket
+}
+
+// child returns the i-th child, or an empty packet when there is none
+func (p *berPacket) child(i int) *berPacket {
+	if i < len(p.children) {
+		return p.children[i]
+	}
+	return &berPacket{}
+}
+
+// str returns the value as a string
+func (p *berPacket) str() string {
+	return string(p.value)
+}
+
+// int returns the value as a signed integer
+func (p *berPacket) int() int64 {
+	var n int64
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+// berTLV encodes an element from its tag and the concatenated contents
+func berTLV(tag byte, contents ...[]byte) []byte {
+	length := 0
+	for _, content := range contents {
+		length += len(content)
+	}
+	out := []byte{tag}
+	if length < 0x80 {
+		out = append(out, byte(length))
+	} else {
+		var lengthBytes []byte
+		for n := length; n > 0; n >>= 8 {
+			lengthBytes = append([]byte{byte(n)}, lengthBytes...)
+		}
+		out = append(out, 0x80|byte(len(lengthBytes)))
+		out = append(out, lengthBytes...)
+	}
+	for _, content := range contents {
+		out = append(out, content...)
+	}
+	return out
+}
+
+// berInt encodes an integer or enumerated value
+func berInt(tag byte, n int64) []byte {
+	var content []byte
+	for {
+		content = append([]byte{byte(n)}, content...)
+		n >>= 8
+		if (n == 0 && content[0]&0x80 == 0) || (n == -1 && content[0]&0x80 != 0) {
+			break
+		}
+	}
+	return berTLV(tag, content)
+}
+
+// berString encodes an octet string
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+// berBool encodes a boolean
+func berBool(b bool) []byte {
+	if b {
+		return berTLV(berBoolean, []byte{0xff})
+	}
+	return berTLV(berBoolean, []byte{0})
+}
+
+// readBERPacket reads one complete element from a stream
+func readBERPacket(r *bufio.Reader) (*berPacket, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readBERLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxBERMessage {
+		return nil, fmt.Errorf("BER message of %d bytes is too large", length)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return decodeBERContent(tag, content)
+}
+
+// readBERLength reads a definite length in short or long form
+func readBERLength(r io.ByteReader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if first&0x80 == 0 {
+		return int(first), nil
+	}
+	count := int(first & 0x7f)
+	if count == 0 || count > 4 {
+		return 0, errBERMalformed // Indefinite or absurd lengths
+	}
+	length := 0
+	for i := 0; i < count; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | int(b)
+	}
+	return length, nil
+}
+
+// decodeBERContent decodes the contents of an element, recursing into constructed elements
+func decodeBERContent(tag byte, content []byte) (*berPacket, error) {
+	packet := &berPacket{tag: tag}
+	if tag&berConstructed == 0 {
+		packet.value = content
+		return packet, nil
+	}
+	for len(content) > 0 {
+		if len(content) < 2 {
+			return nil, errBERMalformed
+		}
+		r := &byteReader{data: content[1:]}
+		length, err := readBERLength(r)
+		if err != nil || length > len(r.data) {
+			return nil, errBERMalformed
+		}
+		child, err := decodeBERContent(content[0], r.data[:length])
+		if err != nil {
+			return nil, err
+		}
+		packet.children = append(packet.children, child)
+		content = r.data[length:]
+	}
+	return packet, nil
+}
+
+// byteReader reads bytes from the front of a slice
+type byteReader struct {
+	data []byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if len(r.data) == 0 {
+		return 0, errBERMalformed
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b, nil
+}
+
+// Search filter choices (RFC 4511 section 4.5.1)
+const (
+	filterAnd            = berContext | berConstructed | 0
+	filterOr             = berContext | berConstructed | 1
+	filterNot            = berContext | berConstructed | 2
+	filterEquality       = berContext | berConstructed | 3
+	filterSubstrings     = berContext | berConstructed | 4
+	filterGreaterOrEqual = berContext | berConstructed | 5
+	filterLessOrEqual    = berContext | berConstructed | 6
+	filterPresent        = berContext | 7
+	filterApprox         = berContext | berConstructed | 8
+)
+
+// compileLDAPFilter encodes a string search filter (RFC 4515), without extensible matches
+func compileLDAPFilter(filter string) ([]byte, error) {
+	encoded, rest, err := compileFilterItem(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP filter %q: %w", filter, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid LDAP filter %q: trailing %q", filter, rest)
+	}
+	return encoded, nil
+}
+
+// compileFilterItem encodes the parenthesized filter at the start of s and returns what follows it
+func compileFilterItem(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("expected (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("unexpected end")
+	}
+
+	switch s[0] {
+	case '&', '|', '!':
+		op := s[0]
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			part, rest, err := compileFilterItem(s)
+			if err != nil {
+				return nil, "", err
+			}
+			parts, s = append(parts, part), rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("expected )")
+		}
+		switch {
+		case op == '!' && len(parts) != 1:
+			return nil, "", errors.New("! takes one filter")
+		case op == '!':
+			return berTLV(filterNot, parts[0]), s[1:], nil
+		case op == '&':
+			return berTLV(filterAnd, parts...), s[1:], nil
+		default:
+			return berTLV(filterOr, parts...), s[1:], nil
+		}
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("expected )")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", errors.New("expected attribute=value")
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = filterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		tag, attr = filterLessOrEqual, attr[:len(attr)-1]
+	case '~':
+		tag, attr = filterApprox, attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, "", errors.New("missing attribute")
+	}
+
+	if tag == filterEquality && value == "*" {
+		return berTLV(filterPresent, []byte(attr)), rest, nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		pieces := strings.Split(value, "*")
+		var subs [][]byte
+		for i, piece := range pieces {
+			if piece == "" {
+				continue
+			}
+			unescaped, err := unescapeFilterValue(piece)
+			if err != nil {
+				return nil, "", err
+			}
+			choice := byte(berContext | 1) // any
+			if i == 0 {
+				choice = berContext | 0 // initial
+			} else if i == len(pieces)-1 {
+				choice = berContext | 2 // final
+			}
+			subs = append(subs, berString(choice, unescaped))
+		}
+		return berTLV(filterSubstrings, berString(berOctetString, attr), berTLV(berSequence, subs...)), rest, nil
+	}
+
+	unescaped, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berTLV(tag, berString(berOctetString, attr), berString(berOctetString, unescaped)), rest, nil
+}
+
+// unescapeFilterValue decodes the \XX escapes of a filter value
+func unescapeFilterValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", errors.New("truncated escape")
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", errors.New("invalid escape")
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// escapeLDAPFilter escapes a value for use in a search filter (RFC 4515 section 3)
+func escapeLDAPFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
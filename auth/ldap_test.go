@@ -0,0 +1,357 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLDAPEntry is an entry of the in-process directory
+type testLDAPEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+// testLDAPServer is an in-process directory speaking the LDAP operations used for logins.
+// Like most directories it refuses simple binds before StartTLS.
+type testLDAPServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	caPEM    string
+	entries  map[string]testLDAPEntry
+}
+
+// startTestLDAPServer serves a directory on a local port until the test ends
+func startTestLDAPServer(t *testing.T, entries map[string]testLDAPEntry) *testLDAPServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testLDAPServer{
+		listener: listener,
+		tls:      &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		caPEM:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		entries:  entries,
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				server.serve(conn)
+			}()
+		}
+	}()
+	return server
+}
+
+// config returns a directory configuration for logging in against the server
+func (s *testLDAPServer) config() *LDAPConfig {
+	return &LDAPConfig{
+		URL:          "ldap://" + s.listener.Addr().String(),
+		StartTLS:     true,
+		CACert:       s.caPEM,
+		BindDN:       "cn=service,dc=example,dc=com",
+		BindPassword: "service-secret",
+		BaseDN:       "dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(mail={email}))",
+	}
+}
+
+// serve answers the requests of one connection
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	r, secure, bound := bufio.NewReader(conn), false, ""
+	reply := func(id int64, ops ...[]byte) {
+		for _, op := range ops {
+			conn.Write(berTLV(berSequence, berInt(berInteger, id), op))
+		}
+	}
+	result := func(tag byte, code int64) []byte {
+		return berTLV(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, ""))
+	}
+
+	for {
+		message, err := readBERPacket(r)
+		if err != nil {
+			return
+		}
+		id, op := message.child(0).int(), message.child(1)
+		switch op.tag {
+		case ldapExtendedRequest:
+			reply(id, result(ldapExtendedResponse, 0))
+			tlsConn := tls.Server(conn, s.tls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, r, secure = tlsConn, bufio.NewReader(tlsConn), true
+		case ldapBindRequest:
+			dn, password := op.child(1).str(), op.child(2).str()
+			entry, ok := s.entries[dn]
+			switch {
+			case !secure:
+				reply(id, result(ldapBindResponse, 13)) // confidentialityRequired
+			case !ok || password == "" || entry.password != password:
+				reply(id, result(ldapBindResponse, ldapResultInvalidCredentials))
+			default:
+				bound = dn
+				reply(id, result(ldapBindResponse, 0))
+			}
+		case ldapSearchRequest:
+			if bound == "" {
+				reply(id, result(ldapSearchDone, 50)) // insufficientAccessRights
+				continue
+			}
+			for dn, entry := range s.entries {
+				if !strings.HasSuffix(dn, op.child(0).str()) || !entry.matches(op.child(6)) {
+					continue
+				}
+				var attrs [][]byte
+				for _, name := range op.child(7).children {
+					var values [][]byte
+					for _, value := range entry.attrs[name.str()] {
+						values = append(values, berString(berOctetString, value))
+					}
+					attrs = append(attrs, berTLV(berSequence, berString(berOctetString, name.str()), berTLV(berSet, values...)))
+				}
+				reply(id, berTLV(ldapSearchEntry, berString(berOctetString, dn), berTLV(berSequence, attrs...)))
+			}
+			reply(id, result(ldapSearchDone, 0))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+// matches evaluates the and, or, not, equality and presence filters against the entry
+func (e testLDAPEntry) matches(filter *berPacket) bool {
+	switch filter.tag {
+	case filterAnd, filterOr:
+		for _, part := range filter.children {
+			if e.matches(part) != (filter.tag == filterAnd) {
+				return filter.tag != filterAnd
+			}
+		}
+		return filter.tag == filterAnd
+	case filterNot:
+		return !e.matches(filter.child(0))
+	case filterPresent:
+		return len(e.attrs[filter.str()]) > 0
+	case filterEquality:
+		for _, value := range e.attrs[filter.child(0).str()] {
+			if strings.EqualFold(value, filter.child(1).str()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// testLDAPSource serves a fixed directory configuration
+type testLDAPSource struct {
+	config *LDAPConfig
+}
+
+func (s testLDAPSource) LDAPConfig(r *http.Request) (*LDAPConfig, error) {
+	return s.config, nil
+}
+
+func (s testLDAPSource) ApplyLDAPRoles(r *http.Request, userService UserServicer, user *User, roles []string) error {
+	return ApplyInstanceLDAPRoles(r.Context(), userService, user, roles)
+}
+
+// fixedTwoFactorPolicy requires admin 2FA or not, without reading the environment
+type fixedTwoFactorPolicy bool
+
+func (p fixedTwoFactorPolicy) AdminTwoFactorRequired(ctx context.Context) (bool, error) {
+	return bool(p), nil
+}
+
+func (p fixedTwoFactorPolicy) SetAdminTwoFactorRequired(ctx context.Context, required bool) error {
+	return nil
+}
+
+// ldapUserService keeps provisioned users in memory; it knows one local password
+type ldapUserService struct {
+	UserServicer
+	users map[string]*User
+}
+
+func (s *ldapUserService) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	if user, ok := s.users[email]; ok {
+		return user, nil
+	}
+	return nil, errors.New("user not found")
+}
+
+func (s *ldapUserService) CreateUser(ctx context.Context, email string) (*User, error) {
+	user := &User{ID: len(s.users) + 100, Email: email}
+	s.users[email] = user
+	return user, nil
+}
+
+func (s *ldapUserService) MakeUserAdmin(ctx context.Context, userID int) error {
+	for _, user := range s.users {
+		if user.ID == userID {
+			user.IsAdmin = true
+		}
+	}
+	return nil
+}
+
+func (s *ldapUserService) VerifyPassword(ctx context.Context, email, password string) (*User, error) {
+	if email == "local@example.com" && password == "local-secret" {
+		return &User{ID: 1, Email: email}, nil
+	}
+	return nil, errors.New("invalid password")
+}
+
+func (s *ldapUserService) UpdateUserLastLogin(ctx context.Context, userID int) error {
+	return nil
+}
+
+// TestLDAPFilter tests compiling search filters and escaping values
+func TestLDAPFilter(t *testing.T) {
+	compiled, err := compileLDAPFilter("(&(objectClass=person)(!(mail=" + escapeLDAPFilter("a*(b)") + ")))")
+	if err != nil {
+		t.Fatalf("Failed to compile the filter: %v", err)
+	}
+	filter, err := decodeBERContent(compiled[0], compiled[2:])
+	if err != nil || filter.tag != filterAnd || len(filter.children) != 2 {
+		t.Fatalf("Expected an and filter of two parts, got %+v (%v)", filter, err)
+	}
+	if value := filter.child(1).child(0).child(1).str(); value != "a*(b)" {
+		t.Errorf("Expected the escaped value to round-trip, got %q", value)
+	}
+	for _, invalid := range []string{"", "mail=x", "(mail=x", "(=x)", "(!(a=1)(b=2))", "(mail=\\zz)", "(a=1)(b=2)"} {
+		if _, err := compileLDAPFilter(invalid); err == nil {
+			t.Errorf("Expected %q to be refused", invalid)
+		}
+	}
+}
+
+// TestLDAPPasswordLogin tests password logins against an in-process directory over StartTLS,
+// with provisioning on first login, group roles, required groups and the local fallback
+func TestLDAPPasswordLogin(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryTwoFactorStore(t)
+	SetAuthLimits(nil) // The failed logins below would otherwise be delayed
+	t.Cleanup(func() { SetAuthLimits(nil) })
+	previousPolicy := getTwoFactorPolicy()
+	SetTwoFactorPolicy(fixedTwoFactorPolicy(false)) // Keep AUTH_REQUIRE_ADMIN_2FA out of the env cache
+	t.Cleanup(func() { SetTwoFactorPolicy(previousPolicy) })
+	server := startTestLDAPServer(t, map[string]testLDAPEntry{
+		"cn=service,dc=example,dc=com": {password: "service-secret"},
+		"uid=ada,ou=people,dc=example,dc=com": {password: "ada-secret", attrs: map[string][]string{
+			"objectClass": {"person"},
+			"mail":        {"Ada@Example.com"},
+			"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com"},
+		}},
+		"uid=bob,ou=people,dc=example,dc=com": {password: "bob-secret", attrs: map[string][]string{
+			"objectClass": {"person"},
+			"mail":        {"bob@example.com"},
+		}},
+		"uid=eve,ou=people,dc=example,dc=com": {password: "eve-secret", attrs: map[string][]string{
+			"objectClass": {"account"},
+			"uid":         {"eve@example.com"},
+			"mail":        {"ada@example.com"},
+			"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com"},
+		}},
+	})
+	config := server.config()
+	config.RequiredGroups = []string{"CN=Staff,OU=Groups,DC=example,DC=com"}
+	config.GroupRoles = map[string]string{"cn=admins,ou=groups,dc=example,dc=com": ldapRoleAdmin}
+	previous := getLDAPSource()
+	SetLDAPSource(testLDAPSource{config: config})
+	t.Cleanup(func() { SetLDAPSource(previous) })
+
+	users := &ldapUserService{users: map[string]*User{}}
+	login := func(email, password string) JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/auth/password-login", strings.NewReader(`{"email":"`+email+`","password":"`+password+`"}`))
+		rec := httptest.NewRecorder()
+		HandlePasswordLogin(rec, req, users)
+		var resp JSONResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+
+	if resp := login("ada@example.com", "ada-secret"); !resp.Success {
+		t.Fatalf("Expected the directory login to succeed, got %+v", resp)
+	}
+	ada := users.users["ada@example.com"]
+	if ada == nil || !ada.IsAdmin {
+		t.Fatalf("Expected ada to be provisioned as an admin from her groups, got %+v", ada)
+	}
+	if resp := login("ada@example.com", "wrong"); resp.Success {
+		t.Error("Expected a wrong password to be refused")
+	}
+	if resp := login("bob@example.com", "bob-secret"); resp.Success || users.users["bob@example.com"] != nil {
+		t.Error("Expected a user outside the required groups to be refused without an account")
+	}
+	if resp := login("*", "service-secret"); resp.Success {
+		t.Error("Expected a wildcard email to match nothing")
+	}
+	if resp := login("local@example.com", "local-secret"); resp.Success {
+		t.Error("Expected local passwords to be refused without the local fallback")
+	}
+	config.LocalFallback = true
+	if resp := login("local@example.com", "local-secret"); !resp.Success {
+		t.Errorf("Expected the local fallback for an email the directory does not know, got %+v", resp)
+	}
+
+	loose := server.config()
+	loose.UserFilter = "(uid={email})"
+	if _, err := loose.Authenticate(context.Background(), "eve@example.com", "eve-secret"); !errors.Is(err, ErrLDAPEmailMismatch) {
+		t.Errorf("Expected an entry with another email to be refused, got %v", err)
+	}
+
+	plain := server.config()
+	plain.StartTLS = false
+	if _, err := plain.Authenticate(context.Background(), "ada@example.com", "ada-secret"); err == nil {
+		t.Error("Expected ldap:// without StartTLS to be refused")
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrUntrustedHost is returned when a link would point at a host that is not known to serve this instance
+var ErrUntrustedHost = errors.New("the request's host is not trusted for links; set APP_BASE_URL or ALLOWED_HOSTS")
+
+// TrustedHostSource reports whether links may point at a host besides APP_BASE_URL and ALLOWED_HOSTS,
+// such as the domain of the request's project
+type TrustedHostSource interface {
+	TrustedHost(r *http.Request, host string) bool
+}
+
+// noTrustedHosts trusts no further hosts
+type noTrustedHosts struct{}
+
+func (noTrustedHosts) TrustedHost(r *http.Request, host string) bool {
+	return false
+}
+
+var (
+	trustedHostSource      TrustedHostSource = noTrustedHosts{}
+	trustedHostSourceMutex                   = &sync.Mutex{}
+)
+
+// SetTrustedHostSource replaces where further trusted hosts are read from
+func SetTrustedHostSource(source TrustedHostSource) {
+	trustedHostSourceMutex.Lock()
+	defer trustedHostSourceMutex.Unlock()
+	trustedHostSource = source
+}
+
+// getTrustedHostSource returns the current trusted host source
+func getTrustedHostSource() TrustedHostSource {
+	trustedHostSourceMutex.Lock()
+	defer trustedHostSourceMutex.Unlock()
+	return trustedHostSource
+}
+
+// RequestBaseURL returns the scheme and host links in emails and redirects should use. The Host
+// header is chosen by the client, so the request's host is only used when it is trusted: the host of
+// APP_BASE_URL, one of the comma-separated ALLOWED_HOSTS, localhost or a host the TrustedHostSource
+// accepts. Other hosts get APP_BASE_URL, or ErrUntrustedHost when it is not set.
+// X-Forwarded-Proto and X-Forwarded-Host are only used when TRUST_PROXY_HEADERS=1.
+func RequestBaseURL(r *http.Request) (string, error) {
+	host := r.Host
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if getEnv("TRUST_PROXY_HEADERS") == "1" {
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+		}
+		if r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+	}
+
+	baseURL := strings.TrimRight(getEnv("APP_BASE_URL"), "/")
+	if trustedLinkHost(r, hostname(host), baseURL) {
+		return scheme + "://" + host, nil
+	}
+	if baseURL == "" {
+		return "", ErrUntrustedHost
+	}
+	return baseURL, nil
+}
+
+// trustedLinkHost reports whether links may point at the request's host name
+func trustedLinkHost(r *http.Request, name, baseURL string) bool {
+	if name == "" {
+		return false
+	}
+	if name == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(name); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	if base, err := url.Parse(baseURL); err == nil && baseURL != "" && strings.EqualFold(base.Hostname(), name) {
+		return true
+	}
+	for _, allowed := range strings.Split(getEnv("ALLOWED_HOSTS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return getTrustedHostSource().TrustedHost(r, name)
+}
+
+// hostname returns a host without its port
+func hostname(host string) string {
+	return (&url.URL{Host: host}).Hostname()
+}
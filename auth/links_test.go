@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// trustedHosts is a trusted host source accepting the listed host names
+type trustedHosts map[string]bool
+
+func (h trustedHosts) TrustedHost(r *http.Request, host string) bool {
+	return h[host]
+}
+
+// useTrustedHosts trusts the host names for links for the duration of a test
+func useTrustedHosts(t *testing.T, hosts ...string) {
+	previous := getTrustedHostSource()
+	trusted := trustedHosts{}
+	for _, host := range hosts {
+		trusted[host] = true
+	}
+	SetTrustedHostSource(trusted)
+	t.Cleanup(func() { SetTrustedHostSource(previous) })
+}
+
+// TestRequestBaseURL tests that links only point at trusted hosts
+func TestRequestBaseURL(t *testing.T) {
+	if os.Getenv("APP_BASE_URL") != "" || os.Getenv("ALLOWED_HOSTS") != "" || os.Getenv("TRUST_PROXY_HEADERS") != "" {
+		t.Skip("Link hosts are configured in the environment")
+	}
+	useTrustedHosts(t, "project.example")
+
+	tests := []struct {
+		host, want string
+		err        error
+	}{
+		{host: "project.example", want: "http://project.example"},
+		{host: "localhost:8800", want: "http://localhost:8800"},
+		{host: "127.0.0.1:8800", want: "http://127.0.0.1:8800"},
+		{host: "attacker.example", err: ErrUntrustedHost},
+		{host: "project.example.attacker.example", err: ErrUntrustedHost},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/auth/request-otp", nil)
+		req.Host = tt.host
+		req.Header.Set("X-Forwarded-Host", "attacker.example")
+		got, err := RequestBaseURL(req)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("Host %s: got %q, %v; want %q, %v", tt.host, got, err, tt.want, tt.err)
+		}
+	}
+}
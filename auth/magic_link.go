@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// magicLinkSubject marks tokens carried by magic login links
+const magicLinkSubject = "magic_link"
+
+// magicLinkClaims tie a login link to the pending OTP it was sent with and to the browser that asked for it
+type magicLinkClaims struct {
+	Email     string `json:"email"`
+	Binding   string `json:"binding"`    // magicLinkBinding of the pending code
+	NonceHash string `json:"nonce_hash"` // SHA-256 of the nonce cookie set on the requesting browser
+	jwt.RegisteredClaims
+}
+
+var (
+	errMagicLinkInvalid = errors.New("invalid or expired login link")
+	errMagicLinkBrowser = errors.New("login link opened in another browser")
+	errMagicLinkUsed    = errors.New("login link already used")
+)
+
+// SendOTPWithMagicLink sends an OTP like SendOTP, with a link that logs the user in when opened in the
+// browser holding nonce in its magic link cookie. The link and the code share one pending OTP,
+// so using either invalidates both, and requesting a new code invalidates older links.
+func SendOTPWithMagicLink(email, ip, baseURL, nonce string) error {
+	return sendOTP(email, ip, func(email, codeHash string) (string, error) {
+		token, err := signMagicLink(email, codeHash, nonce)
+		if err != nil {
+			return "", err
+		}
+		return baseURL + "/auth/magic?token=" + url.QueryEscape(token), nil
+	})
+}
+
+// magicLinkBinding derives the value a link carries to identify its pending code, without revealing the code's hash
+func magicLinkBinding(email, codeHash string) string {
+	return hashOTP(email, "magic:"+codeHash)
+}
+
+// hashNonce hashes the browser nonce so the link does not carry the cookie value itself
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// signMagicLink issues the token of a magic link. It expires with the code it was sent with.
+func signMagicLink(email, codeHash, nonce string) (string, error) {
+	now := time.Now()
+	claims := &magicLinkClaims{
+		Email:     email,
+		Binding:   magicLinkBinding(email, codeHash),
+		NonceHash: hashNonce(nonce),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   magicLinkSubject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(otpTTL)),
+		},
+	}
+	return signToken(claims)
+}
+
+// redeemMagicLink checks a link against the browser's nonce and consumes the pending OTP it was sent with.
+// It returns the email to log in.
+func redeemMagicLink(ctx context.Context, tokenString, nonce string) (string, error) {
+	claims := &magicLinkClaims{}
+	token, err := parseToken(tokenString, claims, jwt.WithSubject(magicLinkSubject))
+	if err != nil || !token.Valid {
+		return "", errMagicLinkInvalid
+	}
+
+	// Check the browser before touching the code, so link scanners in mail clients cannot use it up
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(hashNonce(nonce)), []byte(claims.NonceHash)) != 1 {
+		return "", errMagicLinkBrowser
+	}
+
+	store := getOTPStore()
+	data, err := store.Get(ctx, claims.Email)
+	if err != nil {
+		return "", err
+	}
+	if data == nil || time.Now().After(data.ExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(magicLinkBinding(claims.Email, data.CodeHash)), []byte(claims.Binding)) != 1 {
+		return "", errMagicLinkUsed
+	}
+	consumed, err := store.Consume(ctx, claims.Email, data.CodeHash)
+	if err != nil {
+		return "", err
+	}
+	if !consumed {
+		return "", errMagicLinkUsed
+	}
+	return claims.Email, nil
+}
+
+// CreateMagicLinkHandler creates the handler magic login links point to
+func CreateMagicLinkHandler(userService UserServicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleMagicLink(w, r, userService)
+	}
+}
+
+// HandleMagicLink logs the user in from a magic link and redirects like a completed login
+func HandleMagicLink(w http.ResponseWriter, r *http.Request, userService UserServicer) {
+	fail := func(reason string, err error) {
+		log.Printf("Magic link login failed (%s): %v", reason, err)
+		http.Redirect(w, r, "/login?error="+reason, http.StatusSeeOther)
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if userService == nil {
+		fail("login_failed", errors.New("user service not available"))
+		return
+	}
+	if ok, wait := getAuthLimits().AllowOTPVerify(ClientIP(r)); !ok {
+		log.Printf("Magic link login from %s rate limited", ClientIP(r))
+		SendRateLimited(w, wait)
+		return
+	}
+
+	var nonce string
+	if cookie, err := r.Cookie(GetMagicLinkCookieName()); err == nil {
+		nonce = cookie.Value
+	}
+	email, err := redeemMagicLink(r.Context(), r.URL.Query().Get("token"), nonce)
+	switch {
+	case errors.Is(err, errMagicLinkBrowser):
+		fail("magic_link_other_browser", err)
+		return
+	case errors.Is(err, errMagicLinkInvalid), errors.Is(err, errMagicLinkUsed):
+		fail("magic_link_expired", err)
+		return
+	case err != nil:
+		fail("login_failed", err)
+		return
+	}
+	ClearMagicLinkCookie(w)
+
+	user, err := userService.GetUserByEmail(r.Context(), email)
+	if err != nil {
+		fail("no_account", err)
+		return
+	}
+	if err := userService.UpdateUserLastLogin(r.Context(), user.ID); err != nil {
+		log.Printf("Failed to update last login: %v", err)
+		// Don't fail the login for this, just log it
+	}
+
+	redirect, err := finishBrowserLogin(w, r, user)
+	if err != nil {
+		fail(loginFailure(err), err)
+		return
+	}
+	log.Printf("User %s logged in with a magic link", user.Email)
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// pendingMagicLink stores a code for the email and returns a link token for it bound to nonce
+func pendingMagicLink(t *testing.T, store OTPStore, email, code, nonce string) string {
+	savePendingOTP(t, store, email, code, time.Minute)
+	data, _ := store.Get(context.Background(), email)
+	token, err := signMagicLink(email, data.CodeHash, nonce)
+	if err != nil {
+		t.Fatalf("Failed to sign magic link: %v", err)
+	}
+	return token
+}
+
+// TestMagicLinkSingleUse tests that a link needs the requesting browser's nonce and shares its single use with the code
+func TestMagicLinkSingleUse(t *testing.T) {
+	useMemorySessionStore(t)
+	store := useMemoryOTPStore(t)
+	ctx := context.Background()
+
+	token := pendingMagicLink(t, store, "user@example.com", "123456", "nonce-1")
+	if _, err := redeemMagicLink(ctx, token, "other-nonce"); err != errMagicLinkBrowser {
+		t.Fatalf("Expected a link from another browser to be refused, got %v", err)
+	}
+	if data, _ := store.Get(ctx, "user@example.com"); data == nil {
+		t.Fatal("Expected a refused link to leave the code pending")
+	}
+	if email, err := redeemMagicLink(ctx, token, "nonce-1"); err != nil || email != "user@example.com" {
+		t.Fatalf("Expected the link to log in user@example.com, got %q, %v", email, err)
+	}
+	if _, err := redeemMagicLink(ctx, token, "nonce-1"); err != errMagicLinkUsed {
+		t.Errorf("Expected a used link to be refused, got %v", err)
+	}
+	if valid, _ := VerifyOTP("user@example.com", "123456"); valid {
+		t.Error("Expected the code to be used up by its link")
+	}
+
+	// Using the code, or requesting a new one, invalidates the link
+	token = pendingMagicLink(t, store, "user@example.com", "654321", "nonce-1")
+	if valid, err := VerifyOTP("user@example.com", "654321"); !valid {
+		t.Fatalf("Expected the code to be valid: %v", err)
+	}
+	if _, err := redeemMagicLink(ctx, token, "nonce-1"); err != errMagicLinkUsed {
+		t.Errorf("Expected the link of a used code to be refused, got %v", err)
+	}
+	token = pendingMagicLink(t, store, "user@example.com", "111111", "nonce-1")
+	savePendingOTP(t, store, "user@example.com", "222222", time.Minute)
+	if _, err := redeemMagicLink(ctx, token, "nonce-1"); err != errMagicLinkUsed {
+		t.Errorf("Expected the link of a replaced code to be refused, got %v", err)
+	}
+	if _, err := redeemMagicLink(ctx, token+"x", "nonce-1"); err != errMagicLinkInvalid {
+		t.Errorf("Expected a tampered link to be refused, got %v", err)
+	}
+}
+
+// TestMagicLinkHandler tests that opening a link in the requesting browser starts a session
+func TestMagicLinkHandler(t *testing.T) {
+	useMemorySessionStore(t)
+	store := useMemoryOTPStore(t)
+	users := &oidcUserService{users: map[string]*User{"user@example.com": {ID: 3, Email: "user@example.com"}}}
+	token := pendingMagicLink(t, store, "user@example.com", "123456", "nonce-1")
+
+	open := func(nonce string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/auth/magic?token="+url.QueryEscape(token), nil)
+		if nonce != "" {
+			req.AddCookie(&http.Cookie{Name: GetMagicLinkCookieName(), Value: nonce})
+		}
+		rec := httptest.NewRecorder()
+		HandleMagicLink(rec, req, users)
+		return rec
+	}
+
+	if rec := open(""); rec.Header().Get("Location") != "/login?error=magic_link_other_browser" {
+		t.Errorf("Expected a link without the nonce cookie to be refused, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	rec := open("nonce-1")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Fatalf("Expected a redirect home, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	var session bool
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == GetRefreshCookieName() && cookie.Value != "" {
+			session = true
+		}
+	}
+	if !session {
+		t.Error("Expected the link to start a session")
+	}
+	if rec := open("nonce-1"); rec.Header().Get("Location") != "/login?error=magic_link_expired" {
+		t.Errorf("Expected a used link to be refused, got %s", rec.Header().Get("Location"))
+	}
+}
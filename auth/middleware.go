@@ -1,52 +1,146 @@
 package auth
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
+
+	"github.com/scriptmaster/openagent/common"
 )
 
 // userCtxKey removed, defined in types.go
 
-// AuthMiddleware checks for a valid session cookie and adds user info to context
+// AuthMiddleware checks for a valid session cookie and adds user info to context.
+// When the access token has expired, the refresh token cookie is used to issue new tokens.
+// Requests with an Authorization: Bearer header are authenticated with that token instead.
+// An admin session with an impersonation cookie acts as the impersonated user, see serveImpersonated.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		InitializeJWTSecret(r.Host)
-
-		cookieName := GetSessionCookieName()
-		cookie, err := r.Cookie(cookieName)
-		if err != nil {
-			// No cookie found, treat as not logged in
-			log.Printf("No session cookie '%s' found, redirecting to login.", cookieName)
-			http.Redirect(w, r, "/login?error=please_login", http.StatusSeeOther)
+		if bearer, ok := bearerToken(r); ok {
+			ctx, err := authenticateBearer(r, bearer)
+			if errors.Is(err, ErrTokenScope) {
+				log.Printf("API token denied %s %s: %v", r.Method, r.URL.Path, err)
+				common.JSONError(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				log.Printf("Invalid bearer token for %s: %v", r.URL.Path, err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				sendUnauthorized(w, "Invalid or expired token")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		// Validate the JWT
-		claims, err := ValidateJWT(cookie.Value)
+		claims, err := authenticateSession(w, r)
 		if err != nil {
-			// Invalid or expired token
-			log.Printf("Invalid JWT found: %v, redirecting to login.", err)
-			// Clear the invalid cookie
+			// No usable session, treat as not logged in
+			log.Printf("No valid session (%v), redirecting to login.", err)
+			// Clear any stale cookies
 			ClearSessionCookie(w)
 			http.Redirect(w, r, "/login?error=please_login", http.StatusSeeOther)
 			return
 		}
+		if err := requireActiveAccount(r.Context(), claims.User()); err != nil {
+			log.Printf("Refusing session of user %d: %v", claims.UserID, err)
+			ClearSessionCookie(w)
+			http.Redirect(w, r, "/login?error="+loginFailure(err), http.StatusSeeOther)
+			return
+		}
 
-		// Token is valid, create User struct from claims
-		user := &User{
-			ID:      claims.UserID,
-			Email:   claims.Email,
-			IsAdmin: claims.IsAdmin,
-			// CreatedAt/LastLoggedIn aren't typically stored in JWT,
-			// Fetch from DB if needed in handlers, or omit from context User
+		if cookie, err := r.Cookie(GetImpersonationCookieName()); err == nil {
+			impersonation, err := validateImpersonation(cookie.Value, claims)
+			if err == nil {
+				serveImpersonated(w, r, next, claims, impersonation)
+				return
+			}
+			log.Printf("Ignoring impersonation cookie for user %d: %v", claims.UserID, err)
+			ClearImpersonationCookie(w)
 		}
 
-		// Add user to context
+		// Token is valid, create User struct from claims.
+		// CreatedAt/LastLoggedIn aren't stored in the JWT; fetch from DB if needed in handlers
+		user := claims.User()
+
+		// Add user and session to context
 		ctx := SetUserContext(r.Context(), user)
+		ctx = context.WithValue(ctx, sessionCtxKey{}, claims.ID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// authenticateSession validates the access token cookie, falling back to the refresh token cookie
+// and setting the new cookies when the session is refreshed
+func authenticateSession(w http.ResponseWriter, r *http.Request) (*UserClaims, error) {
+	if cookie, err := r.Cookie(GetSessionCookieName()); err == nil {
+		claims, err := ValidateAccessToken(r.Context(), cookie.Value)
+		if err == nil {
+			return claims, nil
+		}
+		if errors.Is(err, ErrSessionInvalid) {
+			return nil, err // Revoked sessions cannot be refreshed either
+		}
+	}
+
+	cookie, err := r.Cookie(GetRefreshCookieName())
+	if err != nil {
+		return nil, errors.New("no session cookie")
+	}
+	tokens, err := RefreshSession(r.Context(), cookie.Value, r)
+	if err != nil {
+		return nil, err
+	}
+	SetSessionCookies(w, tokens)
+	return ValidateJWT(tokens.AccessToken)
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// authenticateBearer accepts a personal access token, or a session access token for API clients
+// that refresh through /auth/refresh, and returns the request context with the user set
+func authenticateBearer(r *http.Request, bearer string) (context.Context, error) {
+	if strings.HasPrefix(bearer, apiTokenPrefix) {
+		if AccountProjectID(r.Context()) != 0 {
+			return nil, ErrInvalidAPIToken // Tokens belong to ai.users accounts
+		}
+		token, err := ValidateAPIToken(r.Context(), bearer)
+		if err != nil {
+			return nil, err
+		}
+		if !token.Allows(r) {
+			return nil, ErrTokenScope
+		}
+		user := &User{ID: token.UserID, Email: token.Email, IsAdmin: token.IsAdmin}
+		if err := requireActiveAccount(r.Context(), user); err != nil {
+			return nil, err
+		}
+		ctx := SetUserContext(r.Context(), user)
+		return context.WithValue(ctx, apiTokenCtxKey{}, token), nil
+	}
+
+	claims, err := ValidateAccessToken(r.Context(), bearer)
+	if err != nil {
+		return nil, err
+	}
+	user := claims.User()
+	if err := requireActiveAccount(r.Context(), user); err != nil {
+		return nil, err
+	}
+	ctx := SetUserContext(r.Context(), user)
+	return context.WithValue(ctx, sessionCtxKey{}, claims.ID), nil
+}
+
 // IsAdminMiddleware checks if the user in the context is an admin
 // Assumes AuthMiddleware has already run
 func IsAdminMiddleware(next http.Handler) http.Handler {
@@ -59,6 +153,10 @@ func IsAdminMiddleware(next http.Handler) http.Handler {
 			http.Error(w, "Forbidden: Administrator access required", http.StatusForbidden)
 			return
 		}
+		if token := GetAPITokenFromContext(r.Context()); token != nil && !token.HasScope(ScopeAdmin) {
+			http.Error(w, "Forbidden: API token lacks the admin scope", http.StatusForbidden)
+			return
+		}
 		// User is an admin, proceed to the next handler
 		next.ServeHTTP(w, r)
 	})
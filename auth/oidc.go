@@ -0,0 +1,437 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// oidcDiscoveryTTL is how long discovery documents and signing keys are cached
+const oidcDiscoveryTTL = time.Hour
+
+// oidcKeyRefreshInterval limits how often an unknown key ID triggers a JWKS refetch
+const oidcKeyRefreshInterval = time.Minute
+
+// OIDCProviderConfig describes an OpenID Connect identity provider users can log in with
+type OIDCProviderConfig struct {
+	ID             string   `json:"id"`   // Short name used in URLs, e.g. "google"
+	Name           string   `json:"name"` // Label shown on the login page
+	Issuer         string   `json:"issuer"`
+	ClientID       string   `json:"client_id"`
+	ClientSecret   string   `json:"client_secret,omitempty"`
+	Scopes         []string `json:"scopes,omitempty"`          // Defaults to openid, email and profile
+	AllowedDomains []string `json:"allowed_domains,omitempty"` // Only accept emails in these domains when set
+	CreateUsers    bool     `json:"create_users,omitempty"`    // Create accounts for unknown emails
+}
+
+// OIDCProviderSource lists the identity providers available for a request
+type OIDCProviderSource interface {
+	OIDCProviders(r *http.Request) ([]OIDCProviderConfig, error)
+}
+
+// envOIDCProviders reads the instance providers from OIDC_PROVIDERS, a JSON array of OIDCProviderConfig
+type envOIDCProviders struct{}
+
+func (envOIDCProviders) OIDCProviders(r *http.Request) ([]OIDCProviderConfig, error) {
+	return InstanceOIDCProviders()
+}
+
+// InstanceOIDCProviders returns the providers configured for the whole instance in OIDC_PROVIDERS
+func InstanceOIDCProviders() ([]OIDCProviderConfig, error) {
+	raw := strings.TrimSpace(getEnv("OIDC_PROVIDERS"))
+	if raw == "" {
+		return nil, nil
+	}
+	var providers []OIDCProviderConfig
+	if err := json.Unmarshal([]byte(raw), &providers); err != nil {
+		return nil, fmt.Errorf("invalid OIDC_PROVIDERS: %w", err)
+	}
+	return providers, nil
+}
+
+var (
+	oidcProviderSource OIDCProviderSource = envOIDCProviders{}
+	oidcProviderMutex                     = &sync.Mutex{}
+	oidcHTTPClient                        = &http.Client{Timeout: 10 * time.Second}
+)
+
+// SetOIDCProviderSource replaces where identity providers are read from
+func SetOIDCProviderSource(source OIDCProviderSource) {
+	oidcProviderMutex.Lock()
+	defer oidcProviderMutex.Unlock()
+	oidcProviderSource = source
+}
+
+// getOIDCProviderSource returns the current provider source
+func getOIDCProviderSource() OIDCProviderSource {
+	oidcProviderMutex.Lock()
+	defer oidcProviderMutex.Unlock()
+	return oidcProviderSource
+}
+
+// findOIDCProvider returns the provider with the given ID for a request
+func findOIDCProvider(r *http.Request, id string) (*OIDCProviderConfig, error) {
+	providers, err := getOIDCProviderSource().OIDCProviders(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := range providers {
+		if providers[i].ID == id {
+			return &providers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown identity provider %q", id)
+}
+
+// scopes returns the scopes requested from the provider
+func (p *OIDCProviderConfig) scopes() string {
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// allowsEmail reports whether an email is in one of the provider's allowed domains
+func (p *OIDCProviderConfig) allowsEmail(email string) bool {
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range p.AllowedDomains {
+		if strings.EqualFold(strings.TrimPrefix(allowed, "@"), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcDiscovery is the part of a provider's discovery document we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcIssuer caches the discovery document and signing keys of one issuer
+type oidcIssuer struct {
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	fetchedAt   time.Time
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+var (
+	oidcIssuers      = map[string]*oidcIssuer{}
+	oidcIssuersMutex = &sync.Mutex{}
+)
+
+// getOIDCIssuer returns the cache entry of an issuer
+func getOIDCIssuer(issuer string) *oidcIssuer {
+	oidcIssuersMutex.Lock()
+	defer oidcIssuersMutex.Unlock()
+	entry, ok := oidcIssuers[issuer]
+	if !ok {
+		entry = &oidcIssuer{}
+		oidcIssuers[issuer] = entry
+	}
+	return entry
+}
+
+// discover fetches and caches the provider's discovery document
+func (p *OIDCProviderConfig) discover(ctx context.Context) (*oidcDiscovery, error) {
+	entry := getOIDCIssuer(p.Issuer)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.discovery != nil && time.Since(entry.fetchedAt) < oidcDiscoveryTTL {
+		return entry.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := oidcGetJSON(ctx, wellKnown, &discovery); err != nil {
+		return nil, fmt.Errorf("discovery for %s failed: %w", p.Issuer, err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", discovery.Issuer, p.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document for %s is missing endpoints", p.Issuer)
+	}
+	entry.discovery, entry.fetchedAt = &discovery, time.Now()
+	entry.keys = nil // Keys may have moved with the document
+	return &discovery, nil
+}
+
+// signingKey returns the issuer's public key with the given key ID, refetching the JWKS for unknown IDs
+func (p *OIDCProviderConfig) signingKey(ctx context.Context, discovery *oidcDiscovery, kid string) (interface{}, error) {
+	entry := getOIDCIssuer(p.Issuer)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	stale := time.Since(entry.keysFetched) >= oidcDiscoveryTTL
+	if key, ok := entry.keys[kid]; ok && !stale {
+		return key, nil
+	}
+	if entry.keys != nil && !stale && time.Since(entry.keysFetched) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching signing keys failed: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	entry.keys, entry.keysFetched = keys, time.Now()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jsonWebKey is an RSA, EC or Ed25519 (OKP) public key from a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// publicKey converts the JWK to an *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// oidcGetJSON fetches a JSON document
+func oidcGetJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// newPKCE returns a PKCE code verifier and its S256 challenge
+func newPKCE() (verifier, challenge string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// randomToken returns a random URL-safe string for state and nonce values
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// authCodeURL builds the authorization request URL for the provider
+func (p *OIDCProviderConfig) authCodeURL(discovery *oidcDiscovery, redirectURI, state, nonce, challenge string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {p.scopes()},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// exchangeCode redeems an authorization code at the token endpoint and returns the ID token
+func (p *OIDCProviderConfig) exchangeCode(ctx context.Context, discovery *oidcDiscovery, code, redirectURI, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+		"client_id":     {p.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if body.Error != "" {
+		return "", fmt.Errorf("token endpoint error %s: %s", body.Error, body.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned %s without an ID token", resp.Status)
+	}
+	return body.IDToken, nil
+}
+
+// oidcBool accepts both booleans and the "true"/"false" strings some providers send
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = oidcBool(s == "true")
+	return nil
+}
+
+// IDTokenClaims are the ID token claims used to log a user in
+type IDTokenClaims struct {
+	Email           string   `json:"email"`
+	EmailVerified   oidcBool `json:"email_verified"`
+	Name            string   `json:"name"`
+	Nonce           string   `json:"nonce"`
+	AuthorizedParty string   `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry and nonce
+func (p *OIDCProviderConfig) verifyIDToken(ctx context.Context, discovery *oidcDiscovery, rawToken, nonce string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, discovery, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("invalid ID token: nonce mismatch")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, errors.New("invalid ID token: authorized party mismatch")
+	}
+	return claims, nil
+}
@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/scriptmaster/openagent/common"
+)
+
+// oidcStateSubject marks tokens carrying an identity provider login's state
+const oidcStateSubject = "oidc"
+
+// oidcStateTTL is how long the user has to complete the login at the identity provider
+const oidcStateTTL = 10 * time.Minute
+
+// oidcStateClaims carry the state, nonce and PKCE verifier of a login from the login request to the callback
+type oidcStateClaims struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+// OIDCProviderInfo describes a provider on the login page
+type OIDCProviderInfo struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	LoginURL string `json:"login_url"`
+}
+
+// oidcRedirectURI returns the callback URL registered with the providers
+func oidcRedirectURI(r *http.Request) (string, error) {
+	baseURL, err := RequestBaseURL(r)
+	if err != nil {
+		return "", err
+	}
+	return baseURL + "/auth/oidc/callback", nil
+}
+
+// HandleOIDCProviders lists the identity providers available on this host
+func HandleOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	providers, err := getOIDCProviderSource().OIDCProviders(r)
+	if err != nil {
+		log.Printf("Error loading identity providers: %v", err)
+		common.JSONError(w, "Failed to load identity providers", http.StatusInternalServerError)
+		return
+	}
+	infos := make([]OIDCProviderInfo, 0, len(providers))
+	for _, provider := range providers {
+		name := provider.Name
+		if name == "" {
+			name = provider.ID
+		}
+		infos = append(infos, OIDCProviderInfo{
+			ID:       provider.ID,
+			Name:     name,
+			LoginURL: "/auth/oidc/login?provider=" + url.QueryEscape(provider.ID),
+		})
+	}
+	common.JSONResponse(w, infos)
+}
+
+// HandleOIDCLogin sends the browser to the identity provider with a fresh state, nonce and PKCE challenge
+func HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := findOIDCProvider(r, r.URL.Query().Get("provider"))
+	if err != nil {
+		log.Printf("OIDC login: %v", err)
+		http.Redirect(w, r, "/login?error=unknown_provider", http.StatusSeeOther)
+		return
+	}
+	discovery, err := provider.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDC login with %s: %v", provider.ID, err)
+		http.Redirect(w, r, "/login?error=provider_unavailable", http.StatusSeeOther)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier, challenge, err := newPKCE()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	claims := &oidcStateClaims{
+		Provider: provider.ID,
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   oidcStateSubject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcStateTTL)),
+		},
+	}
+	token, err := signToken(claims)
+	if err != nil {
+		log.Printf("Failed to sign OIDC state: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	redirectURI, err := oidcRedirectURI(r)
+	if err != nil {
+		log.Printf("Failed to build the OIDC callback URL: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	SetOIDCCookie(w, token)
+
+	http.Redirect(w, r, provider.authCodeURL(discovery, redirectURI, state, nonce, challenge), http.StatusFound)
+}
+
+// CreateOIDCCallbackHandler creates the handler the identity providers redirect back to
+func CreateOIDCCallbackHandler(userService UserServicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleOIDCCallback(w, r, userService)
+	}
+}
+
+// HandleOIDCCallback checks the state, redeems the code, validates the ID token and logs in
+// the user with the token's verified email
+func HandleOIDCCallback(w http.ResponseWriter, r *http.Request, userService UserServicer) {
+	fail := func(reason string, err error) {
+		log.Printf("OIDC callback failed (%s): %v", reason, err)
+		ClearOIDCCookie(w)
+		http.Redirect(w, r, "/login?error="+reason, http.StatusSeeOther)
+	}
+
+	cookie, err := r.Cookie(GetOIDCCookieName())
+	if err != nil {
+		fail("login_expired", err)
+		return
+	}
+	pending, err := parseOIDCState(cookie.Value)
+	if err != nil {
+		fail("login_expired", err)
+		return
+	}
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(pending.State)) != 1 {
+		fail("invalid_state", errors.New("state mismatch"))
+		return
+	}
+	if providerError := query.Get("error"); providerError != "" {
+		fail("provider_denied", errors.New(providerError+": "+query.Get("error_description")))
+		return
+	}
+
+	provider, err := findOIDCProvider(r, pending.Provider)
+	if err != nil {
+		fail("unknown_provider", err)
+		return
+	}
+	discovery, err := provider.discover(r.Context())
+	if err != nil {
+		fail("provider_unavailable", err)
+		return
+	}
+	redirectURI, err := oidcRedirectURI(r)
+	if err != nil {
+		fail("provider_unavailable", err)
+		return
+	}
+	idToken, err := provider.exchangeCode(r.Context(), discovery, query.Get("code"), redirectURI, pending.Verifier)
+	if err != nil {
+		fail("provider_unavailable", err)
+		return
+	}
+	claims, err := provider.verifyIDToken(r.Context(), discovery, idToken, pending.Nonce)
+	if err != nil {
+		fail("invalid_token", err)
+		return
+	}
+	ClearOIDCCookie(w)
+
+	if claims.Email == "" || !claims.EmailVerified {
+		fail("email_not_verified", errors.New("ID token has no verified email"))
+		return
+	}
+	if !provider.allowsEmail(claims.Email) {
+		fail("email_not_allowed", errors.New(claims.Email+" is not in an allowed domain"))
+		return
+	}
+
+	user, err := oidcUser(r, userService, provider, claims.Email)
+	if err != nil {
+		fail("no_account", err)
+		return
+	}
+	if err := userService.UpdateUserLastLogin(r.Context(), user.ID); err != nil {
+		log.Printf("Failed to update last login: %v", err)
+		// Don't fail the login for this, just log it
+	}
+
+	redirect, err := finishBrowserLogin(w, r, user)
+	if err != nil {
+		fail(loginFailure(err), err)
+		return
+	}
+	log.Printf("User %s logged in with %s", user.Email, provider.ID)
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// parseOIDCState validates the login state cookie
+func parseOIDCState(tokenString string) (*oidcStateClaims, error) {
+	claims := &oidcStateClaims{}
+	token, err := parseToken(tokenString, claims, jwt.WithSubject(oidcStateSubject))
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid login state")
+	}
+	return claims, nil
+}
+
+// oidcUser finds the account for a verified email, creating it when the provider allows sign-ups
+// or when this is the first user of the instance
+func oidcUser(r *http.Request, userService UserServicer, provider *OIDCProviderConfig, email string) (*User, error) {
+	user, err := userService.GetUserByEmail(r.Context(), email)
+	if err == nil {
+		return user, nil
+	}
+
+	if !provider.CreateUsers {
+		adminExists, err := userService.CheckIfAdminExists(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		if adminExists {
+			return nil, errors.New("no account for " + email)
+		}
+	}
+	user, err = userService.CreateUser(r.Context(), email)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Created user %s from %s login", user.Email, provider.ID)
+	return user, nil
+}
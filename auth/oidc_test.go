@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIdP is an in-process OpenID provider issuing RS256 ID tokens
+type mockIdP struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	email         string
+	emailVerified bool
+	challenges    map[string]string // code -> PKCE challenge
+	nonces        map[string]string // code -> nonce
+}
+
+// newMockIdP starts a provider that authorizes every request for the given email
+func newMockIdP(t *testing.T, email string) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	idp := &mockIdP{key: key, email: email, emailVerified: true, challenges: map[string]string{}, nonces: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		code := r.PostForm.Get("code")
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if idp.challenges[code] == "" || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenges[code] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		if id, secret, _ := r.BasicAuth(); id != "client-1" || secret != "shh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(t, idp.nonces[code], idp.key)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize plays the user approving the login and returns the callback query
+func (idp *mockIdP) authorize(t *testing.T, location string) url.Values {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("Invalid authorization URL %q: %v", location, err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "client-1" {
+		t.Fatalf("Expected a PKCE authorization request, got %s", location)
+	}
+	code := "code-" + q.Get("state")
+	idp.challenges[code] = q.Get("code_challenge")
+	idp.nonces[code] = q.Get("nonce")
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+// idToken signs an ID token for the IdP's user
+func (idp *mockIdP) idToken(t *testing.T, nonce string, key *rsa.PrivateKey) string {
+	now := time.Now()
+	claims := &IDTokenClaims{
+		Email:         idp.email,
+		EmailVerified: oidcBool(idp.emailVerified),
+		Nonce:         nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.server.URL,
+			Subject:   "user-1",
+			Audience:  jwt.ClaimStrings{"client-1"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-key"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign ID token: %v", err)
+	}
+	return signed
+}
+
+// staticOIDCProviders offers a fixed list of providers
+type staticOIDCProviders []OIDCProviderConfig
+
+func (p staticOIDCProviders) OIDCProviders(r *http.Request) ([]OIDCProviderConfig, error) {
+	return p, nil
+}
+
+// oidcUserService keeps users in memory
+type oidcUserService struct {
+	UserServicer
+	users map[string]*User
+}
+
+func (s *oidcUserService) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	if user, ok := s.users[email]; ok {
+		return user, nil
+	}
+	return nil, errors.New("user not found")
+}
+
+func (s *oidcUserService) CreateUser(ctx context.Context, email string) (*User, error) {
+	user := &User{ID: len(s.users) + 100, Email: email}
+	s.users[email] = user
+	return user, nil
+}
+
+func (s *oidcUserService) CheckIfAdminExists(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (s *oidcUserService) UpdateUserLastLogin(ctx context.Context, userID int) error {
+	return nil
+}
+
+// oidcLogin runs the login request, the IdP approval and the callback, returning the callback response
+func oidcLogin(t *testing.T, idp *mockIdP, users UserServicer, tamper func(url.Values)) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	HandleOIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/auth/oidc/login?provider=corp", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the IdP, got %d: %s", rec.Code, rec.Body.String())
+	}
+	callback := idp.authorize(t, rec.Header().Get("Location"))
+	if tamper != nil {
+		tamper(callback)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+callback.Encode(), nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	HandleOIDCCallback(rec, req, users)
+	return rec
+}
+
+// useMockIdP installs a provider pointing at a fresh mock IdP
+func useMockIdP(t *testing.T, email string, provider OIDCProviderConfig) *mockIdP {
+	useMemorySessionStore(t)
+	useMemoryTwoFactorStore(t)
+	useTrustedHosts(t, "example.com")
+	idp := newMockIdP(t, email)
+	provider.ID, provider.Issuer, provider.ClientID, provider.ClientSecret = "corp", idp.server.URL, "client-1", "shh"
+	previous := getOIDCProviderSource()
+	SetOIDCProviderSource(staticOIDCProviders{provider})
+	t.Cleanup(func() { SetOIDCProviderSource(previous) })
+	return idp
+}
+
+// TestOIDCLogin tests a full login against the mock IdP for a known user
+func TestOIDCLogin(t *testing.T) {
+	idp := useMockIdP(t, "known@corp.example", OIDCProviderConfig{})
+	users := &oidcUserService{users: map[string]*User{"known@corp.example": {ID: 41, Email: "known@corp.example"}}}
+
+	rec := oidcLogin(t, idp, users, nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Fatalf("Expected a redirect home after login, got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	sessions, _ := ListUserSessions(context.Background(), 0, 41)
+	if len(sessions) != 1 {
+		t.Errorf("Expected one session for the user, got %d", len(sessions))
+	}
+}
+
+// TestOIDCLoginRejected tests that bad state, unverified emails, unknown users and foreign signatures are refused
+func TestOIDCLoginRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider OIDCProviderConfig
+		email    string
+		setup    func(idp *mockIdP)
+		tamper   func(url.Values)
+		reason   string
+	}{
+		{name: "state", email: "known@corp.example", tamper: func(q url.Values) { q.Set("state", "forged") }, reason: "invalid_state"},
+		{name: "unverified", email: "known@corp.example", setup: func(idp *mockIdP) { idp.emailVerified = false }, reason: "email_not_verified"},
+		{name: "unknown user", email: "stranger@corp.example", reason: "no_account"},
+		{name: "domain", email: "known@other.example", provider: OIDCProviderConfig{AllowedDomains: []string{"corp.example"}, CreateUsers: true}, reason: "email_not_allowed"},
+		{name: "signature", email: "known@corp.example", setup: func(idp *mockIdP) {
+			idp.key, _ = rsa.GenerateKey(rand.Reader, 2048) // The JWKS still publishes the original key
+		}, reason: "invalid_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := useMockIdP(t, tt.email, tt.provider)
+			if tt.setup != nil {
+				tt.setup(idp)
+			}
+			users := &oidcUserService{users: map[string]*User{tt.email: {ID: 42, Email: tt.email}}}
+			if tt.reason == "no_account" {
+				users.users = map[string]*User{}
+			}
+
+			rec := oidcLogin(t, idp, users, tt.tamper)
+			if want := "/login?error=" + tt.reason; rec.Header().Get("Location") != want {
+				t.Errorf("Expected a redirect to %s, got %d to %q", want, rec.Code, rec.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+// TestOIDCCreateUsers tests that providers with sign-ups enabled create accounts for new verified emails
+func TestOIDCCreateUsers(t *testing.T) {
+	idp := useMockIdP(t, "new@corp.example", OIDCProviderConfig{CreateUsers: true, AllowedDomains: []string{"corp.example"}})
+	users := &oidcUserService{users: map[string]*User{}}
+
+	rec := oidcLogin(t, idp, users, nil)
+	if rec.Header().Get("Location") != "/" || users.users["new@corp.example"] == nil {
+		t.Fatalf("Expected the user to be created and logged in, got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
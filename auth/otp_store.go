@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// OTPStore keeps pending OTP codes. There is at most one pending code per email.
+type OTPStore interface {
+	// Save stores a code, replacing any pending code for the same email.
+	Save(ctx context.Context, data OTPData) error
+	// Get returns the pending code for an email, or nil when there is none.
+	Get(ctx context.Context, email string) (*OTPData, error)
+	// IncrementAttempts records a verification attempt and returns the new count.
+	IncrementAttempts(ctx context.Context, email string) (int, error)
+	// Consume deletes the code if it still matches codeHash and reports whether it did,
+	// so a code can only be used once even when several instances verify it at the same time.
+	Consume(ctx context.Context, email, codeHash string) (bool, error)
+	// Delete removes the pending code for an email.
+	Delete(ctx context.Context, email string) error
+	// DeleteExpired removes codes that expired before the given time and returns how many were removed.
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
+}
+
+// memoryOTPStore keeps codes in process memory. Codes are lost on restart and not shared between instances.
+type memoryOTPStore struct {
+	mu    sync.Mutex
+	codes map[string]OTPData
+}
+
+// NewMemoryOTPStore creates an in-process OTP store
+func NewMemoryOTPStore() OTPStore {
+	return &memoryOTPStore{codes: make(map[string]OTPData)}
+}
+
+func (s *memoryOTPStore) Save(ctx context.Context, data OTPData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[data.Email] = data
+	return nil
+}
+
+func (s *memoryOTPStore) Get(ctx context.Context, email string) (*OTPData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.codes[email]
+	if !ok {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+func (s *memoryOTPStore) IncrementAttempts(ctx context.Context, email string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.codes[email]
+	if !ok {
+		return 0, nil
+	}
+	data.Attempts++
+	s.codes[email] = data
+	return data.Attempts, nil
+}
+
+func (s *memoryOTPStore) Consume(ctx context.Context, email, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.codes[email]
+	if !ok || data.CodeHash != codeHash {
+		return false, nil
+	}
+	delete(s.codes, email)
+	return true, nil
+}
+
+func (s *memoryOTPStore) Delete(ctx context.Context, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.codes, email)
+	return nil
+}
+
+func (s *memoryOTPStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed int64
+	for email, data := range s.codes {
+		if data.ExpiresAt.Before(before) {
+			delete(s.codes, email)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// postgresOTPStore keeps codes in ai.otp_codes so they survive restarts and are shared between instances
+type postgresOTPStore struct {
+	db *sql.DB
+}
+
+// NewPostgresOTPStore creates an OTP store backed by the ai.otp_codes table
+func NewPostgresOTPStore(db *sql.DB) OTPStore {
+	return &postgresOTPStore{db: db}
+}
+
+func (s *postgresOTPStore) Save(ctx context.Context, data OTPData) error {
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("otp_codes/upsert"),
+		data.Email, data.CodeHash, data.ExpiresAt, data.Attempts, data.IP)
+	return err
+}
+
+func (s *postgresOTPStore) Get(ctx context.Context, email string) (*OTPData, error) {
+	var data OTPData
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("otp_codes/get"), email).
+		Scan(&data.Email, &data.CodeHash, &data.ExpiresAt, &data.Attempts, &data.IP, &data.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func (s *postgresOTPStore) IncrementAttempts(ctx context.Context, email string) (int, error) {
+	var attempts int
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("otp_codes/increment_attempts"), email).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return attempts, err
+}
+
+func (s *postgresOTPStore) Consume(ctx context.Context, email, codeHash string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("otp_codes/consume"), email, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresOTPStore) Delete(ctx context.Context, email string) error {
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("otp_codes/delete"), email)
+	return err
+}
+
+func (s *postgresOTPStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("otp_codes/delete_expired"), before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SetOTPStore replaces the store used by SendOTP and VerifyOTP
+func SetOTPStore(store OTPStore) {
+	otpMutex.Lock()
+	defer otpMutex.Unlock()
+	otpStore = store
+}
+
+// getOTPStore returns the current OTP store
+func getOTPStore() OTPStore {
+	otpMutex.Lock()
+	defer otpMutex.Unlock()
+	return otpStore
+}
+
+// StartOTPSweeper removes expired codes from the current store every interval until stop is called
+func StartOTPSweeper(interval time.Duration) (stop func()) {
+	return startSweeper(interval, "OTP codes", func(ctx context.Context, now time.Time) (int64, error) {
+		return getOTPStore().DeleteExpired(ctx, now)
+	})
+}
+
+// startSweeper calls sweep every interval until stop is called, logging what it removed
+func startSweeper(interval time.Duration, what string, sweep func(ctx context.Context, now time.Time) (int64, error)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				removed, err := sweep(context.Background(), time.Now())
+				if err != nil {
+					log.Printf("Failed to sweep expired %s: %v", what, err)
+				} else if removed > 0 {
+					log.Printf("Swept %d expired %s", removed, what)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// ClientIP returns the IP address of the client that sent the request.
+// X-Forwarded-For and X-Real-IP are only trusted when TRUST_PROXY_HEADERS=1.
+func ClientIP(r *http.Request) string {
+	if common.GetEnv("TRUST_PROXY_HEADERS") == "1" {
+		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
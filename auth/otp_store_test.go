@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// useMemoryOTPStore installs a fresh in-memory store for the duration of a test
+func useMemoryOTPStore(t *testing.T) OTPStore {
+	previous := getOTPStore()
+	store := NewMemoryOTPStore()
+	SetOTPStore(store)
+	t.Cleanup(func() { SetOTPStore(previous) })
+	return store
+}
+
+// savePendingOTP stores a code the way SendOTP does, without sending email
+func savePendingOTP(t *testing.T, store OTPStore, email, code string, ttl time.Duration) {
+	err := store.Save(context.Background(), OTPData{
+		Email:     normalizeEmail(email),
+		CodeHash:  hashOTP(normalizeEmail(email), code),
+		ExpiresAt: time.Now().Add(ttl),
+		IP:        "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatalf("Failed to save OTP: %v", err)
+	}
+}
+
+// TestVerifyOTPSingleUse tests that a valid code is accepted once, whatever the email's case
+func TestVerifyOTPSingleUse(t *testing.T) {
+	store := useMemoryOTPStore(t)
+	savePendingOTP(t, store, "User@Example.com", "123456", time.Minute)
+
+	data, _ := store.Get(context.Background(), "user@example.com")
+	if data == nil || data.CodeHash == "123456" || data.IP != "192.0.2.1" {
+		t.Fatalf("Expected a hashed code with the requesting IP, got %+v", data)
+	}
+
+	if valid, err := VerifyOTP(" user@example.COM ", "123456"); !valid || err != nil {
+		t.Fatalf("Expected code to be valid, got %v, %v", valid, err)
+	}
+	if valid, err := VerifyOTP("user@example.com", "123456"); valid || err == nil {
+		t.Error("Expected a used code to be rejected")
+	}
+}
+
+// TestVerifyOTPAttemptsAndExpiry tests the attempt limit and expiry
+func TestVerifyOTPAttemptsAndExpiry(t *testing.T) {
+	store := useMemoryOTPStore(t)
+	savePendingOTP(t, store, "a@example.com", "111111", time.Minute)
+
+	for i := 0; i < maxOTPAttempts; i++ {
+		if valid, _ := VerifyOTP("a@example.com", "000000"); valid {
+			t.Fatal("Expected a wrong code to be rejected")
+		}
+	}
+	if valid, err := VerifyOTP("a@example.com", "111111"); valid || err == nil || err.Error() != "too many incorrect attempts" {
+		t.Errorf("Expected lockout after %d attempts, got %v, %v", maxOTPAttempts, valid, err)
+	}
+
+	savePendingOTP(t, store, "b@example.com", "222222", -time.Second)
+	if valid, err := VerifyOTP("b@example.com", "222222"); valid || err == nil || err.Error() != "OTP has expired" {
+		t.Errorf("Expected expired code to be rejected, got %v, %v", valid, err)
+	}
+}
+
+// TestOTPSweep tests that expired codes are removed and pending ones kept
+func TestOTPSweep(t *testing.T) {
+	store := NewMemoryOTPStore()
+	savePendingOTP(t, store, "old@example.com", "1", -time.Minute)
+	savePendingOTP(t, store, "new@example.com", "2", time.Minute)
+
+	removed, err := store.DeleteExpired(context.Background(), time.Now())
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected one expired code removed, got %d, %v", removed, err)
+	}
+	if data, _ := store.Get(context.Background(), "new@example.com"); data == nil {
+		t.Error("Expected pending code to be kept")
+	}
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Registers GIF decoding for avatar uploads
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Timezone names are validated without relying on the host's zoneinfo
+	"unicode/utf8"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+const (
+	// avatarSize is the width and height of stored avatars
+	avatarSize = 256
+	// maxAvatarUpload bounds the size of uploaded avatar files
+	maxAvatarUpload = 5 << 20
+	// maxAvatarPixels bounds the dimensions of decoded uploads, so small files cannot expand to huge images
+	maxAvatarPixels = 25_000_000
+	// maxDisplayNameLength is the longest display name accepted, in characters
+	maxDisplayNameLength = 100
+)
+
+// Profile holds the fields users edit on their profile
+type Profile struct {
+	DisplayName string `json:"display_name"`
+	Timezone    string `json:"timezone"` // IANA name such as Europe/Paris; empty uses the browser's
+	Locale      string `json:"locale"`   // BCP 47 tag such as en-GB; empty uses the browser's
+}
+
+// Avatar is an uploaded avatar image, stored as a square PNG
+type Avatar struct {
+	Image     []byte
+	UpdatedAt time.Time
+}
+
+var (
+	// errProfileUnavailable is returned for accounts of a project's user directory, which have no profile fields
+	errProfileUnavailable = errors.New("profiles are not available for this account")
+	// errAvatarImage is returned for uploads that are not a supported image
+	errAvatarImage = errors.New("avatar must be a PNG, JPEG or GIF image")
+
+	localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+)
+
+// Normalize trims the profile fields and checks them
+func (p *Profile) Normalize() error {
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	p.Timezone = strings.TrimSpace(p.Timezone)
+	p.Locale = strings.TrimSpace(p.Locale)
+
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLength {
+		return fmt.Errorf("display name must be at most %d characters", maxDisplayNameLength)
+	}
+	if strings.ContainsAny(p.DisplayName, "\r\n\t") {
+		return errors.New("display name must be a single line")
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil || p.Timezone == "Local" {
+			return fmt.Errorf("unknown timezone %q", p.Timezone)
+		}
+	}
+	if p.Locale != "" && !localePattern.MatchString(p.Locale) {
+		return fmt.Errorf("invalid locale %q", p.Locale)
+	}
+	return nil
+}
+
+// Profile returns the user's editable profile fields
+func (u *User) Profile() Profile {
+	return Profile{DisplayName: u.DisplayName, Timezone: u.Timezone, Locale: u.Locale}
+}
+
+// Name returns the display name of the user, or their email when they have none
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Email
+}
+
+// AvatarURL returns the URL of a user's avatar. Accounts in ai.users point at /avatars/{id}, which serves
+// their upload, their Gravatar or a generated image; accounts of a project's user directory use Gravatar directly.
+func AvatarURL(user *User) string {
+	if user.ProjectID != 0 {
+		return GravatarURL(user.Email)
+	}
+	return "/avatars/" + strconv.Itoa(user.ID)
+}
+
+// GravatarURL returns the Gravatar of an email, with a generated image for addresses without one.
+// GRAVATAR_URL changes the service, for self-hosted mirrors.
+func GravatarURL(email string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	base := strings.TrimSuffix(common.GetEnvOrDefault("GRAVATAR_URL", "https://www.gravatar.com/avatar"), "/")
+	return fmt.Sprintf("%s/%s?s=%d&d=identicon", base, hex.EncodeToString(hash[:]), avatarSize)
+}
+
+// ResizeAvatar decodes an uploaded image, crops it to a centered square and scales it to the avatar size.
+// It returns the result as PNG.
+func ResizeAvatar(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxAvatarUpload+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAvatarUpload {
+		return nil, fmt.Errorf("avatar must be at most %d MB", maxAvatarUpload>>20)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return nil, errAvatarImage
+	}
+	if config.Width*config.Height > maxAvatarPixels {
+		return nil, errors.New("avatar image dimensions are too large")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errAvatarImage
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, scaleSquare(src, avatarSize)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// defaultAvatar draws the avatar shown to others for a user without an upload: a square in a color
+// picked from the user's ID and directory, so it tells nothing about their email
+func defaultAvatar(user *User) (*Avatar, error) {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d/%d", user.ProjectID, user.ID)))
+	fill := color.NRGBA{R: 64 + hash[0]%160, G: 64 + hash[1]%160, B: 64 + hash[2]%160, A: 0xff}
+	img := image.NewNRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = fill.R, fill.G, fill.B, fill.A
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return &Avatar{Image: buf.Bytes()}, nil
+}
+
+// scaleSquare crops the centered square of src and scales it to size×size, averaging the source
+// pixels each destination pixel covers so downscaled photos do not alias
+func scaleSquare(src image.Image, size int) *image.NRGBA {
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := y0+y*side/size, y0+(y+1)*side/size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < size; x++ {
+			sx0, sx1 := x0+x*side/size, x0+(x+1)*side/size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			// Averages are alpha-premultiplied; convert back to straight alpha for NRGBA
+			c := color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)}
+			dst.Set(x, y, color.NRGBAModel.Convert(c))
+		}
+	}
+	return dst
+}
@@ -1,9 +1,13 @@
 package auth
 
 import (
+	"bytes"
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/scriptmaster/openagent/common"
 )
@@ -14,6 +18,7 @@ type ProfilePageData struct {
 	PageTitle  string
 	User       *User // Use pointer to easily check if logged in
 	AppVersion string
+	CSRFToken  string
 	Error      string
 	Success    string
 }
@@ -37,6 +42,7 @@ func HandleProfilePage(w http.ResponseWriter, r *http.Request) {
 		PageTitle:  "User Profile",
 		User:       user,
 		AppVersion: common.GetEnvOrDefault("APP_VERSION", "1.0.0.0"),
+		CSRFToken:  CSRFToken(r.Context()),
 		Error:      r.URL.Query().Get("error"),
 		Success:    r.URL.Query().Get("success"),
 	}
@@ -46,21 +52,154 @@ func HandleProfilePage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// HandleSessionsPage renders the page listing the user's active sessions.
+func HandleSessionsPage(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login?error=please_login", http.StatusSeeOther)
+		return
+	}
+
+	if authTemplates == nil {
+		http.Error(w, "Auth templates not initialized", http.StatusInternalServerError)
+		log.Println("Error: HandleSessionsPage called before InitAuthTemplates")
+		return
+	}
+
+	data := ProfilePageData{
+		AppName:    common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
+		PageTitle:  "Sessions and Devices",
+		User:       user,
+		AppVersion: common.GetEnvOrDefault("APP_VERSION", "1.0.0.0"),
+		CSRFToken:  CSRFToken(r.Context()),
+		Error:      r.URL.Query().Get("error"),
+		Success:    r.URL.Query().Get("success"),
+	}
+
+	if err := authTemplates.ExecuteTemplate(w, "sessions.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // --- API Handlers ---
 
+// SessionInfo describes one of the user's sessions
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"` // The session making the request
+}
+
+// HandleSessionsAPI lists the user's active sessions (GET) or ends one of them (DELETE ?id=).
+func HandleSessionsAPI(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID := GetSessionIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := ListUserSessions(r.Context(), user.ProjectID, user.ID)
+		if err != nil {
+			log.Printf("Error listing sessions for user %d: %v", user.ID, err)
+			common.JSONError(w, "Failed to list sessions", http.StatusInternalServerError)
+			return
+		}
+		list := make([]SessionInfo, 0, len(sessions))
+		for _, session := range sessions {
+			list = append(list, SessionInfo{
+				ID:         session.ID,
+				Device:     DescribeDevice(session.UserAgent),
+				UserAgent:  session.UserAgent,
+				IP:         session.IP,
+				CreatedAt:  session.CreatedAt,
+				LastSeenAt: session.LastSeenAt,
+				Current:    session.ID == currentID,
+			})
+		}
+		common.JSONResponse(w, list)
+
+	case http.MethodDelete:
+		sessionID := r.URL.Query().Get("id")
+		if sessionID == "" {
+			common.JSONError(w, "Session ID is required", http.StatusBadRequest)
+			return
+		}
+		found, err := RevokeUserSession(r.Context(), user, sessionID)
+		if err != nil {
+			log.Printf("Error revoking session for user %d: %v", user.ID, err)
+			common.JSONError(w, "Failed to end session", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			common.JSONError(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if sessionID == currentID {
+			ClearSessionCookie(w)
+		}
+		common.JSONResponse(w, map[string]interface{}{"message": "Session ended", "current": sessionID == currentID})
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // UpdateProfileRequest defines the structure for profile update API calls
 type UpdateProfileRequest struct {
-	Name        *string `json:"name,omitempty"`         // Pointer to distinguish empty vs not provided
-	ProfileIcon *string `json:"profile_icon,omitempty"` // Pointer for icon URL
+	DisplayName *string `json:"display_name,omitempty"` // Pointer to distinguish empty vs not provided
+	Timezone    *string `json:"timezone,omitempty"`
+	Locale      *string `json:"locale,omitempty"`
+}
+
+// CreateProfileAPIHandler creates the handler of /api/profile
+func CreateProfileAPIHandler(userService UserServicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			HandleGetProfileAPI(w, r, userService)
+		case http.MethodPut, http.MethodPatch:
+			HandleUpdateProfileAPI(w, r, userService)
+		default:
+			common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HandleGetProfileAPI returns the current user with their profile fields and avatar URL.
+func HandleGetProfileAPI(w http.ResponseWriter, r *http.Request, userService UserServicer) {
+	user := GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	current, err := userService.GetUserByID(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Error loading the profile of user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+	current.AvatarURL = AvatarURL(current)
+	common.JSONResponse(w, current)
 }
 
-// HandleUpdateProfileAPI handles updates to user name and profile icon.
+// HandleUpdateProfileAPI handles updates to the user's display name, timezone and locale.
 func HandleUpdateProfileAPI(w http.ResponseWriter, r *http.Request, userService UserServicer) {
 	user := GetUserFromContext(r.Context())
 	if user == nil {
 		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if user.ProjectID != 0 {
+		common.JSONError(w, errProfileUnavailable.Error(), http.StatusForbidden)
+		return
+	}
 
 	var req UpdateProfileRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -68,26 +207,154 @@ func HandleUpdateProfileAPI(w http.ResponseWriter, r *http.Request, userService
 		return
 	}
 
-	updated := false
-	// Note: Name and ProfileIcon updates are not supported in the current database schema
-	// These fields don't exist in the ai.users table
-	if req.Name != nil || req.ProfileIcon != nil {
-		common.JSONError(w, "Name and ProfileIcon updates are not currently supported", http.StatusNotImplemented)
+	current, err := userService.GetUserByID(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Error loading the profile of user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+	profile := current.Profile()
+	if req.DisplayName != nil {
+		profile.DisplayName = *req.DisplayName
+	}
+	if req.Timezone != nil {
+		profile.Timezone = *req.Timezone
+	}
+	if req.Locale != nil {
+		profile.Locale = *req.Locale
+	}
+	if err := profile.Normalize(); err != nil {
+		common.JSONError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if !updated {
+	if profile == current.Profile() {
 		common.JSONResponse(w, map[string]string{"message": "No changes detected"})
 		return
 	}
+	if err := userService.UpdateProfile(r.Context(), user.ID, profile); err != nil {
+		log.Printf("Error updating the profile of user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+	current.DisplayName, current.Timezone, current.Locale = profile.DisplayName, profile.Timezone, profile.Locale
+	current.AvatarURL = AvatarURL(current)
 
 	// Return success with the updated user data (excluding password hash)
 	common.JSONResponse(w, map[string]interface{}{
 		"message": "Profile updated successfully",
-		"user":    user, // User object from context should reflect changes made
+		"user":    current,
 	})
 }
 
+// CreateProfileAvatarAPIHandler creates the handler of /api/profile/avatar
+func CreateProfileAvatarAPIHandler(userService UserServicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleProfileAvatarAPI(w, r, userService)
+	}
+}
+
+// HandleProfileAvatarAPI replaces the user's avatar with a multipart upload in the "avatar" field (POST),
+// or goes back to their Gravatar (DELETE). Uploads are cropped to a square and resized on the server.
+func HandleProfileAvatarAPI(w http.ResponseWriter, r *http.Request, userService UserServicer) {
+	user := GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.ProjectID != 0 {
+		common.JSONError(w, errProfileUnavailable.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxAvatarUpload+1<<20) // Room for the multipart envelope
+		file, _, err := r.FormFile("avatar")
+		if err != nil {
+			common.JSONError(w, "An image file in the avatar field is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		image, err := ResizeAvatar(file)
+		if err != nil {
+			common.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := userService.SetAvatar(r.Context(), user.ID, &Avatar{Image: image, UpdatedAt: time.Now()}); err != nil {
+			log.Printf("Error storing the avatar of user %d: %v", user.ID, err)
+			common.JSONError(w, "Failed to update avatar", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %s uploaded an avatar", user.Email)
+		common.JSONResponse(w, map[string]string{"message": "Avatar updated", "avatar_url": AvatarURL(user)})
+
+	case http.MethodDelete:
+		if err := userService.SetAvatar(r.Context(), user.ID, nil); err != nil {
+			log.Printf("Error removing the avatar of user %d: %v", user.ID, err)
+			common.JSONError(w, "Failed to remove avatar", http.StatusInternalServerError)
+			return
+		}
+		common.JSONResponse(w, map[string]string{"message": "Avatar removed", "avatar_url": AvatarURL(user)})
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CreateAvatarHandler creates the handler of /avatars/{id}
+func CreateAvatarHandler(userService UserServicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleAvatar(w, r, userService)
+	}
+}
+
+// HandleAvatar serves the uploaded avatar of a user. Users without one are redirected to their own
+// Gravatar, and administrators to anyone's; everyone else gets a generated image, as the Gravatar URL
+// carries a hash of the email. Browsers revalidate avatars on each use, so a new upload shows up at once.
+func HandleAvatar(w http.ResponseWriter, r *http.Request, userService UserServicer) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	viewer := GetUserFromContext(r.Context())
+	if viewer == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/avatars/"))
+	if err != nil || userID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	user, err := userService.GetUserByID(r.Context(), userID)
+	if err != nil || user == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache")
+	var avatar *Avatar
+	if user.ProjectID == 0 {
+		if avatar, err = userService.GetAvatar(r.Context(), userID); err != nil {
+			log.Printf("Error loading the avatar of user %d: %v", userID, err)
+		}
+	}
+	if avatar == nil && (viewer.IsAdmin || viewer.ID == user.ID && viewer.ProjectID == user.ProjectID) {
+		http.Redirect(w, r, GravatarURL(user.Email), http.StatusFound)
+		return
+	}
+	if avatar == nil {
+		if avatar, err = defaultAvatar(user); err != nil {
+			log.Printf("Error generating the avatar of user %d: %v", userID, err)
+			http.Error(w, "Failed to generate avatar", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeContent(w, r, "avatar.png", avatar.UpdatedAt, bytes.NewReader(avatar.Image))
+}
+
 // ChangePasswordRequest defines the structure for the password change API call
 type ChangePasswordRequest struct {
 	CurrentPassword string `json:"current_password"` // Optional if using OTP
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// profileUserService keeps one user's profile and avatar in memory
+type profileUserService struct {
+	UserServicer
+	user   *User
+	avatar *Avatar
+}
+
+func (s *profileUserService) GetUserByID(ctx context.Context, userID int) (*User, error) {
+	if userID != s.user.ID {
+		return nil, errors.New("user not found")
+	}
+	user := *s.user
+	return &user, nil
+}
+
+func (s *profileUserService) UpdateProfile(ctx context.Context, userID int, profile Profile) error {
+	s.user.DisplayName, s.user.Timezone, s.user.Locale = profile.DisplayName, profile.Timezone, profile.Locale
+	return nil
+}
+
+func (s *profileUserService) GetAvatar(ctx context.Context, userID int) (*Avatar, error) {
+	return s.avatar, nil
+}
+
+func (s *profileUserService) SetAvatar(ctx context.Context, userID int, avatar *Avatar) error {
+	s.avatar = avatar
+	return nil
+}
+
+// TestProfileNormalize tests profile field validation
+func TestProfileNormalize(t *testing.T) {
+	valid := Profile{DisplayName: "  Ada Lovelace ", Timezone: "Europe/London", Locale: "en-GB"}
+	if err := valid.Normalize(); err != nil || valid.DisplayName != "Ada Lovelace" {
+		t.Errorf("Expected a valid profile, got %+v (%v)", valid, err)
+	}
+	for _, profile := range []Profile{
+		{DisplayName: strings.Repeat("a", maxDisplayNameLength+1)},
+		{DisplayName: "two\nlines"},
+		{Timezone: "Mars/Olympus_Mons"},
+		{Timezone: "Local"},
+		{Locale: "english please"},
+	} {
+		if err := profile.Normalize(); err == nil {
+			t.Errorf("Expected %+v to be refused", profile)
+		}
+	}
+}
+
+// TestResizeAvatar tests that uploads are cropped to a centered square and scaled to the avatar size
+func TestResizeAvatar(t *testing.T) {
+	// A wide image whose centre square is red, between blue bands
+	src := image.NewRGBA(image.Rect(0, 0, 900, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 900; x++ {
+			c := color.RGBA{B: 255, A: 255}
+			if x >= 300 && x < 600 {
+				c = color.RGBA{R: 255, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	var upload bytes.Buffer
+	png.Encode(&upload, src)
+
+	data, err := ResizeAvatar(&upload)
+	if err != nil {
+		t.Fatalf("Failed to resize the avatar: %v", err)
+	}
+	avatar, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected a PNG avatar: %v", err)
+	}
+	if avatar.Bounds().Dx() != avatarSize || avatar.Bounds().Dy() != avatarSize {
+		t.Errorf("Expected a %dx%d avatar, got %v", avatarSize, avatarSize, avatar.Bounds())
+	}
+	if r, _, b, _ := avatar.At(0, 0).RGBA(); r != 0xffff || b != 0 {
+		t.Errorf("Expected the centre of the image to be kept, got corner color %v", avatar.At(0, 0))
+	}
+
+	if _, err := ResizeAvatar(strings.NewReader("not an image")); !errors.Is(err, errAvatarImage) {
+		t.Errorf("Expected a non-image upload to be refused, got %v", err)
+	}
+}
+
+// TestProfileAPI tests updating the profile, uploading an avatar and serving it with a Gravatar or generated fallback
+func TestProfileAPI(t *testing.T) {
+	user := &User{ID: 31, Email: "Profile@Example.com"}
+	users := &profileUserService{user: user}
+	do := func(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+		req = req.WithContext(SetUserContext(req.Context(), &User{ID: user.ID, Email: user.Email}))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	profileAPI := CreateProfileAPIHandler(users)
+	avatarAPI := CreateProfileAvatarAPIHandler(users)
+	avatars := CreateAvatarHandler(users)
+
+	rec := do(profileAPI, httptest.NewRequest(http.MethodPut, "/api/profile", strings.NewReader(`{"display_name":"Profile User","timezone":"Asia/Tokyo"}`)))
+	if rec.Code != http.StatusOK || user.DisplayName != "Profile User" || user.Timezone != "Asia/Tokyo" {
+		t.Fatalf("Expected the profile to be updated, got %d: %s (%+v)", rec.Code, rec.Body.String(), user)
+	}
+	if rec := do(profileAPI, httptest.NewRequest(http.MethodPut, "/api/profile", strings.NewReader(`{"locale":"??"}`))); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid locale to be refused, got %d", rec.Code)
+	}
+	rec = do(profileAPI, httptest.NewRequest(http.MethodGet, "/api/profile", nil))
+	var loaded User
+	if err := json.NewDecoder(rec.Body).Decode(&loaded); err != nil || loaded.DisplayName != "Profile User" || loaded.AvatarURL != "/avatars/31" {
+		t.Errorf("Unexpected profile %+v (%v)", loaded, err)
+	}
+
+	rec = do(avatars, httptest.NewRequest(http.MethodGet, "/avatars/31", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != GravatarURL("profile@example.com") {
+		t.Errorf("Expected a redirect to the Gravatar, got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	others := httptest.NewRequest(http.MethodGet, "/avatars/31", nil)
+	others = others.WithContext(SetUserContext(others.Context(), &User{ID: 32, Email: "other@example.com"}))
+	rec = httptest.NewRecorder()
+	avatars(rec, others)
+	if rec.Code != http.StatusOK || rec.Header().Get("Location") != "" || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Expected other users to get a generated avatar, got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = httptest.NewRecorder()
+	avatars(rec, httptest.NewRequest(http.MethodGet, "/avatars/31", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous requests to be refused, got %d", rec.Code)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("avatar", "me.png")
+	png.Encode(part, image.NewRGBA(image.Rect(0, 0, 40, 40)))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/profile/avatar", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if rec := do(avatarAPI, req); rec.Code != http.StatusOK || users.avatar == nil {
+		t.Fatalf("Expected the avatar to be uploaded, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do(avatars, httptest.NewRequest(http.MethodGet, "/avatars/31", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected the uploaded avatar, got %d (%s)", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if uploaded, err := png.DecodeConfig(rec.Body); err != nil || uploaded.Width != avatarSize {
+		t.Errorf("Expected a %d pixel avatar, got %+v (%v)", avatarSize, uploaded, err)
+	}
+
+	if rec := do(avatarAPI, httptest.NewRequest(http.MethodDelete, "/api/profile/avatar", nil)); rec.Code != http.StatusOK || users.avatar != nil {
+		t.Errorf("Expected the avatar to be removed, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a set of token buckets, one per key. Each bucket holds up to Burst tokens
+// and refills at Burst tokens per Period.
+type RateLimiter struct {
+	Burst  int
+	Period time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// tokenBucket is the state of a single key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing burst requests per period for each key.
+func NewRateLimiter(burst int, period time.Duration) *RateLimiter {
+	return &RateLimiter{Burst: burst, Period: period, buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes a token for key. When none is left it returns false and how long until one is.
+// A nil limiter allows everything.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil || l.Burst <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	rate := float64(l.Burst) / l.Period.Seconds() // Tokens per second
+	l.sweep(now)
+
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely, at most once per period
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.Period {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= l.Period {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// LoginThrottle slows down and then locks out repeated failed logins for a key.
+// After DelayAfter consecutive failures each attempt must wait BaseDelay, doubling per
+// further failure up to MaxDelay; after LockoutAfter failures the key is locked for LockoutDuration.
+// Failures older than LockoutDuration are forgotten. A LockoutAfter of 0 only delays.
+type LoginThrottle struct {
+	DelayAfter      int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// loginFailures tracks consecutive failures for a key
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Check returns how long the key must wait before its next attempt, or 0 if it may try now.
+func (t *LoginThrottle) Check(key string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock()
+	t.sweep(now)
+	state, ok := t.failures[key]
+	if !ok {
+		return 0
+	}
+	if now.Before(state.lockedUntil) {
+		return state.lockedUntil.Sub(now)
+	}
+	if !state.lockedUntil.IsZero() || now.Sub(state.last) > t.LockoutDuration {
+		delete(t.failures, key) // Lockout served or failures are old; start over
+		return 0
+	}
+	if wait := state.last.Add(t.delay(state.count)).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Fail records a failed attempt and returns the wait before the next one.
+func (t *LoginThrottle) Fail(key string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock()
+	t.sweep(now)
+	if t.failures == nil {
+		t.failures = make(map[string]*loginFailures)
+	}
+	state, ok := t.failures[key]
+	if !ok {
+		state = &loginFailures{}
+		t.failures[key] = state
+	}
+	state.count++
+	state.last = now
+
+	if t.LockoutAfter > 0 && state.count >= t.LockoutAfter {
+		state.lockedUntil = now.Add(t.LockoutDuration)
+		log.Printf("Login locked for %s after %d failed attempts", key, state.count)
+		return t.LockoutDuration
+	}
+	return t.delay(state.count)
+}
+
+// Succeed clears the failures for a key.
+func (t *LoginThrottle) Succeed(key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
+
+// sweep drops keys whose lockout has ended and whose failures are old, at most once per LockoutDuration,
+// so keys that never come back do not stay in memory
+func (t *LoginThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.LockoutDuration {
+		return
+	}
+	t.lastSweep = now
+	for key, state := range t.failures {
+		if !now.Before(state.lockedUntil) && now.Sub(state.last) > t.LockoutDuration {
+			delete(t.failures, key)
+		}
+	}
+}
+
+// clock returns the current time
+func (t *LoginThrottle) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// delay is the wait required after count consecutive failures
+func (t *LoginThrottle) delay(count int) time.Duration {
+	if t.DelayAfter <= 0 || count < t.DelayAfter {
+		return 0
+	}
+	delay := t.BaseDelay << uint(min(count-t.DelayAfter, 30))
+	if delay > t.MaxDelay || delay <= 0 {
+		delay = t.MaxDelay
+	}
+	return delay
+}
+
+// AuthLimits holds the limits applied to the login endpoints
+type AuthLimits struct {
+	OTPPerEmail    *RateLimiter
+	OTPPerIP       *RateLimiter
+	OTPGlobal      *RateLimiter
+	VerifyPerIP    *RateLimiter
+	PasswordPerIP  *RateLimiter
+	PasskeyPerIP   *RateLimiter
+	PasswordFailed *LoginThrottle // Per client IP and per IP and email; may lock out
+	// PasswordFailedEmail only delays, so nobody can lock a victim out by failing logins with their email
+	PasswordFailedEmail *LoginThrottle
+}
+
+var (
+	authLimits       *AuthLimits
+	authLimitsLoaded bool
+	authLimitsMu     sync.Mutex
+)
+
+// getAuthLimits returns the limits configured from the environment, loading them on first use
+func getAuthLimits() *AuthLimits {
+	authLimitsMu.Lock()
+	defer authLimitsMu.Unlock()
+	if !authLimitsLoaded {
+		authLimits = NewAuthLimitsFromEnv()
+		authLimitsLoaded = true
+	}
+	return authLimits
+}
+
+// SetAuthLimits replaces the limits applied to the login endpoints. nil disables them.
+func SetAuthLimits(limits *AuthLimits) {
+	authLimitsMu.Lock()
+	defer authLimitsMu.Unlock()
+	authLimits = limits
+	authLimitsLoaded = true
+}
+
+// NewAuthLimitsFromEnv builds the login limits. Rates are written as <count>/<period>, e.g. "3/10m".
+//
+//	AUTH_RATE_LIMIT=0            disables all limits
+//	AUTH_OTP_EMAIL_LIMIT         OTP requests per email (default 3/10m)
+//	AUTH_OTP_IP_LIMIT            OTP requests per client IP (default 10/10m)
+//	AUTH_OTP_GLOBAL_LIMIT        OTP requests across all clients (default 100/1m)
+//	AUTH_VERIFY_IP_LIMIT         OTP verifications per client IP (default 20/10m)
+//	AUTH_PASSWORD_IP_LIMIT       password logins per client IP (default 20/10m)
+//	AUTH_PASSKEY_IP_LIMIT        passkey login challenges per client IP (default 30/10m)
+//	AUTH_LOGIN_DELAY_AFTER       failed password logins before delays start (default 3)
+//	AUTH_LOGIN_DELAY             first delay, doubled per further failure (default 1s)
+//	AUTH_LOGIN_MAX_DELAY         longest delay (default 1m)
+//	AUTH_LOGIN_LOCKOUT_AFTER     failed password logins from a client IP before a lockout (default 10);
+//	                             failures for an email from any IP are only delayed
+//	AUTH_LOGIN_LOCKOUT           lockout duration, and how long failures are remembered (default 15m)
+func NewAuthLimitsFromEnv() *AuthLimits {
+	if getEnv("AUTH_RATE_LIMIT") == "0" {
+		return nil
+	}
+	delayAfter := intFromEnv("AUTH_LOGIN_DELAY_AFTER", 3)
+	delay := durationFromEnv("AUTH_LOGIN_DELAY", time.Second)
+	maxDelay := durationFromEnv("AUTH_LOGIN_MAX_DELAY", time.Minute)
+	lockout := durationFromEnv("AUTH_LOGIN_LOCKOUT", 15*time.Minute)
+	return &AuthLimits{
+		OTPPerEmail:   rateLimitFromEnv("AUTH_OTP_EMAIL_LIMIT", "3/10m"),
+		OTPPerIP:      rateLimitFromEnv("AUTH_OTP_IP_LIMIT", "10/10m"),
+		OTPGlobal:     rateLimitFromEnv("AUTH_OTP_GLOBAL_LIMIT", "100/1m"),
+		VerifyPerIP:   rateLimitFromEnv("AUTH_VERIFY_IP_LIMIT", "20/10m"),
+		PasswordPerIP: rateLimitFromEnv("AUTH_PASSWORD_IP_LIMIT", "20/10m"),
+		PasskeyPerIP:  rateLimitFromEnv("AUTH_PASSKEY_IP_LIMIT", "30/10m"),
+		PasswordFailed: &LoginThrottle{
+			DelayAfter:      delayAfter,
+			BaseDelay:       delay,
+			MaxDelay:        maxDelay,
+			LockoutAfter:    intFromEnv("AUTH_LOGIN_LOCKOUT_AFTER", 10),
+			LockoutDuration: lockout,
+		},
+		PasswordFailedEmail: &LoginThrottle{
+			DelayAfter:      delayAfter,
+			BaseDelay:       delay,
+			MaxDelay:        maxDelay,
+			LockoutDuration: lockout,
+		},
+	}
+}
+
+// ParseRate parses a rate such as "3/10m" into a count and period
+func ParseRate(rate string) (int, time.Duration, error) {
+	count, period, ok := strings.Cut(strings.TrimSpace(rate), "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("rate %q must be <count>/<period>", rate)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("invalid count in rate %q", rate)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid period in rate %q", rate)
+	}
+	return n, d, nil
+}
+
+// rateLimitFromEnv builds a limiter from a rate setting. A count of 0 disables the limiter.
+func rateLimitFromEnv(key, fallback string) *RateLimiter {
+	value := getEnv(key)
+	if value == "" {
+		value = fallback
+	}
+	n, period, err := ParseRate(value)
+	if err != nil {
+		log.Printf("Invalid %s: %v; using %s", key, err, fallback)
+		n, period, _ = ParseRate(fallback)
+	}
+	if n == 0 {
+		return nil
+	}
+	return NewRateLimiter(n, period)
+}
+
+// intFromEnv reads an integer setting
+func intFromEnv(key string, fallback int) int {
+	if n, err := strconv.Atoi(getEnv(key)); err == nil && n >= 0 {
+		return n
+	}
+	return fallback
+}
+
+// durationFromEnv reads a duration setting such as "30s"
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(getEnv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// AllowOTPRequest checks the per-IP, per-email and global OTP request limits
+func (l *AuthLimits) AllowOTPRequest(email, ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	return allowAll(
+		rateCheck{l.OTPPerIP, ip},
+		rateCheck{l.OTPPerEmail, email},
+		rateCheck{l.OTPGlobal, "global"},
+	)
+}
+
+// AllowOTPVerify checks the per-IP OTP verification limit
+func (l *AuthLimits) AllowOTPVerify(ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	return l.VerifyPerIP.Allow(ip)
+}
+
+// AllowPasswordLogin checks the per-IP limit and any delay or lockout after failed logins
+func (l *AuthLimits) AllowPasswordLogin(email, ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	wait := max(l.PasswordFailedEmail.Check("email:"+email), l.PasswordFailed.Check("ip:"+ip),
+		l.PasswordFailed.Check(ipEmailKey(ip, email)))
+	if wait > 0 {
+		return false, wait
+	}
+	return l.PasswordPerIP.Allow(ip)
+}
+
+// AllowPasskeyLogin checks the per-IP limit on passkey login challenges
+func (l *AuthLimits) AllowPasskeyLogin(ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	return l.PasskeyPerIP.Allow(ip)
+}
+
+// PasswordLoginFailed records a failed password login for the email, the IP and the two together
+func (l *AuthLimits) PasswordLoginFailed(email, ip string) {
+	if l == nil {
+		return
+	}
+	l.PasswordFailedEmail.Fail("email:" + email)
+	l.PasswordFailed.Fail("ip:" + ip)
+	l.PasswordFailed.Fail(ipEmailKey(ip, email))
+}
+
+// PasswordLoginSucceeded clears failed password logins for the email. The IP's failures are kept,
+// so an attacker cannot reset their count by logging in to an account of their own in between.
+func (l *AuthLimits) PasswordLoginSucceeded(email, ip string) {
+	if l == nil {
+		return
+	}
+	l.PasswordFailedEmail.Succeed("email:" + email)
+	l.PasswordFailed.Succeed(ipEmailKey(ip, email))
+}
+
+// ipEmailKey is the throttle key of password logins for one email from one IP
+func ipEmailKey(ip, email string) string {
+	return "ip-email:" + ip + "|" + email
+}
+
+// allowAll takes a token from each limiter in order, stopping at the first that refuses
+func allowAll(checks ...rateCheck) (bool, time.Duration) {
+	for _, check := range checks {
+		if ok, wait := check.limiter.Allow(check.key); !ok {
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// rateCheck pairs a limiter with the key to check it for
+type rateCheck struct {
+	limiter *RateLimiter
+	key     string
+}
+
+// SendRateLimited responds with 429 Too Many Requests and a Retry-After header in whole seconds
+func SendRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(JSONResponse{
+		Success: false,
+		Message: fmt.Sprintf("Too many attempts. Please try again in %d seconds.", seconds),
+		Data:    map[string]int{"retry_after": seconds},
+	})
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable time source for limiter tests
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// TestRateLimiterBucket tests the burst, the wait reported when empty and refilling
+func TestRateLimiterBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	limiter := NewRateLimiter(3, 30*time.Second)
+	limiter.now = clock.now
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	ok, wait := limiter.Allow("a")
+	if ok || wait != 10*time.Second {
+		t.Fatalf("Expected a 10s wait once the burst is used, got %v, %v", ok, wait)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("Expected other keys to have their own bucket")
+	}
+
+	clock.advance(10 * time.Second)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("Expected a token to be refilled after 10s")
+	}
+	if ok, _ := (*RateLimiter)(nil).Allow("a"); !ok {
+		t.Error("Expected a nil limiter to allow everything")
+	}
+}
+
+// TestLoginThrottle tests progressive delays, lockout and reset on success
+func TestLoginThrottle(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	throttle := &LoginThrottle{DelayAfter: 2, BaseDelay: time.Second, MaxDelay: 3 * time.Second, LockoutAfter: 5, LockoutDuration: time.Minute, now: clock.now}
+
+	want := []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}
+	for i, delay := range want {
+		if wait := throttle.Check("k"); wait != 0 {
+			t.Fatalf("Expected attempt %d to be allowed after waiting, got %v", i+1, wait)
+		}
+		if got := throttle.Fail("k"); got != delay {
+			t.Fatalf("Expected delay %v after failure %d, got %v", delay, i+1, got)
+		}
+		if delay > 0 && throttle.Check("k") != delay {
+			t.Fatalf("Expected Check to report the %v delay", delay)
+		}
+		clock.advance(delay)
+	}
+
+	if got := throttle.Fail("k"); got != time.Minute {
+		t.Fatalf("Expected a lockout after 5 failures, got %v", got)
+	}
+	clock.advance(30 * time.Second)
+	if wait := throttle.Check("k"); wait != 30*time.Second {
+		t.Errorf("Expected 30s of lockout left, got %v", wait)
+	}
+	clock.advance(30 * time.Second)
+	if wait := throttle.Check("k"); wait != 0 {
+		t.Errorf("Expected the lockout to expire, got %v", wait)
+	}
+
+	throttle.Fail("k")
+	throttle.Fail("k")
+	throttle.Succeed("k")
+	if wait := throttle.Check("k"); wait != 0 {
+		t.Errorf("Expected success to clear failures, got %v", wait)
+	}
+}
+
+// TestLoginThrottleSweep tests that failures of keys that never come back are dropped after the lockout window
+func TestLoginThrottleSweep(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	throttle := &LoginThrottle{LockoutAfter: 2, LockoutDuration: time.Minute, now: clock.now}
+
+	throttle.Fail("old")
+	throttle.Fail("locked")
+	clock.advance(30 * time.Second)
+	throttle.Fail("locked")
+	clock.advance(31 * time.Second)
+	throttle.Fail("new")
+	if len(throttle.failures) != 2 {
+		t.Fatalf("Expected the old failure to be swept and the lockout kept, got %d keys", len(throttle.failures))
+	}
+	if wait := throttle.Check("locked"); wait != 29*time.Second {
+		t.Errorf("Expected 29s of lockout left after the sweep, got %v", wait)
+	}
+
+	clock.advance(2 * time.Minute)
+	throttle.Check("other")
+	if len(throttle.failures) != 0 {
+		t.Errorf("Expected every expired key to be swept, got %d keys", len(throttle.failures))
+	}
+}
+
+// TestParseRate tests rate settings
+func TestParseRate(t *testing.T) {
+	if n, period, err := ParseRate(" 3/10m "); err != nil || n != 3 || period != 10*time.Minute {
+		t.Errorf("Expected 3 per 10m, got %d, %v, %v", n, period, err)
+	}
+	for _, bad := range []string{"3", "x/1m", "3/soon", "-1/1m", "3/0s"} {
+		if _, _, err := ParseRate(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// failingUserService rejects every password
+type failingUserService struct{ UserServicer }
+
+func (failingUserService) VerifyPassword(ctx context.Context, email, password string) (*User, error) {
+	return nil, errors.New("invalid password")
+}
+
+// TestPasswordLoginLockout tests that the login endpoint answers 429 with Retry-After once an email is locked out
+func TestPasswordLoginLockout(t *testing.T) {
+	SetAuthLimits(&AuthLimits{PasswordFailed: &LoginThrottle{LockoutAfter: 2, LockoutDuration: time.Minute}})
+	t.Cleanup(func() { SetAuthLimits(nil) })
+
+	login := func(email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth/password-login", strings.NewReader(`{"email":"`+email+`","password":"wrong"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.7:1234"
+		rec := httptest.NewRecorder()
+		HandlePasswordLogin(rec, req, failingUserService{})
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := login("user@example.com"); rec.Code != http.StatusOK {
+			t.Fatalf("Expected failure %d to be a normal response, got %d", i+1, rec.Code)
+		}
+	}
+	rec := login("User@Example.com")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 after the lockout, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected Retry-After: 60, got %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+// TestPasswordLoginLockoutPerClient tests that failures from one IP cannot lock the email out elsewhere,
+// and that a successful login does not reset the failures of its IP
+func TestPasswordLoginLockoutPerClient(t *testing.T) {
+	limits := &AuthLimits{
+		PasswordFailed:      &LoginThrottle{LockoutAfter: 2, LockoutDuration: time.Minute},
+		PasswordFailedEmail: &LoginThrottle{DelayAfter: 5, BaseDelay: time.Second, MaxDelay: time.Second, LockoutDuration: time.Minute},
+	}
+	for i := 0; i < 2; i++ {
+		limits.PasswordLoginFailed("victim@example.com", "198.51.100.1")
+	}
+	if ok, _ := limits.AllowPasswordLogin("victim@example.com", "198.51.100.1"); ok {
+		t.Error("Expected the failing IP to be locked out")
+	}
+	if ok, wait := limits.AllowPasswordLogin("victim@example.com", "192.0.2.7"); !ok {
+		t.Errorf("Expected the email to be allowed from another IP, got a %v wait", wait)
+	}
+
+	limits.PasswordLoginFailed("someone@example.com", "203.0.113.9")
+	limits.PasswordLoginSucceeded("attacker@example.com", "203.0.113.9")
+	limits.PasswordLoginFailed("other@example.com", "203.0.113.9")
+	if ok, _ := limits.AllowPasswordLogin("third@example.com", "203.0.113.9"); ok {
+		t.Error("Expected a successful login to leave the IP's failures in place")
+	}
+}
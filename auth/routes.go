@@ -20,7 +20,7 @@ func RegisterAuthRoutes(router *http.ServeMux, templates types.TemplateEngineInt
 	// Initialize templates for auth handlers
 	InitAuthTemplates(templates)
 
-	log.Printf("\t → \t → 6.X Registering Auth Routes /auth/*, /login, /logout")
+	log.Printf("\t → \t → 6.X Registering Auth Routes /auth/*, /login, /logout, /admin/sessions, /admin/impersonate, /.well-known/jwks.json")
 
 	// Login/Logout page handlers
 	router.HandleFunc("/login", HandleLogin)
@@ -30,6 +30,59 @@ func RegisterAuthRoutes(router *http.ServeMux, templates types.TemplateEngineInt
 	router.HandleFunc("/auth/request-otp", CreateRequestOTPHandler(userService))
 	router.HandleFunc("/auth/verify-otp", CreateVerifyOTPHandler(userService))
 	router.HandleFunc("/auth/password-login", CreatePasswordLoginHandler(userService))
+	router.HandleFunc("/auth/magic", CreateMagicLinkHandler(userService))
+
+	// Identity provider (OpenID Connect) login
+	router.HandleFunc("/auth/oidc/providers", HandleOIDCProviders)
+	router.HandleFunc("/auth/oidc/login", HandleOIDCLogin)
+	router.HandleFunc("/auth/oidc/callback", CreateOIDCCallbackHandler(userService))
+
+	// Passkey (WebAuthn) login
+	router.HandleFunc("/auth/passkey/options", HandlePasskeyLoginOptions)
+	router.HandleFunc("/auth/passkey/login", CreatePasskeyLoginHandler(userService))
+
+	// Second login step
+	router.HandleFunc("/login/2fa", HandleTwoFactorPage)
+	router.HandleFunc("/auth/2fa/verify", HandleTwoFactorVerify)
+	router.HandleFunc("/auth/2fa/setup", HandleTwoFactorLoginSetup)
+	router.HandleFunc("/auth/2fa/enable", HandleTwoFactorLoginEnable)
+
+	// Two-factor settings on the profile; credentials cannot be changed while impersonating
+	router.Handle("/api/profile/2fa", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleTwoFactorStatusAPI))))
+	router.Handle("/api/profile/2fa/setup", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleTwoFactorSetupAPI))))
+	router.Handle("/api/profile/2fa/enable", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleTwoFactorEnableAPI))))
+	router.Handle("/api/profile/2fa/disable", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleTwoFactorDisableAPI))))
+	router.Handle("/api/profile/2fa/recovery-codes", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleRecoveryCodesAPI))))
+	router.Handle("/admin/settings/2fa", AuthMiddleware(IsAdminMiddleware(http.HandlerFunc(HandleTwoFactorPolicy))))
+
+	// Passkeys on the profile
+	router.Handle("/api/profile/passkeys/options", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandlePasskeyOptionsAPI))))
+	router.Handle("/api/profile/passkeys", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandlePasskeysAPI))))
+
+	// Profile fields and avatars
+	router.Handle("/api/profile", AuthMiddleware(http.HandlerFunc(CreateProfileAPIHandler(userService))))
+	router.Handle("/api/profile/avatar", AuthMiddleware(http.HandlerFunc(CreateProfileAvatarAPIHandler(userService))))
+	router.Handle("/avatars/", AuthMiddleware(http.HandlerFunc(CreateAvatarHandler(userService))))
+
+	// Personal access tokens
+	router.Handle("/api/profile/tokens", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleAPITokensAPI))))
+
+	// Token signing keys
+	router.HandleFunc("/.well-known/jwks.json", HandleJWKS)
+	router.Handle("/admin/signing-keys", AuthMiddleware(IsAdminMiddleware(http.HandlerFunc(HandleAdminSigningKeys))))
+
+	// Session endpoints
+	router.HandleFunc("/auth/refresh", HandleRefresh)
+	router.Handle("/auth/logout-all", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleLogoutAll))))
+	router.Handle("/profile/sessions", AuthMiddleware(http.HandlerFunc(HandleSessionsPage)))
+	router.Handle("/api/profile/sessions", AuthMiddleware(NoImpersonationMiddleware(http.HandlerFunc(HandleSessionsAPI))))
+	router.Handle("/admin/sessions", AuthMiddleware(IsAdminMiddleware(http.HandlerFunc(HandleAdminSessions))))
+	router.Handle("/admin/sessions/revoke", AuthMiddleware(IsAdminMiddleware(http.HandlerFunc(HandleAdminRevokeSessions))))
+
+	// Impersonation and its audit log
+	router.Handle("/admin/impersonate", AuthMiddleware(IsAdminMiddleware(http.HandlerFunc(CreateImpersonateHandler(userService)))))
+	router.Handle("/auth/impersonation/stop", AuthMiddleware(http.HandlerFunc(HandleStopImpersonation)))
+	router.Handle("/admin/audit", AuthMiddleware(IsAdminMiddleware(http.HandlerFunc(HandleAdminAudit))))
 }
 
 // AdminMiddleware checks if a user is an admin
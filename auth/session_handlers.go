@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RefreshRequest is the optional body of a refresh request from clients that do not use cookies
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// HandleRefresh exchanges a refresh token for new tokens. Browsers send the refresh cookie and
+// get new cookies; other clients post the token and get the new tokens in the response.
+func HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefreshRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendUnauthorized(w, "Invalid request")
+			return
+		}
+	}
+	fromCookie := req.RefreshToken == ""
+	if fromCookie {
+		cookie, err := r.Cookie(GetRefreshCookieName())
+		if err != nil {
+			sendUnauthorized(w, "Refresh token is required")
+			return
+		}
+		req.RefreshToken = cookie.Value
+	}
+
+	tokens, err := RefreshSession(r.Context(), req.RefreshToken, r)
+	if err != nil {
+		log.Printf("Session refresh failed: %v", err)
+		if fromCookie {
+			ClearSessionCookie(w)
+		}
+		sendUnauthorized(w, "Session expired. Please login again.")
+		return
+	}
+
+	data := map[string]interface{}{"expires_at": tokens.AccessExpiresAt}
+	if fromCookie {
+		SetSessionCookies(w, tokens)
+	} else {
+		data["access_token"] = tokens.AccessToken
+		data["refresh_token"] = tokens.RefreshToken
+	}
+	SendJSONResponse(w, true, "Session refreshed", data, "")
+}
+
+// HandleLogoutAll ends every session of the current user, on all devices
+func HandleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	if user == nil {
+		sendUnauthorized(w, "Please login before to proceed.")
+		return
+	}
+
+	revoked, err := RevokeUserSessions(r.Context(), user.ProjectID, user.ID)
+	if err != nil {
+		log.Printf("Failed to revoke sessions of user %d: %v", user.ID, err)
+		SendJSONResponse(w, false, "Failed to log out of all sessions", nil, "")
+		return
+	}
+	log.Printf("User %d logged out of %d sessions", user.ID, revoked)
+	ClearSessionCookie(w)
+	SendJSONResponse(w, true, "Logged out of all sessions", map[string]int64{"revoked": revoked}, "/login")
+}
+
+// AdminRevokeRequest selects the sessions an admin revokes: one session, or all sessions of a user
+type AdminRevokeRequest struct {
+	SessionID string `json:"session_id"`
+	UserID    int    `json:"user_id"`
+	ProjectID int64  `json:"project_id"` // User directory of UserID; 0 for ai.users accounts
+}
+
+// HandleAdminSessions lists the active sessions of a user (GET ?user_id=, plus ?project_id= for project directory accounts)
+func HandleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		SendJSONResponse(w, false, "user_id is required", nil, "")
+		return
+	}
+
+	projectID, _ := strconv.ParseInt(r.URL.Query().Get("project_id"), 10, 64)
+
+	sessions, err := ListUserSessions(r.Context(), projectID, userID)
+	if err != nil {
+		log.Printf("Failed to list sessions of user %d: %v", userID, err)
+		SendJSONResponse(w, false, "Failed to list sessions", nil, "")
+		return
+	}
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	SendJSONResponse(w, true, "", sessions, "")
+}
+
+// HandleAdminRevokeSessions forces one session, or all sessions of a user, to end
+func HandleAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := GetUserFromContext(r.Context())
+
+	var req AdminRevokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendJSONResponse(w, false, "Invalid request", nil, "")
+		return
+	}
+	req.SessionID = strings.TrimSpace(req.SessionID)
+
+	switch {
+	case req.SessionID != "":
+		if err := RevokeSession(r.Context(), req.SessionID); err != nil {
+			log.Printf("Failed to revoke session %s: %v", req.SessionID, err)
+			SendJSONResponse(w, false, "Failed to revoke session", nil, "")
+			return
+		}
+		log.Printf("Admin %s revoked session %s", admin.Email, req.SessionID)
+		SendJSONResponse(w, true, "Session revoked", nil, "")
+	case req.UserID > 0:
+		revoked, err := RevokeUserSessions(r.Context(), req.ProjectID, req.UserID)
+		if err != nil {
+			log.Printf("Failed to revoke sessions of user %d: %v", req.UserID, err)
+			SendJSONResponse(w, false, "Failed to revoke sessions", nil, "")
+			return
+		}
+		log.Printf("Admin %s revoked %d sessions of user %d", admin.Email, revoked, req.UserID)
+		SendJSONResponse(w, true, "Sessions revoked", map[string]int64{"revoked": revoked}, "")
+	default:
+		SendJSONResponse(w, false, "session_id or user_id is required", nil, "")
+	}
+}
+
+// currentSessionID returns the session of the request's cookies, checking the refresh token so
+// a cookie naming someone else's session cannot end it
+func currentSessionID(r *http.Request) string {
+	if cookie, err := r.Cookie(GetSessionCookieName()); err == nil {
+		if claims, err := ValidateJWT(cookie.Value); err == nil && claims.ID != "" {
+			return claims.ID
+		}
+	}
+	cookie, err := r.Cookie(GetRefreshCookieName())
+	if err != nil {
+		return ""
+	}
+	id, secret, _ := strings.Cut(cookie.Value, ".")
+	session, err := getSessionStore().Get(r.Context(), id)
+	if err != nil || session == nil {
+		return ""
+	}
+	if hash := hashRefreshSecret(secret); hash == session.RefreshHash || hash == session.PrevRefreshHash {
+		return session.ID
+	}
+	return ""
+}
+
+// sendUnauthorized responds with 401 Unauthorized in the JSON response format
+func sendUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: message})
+}
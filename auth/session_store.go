@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// revokedSessionRetention is how long revoked sessions are kept so reuse of their refresh tokens is still recognised
+const revokedSessionRetention = 24 * time.Hour
+
+// SessionStore keeps login sessions.
+type SessionStore interface {
+	// Create stores a new session.
+	Create(ctx context.Context, session Session) error
+	// Get returns a session by ID, or nil when there is none.
+	Get(ctx context.Context, id string) (*Session, error)
+	// Rotate replaces the refresh token hash if it still equals oldHash and reports whether it did,
+	// so only one of several concurrent refreshes rotates the token.
+	Rotate(ctx context.Context, id, oldHash, newHash string, expiresAt time.Time, ip string) (bool, error)
+	// ListByUser returns the active sessions of a user of a user directory (0 for ai.users), most recently used first.
+	ListByUser(ctx context.Context, projectID int64, userID int) ([]Session, error)
+	// Revoke ends a session.
+	Revoke(ctx context.Context, id string) error
+	// RevokeUser ends all active sessions of a user of a user directory and returns how many were ended.
+	RevokeUser(ctx context.Context, projectID int64, userID int) (int64, error)
+	// DeleteExpired removes sessions that expired before the given time, and revoked sessions after a retention period.
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
+	// RememberDevice records a login from a device and reports whether the user had used it before.
+	RememberDevice(ctx context.Context, userID int, deviceHash, description string) (DeviceStatus, error)
+}
+
+// DeviceStatus says whether a login came from a device the user has used before
+type DeviceStatus int
+
+const (
+	DeviceKnown DeviceStatus = iota // Used before
+	DeviceNew                       // Not used before, but the user has logged in from other devices
+	DeviceFirst                     // The user's first recorded device
+)
+
+// memorySessionStore keeps sessions in process memory. Sessions are lost on restart and not shared between instances.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+	devices  map[int]map[string]bool
+}
+
+// NewMemorySessionStore creates an in-process session store
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]Session), devices: make(map[int]map[string]bool)}
+}
+
+func (s *memorySessionStore) Create(ctx context.Context, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memorySessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func (s *memorySessionStore) Rotate(ctx context.Context, id, oldHash, newHash string, expiresAt time.Time, ip string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || session.RevokedAt != nil || session.RefreshHash != oldHash {
+		return false, nil
+	}
+	now := time.Now()
+	session.PrevRefreshHash = session.RefreshHash
+	session.RefreshHash = newHash
+	session.RotatedAt = now
+	session.LastSeenAt = now
+	session.ExpiresAt = expiresAt
+	session.IP = ip
+	s.sessions[id] = session
+	return true, nil
+}
+
+func (s *memorySessionStore) ListByUser(ctx context.Context, projectID int64, userID int) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var list []Session
+	for _, session := range s.sessions {
+		if session.ProjectID == projectID && session.UserID == userID && session.Active(now) {
+			list = append(list, session)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeenAt.After(list[j].LastSeenAt) })
+	return list, nil
+}
+
+func (s *memorySessionStore) Revoke(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[id]; ok && session.RevokedAt == nil {
+		now := time.Now()
+		session.RevokedAt = &now
+		s.sessions[id] = session
+	}
+	return nil
+}
+
+func (s *memorySessionStore) RevokeUser(ctx context.Context, projectID int64, userID int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var revoked int64
+	for id, session := range s.sessions {
+		if session.ProjectID == projectID && session.UserID == userID && session.Active(now) {
+			session.RevokedAt = &now
+			s.sessions[id] = session
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (s *memorySessionStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed int64
+	for id, session := range s.sessions {
+		if session.ExpiresAt.Before(before) || (session.RevokedAt != nil && session.RevokedAt.Before(before.Add(-revokedSessionRetention))) {
+			delete(s.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *memorySessionStore) RememberDevice(ctx context.Context, userID int, deviceHash, description string) (DeviceStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices, ok := s.devices[userID]
+	if !ok {
+		s.devices[userID] = map[string]bool{deviceHash: true}
+		return DeviceFirst, nil
+	}
+	if devices[deviceHash] {
+		return DeviceKnown, nil
+	}
+	devices[deviceHash] = true
+	return DeviceNew, nil
+}
+
+// postgresSessionStore keeps sessions in ai.sessions so they survive restarts and are shared between instances
+type postgresSessionStore struct {
+	db *sql.DB
+}
+
+// NewPostgresSessionStore creates a session store backed by the ai.sessions table
+func NewPostgresSessionStore(db *sql.DB) SessionStore {
+	return &postgresSessionStore{db: db}
+}
+
+func (s *postgresSessionStore) Create(ctx context.Context, session Session) error {
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("sessions/create"),
+		session.ID, session.UserID, session.Email, session.IsAdmin, session.RefreshHash, session.IP, session.UserAgent, session.ExpiresAt, session.ProjectID)
+	return err
+}
+
+func (s *postgresSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	session, err := scanSession(s.db.QueryRowContext(ctx, common.MustGetSQL("sessions/get"), id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *postgresSessionStore) Rotate(ctx context.Context, id, oldHash, newHash string, expiresAt time.Time, ip string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("sessions/rotate"), id, oldHash, newHash, expiresAt, ip)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresSessionStore) ListByUser(ctx context.Context, projectID int64, userID int) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("sessions/list_by_user"), userID, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *session)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresSessionStore) Revoke(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("sessions/revoke"), id)
+	return err
+}
+
+func (s *postgresSessionStore) RevokeUser(ctx context.Context, projectID int64, userID int) (int64, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("sessions/revoke_user"), userID, projectID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *postgresSessionStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("sessions/delete_expired"), before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *postgresSessionStore) RememberDevice(ctx context.Context, userID int, deviceHash, description string) (DeviceStatus, error) {
+	var known int
+	if err := s.db.QueryRowContext(ctx, common.MustGetSQL("sessions/count_devices"), userID).Scan(&known); err != nil {
+		return DeviceKnown, err
+	}
+	var inserted bool
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("sessions/remember_device"), userID, deviceHash, description).Scan(&inserted)
+	switch {
+	case err != nil:
+		return DeviceKnown, err
+	case !inserted:
+		return DeviceKnown, nil
+	case known == 0:
+		return DeviceFirst, nil
+	default:
+		return DeviceNew, nil
+	}
+}
+
+// scanSession reads a row selected by the sessions/get and sessions/list_by_user queries
+func scanSession(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	var session Session
+	var rotatedAt, revokedAt sql.NullTime
+	err := row.Scan(&session.ID, &session.UserID, &session.Email, &session.IsAdmin, &session.RefreshHash, &session.PrevRefreshHash,
+		&session.IP, &session.UserAgent, &session.CreatedAt, &session.LastSeenAt, &rotatedAt, &session.ExpiresAt, &revokedAt, &session.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	if rotatedAt.Valid {
+		session.RotatedAt = rotatedAt.Time
+	}
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+	return &session, nil
+}
+
+var (
+	sessionStore      = NewMemorySessionStore() // Replaced with the Postgres store once the database is up
+	sessionStoreMutex = &sync.Mutex{}
+)
+
+// SetSessionStore replaces the store used for login sessions
+func SetSessionStore(store SessionStore) {
+	sessionStoreMutex.Lock()
+	defer sessionStoreMutex.Unlock()
+	sessionStore = store
+}
+
+// getSessionStore returns the current session store
+func getSessionStore() SessionStore {
+	sessionStoreMutex.Lock()
+	defer sessionStoreMutex.Unlock()
+	return sessionStore
+}
+
+// StartSessionSweeper removes expired sessions from the current store every interval until stop is called
+func StartSessionSweeper(interval time.Duration) (stop func()) {
+	return startSweeper(interval, "sessions", func(ctx context.Context, now time.Time) (int64, error) {
+		return getSessionStore().DeleteExpired(ctx, now)
+	})
+}
@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scriptmaster/openagent/mailer"
+)
+
+// useMemorySessionStore installs a fresh in-memory session store and signing keys for the duration of a test
+func useMemorySessionStore(t *testing.T) SessionStore {
+	previous, previousKeys := getSessionStore(), getSigningKeyStore()
+	store := NewMemorySessionStore()
+	SetSessionStore(store)
+	SetSigningKeyStore(NewMemorySigningKeyStore())
+	t.Cleanup(func() {
+		SetSessionStore(previous)
+		SetSigningKeyStore(previousKeys)
+	})
+	return store
+}
+
+// newSessionRequest creates a request carrying the given cookies
+func newSessionRequest(method, path string, cookies ...*http.Cookie) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+// TestRefreshSessionRotation tests rotation, the grace period for concurrent refreshes and reuse detection
+func TestRefreshSessionRotation(t *testing.T) {
+	useMemorySessionStore(t)
+	ctx := context.Background()
+	req := newSessionRequest(http.MethodPost, "/auth/refresh")
+
+	tokens, err := CreateSession(ctx, &User{ID: 7, Email: "user@example.com"}, req)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	claims, err := ValidateAccessToken(ctx, tokens.AccessToken)
+	if err != nil || claims.ID != tokens.SessionID || claims.UserID != 7 {
+		t.Fatalf("Expected an access token for the session, got %+v, %v", claims, err)
+	}
+
+	rotated, err := RefreshSession(ctx, tokens.RefreshToken, req)
+	if err != nil || rotated.RefreshToken == "" || rotated.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("Expected a rotated refresh token, got %+v, %v", rotated, err)
+	}
+
+	// A request racing the rotation still gets an access token, but no new refresh token
+	racing, err := RefreshSession(ctx, tokens.RefreshToken, req)
+	if err != nil || racing.AccessToken == "" || racing.RefreshToken != "" {
+		t.Fatalf("Expected an access token within the grace period, got %+v, %v", racing, err)
+	}
+
+	refreshReuseGrace = 0
+	t.Cleanup(func() { refreshReuseGrace = 30 * time.Second })
+	if _, err := RefreshSession(ctx, tokens.RefreshToken, req); err != ErrRefreshReused {
+		t.Fatalf("Expected reuse of a rotated token to be detected, got %v", err)
+	}
+	if _, err := RefreshSession(ctx, rotated.RefreshToken, req); err != ErrSessionInvalid {
+		t.Errorf("Expected the session to be revoked after reuse, got %v", err)
+	}
+	if _, err := ValidateAccessToken(ctx, rotated.AccessToken); err != ErrSessionInvalid {
+		t.Errorf("Expected access tokens of a revoked session to be rejected, got %v", err)
+	}
+}
+
+// TestAuthMiddlewareSessions tests refreshing through the refresh cookie and rejection after logging out everywhere
+func TestAuthMiddlewareSessions(t *testing.T) {
+	useMemorySessionStore(t)
+	tokens, err := CreateSession(context.Background(), &User{ID: 3, Email: "user@example.com"}, newSessionRequest(http.MethodGet, "/"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	var sessionID string
+	handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionID = GetSessionIDFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// Only the refresh cookie: the middleware issues new tokens
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newSessionRequest(http.MethodGet, "/dashboard", &http.Cookie{Name: GetRefreshCookieName(), Value: tokens.RefreshToken}))
+	if rec.Code != http.StatusNoContent || sessionID != tokens.SessionID {
+		t.Fatalf("Expected the session to be refreshed, got %d for session %q", rec.Code, sessionID)
+	}
+	cookies := map[string]string{}
+	for _, cookie := range rec.Result().Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	if cookies[GetSessionCookieName()] == "" || cookies[GetRefreshCookieName()] == "" || cookies[GetRefreshCookieName()] == tokens.RefreshToken {
+		t.Fatalf("Expected new access and refresh cookies, got %v", cookies)
+	}
+
+	// Log out everywhere, then the access token is rejected before it expires
+	rec = httptest.NewRecorder()
+	access := &http.Cookie{Name: GetSessionCookieName(), Value: cookies[GetSessionCookieName()]}
+	AuthMiddleware(http.HandlerFunc(HandleLogoutAll)).ServeHTTP(rec, newSessionRequest(http.MethodPost, "/auth/logout-all", access))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected logout-all to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, newSessionRequest(http.MethodGet, "/dashboard", access))
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("Expected a redirect to login after revocation, got %d", rec.Code)
+	}
+}
+
+// TestLogoutRevokesSession tests that logging out ends the session identified by a valid refresh cookie only
+func TestLogoutRevokesSession(t *testing.T) {
+	store := useMemorySessionStore(t)
+	ctx := context.Background()
+	tokens, err := CreateSession(ctx, &User{ID: 5, Email: "user@example.com"}, newSessionRequest(http.MethodGet, "/"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	forged := &http.Cookie{Name: GetRefreshCookieName(), Value: tokens.SessionID + ".not-the-secret"}
+	HandleLogout(httptest.NewRecorder(), newSessionRequest(http.MethodGet, "/logout", forged))
+	if session, _ := store.Get(ctx, tokens.SessionID); !session.Active(time.Now()) {
+		t.Fatal("Expected a forged refresh cookie not to end the session")
+	}
+
+	valid := &http.Cookie{Name: GetRefreshCookieName(), Value: tokens.RefreshToken}
+	HandleLogout(httptest.NewRecorder(), newSessionRequest(http.MethodGet, "/logout", valid))
+	if session, _ := store.Get(ctx, tokens.SessionID); session.Active(time.Now()) {
+		t.Error("Expected logout to revoke the session")
+	}
+}
+
+// TestSessionsAPI tests listing sessions with the current one marked, and that users can only end their own sessions
+func TestSessionsAPI(t *testing.T) {
+	useMemorySessionStore(t)
+	ctx := context.Background()
+	user := &User{ID: 9, Email: "user@example.com"}
+	laptop := newSessionRequest(http.MethodGet, "/")
+	laptop.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15")
+	current, _ := CreateSession(ctx, user, laptop)
+	other, _ := CreateSession(ctx, user, newSessionRequest(http.MethodGet, "/"))
+	stranger, _ := CreateSession(ctx, &User{ID: 10, Email: "other@example.com"}, newSessionRequest(http.MethodGet, "/"))
+
+	api := AuthMiddleware(http.HandlerFunc(HandleSessionsAPI))
+	access := &http.Cookie{Name: GetSessionCookieName(), Value: current.AccessToken}
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, newSessionRequest(http.MethodGet, "/api/profile/sessions", access))
+	var list []SessionInfo
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil || len(list) != 2 {
+		t.Fatalf("Expected two sessions, got %v (%v)", list, err)
+	}
+	for _, info := range list {
+		if info.Current != (info.ID == current.SessionID) {
+			t.Errorf("Expected only the requesting session to be current, got %+v", info)
+		}
+		if info.ID == current.SessionID && info.Device != "Safari on macOS" {
+			t.Errorf("Expected the device to be described, got %q", info.Device)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, newSessionRequest(http.MethodDelete, "/api/profile/sessions?id="+stranger.SessionID, access))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's session to be not found, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, newSessionRequest(http.MethodDelete, "/api/profile/sessions?id="+other.SessionID, access))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the session to be ended, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := ValidateAccessToken(ctx, other.AccessToken); err != ErrSessionInvalid {
+		t.Errorf("Expected the ended session to be rejected, got %v", err)
+	}
+}
+
+// TestNewDeviceAlert tests that only logins from a new device, after the first one, send an alert
+func TestNewDeviceAlert(t *testing.T) {
+	useMemorySessionStore(t)
+	useTrustedHosts(t, "example.com")
+	mailer.TemplateDir = "../data/mail"
+	sent := make(chan mailer.Message, 3)
+	mailer.SetDefault(mailer.MailerFunc(func(ctx context.Context, msg mailer.Message) error {
+		if msg.To[0] == "devices@example.com" { // Ignore alerts still being sent by earlier tests
+			sent <- msg
+		}
+		return nil
+	}))
+	t.Cleanup(func() {
+		mailer.TemplateDir = ""
+		mailer.SetDefault(nil)
+	})
+
+	login := func(userAgent string) {
+		req := newSessionRequest(http.MethodPost, "/auth/verify-otp")
+		req.Header.Set("User-Agent", userAgent)
+		if _, err := CreateSession(context.Background(), &User{ID: 4, Email: "devices@example.com"}, req); err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+	}
+	login("Mozilla/5.0 (X11; Linux x86_64) Firefox/124.0")
+	login("Mozilla/5.0 (X11; Linux x86_64) Firefox/125.0") // Browser update, same device
+	login("Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) Version/17.4 Mobile Safari/604.1")
+
+	select {
+	case msg := <-sent:
+		if !strings.Contains(msg.Text, "Safari on iOS") || !strings.Contains(msg.Text, "http://example.com/profile/sessions") {
+			t.Errorf("Unexpected alert: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected an alert for the new device")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(sent) != 0 {
+		t.Errorf("Expected a single alert, got %d more", len(sent))
+	}
+}
+
+// TestProjectBoundSessions tests that sessions of a project's user directory only work on that project's hosts
+// and are listed apart from ai.users sessions with the same user ID
+func TestProjectBoundSessions(t *testing.T) {
+	useMemorySessionStore(t)
+	ctx := context.Background()
+	projectCtx := SetAccountProjectID(ctx, 4)
+	req := newSessionRequest(http.MethodPost, "/auth/refresh").WithContext(projectCtx)
+
+	tokens, err := CreateSession(projectCtx, &User{ID: 7, Email: "member@example.com", ProjectID: 4, IsAdmin: true}, req)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	claims, err := ValidateAccessToken(projectCtx, tokens.AccessToken)
+	if err != nil || claims.ProjectID != 4 || claims.IsAdmin {
+		t.Fatalf("Expected a non-admin access token for project 4, got %+v, %v", claims, err)
+	}
+	if _, err := ValidateAccessToken(ctx, tokens.AccessToken); err != ErrSessionProject {
+		t.Errorf("Expected the token to be refused on other hosts, got %v", err)
+	}
+	if _, err := RefreshSession(ctx, tokens.RefreshToken, newSessionRequest(http.MethodPost, "/auth/refresh")); err != ErrSessionProject {
+		t.Errorf("Expected the refresh token to be refused on other hosts, got %v", err)
+	}
+
+	if _, err := CreateSession(ctx, &User{ID: 7, Email: "user@example.com"}, newSessionRequest(http.MethodPost, "/auth/login")); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessions, err := ListUserSessions(ctx, 4, 7)
+	if err != nil || len(sessions) != 1 || sessions[0].ID != tokens.SessionID {
+		t.Errorf("Expected only the project session to be listed, got %v, %v", sessions, err)
+	}
+}
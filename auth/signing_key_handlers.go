@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// HandleJWKS publishes the public keys that verify our JWTs at /.well-known/jwks.json,
+// including retired keys still in their grace period
+func HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := activeSigningKey(r.Context()); err != nil {
+		log.Printf("Error loading signing keys: %v", err)
+		common.JSONError(w, "Failed to load signing keys", http.StatusInternalServerError)
+		return
+	}
+	keys, err := SigningKeys(r.Context())
+	if err != nil {
+		log.Printf("Error loading signing keys: %v", err)
+		common.JSONError(w, "Failed to load signing keys", http.StatusInternalServerError)
+		return
+	}
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{Keys: make([]jsonWebKey, 0, len(keys))}
+	for i := range keys {
+		jwks.Keys = append(jwks.Keys, keys[i].publicJWK())
+	}
+	// Verifiers refetch on unknown kids, so a short cache is enough
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	common.JSONResponse(w, jwks)
+}
+
+// HandleAdminSigningKeys lists the signing keys (GET) or rotates them (POST): the new key signs
+// from now on and the old one keeps verifying for AUTH_KEY_GRACE
+func HandleAdminSigningKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		key, err := RotateSigningKey(r.Context())
+		if err != nil {
+			log.Printf("Error rotating signing keys: %v", err)
+			common.JSONError(w, "Failed to rotate signing keys", http.StatusInternalServerError)
+			return
+		}
+		if admin := GetUserFromContext(r.Context()); admin != nil {
+			log.Printf("Admin %s rotated the signing keys, new key %s", admin.Email, key.ID)
+		}
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys, err := SigningKeys(r.Context())
+	if err != nil {
+		log.Printf("Error loading signing keys: %v", err)
+		common.JSONError(w, "Failed to load signing keys", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []SigningKey{}
+	}
+	common.JSONResponse(w, keys)
+}
@@ -0,0 +1,457 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/scriptmaster/openagent/common"
+)
+
+// Signing algorithms for AUTH_SIGNING_ALG
+const (
+	SigningAlgEdDSA = "EdDSA"
+	SigningAlgRS256 = "RS256"
+)
+
+// signingKeyRefresh is how often the keys are reloaded, so keys rotated by another instance are picked up
+const signingKeyRefresh = time.Minute
+
+// SigningKey is an asymmetric key that signs JWTs. The newest active key signs; retired keys keep
+// verifying until ExpiresAt so tokens issued just before a rotation stay valid.
+type SigningKey struct {
+	ID         string        `json:"kid"`
+	Algorithm  string        `json:"algorithm"`
+	PrivateKey crypto.Signer `json:"-"`
+	CreatedAt  time.Time     `json:"created_at"`
+	RetiredAt  *time.Time    `json:"retired_at,omitempty"`
+	ExpiresAt  *time.Time    `json:"expires_at,omitempty"`
+}
+
+// Active reports whether the key may sign new tokens
+func (k *SigningKey) Active() bool {
+	return k.RetiredAt == nil
+}
+
+// method returns the JWT signing method of the key's algorithm
+func (k *SigningKey) method() jwt.SigningMethod {
+	if k.Algorithm == SigningAlgRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// publicJWK returns the public half of the key as a JWK for /.well-known/jwks.json
+func (k *SigningKey) publicJWK() jsonWebKey {
+	jwk := jsonWebKey{Kid: k.ID, Use: "sig", Alg: k.Algorithm}
+	switch public := k.PrivateKey.Public().(type) {
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	}
+	return jwk
+}
+
+// SigningKeyStore keeps the keys that sign JWTs.
+type SigningKeyStore interface {
+	// Create stores a new active key.
+	Create(ctx context.Context, key SigningKey) error
+	// List returns the keys that still verify tokens, newest first.
+	List(ctx context.Context) ([]SigningKey, error)
+	// RetireOthers stops all active keys except id from signing; they verify until expiresAt.
+	RetireOthers(ctx context.Context, id string, retiredAt, expiresAt time.Time) error
+	// DeleteExpired removes keys that stopped verifying before the given time.
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
+}
+
+// memorySigningKeyStore keeps keys in process memory. Tokens stop verifying on restart and other instances cannot verify them.
+type memorySigningKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]SigningKey
+}
+
+// NewMemorySigningKeyStore creates an in-process signing key store
+func NewMemorySigningKeyStore() SigningKeyStore {
+	return &memorySigningKeyStore{keys: make(map[string]SigningKey)}
+}
+
+func (s *memorySigningKeyStore) Create(ctx context.Context, key SigningKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memorySigningKeyStore) List(ctx context.Context) ([]SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var list []SigningKey
+	for _, key := range s.keys {
+		if key.ExpiresAt == nil || key.ExpiresAt.After(now) {
+			list = append(list, key)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (s *memorySigningKeyStore) RetireOthers(ctx context.Context, id string, retiredAt, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for kid, key := range s.keys {
+		if kid != id && key.RetiredAt == nil {
+			key.RetiredAt, key.ExpiresAt = &retiredAt, &expiresAt
+			s.keys[kid] = key
+		}
+	}
+	return nil
+}
+
+func (s *memorySigningKeyStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed int64
+	for kid, key := range s.keys {
+		if key.ExpiresAt != nil && key.ExpiresAt.Before(before) {
+			delete(s.keys, kid)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// postgresSigningKeyStore keeps keys in ai.signing_keys so tokens verify across restarts and instances.
+// Private keys are stored encrypted.
+type postgresSigningKeyStore struct {
+	db *sql.DB
+}
+
+// NewPostgresSigningKeyStore creates a signing key store backed by the ai.signing_keys table
+func NewPostgresSigningKeyStore(db *sql.DB) SigningKeyStore {
+	return &postgresSigningKeyStore{db: db}
+}
+
+func (s *postgresSigningKeyStore) Create(ctx context.Context, key SigningKey) error {
+	encrypted, err := encryptSigningKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, common.MustGetSQL("signing_keys/create"), key.ID, key.Algorithm, encrypted, key.CreatedAt)
+	return err
+}
+
+func (s *postgresSigningKeyStore) List(ctx context.Context) ([]SigningKey, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("signing_keys/list"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []SigningKey
+	for rows.Next() {
+		var key SigningKey
+		var encrypted string
+		var retiredAt, expiresAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Algorithm, &encrypted, &key.CreatedAt, &retiredAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if key.PrivateKey, err = decryptSigningKey(encrypted); err != nil {
+			// Keys encrypted with another SIGNING_KEY_ENCRYPTION_KEY are skipped, not fatal
+			log.Printf("Skipping signing key %s: %v", key.ID, err)
+			continue
+		}
+		if retiredAt.Valid {
+			key.RetiredAt = &retiredAt.Time
+		}
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+		list = append(list, key)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresSigningKeyStore) RetireOthers(ctx context.Context, id string, retiredAt, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("signing_keys/retire_others"), id, retiredAt, expiresAt)
+	return err
+}
+
+func (s *postgresSigningKeyStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("signing_keys/delete_expired"), before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// signingKeyEncryptionKey derives the key that encrypts stored private keys from
+// SIGNING_KEY_ENCRYPTION_KEY (default SESSION_SALT)
+func signingKeyEncryptionKey() []byte {
+	key := getEnv("SIGNING_KEY_ENCRYPTION_KEY")
+	if key == "" {
+		key = getEnv("SESSION_SALT")
+	}
+	sum := sha256.Sum256([]byte("signing:" + key))
+	return sum[:]
+}
+
+// encryptSigningKey encodes a private key as PKCS #8 and encrypts it with AES-GCM for storage
+func encryptSigningKey(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return sealAESGCM(signingKeyEncryptionKey(), der)
+}
+
+// decryptSigningKey reverses encryptSigningKey
+func decryptSigningKey(encrypted string) (crypto.Signer, error) {
+	der, err := openAESGCM(signingKeyEncryptionKey(), encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt signing key: %w", err)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported signing key type")
+	}
+	return signer, nil
+}
+
+// signingAlgorithm is the algorithm of new keys (AUTH_SIGNING_ALG: EdDSA, the default, or RS256)
+func signingAlgorithm() string {
+	if getEnv("AUTH_SIGNING_ALG") == SigningAlgRS256 {
+		return SigningAlgRS256
+	}
+	return SigningAlgEdDSA
+}
+
+// signingKeyRotation is how long a key signs before it is replaced (AUTH_KEY_ROTATION, default 30 days)
+func signingKeyRotation() time.Duration {
+	return durationFromEnv("AUTH_KEY_ROTATION", 720*time.Hour)
+}
+
+// signingKeyGrace is how long a replaced key still verifies (AUTH_KEY_GRACE, default 24h).
+// It is never shorter than the access token lifetime, so rotation does not cut access tokens short.
+func signingKeyGrace() time.Duration {
+	grace := durationFromEnv("AUTH_KEY_GRACE", 24*time.Hour)
+	if ttl := accessTokenTTL(); grace < ttl {
+		return ttl
+	}
+	return grace
+}
+
+// generateSigningKey creates a new key for the algorithm
+func generateSigningKey(algorithm string) (*SigningKey, error) {
+	kid, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{ID: kid[:16], Algorithm: algorithm, CreatedAt: time.Now()}
+	switch algorithm {
+	case SigningAlgEdDSA:
+		_, key.PrivateKey, err = ed25519.GenerateKey(rand.Reader)
+	case SigningAlgRS256:
+		key.PrivateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// signingKeyring caches the stored keys
+type signingKeyring struct {
+	mu       sync.Mutex
+	store    SigningKeyStore
+	keys     []SigningKey
+	loadedAt time.Time
+}
+
+var (
+	keyring       = &signingKeyring{store: NewMemorySigningKeyStore()} // Store replaced with the Postgres store once the database is up
+	firstKeyMutex = &sync.Mutex{}
+)
+
+// SetSigningKeyStore replaces the store of the keys that sign JWTs
+func SetSigningKeyStore(store SigningKeyStore) {
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+	keyring.store = store
+	keyring.keys, keyring.loadedAt = nil, time.Time{}
+}
+
+// getSigningKeyStore returns the current signing key store
+func getSigningKeyStore() SigningKeyStore {
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+	return keyring.store
+}
+
+// load returns the cached keys, reloading them when older than maxAge
+func (k *signingKeyring) load(ctx context.Context, maxAge time.Duration) ([]SigningKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys != nil && time.Since(k.loadedAt) < maxAge {
+		return k.keys, nil
+	}
+	keys, err := k.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	k.keys, k.loadedAt = keys, time.Now()
+	return keys, nil
+}
+
+// invalidate makes the next load read the store
+func (k *signingKeyring) invalidate() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = nil
+}
+
+// activeSigningKey returns the key that signs new tokens, creating the first key when there is none
+func activeSigningKey(ctx context.Context) (*SigningKey, error) {
+	keys, err := keyring.load(ctx, signingKeyRefresh)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if keys[i].Active() {
+			return &keys[i], nil
+		}
+	}
+
+	// Only one request creates the first key; the others use it
+	firstKeyMutex.Lock()
+	defer firstKeyMutex.Unlock()
+	if keys, err = keyring.load(ctx, 0); err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if keys[i].Active() {
+			return &keys[i], nil
+		}
+	}
+	return RotateSigningKey(ctx)
+}
+
+// verificationKey returns the key with the given kid. Unknown kids reload the keys first, since
+// another instance may have just rotated them.
+func verificationKey(ctx context.Context, kid string) (*SigningKey, error) {
+	for _, maxAge := range []time.Duration{signingKeyRefresh, 5 * time.Second} {
+		keys, err := keyring.load(ctx, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for i := range keys {
+			if keys[i].ID == kid && (keys[i].ExpiresAt == nil || keys[i].ExpiresAt.After(now)) {
+				return &keys[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// SigningKeys returns the keys that still verify tokens, newest first
+func SigningKeys(ctx context.Context) ([]SigningKey, error) {
+	return keyring.load(ctx, signingKeyRefresh)
+}
+
+// RotateSigningKey creates a new signing key with AUTH_SIGNING_ALG and retires the others,
+// which keep verifying tokens for the grace period
+func RotateSigningKey(ctx context.Context) (*SigningKey, error) {
+	return rotateSigningKey(ctx, signingAlgorithm())
+}
+
+// rotateSigningKey replaces the active key with a new key for the algorithm
+func rotateSigningKey(ctx context.Context, algorithm string) (*SigningKey, error) {
+	key, err := generateSigningKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	store := getSigningKeyStore()
+	if err := store.Create(ctx, *key); err != nil {
+		return nil, fmt.Errorf("failed to store signing key: %w", err)
+	}
+	if err := store.RetireOthers(ctx, key.ID, key.CreatedAt, key.CreatedAt.Add(signingKeyGrace())); err != nil {
+		return nil, fmt.Errorf("failed to retire signing keys: %w", err)
+	}
+	keyring.invalidate()
+	log.Printf("Created %s signing key %s", key.Algorithm, key.ID)
+	return key, nil
+}
+
+// rotateDueSigningKey replaces the active key once it has signed for AUTH_KEY_ROTATION and
+// removes keys past their grace period
+func rotateDueSigningKey(ctx context.Context, now time.Time) (int64, error) {
+	keys, err := keyring.load(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if key.Active() && now.Sub(key.CreatedAt) >= signingKeyRotation() {
+			if _, err := RotateSigningKey(ctx); err != nil {
+				return 0, err
+			}
+			break
+		}
+	}
+	return getSigningKeyStore().DeleteExpired(ctx, now)
+}
+
+// StartSigningKeyRotation checks every interval whether the signing key is due for rotation until stop is called
+func StartSigningKeyRotation(interval time.Duration) (stop func()) {
+	return startSweeper(interval, "signing keys", rotateDueSigningKey)
+}
+
+// signToken signs claims with the active key and names it in the kid header
+func signToken(claims jwt.Claims) (string, error) {
+	key, err := activeSigningKey(context.Background())
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+// parseToken verifies a token signed by signToken with the key named in its kid header
+func parseToken(tokenString string, claims jwt.Claims, options ...jwt.ParserOption) (*jwt.Token, error) {
+	options = append([]jwt.ParserOption{jwt.WithValidMethods([]string{SigningAlgEdDSA, SigningAlgRS256})}, options...)
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := verificationKey(context.Background(), kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.PrivateKey.Public(), nil
+	}, options...)
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestSigningKeyRotation tests that tokens carry the signing key's kid and that retired keys verify only during the grace period
+func TestSigningKeyRotation(t *testing.T) {
+	useMemorySessionStore(t)
+	ctx := context.Background()
+	claims := &UserClaims{UserID: 1, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}}
+
+	old, err := signToken(claims)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	first, err := activeSigningKey(ctx)
+	if err != nil || first.Algorithm != SigningAlgEdDSA {
+		t.Fatalf("Expected an EdDSA key by default, got %+v, %v", first, err)
+	}
+	parsed, _, _ := jwt.NewParser().ParseUnverified(old, &UserClaims{})
+	if parsed.Header["kid"] != first.ID {
+		t.Errorf("Expected kid %s, got %v", first.ID, parsed.Header["kid"])
+	}
+
+	second, err := rotateSigningKey(ctx, SigningAlgRS256)
+	if err != nil || second.Algorithm != SigningAlgRS256 {
+		t.Fatalf("Expected an RS256 key, got %+v, %v", second, err)
+	}
+	if active, _ := activeSigningKey(ctx); active.ID != second.ID {
+		t.Errorf("Expected the new key to sign, got %s", active.ID)
+	}
+	if _, err := ValidateJWT(old); err != nil {
+		t.Errorf("Expected tokens of the retired key to verify during the grace period: %v", err)
+	}
+	fresh, _ := signToken(claims)
+	if _, err := ValidateJWT(fresh); err != nil {
+		t.Errorf("Expected tokens of the new key to verify: %v", err)
+	}
+
+	// Once the grace period is over the old key is removed and its tokens fail
+	if removed, _ := rotateDueSigningKey(ctx, time.Now().Add(signingKeyGrace()+time.Minute)); removed != 1 {
+		t.Fatalf("Expected the retired key to be removed, removed %d", removed)
+	}
+	keyring.invalidate()
+	if _, err := ValidateJWT(old); err == nil {
+		t.Error("Expected tokens of a removed key to be refused")
+	}
+}
+
+// TestSigningKeyDueRotation tests that the sweeper only rotates keys older than AUTH_KEY_ROTATION
+func TestSigningKeyDueRotation(t *testing.T) {
+	useMemorySessionStore(t)
+	ctx := context.Background()
+	first, _ := activeSigningKey(ctx)
+
+	rotateDueSigningKey(ctx, time.Now())
+	if active, _ := activeSigningKey(ctx); active.ID != first.ID {
+		t.Error("Expected a fresh key not to be rotated")
+	}
+	rotateDueSigningKey(ctx, time.Now().Add(signingKeyRotation()))
+	if active, _ := activeSigningKey(ctx); active.ID == first.ID {
+		t.Error("Expected a key past AUTH_KEY_ROTATION to be rotated")
+	}
+}
+
+// TestJWKS tests that the published keys verify our tokens
+func TestJWKS(t *testing.T) {
+	useMemorySessionStore(t)
+	token, err := signToken(&UserClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	HandleJWKS(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &jwks); err != nil || len(jwks.Keys) != 1 {
+		t.Fatalf("Expected one published key, got %s (%v)", rec.Body.String(), err)
+	}
+	if jwks.Keys[0].Kty != "OKP" || jwks.Keys[0].Alg != SigningAlgEdDSA {
+		t.Errorf("Expected an Ed25519 JWK, got %+v", jwks.Keys[0])
+	}
+
+	_, err = jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		for _, key := range jwks.Keys {
+			if key.Kid == token.Header["kid"] {
+				return key.publicKey()
+			}
+		}
+		return nil, nil
+	}, jwt.WithValidMethods([]string{SigningAlgEdDSA}))
+	if err != nil {
+		t.Errorf("Expected the JWKS to verify the token: %v", err)
+	}
+}
+
+// TestSigningKeyEncryption tests that stored private keys round-trip through encryption and that tampering is detected
+func TestSigningKeyEncryption(t *testing.T) {
+	for _, algorithm := range []string{SigningAlgEdDSA, SigningAlgRS256} {
+		key, err := generateSigningKey(algorithm)
+		if err != nil {
+			t.Fatalf("Failed to generate %s key: %v", algorithm, err)
+		}
+		encrypted, err := encryptSigningKey(key.PrivateKey)
+		if err != nil {
+			t.Fatalf("Failed to encrypt %s key: %v", algorithm, err)
+		}
+		decrypted, err := decryptSigningKey(encrypted)
+		if err != nil {
+			t.Fatalf("Failed to decrypt %s key: %v", algorithm, err)
+		}
+		if public, ok := decrypted.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !public.Equal(key.PrivateKey.Public()) {
+			t.Errorf("Expected the decrypted %s key to match", algorithm)
+		}
+	}
+
+	key, _ := generateSigningKey(SigningAlgEdDSA)
+	encrypted, _ := encryptSigningKey(key.PrivateKey)
+	sealed, _ := base64.StdEncoding.DecodeString(encrypted)
+	sealed[len(sealed)-1] ^= 1
+	if _, err := decryptSigningKey(base64.StdEncoding.EncodeToString(sealed)); err == nil {
+		t.Error("Expected a tampered key to be refused")
+	}
+}
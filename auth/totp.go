@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters, using the defaults every authenticator app supports
+const (
+	totpDigits = 6
+	totpPeriod = 30 // Seconds per step
+	totpSkew   = 1  // Steps accepted either side of the current one, for clock drift
+
+	recoveryCodeCount = 10
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret creates a random 160-bit secret, base32 encoded as authenticator apps expect
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI that authenticator apps read from a QR code
+func TOTPProvisioningURI(secret, email, issuer string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(issuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// TOTPCode returns the code for a secret at the given time
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCodeAt(key, t.Unix()/totpPeriod), nil
+}
+
+// ValidateTOTP checks a code against the steps around t and returns the matching step.
+// Steps up to lastStep are rejected, so a code cannot be used twice.
+func ValidateTOTP(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCodeAt(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCodeAt computes the RFC 4226 HOTP value for a counter
+func totpCodeAt(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// decodeTOTPSecret decodes a base32 secret, ignoring case, spaces and padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	return base32NoPadding.DecodeString(secret)
+}
+
+// generateRecoveryCodes creates single-use recovery codes such as "k3m9q-x7p2d"
+func generateRecoveryCodes() ([]string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789" // No look-alike characters
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code for storage, however it was typed
+func hashRecoveryCode(userID int, code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	return hashOTP("recovery:"+strconv.Itoa(userID), code)
+}
+
+// totpEncryptionKey derives the key that encrypts stored TOTP secrets from
+// TOTP_ENCRYPTION_KEY (default SESSION_SALT)
+func totpEncryptionKey() []byte {
+	key := getEnv("TOTP_ENCRYPTION_KEY")
+	if key == "" {
+		key = getEnv("SESSION_SALT")
+	}
+	sum := sha256.Sum256([]byte("totp:" + key))
+	return sum[:]
+}
+
+// encryptTOTPSecret encrypts a secret with AES-GCM for storage
+func encryptTOTPSecret(secret string) (string, error) {
+	return sealAESGCM(totpEncryptionKey(), []byte(secret))
+}
+
+// decryptTOTPSecret reverses encryptTOTPSecret
+func decryptTOTPSecret(encrypted string) (string, error) {
+	plain, err := openAESGCM(totpEncryptionKey(), encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+// sealAESGCM encrypts data with a 32-byte key and returns the nonce and ciphertext, base64 encoded
+func sealAESGCM(key, plain []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// openAESGCM reverses sealAESGCM
+func openAESGCM(key []byte, encrypted string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
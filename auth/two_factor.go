@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/scriptmaster/openagent/common"
+)
+
+// twoFactorSubject marks tokens for a login that still needs its second factor
+const twoFactorSubject = "2fa"
+
+// twoFactorPendingTTL is how long the user has to complete the second factor step
+const twoFactorPendingTTL = 10 * time.Minute
+
+var (
+	// ErrTwoFactorEnabled is returned when enrolling a user who already has 2FA enabled
+	ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrInvalidTwoFactorCode is returned for wrong, reused or expired codes
+	ErrInvalidTwoFactorCode = errors.New("invalid authentication code")
+)
+
+// TwoFactorPolicy decides whether administrators must use two-factor authentication.
+type TwoFactorPolicy interface {
+	AdminTwoFactorRequired(ctx context.Context) (bool, error)
+	SetAdminTwoFactorRequired(ctx context.Context, required bool) error
+}
+
+// envTwoFactorPolicy reads AUTH_REQUIRE_ADMIN_2FA; it is used until the server installs the settings-backed policy
+type envTwoFactorPolicy struct{}
+
+func (envTwoFactorPolicy) AdminTwoFactorRequired(ctx context.Context) (bool, error) {
+	return getEnv("AUTH_REQUIRE_ADMIN_2FA") == "1", nil
+}
+
+func (envTwoFactorPolicy) SetAdminTwoFactorRequired(ctx context.Context, required bool) error {
+	return errors.New("set AUTH_REQUIRE_ADMIN_2FA to change the two-factor policy")
+}
+
+var (
+	twoFactorPolicy      TwoFactorPolicy = envTwoFactorPolicy{}
+	twoFactorPolicyMutex                 = &sync.Mutex{}
+)
+
+// SetTwoFactorPolicy replaces the policy deciding whether admins must use 2FA
+func SetTwoFactorPolicy(policy TwoFactorPolicy) {
+	twoFactorPolicyMutex.Lock()
+	defer twoFactorPolicyMutex.Unlock()
+	twoFactorPolicy = policy
+}
+
+// getTwoFactorPolicy returns the current two-factor policy
+func getTwoFactorPolicy() TwoFactorPolicy {
+	twoFactorPolicyMutex.Lock()
+	defer twoFactorPolicyMutex.Unlock()
+	return twoFactorPolicy
+}
+
+// twoFactorStatus reports whether a user has enabled 2FA and whether policy requires it
+func twoFactorStatus(ctx context.Context, user *User) (enrolled, required bool, err error) {
+	if user.ProjectID != 0 {
+		return false, false, nil // Enrolments belong to ai.users accounts
+	}
+	enrolment, err := getTwoFactorStore().Get(ctx, user.ID)
+	if err != nil {
+		return false, false, err
+	}
+	enrolled = enrolment != nil && enrolment.Enabled
+	if user.IsAdmin {
+		if required, err = getTwoFactorPolicy().AdminTwoFactorRequired(ctx); err != nil {
+			return false, false, err
+		}
+	}
+	return enrolled, required, nil
+}
+
+// BeginTwoFactorEnrolment stores a new pending TOTP secret for the user and returns it with its provisioning URI
+func BeginTwoFactorEnrolment(ctx context.Context, user *User) (secret, uri string, err error) {
+	if secret, err = GenerateTOTPSecret(); err != nil {
+		return "", "", err
+	}
+	saved, err := getTwoFactorStore().SavePending(ctx, user.ID, secret)
+	if err != nil {
+		return "", "", err
+	}
+	if !saved {
+		return "", "", ErrTwoFactorEnabled
+	}
+	issuer := common.GetEnvOrDefault("APP_NAME", "OpenAgent")
+	return secret, TOTPProvisioningURI(secret, user.Email, issuer), nil
+}
+
+// FinishTwoFactorEnrolment enables 2FA once the user proves their app produces codes for the
+// pending secret, and returns the new recovery codes, which are only shown this once
+func FinishTwoFactorEnrolment(ctx context.Context, user *User, code string) ([]string, error) {
+	store := getTwoFactorStore()
+	enrolment, err := store.Get(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enrolment == nil {
+		return nil, errors.New("start two-factor setup first")
+	}
+	if enrolment.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	step, ok := ValidateTOTP(enrolment.Secret, code, time.Now(), enrolment.LastStep)
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes, hashes, err := newRecoveryCodes(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := store.Enable(ctx, user.ID, step, hashes)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor checks a TOTP code, or an unused recovery code, for a user with 2FA enabled.
+// Each code is accepted only once.
+func VerifySecondFactor(ctx context.Context, userID int, code string) (bool, error) {
+	store := getTwoFactorStore()
+	enrolment, err := store.Get(ctx, userID)
+	if err != nil || enrolment == nil || !enrolment.Enabled {
+		return false, err
+	}
+	if step, ok := ValidateTOTP(enrolment.Secret, code, time.Now(), enrolment.LastStep); ok {
+		return store.UseStep(ctx, userID, step)
+	}
+	if len(code) > totpDigits {
+		return store.UseRecoveryCode(ctx, userID, hashRecoveryCode(userID, code))
+	}
+	return false, nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes and returns the new ones
+func RegenerateRecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := getTwoFactorStore().ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor removes a user's TOTP secret and recovery codes
+func DisableTwoFactor(ctx context.Context, userID int) error {
+	return getTwoFactorStore().Delete(ctx, userID)
+}
+
+// newRecoveryCodes generates recovery codes and their hashes
+func newRecoveryCodes(userID int) ([]string, []string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(userID, code)
+	}
+	return codes, hashes, nil
+}
+
+// twoFactorClaims identify a user who passed the first login step
+type twoFactorClaims struct {
+	UserID  int    `json:"user_id"`
+	Email   string `json:"email"`
+	IsAdmin bool   `json:"is_admin"`
+	Enroll  bool   `json:"enroll"` // The user must set up 2FA before logging in
+	jwt.RegisteredClaims
+}
+
+// signTwoFactorToken issues the short-lived token carried between the first and second login step
+func signTwoFactorToken(user *User, enroll bool) (string, error) {
+	now := time.Now()
+	claims := &twoFactorClaims{
+		UserID:  user.ID,
+		Email:   user.Email,
+		IsAdmin: user.IsAdmin,
+		Enroll:  enroll,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   twoFactorSubject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(twoFactorPendingTTL)),
+		},
+	}
+	return signToken(claims)
+}
+
+// pendingTwoFactorUser returns the user waiting for the second login step, from the 2FA cookie
+func pendingTwoFactorUser(r *http.Request) (*User, bool, error) {
+	cookie, err := r.Cookie(GetTwoFactorCookieName())
+	if err != nil {
+		return nil, false, errors.New("no pending two-factor login")
+	}
+	claims := &twoFactorClaims{}
+	_, err = parseToken(cookie.Value, claims, jwt.WithSubject(twoFactorSubject))
+	if err != nil {
+		return nil, false, err
+	}
+	return &User{ID: claims.UserID, Email: claims.Email, IsAdmin: claims.IsAdmin}, claims.Enroll, nil
+}
+
+// checkSecondFactor verifies a code for a user, slowing down and locking out repeated failures
+// the same way as password logins. It returns how long to wait when the user is throttled.
+func checkSecondFactor(r *http.Request, user *User, code string) (bool, time.Duration, error) {
+	limits := getAuthLimits()
+	key := "2fa:" + strconv.Itoa(user.ID)
+	if ok, wait := limits.AllowOTPVerify(ClientIP(r)); !ok {
+		return false, wait, nil
+	}
+	if limits != nil {
+		if wait := limits.PasswordFailed.Check(key); wait > 0 {
+			return false, wait, nil
+		}
+	}
+
+	valid, err := VerifySecondFactor(r.Context(), user.ID, code)
+	if err != nil {
+		return false, 0, err
+	}
+	if limits != nil {
+		if valid {
+			limits.PasswordFailed.Succeed(key)
+		} else {
+			limits.PasswordFailed.Fail(key)
+		}
+	}
+	return valid, 0, nil
+}
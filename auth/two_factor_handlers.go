@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// TwoFactorCodeRequest carries a TOTP or recovery code
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// TwoFactorPageData holds data for the second login step page
+type TwoFactorPageData struct {
+	AppName    string
+	PageTitle  string
+	AppVersion string
+	CSRFToken  string
+	Enroll     bool // Show the setup steps instead of asking for a code
+}
+
+// HandleTwoFactorPage renders the second login step, or 2FA setup when policy requires it
+func HandleTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	_, enroll, err := pendingTwoFactorUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login?error=session_expired", http.StatusSeeOther)
+		return
+	}
+
+	data := TwoFactorPageData{
+		AppName:    common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
+		PageTitle:  "Two-Factor Authentication - " + common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
+		AppVersion: common.GetEnvOrDefault("APP_VERSION", "1.0.0.0"),
+		CSRFToken:  CSRFToken(r.Context()),
+		Enroll:     enroll,
+	}
+	if err := authTemplates.ExecuteTemplate(w, "login-2fa.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleTwoFactorVerify completes a login with a TOTP or recovery code
+func HandleTwoFactorVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, enroll, err := pendingTwoFactorUser(r)
+	if err != nil || enroll {
+		SendJSONResponse(w, false, "Your login has expired. Please login again.", nil, "/login")
+		return
+	}
+
+	var req TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		SendJSONResponse(w, false, "Authentication code is required", nil, "")
+		return
+	}
+
+	valid, wait, err := checkSecondFactor(r, user, req.Code)
+	if wait > 0 {
+		SendRateLimited(w, wait)
+		return
+	}
+	if err != nil {
+		log.Printf("Second factor check failed for user %d: %v", user.ID, err)
+		SendJSONResponse(w, false, "Failed to verify code", nil, "")
+		return
+	}
+	if !valid {
+		log.Printf("Invalid second factor for user %d", user.ID)
+		SendJSONResponse(w, false, "Invalid authentication code", nil, "")
+		return
+	}
+
+	ClearTwoFactorCookie(w)
+	startSession(w, r, user, "Login successful", nil)
+}
+
+// HandleTwoFactorLoginSetup starts the 2FA setup that policy requires before a login can complete
+func HandleTwoFactorLoginSetup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, enroll, err := pendingTwoFactorUser(r)
+	if err != nil || !enroll {
+		SendJSONResponse(w, false, "Your login has expired. Please login again.", nil, "/login")
+		return
+	}
+
+	secret, uri, err := BeginTwoFactorEnrolment(r.Context(), user)
+	if err != nil {
+		log.Printf("Failed to start two-factor setup for user %d: %v", user.ID, err)
+		SendJSONResponse(w, false, "Failed to start two-factor setup", nil, "")
+		return
+	}
+	SendJSONResponse(w, true, "", map[string]string{"secret": secret, "uri": uri}, "")
+}
+
+// HandleTwoFactorLoginEnable finishes the required 2FA setup and completes the login
+func HandleTwoFactorLoginEnable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, enroll, err := pendingTwoFactorUser(r)
+	if err != nil || !enroll {
+		SendJSONResponse(w, false, "Your login has expired. Please login again.", nil, "/login")
+		return
+	}
+	if ok, wait := getAuthLimits().AllowOTPVerify(ClientIP(r)); !ok {
+		SendRateLimited(w, wait)
+		return
+	}
+
+	var req TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		SendJSONResponse(w, false, "Authentication code is required", nil, "")
+		return
+	}
+	codes, err := FinishTwoFactorEnrolment(r.Context(), user, req.Code)
+	if err != nil {
+		log.Printf("Failed to enable two-factor for user %d: %v", user.ID, err)
+		SendJSONResponse(w, false, twoFactorErrorMessage(err), nil, "")
+		return
+	}
+
+	ClearTwoFactorCookie(w)
+	startSession(w, r, user, "Two-factor authentication enabled", map[string][]string{"recovery_codes": codes})
+}
+
+// HandleTwoFactorStatusAPI returns whether the current user has 2FA enabled
+func HandleTwoFactorStatusAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return
+	}
+	enrolment, err := getTwoFactorStore().Get(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Error loading two-factor status for user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to load two-factor status", http.StatusInternalServerError)
+		return
+	}
+	_, required, err := twoFactorStatus(r.Context(), user)
+	if err != nil {
+		log.Printf("Error loading two-factor policy: %v", err)
+		common.JSONError(w, "Failed to load two-factor status", http.StatusInternalServerError)
+		return
+	}
+
+	status := map[string]interface{}{"enabled": false, "recovery_codes_left": 0, "required": required}
+	if enrolment != nil && enrolment.Enabled {
+		status["enabled"] = true
+		status["recovery_codes_left"] = enrolment.RecoveryCodesLeft
+	}
+	common.JSONResponse(w, status)
+}
+
+// HandleTwoFactorSetupAPI creates a pending TOTP secret for the current user (POST)
+func HandleTwoFactorSetupAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret, uri, err := BeginTwoFactorEnrolment(r.Context(), user)
+	if errors.Is(err, ErrTwoFactorEnabled) {
+		common.JSONError(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting two-factor setup for user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to start two-factor setup", http.StatusInternalServerError)
+		return
+	}
+	common.JSONResponse(w, map[string]string{"secret": secret, "uri": uri})
+}
+
+// HandleTwoFactorEnableAPI enables 2FA with the first code from the user's app and returns recovery codes (POST {code})
+func HandleTwoFactorEnableAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return
+	}
+	var req TwoFactorCodeRequest
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.Code == "" {
+		common.JSONError(w, "Authentication code is required", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := FinishTwoFactorEnrolment(r.Context(), user, req.Code)
+	if err != nil {
+		log.Printf("Error enabling two-factor for user %d: %v", user.ID, err)
+		common.JSONError(w, twoFactorErrorMessage(err), http.StatusBadRequest)
+		return
+	}
+	common.JSONResponse(w, map[string]interface{}{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// HandleTwoFactorDisableAPI turns 2FA off after checking a current code (POST {code})
+func HandleTwoFactorDisableAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	if _, required, err := twoFactorStatus(r.Context(), user); err != nil || required {
+		common.JSONError(w, "Two-factor authentication is required for administrators", http.StatusForbidden)
+		return
+	}
+
+	if err := DisableTwoFactor(r.Context(), user.ID); err != nil {
+		log.Printf("Error disabling two-factor for user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d disabled two-factor authentication", user.ID)
+	common.JSONResponse(w, map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// HandleRecoveryCodesAPI replaces the recovery codes after checking a current code (POST {code})
+func HandleRecoveryCodesAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	codes, err := RegenerateRecoveryCodes(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Error regenerating recovery codes for user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	common.JSONResponse(w, map[string]interface{}{"message": "New recovery codes created", "recovery_codes": codes})
+}
+
+// requireInstanceAccount returns the logged-in user when it is an ai.users account and writes the error response otherwise.
+// Two-factor enrolments and API tokens are keyed by ai.users IDs, so project directory accounts cannot use them.
+func requireInstanceAccount(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user := GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if user.ProjectID != 0 {
+		common.JSONError(w, "Not available for project accounts", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// requireSecondFactor checks the code posted with a sensitive 2FA change and writes the error response when it fails
+func requireSecondFactor(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return nil, false
+	}
+	var req TwoFactorCodeRequest
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.Code == "" {
+		common.JSONError(w, "Authentication code is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	valid, wait, err := checkSecondFactor(r, user, req.Code)
+	switch {
+	case wait > 0:
+		SendRateLimited(w, wait)
+	case err != nil:
+		log.Printf("Second factor check failed for user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to verify code", http.StatusInternalServerError)
+	case !valid:
+		common.JSONError(w, "Invalid authentication code", http.StatusBadRequest)
+	default:
+		return user, true
+	}
+	return nil, false
+}
+
+// HandleTwoFactorPolicy reads (GET) or changes (POST {required}) whether admins must use 2FA
+func HandleTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := getTwoFactorPolicy()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Required bool `json:"required"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			common.JSONError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := policy.SetAdminTwoFactorRequired(r.Context(), req.Required); err != nil {
+			log.Printf("Error updating two-factor policy: %v", err)
+			common.JSONError(w, "Failed to update two-factor policy: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if admin := GetUserFromContext(r.Context()); admin != nil {
+			log.Printf("Admin %s set two-factor required for admins to %t", admin.Email, req.Required)
+		}
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	required, err := policy.AdminTwoFactorRequired(r.Context())
+	if err != nil {
+		log.Printf("Error reading two-factor policy: %v", err)
+		common.JSONError(w, "Failed to read two-factor policy", http.StatusInternalServerError)
+		return
+	}
+	common.JSONResponse(w, map[string]bool{"required": required})
+}
+
+// twoFactorErrorMessage returns the message shown for an enrolment error
+func twoFactorErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidTwoFactorCode):
+		return "Invalid authentication code"
+	case errors.Is(err, ErrTwoFactorEnabled):
+		return "Two-factor authentication is already enabled"
+	default:
+		return "Failed to enable two-factor authentication"
+	}
+}
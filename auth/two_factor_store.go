@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// TwoFactor is a user's TOTP enrolment
+type TwoFactor struct {
+	UserID            int
+	Secret            string // Base32 TOTP secret
+	Enabled           bool   // False while enrolment waits for the first code
+	LastStep          int64  // Last accepted time step
+	RecoveryCodesLeft int
+}
+
+// TwoFactorStore keeps TOTP secrets and hashed recovery codes.
+type TwoFactorStore interface {
+	// Get returns the enrolment of a user, or nil when there is none.
+	Get(ctx context.Context, userID int) (*TwoFactor, error)
+	// SavePending stores a new secret that is not enabled yet. It reports false when 2FA is already enabled.
+	SavePending(ctx context.Context, userID int, secret string) (bool, error)
+	// Enable turns on a pending enrolment with its first accepted step and recovery codes.
+	Enable(ctx context.Context, userID int, step int64, recoveryHashes []string) (bool, error)
+	// UseStep records an accepted step if it is newer than the last one and reports whether it was.
+	UseStep(ctx context.Context, userID int, step int64) (bool, error)
+	// ReplaceRecoveryCodes replaces all recovery codes of a user.
+	ReplaceRecoveryCodes(ctx context.Context, userID int, recoveryHashes []string) error
+	// UseRecoveryCode marks an unused recovery code as used and reports whether there was one.
+	UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error)
+	// Delete removes the enrolment and recovery codes of a user.
+	Delete(ctx context.Context, userID int) error
+}
+
+// memoryTwoFactorStore keeps enrolments in process memory, for tests and running without a database
+type memoryTwoFactorStore struct {
+	mu            sync.Mutex
+	enrolments    map[int]TwoFactor
+	recoveryCodes map[int]map[string]bool // Hash to used
+}
+
+// NewMemoryTwoFactorStore creates an in-process two-factor store
+func NewMemoryTwoFactorStore() TwoFactorStore {
+	return &memoryTwoFactorStore{enrolments: make(map[int]TwoFactor), recoveryCodes: make(map[int]map[string]bool)}
+}
+
+func (s *memoryTwoFactorStore) Get(ctx context.Context, userID int) (*TwoFactor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enrolment, ok := s.enrolments[userID]
+	if !ok {
+		return nil, nil
+	}
+	enrolment.RecoveryCodesLeft = 0
+	for _, used := range s.recoveryCodes[userID] {
+		if !used {
+			enrolment.RecoveryCodesLeft++
+		}
+	}
+	return &enrolment, nil
+}
+
+func (s *memoryTwoFactorStore) SavePending(ctx context.Context, userID int, secret string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enrolments[userID].Enabled {
+		return false, nil
+	}
+	s.enrolments[userID] = TwoFactor{UserID: userID, Secret: secret}
+	return true, nil
+}
+
+func (s *memoryTwoFactorStore) Enable(ctx context.Context, userID int, step int64, recoveryHashes []string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enrolment, ok := s.enrolments[userID]
+	if !ok || enrolment.Enabled {
+		return false, nil
+	}
+	enrolment.Enabled = true
+	enrolment.LastStep = step
+	s.enrolments[userID] = enrolment
+	s.setRecoveryCodes(userID, recoveryHashes)
+	return true, nil
+}
+
+func (s *memoryTwoFactorStore) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enrolment, ok := s.enrolments[userID]
+	if !ok || step <= enrolment.LastStep {
+		return false, nil
+	}
+	enrolment.LastStep = step
+	s.enrolments[userID] = enrolment
+	return true, nil
+}
+
+func (s *memoryTwoFactorStore) ReplaceRecoveryCodes(ctx context.Context, userID int, recoveryHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setRecoveryCodes(userID, recoveryHashes)
+	return nil
+}
+
+// setRecoveryCodes replaces the codes of a user; the caller holds the lock
+func (s *memoryTwoFactorStore) setRecoveryCodes(userID int, recoveryHashes []string) {
+	codes := make(map[string]bool, len(recoveryHashes))
+	for _, hash := range recoveryHashes {
+		codes[hash] = false
+	}
+	s.recoveryCodes[userID] = codes
+}
+
+func (s *memoryTwoFactorStore) UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, ok := s.recoveryCodes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	s.recoveryCodes[userID][hash] = true
+	return true, nil
+}
+
+func (s *memoryTwoFactorStore) Delete(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.enrolments, userID)
+	delete(s.recoveryCodes, userID)
+	return nil
+}
+
+// postgresTwoFactorStore keeps enrolments in ai.user_totp, with secrets encrypted, and codes in ai.user_recovery_codes
+type postgresTwoFactorStore struct {
+	db *sql.DB
+}
+
+// NewPostgresTwoFactorStore creates a two-factor store backed by the database
+func NewPostgresTwoFactorStore(db *sql.DB) TwoFactorStore {
+	return &postgresTwoFactorStore{db: db}
+}
+
+func (s *postgresTwoFactorStore) Get(ctx context.Context, userID int) (*TwoFactor, error) {
+	enrolment := TwoFactor{UserID: userID}
+	var encrypted string
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("two_factor/get"), userID).
+		Scan(&encrypted, &enrolment.Enabled, &enrolment.LastStep, &enrolment.RecoveryCodesLeft)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enrolment.Secret, err = decryptTOTPSecret(encrypted); err != nil {
+		return nil, err
+	}
+	return &enrolment, nil
+}
+
+func (s *postgresTwoFactorStore) SavePending(ctx context.Context, userID int, secret string) (bool, error) {
+	encrypted, err := encryptTOTPSecret(secret)
+	if err != nil {
+		return false, err
+	}
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("two_factor/save_pending"), userID, encrypted)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresTwoFactorStore) Enable(ctx context.Context, userID int, step int64, recoveryHashes []string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, common.MustGetSQL("two_factor/enable"), userID, step)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryHashes); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *postgresTwoFactorStore) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("two_factor/use_step"), userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresTwoFactorStore) ReplaceRecoveryCodes(ctx context.Context, userID int, recoveryHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and inserts new ones within tx
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, recoveryHashes []string) error {
+	if _, err := tx.ExecContext(ctx, common.MustGetSQL("two_factor/delete_recovery_codes"), userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		if _, err := tx.ExecContext(ctx, common.MustGetSQL("two_factor/insert_recovery_code"), userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *postgresTwoFactorStore) UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("two_factor/use_recovery_code"), userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresTwoFactorStore) Delete(ctx context.Context, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, common.MustGetSQL("two_factor/delete_recovery_codes"), userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, common.MustGetSQL("two_factor/delete"), userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var (
+	twoFactorStore      = NewMemoryTwoFactorStore() // Replaced with the Postgres store once the database is up
+	twoFactorStoreMutex = &sync.Mutex{}
+)
+
+// SetTwoFactorStore replaces the store used for TOTP enrolments
+func SetTwoFactorStore(store TwoFactorStore) {
+	twoFactorStoreMutex.Lock()
+	defer twoFactorStoreMutex.Unlock()
+	twoFactorStore = store
+}
+
+// getTwoFactorStore returns the current two-factor store
+func getTwoFactorStore() TwoFactorStore {
+	twoFactorStoreMutex.Lock()
+	defer twoFactorStoreMutex.Unlock()
+	return twoFactorStore
+}
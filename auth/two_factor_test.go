@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useMemoryTwoFactorStore installs a fresh in-memory 2FA store for the duration of a test
+func useMemoryTwoFactorStore(t *testing.T) TwoFactorStore {
+	previous := getTwoFactorStore()
+	store := NewMemoryTwoFactorStore()
+	SetTwoFactorStore(store)
+	t.Cleanup(func() { SetTwoFactorStore(previous) })
+	return store
+}
+
+// enableTwoFactor enrols a user and returns their secret and recovery codes
+func enableTwoFactor(t *testing.T, user *User) (string, []string) {
+	secret, _, err := BeginTwoFactorEnrolment(context.Background(), user)
+	if err != nil {
+		t.Fatalf("Failed to begin enrolment: %v", err)
+	}
+	// Use the previous step so the current code is still unused for the test itself
+	code, _ := TOTPCode(secret, time.Now().Add(-totpPeriod*time.Second))
+	codes, err := FinishTwoFactorEnrolment(context.Background(), user, code)
+	if err != nil {
+		t.Fatalf("Failed to finish enrolment: %v", err)
+	}
+	return secret, codes
+}
+
+// TestTOTPCode tests code generation against the RFC 6238 SHA-1 test vectors
+func TestTOTPCode(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // base32 of "12345678901234567890"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		got, err := TOTPCode(secret, time.Unix(unix, 0))
+		if err != nil || got != want {
+			t.Errorf("TOTPCode at %d: expected %s, got %s (%v)", unix, want, got, err)
+		}
+	}
+
+	// Codes from the neighbouring steps are accepted for clock skew, but not further away
+	now := time.Unix(1111111109, 0)
+	previous, _ := TOTPCode(secret, now.Add(-30*time.Second))
+	if _, ok := ValidateTOTP(secret, previous, now, 0); !ok {
+		t.Error("Expected the previous step's code to be accepted")
+	}
+	old, _ := TOTPCode(secret, now.Add(-90*time.Second))
+	if _, ok := ValidateTOTP(secret, old, now, 0); ok {
+		t.Error("Expected a code three steps old to be rejected")
+	}
+}
+
+// TestVerifySecondFactor tests that TOTP and recovery codes are each accepted only once
+func TestVerifySecondFactor(t *testing.T) {
+	useMemoryTwoFactorStore(t)
+	ctx := context.Background()
+	user := &User{ID: 11, Email: "totp@example.com"}
+	secret, recovery := enableTwoFactor(t, user)
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(recovery))
+	}
+
+	if _, _, err := BeginTwoFactorEnrolment(ctx, user); err != ErrTwoFactorEnabled {
+		t.Errorf("Expected re-enrolling to be refused, got %v", err)
+	}
+
+	code, _ := TOTPCode(secret, time.Now())
+	if ok, err := VerifySecondFactor(ctx, user.ID, code); !ok || err != nil {
+		t.Fatalf("Expected the current code to be accepted, got %v, %v", ok, err)
+	}
+	if ok, _ := VerifySecondFactor(ctx, user.ID, code); ok {
+		t.Error("Expected a replayed code to be rejected")
+	}
+
+	if ok, err := VerifySecondFactor(ctx, user.ID, strings.ToUpper(recovery[0])); !ok || err != nil {
+		t.Fatalf("Expected a recovery code to be accepted, got %v, %v", ok, err)
+	}
+	if ok, _ := VerifySecondFactor(ctx, user.ID, recovery[0]); ok {
+		t.Error("Expected a used recovery code to be rejected")
+	}
+	if ok, _ := VerifySecondFactor(ctx, 12, recovery[1]); ok {
+		t.Error("Expected a recovery code to only work for its own user")
+	}
+
+	enrolment, _ := getTwoFactorStore().Get(ctx, user.ID)
+	if enrolment.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Errorf("Expected %d recovery codes left, got %d", recoveryCodeCount-1, enrolment.RecoveryCodesLeft)
+	}
+}
+
+// passwordUserService accepts every password for its user
+type passwordUserService struct {
+	UserServicer
+	user *User
+}
+
+func (s passwordUserService) VerifyPassword(ctx context.Context, email, password string) (*User, error) {
+	return s.user, nil
+}
+
+func (passwordUserService) UpdateUserLastLogin(ctx context.Context, userID int) error {
+	return nil
+}
+
+// TestLoginWithSecondFactor tests that password login stops at the second step until a valid code is posted
+func TestLoginWithSecondFactor(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryTwoFactorStore(t)
+	user := &User{ID: 21, Email: "second-factor@example.com"}
+	secret, _ := enableTwoFactor(t, user)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/password-login", strings.NewReader(`{"email":"second-factor@example.com","password":"secret"}`))
+	rec := httptest.NewRecorder()
+	HandlePasswordLogin(rec, req, passwordUserService{user: user})
+
+	var resp JSONResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || !resp.Success || resp.Redirect != "/login/2fa" {
+		t.Fatalf("Expected a redirect to the second step, got %+v, %v", resp, err)
+	}
+	var pending *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == GetSessionCookieName() && cookie.Value != "" {
+			t.Fatal("Expected no session before the second factor")
+		}
+		if cookie.Name == GetTwoFactorCookieName() {
+			pending = cookie
+		}
+	}
+	if pending == nil {
+		t.Fatal("Expected a pending two-factor cookie")
+	}
+
+	// The pending token does not work as a session
+	if _, err := ValidateJWT(pending.Value); err == nil {
+		t.Error("Expected the pending token to be rejected as a session token")
+	}
+
+	verify := func(code string) JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/auth/2fa/verify", strings.NewReader(`{"code":"`+code+`"}`))
+		req.AddCookie(pending)
+		rec := httptest.NewRecorder()
+		HandleTwoFactorVerify(rec, req)
+		var resp JSONResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+
+	if resp := verify("000000"); resp.Success {
+		t.Fatal("Expected a wrong code to be rejected")
+	}
+	code, _ := TOTPCode(secret, time.Now())
+	if resp := verify(code); !resp.Success || resp.Redirect != "/" {
+		t.Fatalf("Expected login to complete, got %+v", resp)
+	}
+	if sessions, _ := ListUserSessions(context.Background(), 0, user.ID); len(sessions) != 1 {
+		t.Errorf("Expected one session after the second factor, got %d", len(sessions))
+	}
+}
+
+// TestAdminTwoFactorRequired tests that admins without 2FA are sent to set it up when policy requires it
+func TestAdminTwoFactorRequired(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryTwoFactorStore(t)
+	t.Setenv("AUTH_REQUIRE_ADMIN_2FA", "1")
+	admin := &User{ID: 31, Email: "admin-2fa@example.com", IsAdmin: true}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/password-login", strings.NewReader(`{"email":"admin-2fa@example.com","password":"secret"}`))
+	rec := httptest.NewRecorder()
+	HandlePasswordLogin(rec, req, passwordUserService{user: admin})
+
+	var resp struct {
+		JSONResponse
+		Data map[string]bool `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Redirect != "/login/2fa" || !resp.Data["enroll"] {
+		t.Fatalf("Expected the admin to be sent to 2FA setup, got %+v, %v", resp, err)
+	}
+
+	// The same login for a regular user goes straight through
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/auth/password-login", strings.NewReader(`{"email":"user-2fa@example.com","password":"secret"}`))
+	HandlePasswordLogin(rec, req, passwordUserService{user: &User{ID: 32, Email: "user-2fa@example.com"}})
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Redirect != "/" {
+		t.Errorf("Expected a regular user to log in without 2FA, got %+v, %v", resp, err)
+	}
+}
@@ -23,11 +23,18 @@ type UserServicer interface {
 	// MakeUserAdmin grants admin privileges to a user.
 	MakeUserAdmin(ctx context.Context, userID int) error
 
+	// GetUserByID retrieves a user by ID, checking project context first.
+	GetUserByID(ctx context.Context, userID int) (*User, error)
+
 	// --- Profile Methods ---
 	// UpdatePasswordHash updates the user's password hash after verification.
 	UpdatePasswordHash(ctx context.Context, userID int, newHash string) error
-
-	// TODO: Add methods for profile updates (Name, Password, Icon) when database schema supports them
+	// UpdateProfile updates the display name, timezone and locale of an ai.users account.
+	UpdateProfile(ctx context.Context, userID int, profile Profile) error
+	// GetAvatar returns the uploaded avatar of an ai.users account, or nil when it has none.
+	GetAvatar(ctx context.Context, userID int) (*Avatar, error)
+	// SetAvatar stores the avatar of an ai.users account, or removes it when avatar is nil.
+	SetAvatar(ctx context.Context, userID int, avatar *Avatar) error
 }
 
 // User represents a user in the system
@@ -38,22 +45,46 @@ type User struct {
 	IsAdmin      bool      `json:"is_admin" db:"is_admin"`
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 	LastLoggedIn time.Time `json:"last_logged_in" db:"last_logged_in"`
+	ProjectID    int64     `json:"project_id,omitempty"` // Project whose user directory holds the account; 0 for ai.users accounts
+	DisplayName  string    `json:"display_name,omitempty" db:"display_name"`
+	Timezone     string    `json:"timezone,omitempty" db:"timezone"`
+	Locale       string    `json:"locale,omitempty" db:"locale"`
+	AvatarURL    string    `json:"avatar_url,omitempty"`   // Filled in by SetUserContext, see AvatarURL
+	Impersonator *User     `json:"impersonator,omitempty"` // Admin acting as this user, set while impersonating
 }
 
-// OTPData stores information about an OTP
+// OTPData stores information about a pending OTP. Only a hash of the code is kept.
 type OTPData struct {
 	Email     string
-	OTP       string
+	CodeHash  string
 	ExpiresAt time.Time
 	Attempts  int
+	IP        string // Address of the client that requested the code
+	CreatedAt time.Time
 }
 
-// Session represents a user session
+// Session is a login on one device. Its ID is the jti of the access tokens issued for it;
+// the refresh token is only stored as a hash.
 type Session struct {
-	Token     string
-	User      *User
-	CreatedAt time.Time
-	ExpiresAt time.Time
+	ID              string     `json:"id"`
+	UserID          int        `json:"user_id"`
+	Email           string     `json:"email"`
+	IsAdmin         bool       `json:"is_admin"`
+	ProjectID       int64      `json:"project_id,omitempty"` // User directory of the account, see User.ProjectID
+	RefreshHash     string     `json:"-"`
+	PrevRefreshHash string     `json:"-"` // Accepted briefly after rotation for concurrent requests
+	IP              string     `json:"ip"`
+	UserAgent       string     `json:"user_agent"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastSeenAt      time.Time  `json:"last_seen_at"`
+	RotatedAt       time.Time  `json:"-"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the session can still be used at the given time
+func (s *Session) Active(now time.Time) bool {
+	return s != nil && s.RevokedAt == nil && now.Before(s.ExpiresAt)
 }
 
 // --- Structs from handlers.go ---
@@ -82,3 +113,15 @@ type OTPVerifyRequest struct {
 // userCtxKey is the key used for storing user in request context
 // Making it private ensures it's only used within this package
 type userCtxKey struct{}
+
+// sessionCtxKey is the key used for storing the current session ID in request context
+type sessionCtxKey struct{}
+
+// apiTokenCtxKey is the key used for storing the API token a request was authenticated with
+type apiTokenCtxKey struct{}
+
+// accountProjectCtxKey is the key used for storing the project whose user directory serves the request's host
+type accountProjectCtxKey struct{}
+
+// impersonationCtxKey is the key used for storing the ID of the impersonation a request is made in
+type impersonationCtxKey struct{}
@@ -0,0 +1,553 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebAuthn (passkey) registration and assertion ceremonies. Attestation is not requested, so
+// registrations prove possession of the key but not the authenticator model.
+
+// webauthnTimeout is how long the browser waits for the user, and how long a challenge stays valid
+const webauthnTimeout = 5 * time.Minute
+
+// maxCredentialIDLength is the longest credential ID accepted (WebAuthn section 7.1)
+const maxCredentialIDLength = 1023
+
+// Ceremony types, as sent in the client data
+const (
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+)
+
+// COSE algorithms of the supported credential public keys
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// Authenticator data flags
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+	authDataExtensions   = 0x80
+)
+
+var (
+	// ErrWebAuthnChallenge is returned for unknown, expired and already answered challenges
+	ErrWebAuthnChallenge = errors.New("unknown or expired passkey challenge")
+	// ErrWebAuthnCredentialExists is returned when registering a credential that is already stored
+	ErrWebAuthnCredentialExists = errors.New("this passkey is already registered")
+	// ErrWebAuthnUnknownCredential is returned when logging in with a credential that is not stored
+	ErrWebAuthnUnknownCredential = errors.New("unknown passkey")
+)
+
+// RelyingParty is the WebAuthn relying party of a host. Credentials are scoped to its ID, a domain,
+// and ceremonies are only accepted from its origins.
+type RelyingParty struct {
+	ID      string   `json:"rp_id,omitempty"`   // Default: the request's host name
+	Name    string   `json:"rp_name,omitempty"` // Shown by authenticators; default APP_NAME
+	Origins []string `json:"origins,omitempty"` // Default: the request's scheme and host
+}
+
+// WebAuthnRPSource selects the relying party for a request's host
+type WebAuthnRPSource interface {
+	RelyingParty(r *http.Request) (*RelyingParty, error)
+}
+
+// envWebAuthnRP reads the relying party from WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME and WEBAUTHN_ORIGINS
+type envWebAuthnRP struct{}
+
+func (envWebAuthnRP) RelyingParty(r *http.Request) (*RelyingParty, error) {
+	return InstanceRelyingParty(r), nil
+}
+
+// InstanceRelyingParty returns the relying party configured for the whole instance, completed from the request
+func InstanceRelyingParty(r *http.Request) *RelyingParty {
+	rp := RelyingParty{ID: getEnv("WEBAUTHN_RP_ID"), Name: getEnv("WEBAUTHN_RP_NAME")}
+	for _, origin := range strings.Split(getEnv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			rp.Origins = append(rp.Origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return RequestRelyingParty(r, rp)
+}
+
+// RequestRelyingParty fills in the unset fields of a relying party from the request
+func RequestRelyingParty(r *http.Request, rp RelyingParty) *RelyingParty {
+	if rp.ID == "" {
+		rp.ID = (&url.URL{Host: r.Host}).Hostname()
+	}
+	if rp.Name == "" {
+		rp.Name = getEnv("APP_NAME")
+	}
+	if rp.Name == "" {
+		rp.Name = "OpenAgent"
+	}
+	if len(rp.Origins) == 0 {
+		if origin, err := RequestBaseURL(r); err == nil {
+			rp.Origins = []string{origin}
+		}
+	}
+	return &rp
+}
+
+var (
+	webauthnRPSource      WebAuthnRPSource = envWebAuthnRP{}
+	webauthnRPSourceMutex                  = &sync.Mutex{}
+)
+
+// SetWebAuthnRPSource replaces where the relying party of a request is read from
+func SetWebAuthnRPSource(source WebAuthnRPSource) {
+	webauthnRPSourceMutex.Lock()
+	defer webauthnRPSourceMutex.Unlock()
+	webauthnRPSource = source
+}
+
+// getWebAuthnRPSource returns the current relying party source
+func getWebAuthnRPSource() WebAuthnRPSource {
+	webauthnRPSourceMutex.Lock()
+	defer webauthnRPSourceMutex.Unlock()
+	return webauthnRPSource
+}
+
+// Base64URL is binary data that JSON carries as unpadded base64url, as WebAuthn's JSON forms do
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// rpEntity and userEntity describe the relying party and the account to the authenticator
+type rpEntity struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+// credentialParameter is an accepted key type
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// credentialDescriptor names an existing credential
+type credentialDescriptor struct {
+	Type       string    `json:"type"`
+	ID         Base64URL `json:"id"`
+	Transports []string  `json:"transports,omitempty"`
+}
+
+// authenticatorSelection asks for a discoverable credential, so it can be offered without an email
+type authenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// creationOptions are the options for navigator.credentials.create, in WebAuthn's JSON form
+type creationOptions struct {
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	Challenge              Base64URL              `json:"challenge"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// requestOptions are the options for navigator.credentials.get. They allow any discoverable
+// credential of the relying party, which also makes them usable for conditional UI.
+type requestOptions struct {
+	Challenge        Base64URL              `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// webauthnCredentialJSON is a PublicKeyCredential from the browser, from a registration or a login
+type webauthnCredentialJSON struct {
+	ID       string    `json:"id"`
+	RawID    Base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64URL `json:"clientDataJSON"`
+		AttestationObject Base64URL `json:"attestationObject,omitempty"` // Registration
+		Transports        []string  `json:"transports,omitempty"`        // Registration
+		AuthenticatorData Base64URL `json:"authenticatorData,omitempty"` // Login
+		Signature         Base64URL `json:"signature,omitempty"`         // Login
+		UserHandle        Base64URL `json:"userHandle,omitempty"`        // Login
+	} `json:"response"`
+}
+
+// collectedClientData is the client data the browser signs over
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// authenticatorData is the parsed authenticator data of a registration or login
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte // Registration only
+	PublicKey    []byte // COSE key, registration only
+}
+
+// webauthnUserHandle is the user ID given to authenticators; it names the account without personal data
+func webauthnUserHandle(userID int) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+// newWebAuthnChallenge creates and stores a challenge for a ceremony
+func newWebAuthnChallenge(ctx context.Context, ceremony, rpID string, userID int) (Base64URL, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	err := getWebAuthnStore().SaveChallenge(ctx, WebAuthnChallenge{
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Ceremony:  ceremony,
+		RPID:      rpID,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(webauthnTimeout),
+	})
+	return challenge, err
+}
+
+// beginRegistration returns the options to create a passkey for the user
+func beginRegistration(ctx context.Context, rp *RelyingParty, user *User) (*creationOptions, error) {
+	existing, err := getWebAuthnStore().ListCredentials(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := newWebAuthnChallenge(ctx, ceremonyCreate, rp.ID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	displayName := user.DisplayName
+	if displayName == "" {
+		displayName = user.Email
+	}
+	options := &creationOptions{
+		RP:        rpEntity{ID: rp.ID, Name: rp.Name},
+		User:      userEntity{ID: webauthnUserHandle(user.ID), Name: user.Email, DisplayName: displayName},
+		Challenge: challenge,
+		PubKeyCredParams: []credentialParameter{
+			{Type: "public-key", Alg: coseES256},
+			{Type: "public-key", Alg: coseEdDSA},
+			{Type: "public-key", Alg: coseRS256},
+		},
+		Timeout:                webauthnTimeout.Milliseconds(),
+		ExcludeCredentials:     []credentialDescriptor{},
+		AuthenticatorSelection: authenticatorSelection{ResidentKey: "required", RequireResidentKey: true, UserVerification: "preferred"},
+		Attestation:            "none",
+	}
+	for _, credential := range existing {
+		if credential.RPID == rp.ID {
+			options.ExcludeCredentials = append(options.ExcludeCredentials,
+				credentialDescriptor{Type: "public-key", ID: credential.CredentialID, Transports: credential.Transports})
+		}
+	}
+	return options, nil
+}
+
+// finishRegistration verifies a new credential for the user and stores it
+func finishRegistration(ctx context.Context, rp *RelyingParty, user *User, name string, response *webauthnCredentialJSON) (*WebAuthnCredential, error) {
+	if _, err := verifyClientData(ctx, rp, response.Response.ClientDataJSON, ceremonyCreate, user.ID); err != nil {
+		return nil, err
+	}
+
+	attestation, err := cborMap(response.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := authData.check(rp); err != nil {
+		return nil, err
+	}
+	if authData.Flags&authDataAttested == 0 {
+		return nil, errors.New("registration has no attested credential")
+	}
+	if !bytes.Equal(authData.CredentialID, response.RawID) {
+		return nil, errors.New("credential ID does not match the attested credential")
+	}
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return nil, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	credential := &WebAuthnCredential{
+		UserID:       user.ID,
+		RPID:         rp.ID,
+		CredentialID: authData.CredentialID,
+		PublicKey:    authData.PublicKey,
+		SignCount:    authData.SignCount,
+		Transports:   response.Response.Transports,
+		Name:         name,
+	}
+	if err := getWebAuthnStore().CreateCredential(ctx, credential); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// beginLogin returns the options to log in with any passkey of the relying party
+func beginLogin(ctx context.Context, rp *RelyingParty) (*requestOptions, error) {
+	challenge, err := newWebAuthnChallenge(ctx, ceremonyGet, rp.ID, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &requestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          webauthnTimeout.Milliseconds(),
+		AllowCredentials: []credentialDescriptor{},
+		UserVerification: "preferred",
+	}, nil
+}
+
+// finishLogin verifies a login assertion and returns the credential used and whether the
+// authenticator verified the user, with a PIN or biometric
+func finishLogin(ctx context.Context, rp *RelyingParty, response *webauthnCredentialJSON) (*WebAuthnCredential, bool, error) {
+	clientDataHash, err := verifyClientData(ctx, rp, response.Response.ClientDataJSON, ceremonyGet, 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	store := getWebAuthnStore()
+	credential, err := store.GetCredential(ctx, rp.ID, response.RawID)
+	if err != nil {
+		return nil, false, err
+	}
+	if credential == nil {
+		return nil, false, ErrWebAuthnUnknownCredential
+	}
+	if len(response.Response.UserHandle) > 0 && !bytes.Equal(response.Response.UserHandle, webauthnUserHandle(credential.UserID)) {
+		return nil, false, errors.New("user handle does not match the passkey")
+	}
+
+	rawAuthData := response.Response.AuthenticatorData
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := authData.check(rp); err != nil {
+		return nil, false, err
+	}
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash...)
+	if err := verifyCOSESignature(credential.PublicKey, signed, response.Response.Signature); err != nil {
+		return nil, false, err
+	}
+
+	// A counter that does not grow means the key may have been cloned; authenticators without a counter always send 0
+	ok, err := store.UseCredential(ctx, credential.ID, authData.SignCount, time.Now())
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, fmt.Errorf("signature counter of passkey %d went back from %d to %d", credential.ID, credential.SignCount, authData.SignCount)
+	}
+	credential.SignCount = authData.SignCount
+	return credential, authData.Flags&authDataUserVerified != 0, nil
+}
+
+// verifyClientData checks the client data of a ceremony and uses up its challenge.
+// It returns the hash of the client data, which logins sign over.
+func verifyClientData(ctx context.Context, rp *RelyingParty, raw []byte, ceremony string, userID int) ([]byte, error) {
+	var clientData collectedClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return nil, fmt.Errorf("invalid client data: %w", err)
+	}
+
+	// Challenges are taken first, so any refused answer uses them up
+	challenge, err := getWebAuthnStore().TakeChallenge(ctx, clientData.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil || challenge.Ceremony != ceremony || challenge.RPID != rp.ID || challenge.UserID != userID || !time.Now().Before(challenge.ExpiresAt) {
+		return nil, ErrWebAuthnChallenge
+	}
+	if clientData.Type != ceremony {
+		return nil, fmt.Errorf("client data is for %q, not %q", clientData.Type, ceremony)
+	}
+	if clientData.CrossOrigin {
+		return nil, errors.New("cross-origin passkey ceremonies are not accepted")
+	}
+	if !containsString(rp.Origins, clientData.Origin) {
+		return nil, fmt.Errorf("origin %q is not an origin of relying party %s", clientData.Origin, rp.ID)
+	}
+	hash := sha256.Sum256(raw)
+	return hash[:], nil
+}
+
+// parseAuthenticatorData parses authenticator data (WebAuthn section 6.1)
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	authData := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if authData.Flags&authDataAttested != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18])) // After the 16-byte AAGUID
+		rest = rest[18:]
+		if idLength == 0 || idLength > maxCredentialIDLength || idLength > len(rest) {
+			return nil, errors.New("invalid credential ID length")
+		}
+		authData.CredentialID, rest = rest[:idLength], rest[idLength:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		authData.PublicKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if authData.Flags&authDataExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authenticator extensions: %w", err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes in authenticator data")
+	}
+	return authData, nil
+}
+
+// check verifies that the authenticator data is for the relying party and that the user was present
+func (d *authenticatorData) check(rp *RelyingParty) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(d.RPIDHash, rpIDHash[:]) {
+		return fmt.Errorf("authenticator data is not for relying party %s", rp.ID)
+	}
+	if d.Flags&authDataUserPresent == 0 {
+		return errors.New("user presence was not confirmed")
+	}
+	return nil
+}
+
+// parseCOSEKey decodes a credential public key (RFC 9053) of one of the supported algorithms
+func parseCOSEKey(raw []byte) (crypto.PublicKey, error) {
+	key, err := cborMap(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	crv, _ := key[int64(-1)].(int64)
+	x, _ := key[int64(-2)].([]byte)
+
+	switch {
+	case kty == 2 && alg == coseES256 && crv == 1: // EC2 on P-256
+		y, _ := key[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 public key")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, errors.New("P-256 public key is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case kty == 1 && alg == coseEdDSA && crv == 6: // OKP with Ed25519
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	case kty == 3 && alg == coseRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA public exponent")
+		}
+		publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if publicKey.N.BitLen() < 2048 {
+			return nil, errors.New("RSA public keys must have at least 2048 bits")
+		}
+		return publicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported credential public key (kty %d, alg %d)", kty, alg)
+}
+
+// verifyCOSESignature checks a signature over data with a credential public key
+func verifyCOSESignature(rawKey, data, signature []byte) error {
+	publicKey, err := parseCOSEKey(rawKey)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	valid := false
+	switch publicKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(publicKey, digest[:], signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(publicKey, data, signature)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return errors.New("invalid passkey signature")
+	}
+	return nil
+}
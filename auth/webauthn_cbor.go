@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The subset of CBOR (RFC 8949) that WebAuthn attestation objects and COSE keys use:
+// definite lengths only, integers, byte and text strings, arrays, maps and simple values
+
+// maxCBORDepth bounds the nesting of decoded items
+const maxCBORDepth = 16
+
+var errCBORMalformed = errors.New("malformed CBOR data")
+
+// decodeCBOR decodes the first item in data and returns it with the bytes that follow it.
+// Integers decode to int64, byte strings to []byte, text to string, arrays to []interface{},
+// maps to map[interface{}]interface{} and simple values to bool or nil.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("CBOR nested deeper than %d", maxCBORDepth)
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORMalformed
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	// Simple values and floats carry their value in the additional information
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("unsupported CBOR simple value %d", info)
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, errCBORMalformed // Indefinite lengths, reserved values or truncated data
+	}
+
+	switch major {
+	case 0, 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer out of range")
+		}
+		if major == 1 {
+			return -1 - int64(arg), data, nil
+		}
+		return int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORMalformed
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return append([]byte(nil), data[:arg]...), data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORMalformed // Every item takes at least one byte
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			var err error
+			if item, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, errCBORMalformed
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			var err error
+			if key, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("unsupported CBOR map key")
+			}
+			if value, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			if _, exists := items[key]; exists {
+				return nil, nil, fmt.Errorf("duplicate CBOR map key %v", key)
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported CBOR major type %d", major) // Tags
+}
+
+// cborMap decodes data that must be exactly one map
+func cborMap(data []byte) (map[interface{}]interface{}, error) {
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes after CBOR map")
+	}
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("expected a CBOR map")
+	}
+	return m, nil
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// RegisterPasskeyRequest is the body of a passkey registration
+type RegisterPasskeyRequest struct {
+	Name       string                 `json:"name"`
+	Credential webauthnCredentialJSON `json:"credential"`
+}
+
+// PasskeyLoginRequest is the body of a passkey login
+type PasskeyLoginRequest struct {
+	Credential webauthnCredentialJSON `json:"credential"`
+}
+
+// requestRelyingParty returns the relying party of the request's host and writes the error response when there is none
+func requestRelyingParty(w http.ResponseWriter, r *http.Request) (*RelyingParty, bool) {
+	rp, err := getWebAuthnRPSource().RelyingParty(r)
+	if err != nil {
+		log.Printf("Error reading the passkey relying party for %s: %v", r.Host, err)
+		common.JSONError(w, "Passkeys are not available on this host", http.StatusInternalServerError)
+		return nil, false
+	}
+	return rp, true
+}
+
+// HandlePasskeyOptionsAPI returns the options to register a new passkey for the logged-in user (POST)
+func HandlePasskeyOptionsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return
+	}
+	rp, ok := requestRelyingParty(w, r)
+	if !ok {
+		return
+	}
+	options, err := beginRegistration(r.Context(), rp, user)
+	if err != nil {
+		log.Printf("Error starting passkey registration for user %d: %v", user.ID, err)
+		common.JSONError(w, "Failed to start passkey registration", http.StatusInternalServerError)
+		return
+	}
+	common.JSONResponse(w, map[string]interface{}{"publicKey": options})
+}
+
+// HandlePasskeysAPI lists the user's passkeys (GET), registers one (POST) or removes one (DELETE ?id=)
+func HandlePasskeysAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		credentials, err := getWebAuthnStore().ListCredentials(r.Context(), user.ID)
+		if err != nil {
+			log.Printf("Error listing passkeys for user %d: %v", user.ID, err)
+			common.JSONError(w, "Failed to list passkeys", http.StatusInternalServerError)
+			return
+		}
+		if credentials == nil {
+			credentials = []WebAuthnCredential{}
+		}
+		common.JSONResponse(w, credentials)
+
+	case http.MethodPost:
+		// A passkey logs in without a second factor, so a leaked API token must not be able to add one
+		if GetAPITokenFromContext(r.Context()) != nil {
+			common.JSONError(w, "Passkeys can only be added from a logged-in session", http.StatusForbidden)
+			return
+		}
+		rp, ok := requestRelyingParty(w, r)
+		if !ok {
+			return
+		}
+		var req RegisterPasskeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			common.JSONError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		credential, err := finishRegistration(r.Context(), rp, user, req.Name, &req.Credential)
+		if err != nil {
+			log.Printf("Passkey registration for user %d failed: %v", user.ID, err)
+			common.JSONError(w, "Passkey registration failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("User %d registered passkey %d (%s) for %s", user.ID, credential.ID, credential.Name, rp.ID)
+		common.JSONResponse(w, map[string]interface{}{"message": "Passkey added", "passkey": credential})
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			common.JSONError(w, "Passkey ID is required", http.StatusBadRequest)
+			return
+		}
+		found, err := getWebAuthnStore().DeleteCredential(r.Context(), user.ID, id)
+		if err != nil {
+			log.Printf("Error removing passkey %d for user %d: %v", id, user.ID, err)
+			common.JSONError(w, "Failed to remove passkey", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			common.JSONError(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("User %d removed passkey %d", user.ID, id)
+		common.JSONResponse(w, map[string]string{"message": "Passkey removed"})
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlePasskeyLoginOptions returns the options to log in with a passkey (POST). The login page
+// requests them on load for conditional UI, where the browser offers passkeys in the email field.
+func HandlePasskeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ok, wait := getAuthLimits().AllowPasskeyLogin(ClientIP(r)); !ok {
+		SendRateLimited(w, wait)
+		return
+	}
+	rp, ok := requestRelyingParty(w, r)
+	if !ok {
+		return
+	}
+	options, err := beginLogin(r.Context(), rp)
+	if err != nil {
+		log.Printf("Error starting passkey login: %v", err)
+		SendJSONResponse(w, false, "Failed to start passkey login", nil, "")
+		return
+	}
+	common.JSONResponse(w, map[string]interface{}{"publicKey": options})
+}
+
+// CreatePasskeyLoginHandler creates a handler that logs in with a passkey assertion (POST {credential}).
+// Passkeys whose authenticator verified the user (PIN or biometric) count as two factors;
+// other passkeys go through the second factor step like a password.
+func CreatePasskeyLoginHandler(userService UserServicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rp, ok := requestRelyingParty(w, r)
+		if !ok {
+			return
+		}
+		var req PasskeyLoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			SendJSONResponse(w, false, "Invalid request format", nil, "")
+			return
+		}
+
+		credential, userVerified, err := finishLogin(r.Context(), rp, &req.Credential)
+		if err != nil {
+			log.Printf("Passkey login from %s failed: %v", ClientIP(r), err)
+			SendJSONResponse(w, false, "Passkey login failed", nil, "")
+			return
+		}
+		// Passkeys are keyed by ai.users IDs; a project directory account with the same ID is not the owner
+		user, err := userService.GetUserByID(r.Context(), credential.UserID)
+		if err != nil || user == nil || user.ProjectID != 0 {
+			log.Printf("Passkey %d belongs to unknown user %d: %v", credential.ID, credential.UserID, err)
+			SendJSONResponse(w, false, "Passkey login failed", nil, "")
+			return
+		}
+
+		if err := userService.UpdateUserLastLogin(r.Context(), user.ID); err != nil {
+			log.Printf("Failed to update last login: %v", err)
+		}
+		log.Printf("User %d logged in with passkey %d", user.ID, credential.ID)
+		if userVerified {
+			startSession(w, r, user, "Login successful", nil)
+			return
+		}
+		completeLogin(w, r, user, "Login successful")
+	}
+}
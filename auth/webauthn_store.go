@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// WebAuthnCredential is a passkey registered by a user
+type WebAuthnCredential struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"-"`
+	RPID         string     `json:"rp_id"`
+	CredentialID []byte     `json:"-"`
+	PublicKey    []byte     `json:"-"` // COSE key
+	SignCount    uint32     `json:"-"`
+	Transports   []string   `json:"transports,omitempty"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnChallenge is an issued ceremony challenge, answered at most once
+type WebAuthnChallenge struct {
+	Challenge string // Base64url, as echoed in the client data
+	Ceremony  string // webauthn.create or webauthn.get
+	RPID      string
+	UserID    int // Registering user; 0 for logins
+	ExpiresAt time.Time
+}
+
+// WebAuthnStore keeps passkeys and pending ceremony challenges.
+type WebAuthnStore interface {
+	// CreateCredential stores a new credential and sets its ID. It returns ErrWebAuthnCredentialExists for a known credential ID.
+	CreateCredential(ctx context.Context, credential *WebAuthnCredential) error
+	// GetCredential returns a credential of a relying party by its credential ID, or nil when there is none.
+	GetCredential(ctx context.Context, rpID string, credentialID []byte) (*WebAuthnCredential, error)
+	// ListCredentials returns the credentials of a user, oldest first.
+	ListCredentials(ctx context.Context, userID int) ([]WebAuthnCredential, error)
+	// UseCredential records a login if the signature counter grew, or both counters are 0, and reports whether it did.
+	UseCredential(ctx context.Context, id int, signCount uint32, at time.Time) (bool, error)
+	// DeleteCredential removes a credential of a user and reports whether there was one.
+	DeleteCredential(ctx context.Context, userID, id int) (bool, error)
+	// SaveChallenge stores a challenge until it is taken or expires.
+	SaveChallenge(ctx context.Context, challenge WebAuthnChallenge) error
+	// TakeChallenge removes and returns an unexpired challenge, or nil when there is none.
+	TakeChallenge(ctx context.Context, challenge string) (*WebAuthnChallenge, error)
+}
+
+// memoryWebAuthnStore keeps passkeys in process memory, for tests and running without a database
+type memoryWebAuthnStore struct {
+	mu          sync.Mutex
+	nextID      int
+	credentials map[int]WebAuthnCredential
+	challenges  map[string]WebAuthnChallenge
+}
+
+// NewMemoryWebAuthnStore creates an in-process passkey store
+func NewMemoryWebAuthnStore() WebAuthnStore {
+	return &memoryWebAuthnStore{credentials: make(map[int]WebAuthnCredential), challenges: make(map[string]WebAuthnChallenge)}
+}
+
+func (s *memoryWebAuthnStore) CreateCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.credentials {
+		if bytes.Equal(existing.CredentialID, credential.CredentialID) {
+			return ErrWebAuthnCredentialExists
+		}
+	}
+	s.nextID++
+	credential.ID = s.nextID
+	credential.CreatedAt = time.Now()
+	s.credentials[credential.ID] = *credential
+	return nil
+}
+
+func (s *memoryWebAuthnStore) GetCredential(ctx context.Context, rpID string, credentialID []byte) (*WebAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, credential := range s.credentials {
+		if credential.RPID == rpID && bytes.Equal(credential.CredentialID, credentialID) {
+			return &credential, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryWebAuthnStore) ListCredentials(ctx context.Context, userID int) ([]WebAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var credentials []WebAuthnCredential
+	for _, credential := range s.credentials {
+		if credential.UserID == userID {
+			credentials = append(credentials, credential)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].ID < credentials[j].ID })
+	return credentials, nil
+}
+
+func (s *memoryWebAuthnStore) UseCredential(ctx context.Context, id int, signCount uint32, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credential, ok := s.credentials[id]
+	if !ok || (signCount <= credential.SignCount && (signCount != 0 || credential.SignCount != 0)) {
+		return false, nil
+	}
+	credential.SignCount = signCount
+	credential.LastUsedAt = &at
+	s.credentials[id] = credential
+	return true, nil
+}
+
+func (s *memoryWebAuthnStore) DeleteCredential(ctx context.Context, userID, id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if credential, ok := s.credentials[id]; !ok || credential.UserID != userID {
+		return false, nil
+	}
+	delete(s.credentials, id)
+	return true, nil
+}
+
+func (s *memoryWebAuthnStore) SaveChallenge(ctx context.Context, challenge WebAuthnChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, existing := range s.challenges {
+		if !now.Before(existing.ExpiresAt) {
+			delete(s.challenges, key)
+		}
+	}
+	s.challenges[challenge.Challenge] = challenge
+	return nil
+}
+
+func (s *memoryWebAuthnStore) TakeChallenge(ctx context.Context, challenge string) (*WebAuthnChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.challenges[challenge]
+	delete(s.challenges, challenge)
+	if !ok || !time.Now().Before(stored.ExpiresAt) {
+		return nil, nil
+	}
+	return &stored, nil
+}
+
+// postgresWebAuthnStore keeps passkeys in ai.webauthn_credentials and challenges in ai.webauthn_challenges
+type postgresWebAuthnStore struct {
+	db *sql.DB
+}
+
+// NewPostgresWebAuthnStore creates a passkey store backed by the database
+func NewPostgresWebAuthnStore(db *sql.DB) WebAuthnStore {
+	return &postgresWebAuthnStore{db: db}
+}
+
+func (s *postgresWebAuthnStore) CreateCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("webauthn/create_credential"),
+		credential.UserID, credential.RPID, credential.CredentialID, credential.PublicKey,
+		int64(credential.SignCount), strings.Join(credential.Transports, ","), credential.Name).
+		Scan(&credential.ID, &credential.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ErrWebAuthnCredentialExists
+	}
+	return err
+}
+
+// scanWebAuthnCredential scans the columns selected by the webauthn/get_credential and list_credentials queries
+func scanWebAuthnCredential(row interface{ Scan(...interface{}) error }) (WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	var signCount int64
+	var transports string
+	var lastUsedAt sql.NullTime
+	err := row.Scan(&credential.ID, &credential.UserID, &credential.RPID, &credential.CredentialID, &credential.PublicKey,
+		&signCount, &transports, &credential.Name, &credential.CreatedAt, &lastUsedAt)
+	credential.SignCount = uint32(signCount)
+	if transports != "" {
+		credential.Transports = strings.Split(transports, ",")
+	}
+	if lastUsedAt.Valid {
+		credential.LastUsedAt = &lastUsedAt.Time
+	}
+	return credential, err
+}
+
+func (s *postgresWebAuthnStore) GetCredential(ctx context.Context, rpID string, credentialID []byte) (*WebAuthnCredential, error) {
+	credential, err := scanWebAuthnCredential(s.db.QueryRowContext(ctx, common.MustGetSQL("webauthn/get_credential"), rpID, credentialID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+func (s *postgresWebAuthnStore) ListCredentials(ctx context.Context, userID int) ([]WebAuthnCredential, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("webauthn/list_credentials"), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var credentials []WebAuthnCredential
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (s *postgresWebAuthnStore) UseCredential(ctx context.Context, id int, signCount uint32, at time.Time) (bool, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("webauthn/use_credential"), id, int64(signCount), at)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresWebAuthnStore) DeleteCredential(ctx context.Context, userID, id int) (bool, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("webauthn/delete_credential"), userID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresWebAuthnStore) SaveChallenge(ctx context.Context, challenge WebAuthnChallenge) error {
+	if _, err := s.db.ExecContext(ctx, common.MustGetSQL("webauthn/delete_expired_challenges")); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("webauthn/save_challenge"),
+		challenge.Challenge, challenge.Ceremony, challenge.RPID, challenge.UserID, challenge.ExpiresAt)
+	return err
+}
+
+func (s *postgresWebAuthnStore) TakeChallenge(ctx context.Context, challenge string) (*WebAuthnChallenge, error) {
+	taken := WebAuthnChallenge{Challenge: challenge}
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("webauthn/take_challenge"), challenge).
+		Scan(&taken.Ceremony, &taken.RPID, &taken.UserID, &taken.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &taken, nil
+}
+
+var (
+	webauthnStore      = NewMemoryWebAuthnStore() // Replaced with the Postgres store once the database is up
+	webauthnStoreMutex = &sync.Mutex{}
+)
+
+// SetWebAuthnStore replaces the store used for passkeys
+func SetWebAuthnStore(store WebAuthnStore) {
+	webauthnStoreMutex.Lock()
+	defer webauthnStoreMutex.Unlock()
+	webauthnStore = store
+}
+
+// getWebAuthnStore returns the current passkey store
+func getWebAuthnStore() WebAuthnStore {
+	webauthnStoreMutex.Lock()
+	defer webauthnStoreMutex.Unlock()
+	return webauthnStore
+}
@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useMemoryWebAuthnStore installs a fresh in-memory passkey store for the duration of a test
+func useMemoryWebAuthnStore(t *testing.T) WebAuthnStore {
+	previous := getWebAuthnStore()
+	store := NewMemoryWebAuthnStore()
+	SetWebAuthnStore(store)
+	t.Cleanup(func() { SetWebAuthnStore(previous) })
+	return store
+}
+
+// testRPSource always returns the same relying party
+type testRPSource struct {
+	rp RelyingParty
+}
+
+func (s testRPSource) RelyingParty(r *http.Request) (*RelyingParty, error) {
+	rp := s.rp
+	return &rp, nil
+}
+
+// cborPair is a map entry for cborEncode, which keeps map keys in the given order
+type cborPair struct {
+	key, value interface{}
+}
+
+// cborEncode encodes the value types decodeCBOR produces; maps are given as []cborPair
+func cborEncode(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		}
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	switch v := v.(type) {
+	case int:
+		return cborEncode(int64(v))
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, cborEncode(item)...)
+		}
+		return out
+	case []cborPair:
+		out := head(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, cborEncode(pair.key)...)
+			out = append(out, cborEncode(pair.value)...)
+		}
+		return out
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	}
+	panic("unsupported CBOR value")
+}
+
+// testAuthenticator is a software authenticator holding one ES256 passkey
+type testAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	rpID         string
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &testAuthenticator{t: t, key: key, credentialID: credentialID}
+}
+
+// authenticatorData builds authenticator data, with the attested credential for registrations
+func (a *testAuthenticator) authenticatorData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if flags&authDataAttested != 0 {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, cborEncode([]cborPair{
+			{1, 2},         // kty: EC2
+			{3, coseES256}, // alg
+			{-1, 1},        // crv: P-256
+			{-2, a.key.PublicKey.X.FillBytes(make([]byte, 32))},
+			{-3, a.key.PublicKey.Y.FillBytes(make([]byte, 32))},
+		})...)
+	}
+	return data
+}
+
+// clientData builds the client data a browser at origin would send for a challenge
+func (a *testAuthenticator) clientData(ceremony string, challenge []byte, origin string) []byte {
+	raw, _ := json.Marshal(collectedClientData{Type: ceremony, Challenge: base64.RawURLEncoding.EncodeToString(challenge), Origin: origin})
+	return raw
+}
+
+// create answers creation options like navigator.credentials.create with attestation "none"
+func (a *testAuthenticator) create(options *creationOptions, origin string) *webauthnCredentialJSON {
+	a.rpID, a.userHandle = options.RP.ID, options.User.ID
+	credential := &webauthnCredentialJSON{ID: base64.RawURLEncoding.EncodeToString(a.credentialID), RawID: a.credentialID, Type: "public-key"}
+	credential.Response.ClientDataJSON = a.clientData(ceremonyCreate, options.Challenge, origin)
+	credential.Response.AttestationObject = cborEncode([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authenticatorData(authDataUserPresent | authDataUserVerified | authDataAttested)},
+	})
+	credential.Response.Transports = []string{"internal"}
+	return credential
+}
+
+// get answers request options like navigator.credentials.get, counting the signature
+func (a *testAuthenticator) get(options *requestOptions, origin string, flags byte) *webauthnCredentialJSON {
+	a.signCount++
+	credential := &webauthnCredentialJSON{ID: base64.RawURLEncoding.EncodeToString(a.credentialID), RawID: a.credentialID, Type: "public-key"}
+	credential.Response.ClientDataJSON = a.clientData(ceremonyGet, options.Challenge, origin)
+	credential.Response.AuthenticatorData = a.authenticatorData(flags)
+	credential.Response.UserHandle = a.userHandle
+	clientDataHash := sha256.Sum256(credential.Response.ClientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), credential.Response.AuthenticatorData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("Failed to sign: %v", err)
+	}
+	credential.Response.Signature = signature
+	return credential
+}
+
+// passkeyUserService finds its one user by ID
+type passkeyUserService struct {
+	passwordUserService
+}
+
+func (s passkeyUserService) GetUserByID(ctx context.Context, userID int) (*User, error) {
+	if userID != s.user.ID {
+		return nil, nil
+	}
+	return s.user, nil
+}
+
+// TestPasskeyRegistrationAndLogin tests both ceremonies end to end with a software authenticator,
+// including the login endpoints, single-use challenges, origin checks and clone detection
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	useMemorySessionStore(t)
+	useMemoryTwoFactorStore(t)
+	store := useMemoryWebAuthnStore(t)
+	SetAuthLimits(nil)
+	t.Cleanup(func() { SetAuthLimits(nil) })
+	previousPolicy := getTwoFactorPolicy()
+	SetTwoFactorPolicy(fixedTwoFactorPolicy(false))
+	t.Cleanup(func() { SetTwoFactorPolicy(previousPolicy) })
+	rp := &RelyingParty{ID: "example.com", Name: "Example", Origins: []string{"https://example.com"}}
+	previousRP := getWebAuthnRPSource()
+	SetWebAuthnRPSource(testRPSource{rp: *rp})
+	t.Cleanup(func() { SetWebAuthnRPSource(previousRP) })
+
+	ctx := context.Background()
+	user := &User{ID: 41, Email: "passkey@example.com"}
+	authenticator := newTestAuthenticator(t)
+
+	// Registration
+	options, err := beginRegistration(ctx, rp, user)
+	if err != nil {
+		t.Fatalf("beginRegistration failed: %v", err)
+	}
+	if options.RP.ID != "example.com" || !bytes.Equal(options.User.ID, webauthnUserHandle(user.ID)) || options.Attestation != "none" {
+		t.Errorf("Unexpected creation options %+v", options)
+	}
+	if _, err := finishRegistration(ctx, rp, user, "Laptop", authenticator.create(options, "https://evil.example")); err == nil {
+		t.Error("Expected a registration from another origin to be refused")
+	}
+	if _, err := finishRegistration(ctx, rp, user, "Laptop", authenticator.create(options, "https://example.com")); err != ErrWebAuthnChallenge {
+		t.Errorf("Expected the challenge to be used up by the refused attempt, got %v", err)
+	}
+	options, _ = beginRegistration(ctx, rp, user)
+	credential, err := finishRegistration(ctx, rp, user, "Laptop", authenticator.create(options, "https://example.com"))
+	if err != nil {
+		t.Fatalf("finishRegistration failed: %v", err)
+	}
+	if credential.Name != "Laptop" || credential.UserID != user.ID || credential.RPID != "example.com" {
+		t.Errorf("Unexpected credential %+v", credential)
+	}
+	options, _ = beginRegistration(ctx, rp, user)
+	if len(options.ExcludeCredentials) != 1 || !bytes.Equal(options.ExcludeCredentials[0].ID, authenticator.credentialID) {
+		t.Errorf("Expected the registered passkey to be excluded, got %+v", options.ExcludeCredentials)
+	}
+	if _, err := finishRegistration(ctx, rp, user, "Again", authenticator.create(options, "https://example.com")); err != ErrWebAuthnCredentialExists {
+		t.Errorf("Expected a second registration of the same passkey to be refused, got %v", err)
+	}
+
+	// Login through the endpoints
+	users := passkeyUserService{passwordUserService{user: user}}
+	loginOptions := func() *requestOptions {
+		rec := httptest.NewRecorder()
+		HandlePasskeyLoginOptions(rec, httptest.NewRequest(http.MethodPost, "/auth/passkey/options", nil))
+		var resp struct {
+			PublicKey requestOptions `json:"publicKey"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp.PublicKey.Challenge) == 0 {
+			t.Fatalf("Expected login options, got %v", err)
+		}
+		return &resp.PublicKey
+	}
+	login := func(credential *webauthnCredentialJSON) JSONResponse {
+		body, _ := json.Marshal(PasskeyLoginRequest{Credential: *credential})
+		rec := httptest.NewRecorder()
+		CreatePasskeyLoginHandler(users)(rec, httptest.NewRequest(http.MethodPost, "/auth/passkey/login", bytes.NewReader(body)))
+		var resp JSONResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+
+	request := loginOptions()
+	if request.RPID != "example.com" || len(request.AllowCredentials) != 0 {
+		t.Errorf("Expected discoverable login options for example.com, got %+v", request)
+	}
+	assertion := authenticator.get(request, "https://example.com", authDataUserPresent|authDataUserVerified)
+	if resp := login(assertion); !resp.Success || resp.Redirect != "/" {
+		t.Fatalf("Expected the passkey login to succeed, got %+v", resp)
+	}
+	if resp := login(assertion); resp.Success {
+		t.Error("Expected a replayed assertion to be refused")
+	}
+	if resp := login(authenticator.get(loginOptions(), "https://evil.example", authDataUserPresent|authDataUserVerified)); resp.Success {
+		t.Error("Expected an assertion from another origin to be refused")
+	}
+
+	// Without user verification, users with 2FA still need their second factor
+	enableTwoFactor(t, user)
+	if resp := login(authenticator.get(loginOptions(), "https://example.com", authDataUserPresent)); !resp.Success || resp.Redirect != "/login/2fa" {
+		t.Errorf("Expected a login without user verification to go to the second step, got %+v", resp)
+	}
+	if resp := login(authenticator.get(loginOptions(), "https://example.com", authDataUserPresent|authDataUserVerified)); !resp.Success || resp.Redirect != "/" {
+		t.Errorf("Expected a verified passkey login to skip the second step, got %+v", resp)
+	}
+
+	// A signature counter that goes back means a cloned key
+	authenticator.signCount = 1
+	if resp := login(authenticator.get(loginOptions(), "https://example.com", authDataUserPresent|authDataUserVerified)); resp.Success {
+		t.Error("Expected a signature counter that went back to be refused")
+	}
+
+	// Tampered signatures and unknown passkeys are refused
+	tampered := authenticator.get(loginOptions(), "https://example.com", authDataUserPresent|authDataUserVerified)
+	tampered.Response.Signature[len(tampered.Response.Signature)-1] ^= 1
+	if resp := login(tampered); resp.Success {
+		t.Error("Expected a tampered signature to be refused")
+	}
+	stranger := newTestAuthenticator(t)
+	stranger.rpID = "example.com"
+	if resp := login(stranger.get(loginOptions(), "https://example.com", authDataUserPresent|authDataUserVerified)); resp.Success {
+		t.Error("Expected an unknown passkey to be refused")
+	}
+
+	if removed, _ := store.DeleteCredential(ctx, user.ID+1, credential.ID); removed {
+		t.Error("Expected another user not to be able to remove the passkey")
+	}
+	if removed, _ := store.DeleteCredential(ctx, user.ID, credential.ID); !removed {
+		t.Error("Expected the passkey to be removed")
+	}
+	if resp := login(authenticator.get(loginOptions(), "https://example.com", authDataUserPresent|authDataUserVerified)); resp.Success {
+		t.Error("Expected a removed passkey to be refused")
+	}
+}
+
+// TestDecodeCBOR tests decoding and the refusal of malformed and unsupported input
+func TestDecodeCBOR(t *testing.T) {
+	encoded := cborEncode([]cborPair{{1, -7}, {"list", []interface{}{[]byte{1, 2}, "x", true}}})
+	decoded, err := cborMap(encoded)
+	if err != nil {
+		t.Fatalf("cborMap failed: %v", err)
+	}
+	if decoded[int64(1)] != int64(-7) {
+		t.Errorf("Expected -7, got %v", decoded[int64(1)])
+	}
+	list, _ := decoded["list"].([]interface{})
+	if len(list) != 3 || !bytes.Equal(list[0].([]byte), []byte{1, 2}) || list[1] != "x" || list[2] != true {
+		t.Errorf("Unexpected list %v", decoded["list"])
+	}
+	if _, rest, err := decodeCBOR(append(cborEncode(300), 0xff)); err != nil || !bytes.Equal(rest, []byte{0xff}) {
+		t.Errorf("Expected the bytes after the item to be returned, got %v, %v", rest, err)
+	}
+
+	deep := []byte{}
+	for i := 0; i < 40; i++ {
+		deep = append(deep, 0x81) // Array of one item
+	}
+	for name, data := range map[string][]byte{
+		"empty":          {},
+		"truncated":      {0x59, 0x01},
+		"short string":   {0x45, 1, 2},
+		"indefinite":     {0x9f, 0x01, 0xff},
+		"tag":            {0xc0, 0x01},
+		"float":          {0xfb, 0, 0, 0, 0, 0, 0, 0, 0},
+		"duplicate key":  cborEncode([]cborPair{{1, 1}, {1, 2}}),
+		"bytes map key":  cborEncode([]cborPair{{[]byte{1}, 1}}),
+		"huge array":     {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"too deep":       append(deep, 0x01),
+		"trailing bytes": append(cborEncode([]cborPair{}), 0x00),
+		"not a map":      cborEncode(1),
+	} {
+		if _, err := cborMap(data); err == nil {
+			t.Errorf("Expected %s to be refused", name)
+		}
+	}
+}
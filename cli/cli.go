@@ -102,23 +102,23 @@ var listUsersCmd = &cobra.Command{
 		defer db.Close()
 
 		// Query users
-		listQuery := "SELECT id, email, is_admin, created_at, last_logged_in FROM ai.users ORDER BY id"
+		listQuery := "SELECT id, email, is_admin, is_active, deleted_at IS NOT NULL, created_at, last_logged_in FROM ai.users ORDER BY id"
 		rows, err := db.Query(listQuery)
 		if err != nil {
 			log.Fatalf("Error querying users: %v", err)
 		}
 		defer rows.Close()
 
-		fmt.Printf("%-5s %-30s %-10s %-20s %-20s\n", "ID", "Email", "Admin", "Created", "Last Login")
-		fmt.Println("----------------------------------------------------------------------------------------")
+		fmt.Printf("%-5s %-30s %-10s %-12s %-20s %-20s\n", "ID", "Email", "Admin", "Status", "Created", "Last Login")
+		fmt.Println("-----------------------------------------------------------------------------------------------------")
 
 		for rows.Next() {
 			var id int
 			var email string
-			var isAdmin bool
+			var isAdmin, isActive, isDeleted bool
 			var createdAt, lastLoggedIn sql.NullTime
 
-			err := rows.Scan(&id, &email, &isAdmin, &createdAt, &lastLoggedIn)
+			err := rows.Scan(&id, &email, &isAdmin, &isActive, &isDeleted, &createdAt, &lastLoggedIn)
 			if err != nil {
 				log.Printf("Error scanning user row: %v", err)
 				continue
@@ -139,7 +139,14 @@ var listUsersCmd = &cobra.Command{
 				adminStr = "Yes"
 			}
 
-			fmt.Printf("%-5d %-30s %-10s %-20s %-20s\n", id, email, adminStr, createdStr, lastLoginStr)
+			statusStr := "Active"
+			if isDeleted {
+				statusStr = "Deleted"
+			} else if !isActive {
+				statusStr = "Deactivated"
+			}
+
+			fmt.Printf("%-5d %-30s %-10s %-12s %-20s %-20s\n", id, email, adminStr, statusStr, createdStr, lastLoginStr)
 		}
 
 		if err = rows.Err(); err != nil {
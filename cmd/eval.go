@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	evalJSON          bool
+	evalKeepWorkspace bool
+	evalOllamaURL     string
+	evalModel         string
+	evalSystemPrompt  string
+)
+
+var evalCmd = &cobra.Command{
+	Use:   "eval [scenario files or directories...]",
+	Short: "Run agent evaluation scenarios",
+	Long: `Runs YAML agent scenarios against the agent engine and reports pass rates and step counts.
+Scenarios with a scripted transcript run offline; the others use the configured Ollama model.
+Defaults to data/evals when no path is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := godotenv.Load(); err != nil {
+			fmt.Printf("Warning: Error loading .env file from root: %v\n", err)
+		}
+		if len(args) == 0 {
+			args = []string{"data/evals"}
+		}
+
+		scenarios, err := server.LoadEvalScenarios(args...)
+		if err != nil {
+			fmt.Printf("Error loading scenarios: %v\n", err)
+			os.Exit(1)
+		}
+		if len(scenarios) == 0 {
+			fmt.Println("No scenarios found")
+			os.Exit(1)
+		}
+
+		if evalOllamaURL == "" {
+			evalOllamaURL = common.GetEnvOrDefault("OLLAMA_URL", "http://host.docker.internal:11434")
+		}
+		if evalModel == "" {
+			evalModel = common.GetEnvOrDefault("OLLAMA_MODEL", "llama3:8b")
+		}
+		opts := server.EvalOptions{
+			Model:         server.NewOllamaClient(evalOllamaURL, nil),
+			ModelName:     evalModel,
+			KeepWorkspace: evalKeepWorkspace,
+		}
+		if evalSystemPrompt != "" {
+			content, err := os.ReadFile(evalSystemPrompt)
+			if err != nil {
+				fmt.Printf("Error reading system prompt: %v\n", err)
+				os.Exit(1)
+			}
+			opts.SystemPrompt = string(content)
+		}
+
+		report := server.RunEval(context.Background(), scenarios, opts)
+
+		if evalJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				fmt.Printf("Error encoding report: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			printEvalReport(report)
+		}
+
+		if report.Passed != report.Total {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(evalCmd)
+	evalCmd.Flags().BoolVar(&evalJSON, "json", false, "Print the report as JSON")
+	evalCmd.Flags().BoolVar(&evalKeepWorkspace, "keep", false, "Keep scenario workspaces on disk")
+	evalCmd.Flags().StringVar(&evalOllamaURL, "ollama-url", "", "Ollama URL for unscripted scenarios (default $OLLAMA_URL)")
+	evalCmd.Flags().StringVar(&evalModel, "model", "", "Model name for unscripted scenarios (default $OLLAMA_MODEL)")
+	evalCmd.Flags().StringVar(&evalSystemPrompt, "system-prompt", "", "File with a system prompt template to evaluate instead of the built-in one")
+}
+
+func printEvalReport(report server.EvalReport) {
+	fmt.Printf("%-6s %-30s %-6s %-26s %s\n", "Result", "Scenario", "Steps", "State", "Duration")
+	fmt.Println(strings.Repeat("-", 80))
+	for _, result := range report.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Printf("%-6s %-30s %-6d %-26s %s\n", status, result.Name, result.Steps, result.State, result.Duration.Round(time.Millisecond))
+		for _, failure := range result.Failures {
+			fmt.Printf("       - %s\n", failure)
+		}
+		if result.Workspace != "" {
+			fmt.Printf("       workspace: %s\n", result.Workspace)
+		}
+	}
+	fmt.Println(strings.Repeat("-", 80))
+	fmt.Printf("Passed %d/%d (%.1f%%), %d steps total, %.1f steps per scenario\n",
+		report.Passed, report.Total, report.PassRate*100, report.TotalSteps, report.AvgSteps)
+}
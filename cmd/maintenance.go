@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/joho/godotenv"
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/spf13/cobra"
+)
+
+var recoveryCodeNote string
+
+var maintenanceCmd = &cobra.Command{
+	Use:   "maintenance",
+	Short: "Break-glass access to maintenance",
+	Long:  `Commands for operators with shell access to the server, which keep working when the database is down.`,
+}
+
+var recoveryCodeCmd = &cobra.Command{
+	Use:   "recovery-code",
+	Short: "Print a one-time recovery code for /maintenance",
+	Long: `Issues a short-lived, single-use recovery code that opens a maintenance session at /maintenance
+or completes the initial setup at /config. The code is only shown once; issuing and using it is logged.
+Codes are kept in BREAKGLASS_FILE (default data/breakglass.json) and expire after BREAKGLASS_CODE_TTL (default 15m).`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := godotenv.Load(); err != nil {
+			fmt.Printf("Warning: Error loading .env file from root: %v\n", err)
+		}
+		note := recoveryCodeNote
+		if note == "" {
+			note = "cli by " + os.Getenv("USER")
+		}
+
+		code, expiresAt, err := auth.IssueBreakGlassCode(note)
+		if err != nil {
+			fmt.Printf("Error issuing recovery code: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(code)
+		fmt.Fprintf(os.Stderr, "Valid once until %s\n", expiresAt.Local().Format("2006-01-02 15:04:05"))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(maintenanceCmd)
+	maintenanceCmd.AddCommand(recoveryCodeCmd)
+
+	recoveryCodeCmd.Flags().StringVar(&recoveryCodeNote, "note", "", "Why the code is needed, recorded with it (defaults to the OS user)")
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/projects"
+	"github.com/scriptmaster/openagent/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	deleteUserConfirmed bool
+	exportUserOutput    string
+)
+
+var listUsersCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List users and their account status",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		initializeUserServiceForCmd()
+		accounts, err := server.NewAccountService(server.GetDB()).ListAccounts(ctx)
+		if err != nil {
+			fmt.Printf("Error listing users: %v\n", err)
+			os.Exit(1)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tEMAIL\tADMIN\tSTATUS\tLAST LOGIN")
+		for _, account := range accounts {
+			fmt.Fprintf(tw, "%d\t%s\t%t\t%s\t%s\n", account.ID, account.Email, account.IsAdmin,
+				accountStatus(account), formatTokenTime(account.LastLoggedIn, "never"))
+		}
+		tw.Flush()
+	},
+}
+
+var deactivateUserCmd = &cobra.Command{
+	Use:   "deactivate [email]",
+	Short: "Stop a user from logging in and end their sessions",
+	Long:  `Deactivates the user: they can no longer log in, and their sessions and API tokens stop working until they are reactivated.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		accounts, user := findUserForLifecycleCmd(ctx, args[0])
+
+		if _, err := accounts.DeactivateUser(ctx, nil, user.ID); err != nil {
+			fmt.Printf("Error deactivating %s: %v\n", user.Email, err)
+			os.Exit(1)
+		}
+		fmt.Printf("User %s deactivated\n", user.Email)
+	},
+}
+
+var reactivateUserCmd = &cobra.Command{
+	Use:   "reactivate [email]",
+	Short: "Let a deactivated user log in again",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		accounts, user := findUserForLifecycleCmd(ctx, args[0])
+
+		if _, err := accounts.ReactivateUser(ctx, nil, user.ID); err != nil {
+			fmt.Printf("Error reactivating %s: %v\n", user.Email, err)
+			os.Exit(1)
+		}
+		fmt.Printf("User %s reactivated\n", user.Email)
+	},
+}
+
+var deleteUserCmd = &cobra.Command{
+	Use:   "delete [email]",
+	Short: "Delete and anonymize a user",
+	Long: `Honors a deletion request: erases the user's email, password and profile, removes their
+sessions, devices, API tokens, passkeys, two-factor enrolment, avatar, voice conversations,
+pending login codes and project memberships, anonymizes the invitations sent to them and their
+audit log entries and clears the goals of their agent runs, all in one transaction. The
+anonymized account is kept so references stay valid.
+This cannot be undone; consider exporting the user's data first.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		accounts, user := findUserForLifecycleCmd(ctx, args[0])
+
+		if !deleteUserConfirmed {
+			fmt.Printf("Deleting %s cannot be undone. Run again with --yes to confirm.\n", user.Email)
+			os.Exit(1)
+		}
+		if err := accounts.DeleteUser(ctx, nil, user.ID); err != nil {
+			fmt.Printf("Error deleting %s: %v\n", user.Email, err)
+			os.Exit(1)
+		}
+		fmt.Printf("User %s deleted\n", user.Email)
+	},
+}
+
+var exportUserCmd = &cobra.Command{
+	Use:   "export [email]",
+	Short: "Export a user's data as JSON",
+	Long:  `Writes the user's account, profile, sessions, agent runs and project memberships as JSON.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		accounts, user := findUserForLifecycleCmd(ctx, args[0])
+
+		export, err := accounts.ExportUserData(ctx, nil, user.ID)
+		if err != nil {
+			fmt.Printf("Error exporting data of %s: %v\n", user.Email, err)
+			os.Exit(1)
+		}
+		data, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			fmt.Printf("Error encoding export: %v\n", err)
+			os.Exit(1)
+		}
+		if exportUserOutput == "" {
+			fmt.Println(string(data))
+			return
+		}
+		if err := os.WriteFile(exportUserOutput, append(data, '\n'), 0600); err != nil {
+			fmt.Printf("Error writing %s: %v\n", exportUserOutput, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Data of %s written to %s\n", user.Email, exportUserOutput)
+	},
+}
+
+func init() {
+	userCmd.AddCommand(listUsersCmd)
+	userCmd.AddCommand(deactivateUserCmd)
+	userCmd.AddCommand(reactivateUserCmd)
+	userCmd.AddCommand(deleteUserCmd)
+	userCmd.AddCommand(exportUserCmd)
+
+	deleteUserCmd.Flags().BoolVar(&deleteUserConfirmed, "yes", false, "Confirm the deletion")
+	exportUserCmd.Flags().StringVarP(&exportUserOutput, "output", "o", "", "File to write the export to (default stdout)")
+}
+
+// findUserForLifecycleCmd connects to the database, switches the stores an account change touches
+// to it and looks up the user
+func findUserForLifecycleCmd(ctx context.Context, email string) (*server.AccountService, *auth.User) {
+	userService := initializeUserServiceForCmd()
+	db := server.GetDB()
+	auth.SetSessionStore(auth.NewPostgresSessionStore(db))
+	auth.SetAPITokenStore(auth.NewPostgresAPITokenStore(db))
+	auth.SetTwoFactorStore(auth.NewPostgresTwoFactorStore(db))
+	auth.SetWebAuthnStore(auth.NewPostgresWebAuthnStore(db))
+	auth.SetAuditStore(auth.NewPostgresAuditStore(db))
+	projects.SetMemberStore(projects.NewPostgresMemberStore(db))
+
+	user, err := userService.GetUserByEmail(ctx, email)
+	if err != nil {
+		fmt.Printf("Error finding user %s: %v\n", email, err)
+		os.Exit(1)
+	}
+	return server.NewAccountService(db), user
+}
+
+// accountStatus describes an account's status for the user list
+func accountStatus(account server.AccountSummary) string {
+	switch {
+	case account.DeletedAt != nil:
+		return "deleted"
+	case !account.IsActive:
+		return "deactivated"
+	default:
+		return "active"
+	}
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	tokenName        string
+	tokenScopes      string
+	tokenExpiresDays int
+)
+
+var userTokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage a user's API tokens",
+	Long:  `Create, list and revoke personal access tokens used with Authorization: Bearer.`,
+}
+
+var createTokenCmd = &cobra.Command{
+	Use:   "create [email]",
+	Short: "Create an API token for a user",
+	Long:  `Creates a personal access token for the user and prints it. The token is only shown once.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		user := findUserForTokenCmd(ctx, args[0])
+
+		_, secret, err := auth.CreateAPIToken(ctx, user, tokenName, strings.Split(tokenScopes, ","), time.Duration(tokenExpiresDays)*24*time.Hour)
+		if err != nil {
+			fmt.Printf("Error creating token: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(secret)
+	},
+}
+
+var listTokensCmd = &cobra.Command{
+	Use:   "list [email]",
+	Short: "List a user's API tokens",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		user := findUserForTokenCmd(ctx, args[0])
+
+		tokens, err := auth.ListAPITokens(ctx, user.ID)
+		if err != nil {
+			fmt.Printf("Error listing tokens: %v\n", err)
+			os.Exit(1)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tLAST USED\tEXPIRES")
+		for _, token := range tokens {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Name, token.Prefix, strings.Join(token.Scopes, ","),
+				formatTokenTime(token.LastUsedAt, "never"), formatTokenTime(token.ExpiresAt, "never"))
+		}
+		tw.Flush()
+	},
+}
+
+var revokeTokenCmd = &cobra.Command{
+	Use:   "revoke [email] [id]",
+	Short: "Revoke one of a user's API tokens",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		user := findUserForTokenCmd(ctx, args[0])
+
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Printf("Invalid token ID %q\n", args[1])
+			os.Exit(1)
+		}
+		found, err := auth.RevokeAPIToken(ctx, user.ID, id)
+		if err != nil {
+			fmt.Printf("Error revoking token: %v\n", err)
+			os.Exit(1)
+		}
+		if !found {
+			fmt.Printf("No active token %d for %s\n", id, user.Email)
+			os.Exit(1)
+		}
+		fmt.Printf("Token %d revoked\n", id)
+	},
+}
+
+func init() {
+	userCmd.AddCommand(userTokenCmd)
+	userTokenCmd.AddCommand(createTokenCmd)
+	userTokenCmd.AddCommand(listTokensCmd)
+	userTokenCmd.AddCommand(revokeTokenCmd)
+
+	createTokenCmd.Flags().StringVar(&tokenName, "name", "cli", "Name to recognise the token by")
+	createTokenCmd.Flags().StringVar(&tokenScopes, "scopes", auth.ScopeRead, "Comma-separated scopes: read, write, admin")
+	createTokenCmd.Flags().IntVar(&tokenExpiresDays, "expires-days", 90, "Days until the token expires (0 for never)")
+}
+
+// findUserForTokenCmd connects to the database, switches the token store to it and looks up the user
+func findUserForTokenCmd(ctx context.Context, email string) *auth.User {
+	userService := initializeUserServiceForCmd()
+	auth.SetAPITokenStore(auth.NewPostgresAPITokenStore(server.GetDB()))
+
+	user, err := userService.GetUserByEmail(ctx, email)
+	if err != nil {
+		fmt.Printf("Error finding user %s: %v\n", email, err)
+		os.Exit(1)
+	}
+	return user
+}
+
+// formatTokenTime formats an optional time for the token list
+func formatTokenTime(t *time.Time, none string) string {
+	if t == nil {
+		return none
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -1,5 +1,11 @@
 package common
 
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
 // ProjectDB represents the data for a project's database connection
 type ProjectDB struct {
 	ID               int    `db:"id"`
@@ -22,6 +28,47 @@ type ProjectDBService interface {
 	DeleteProjectDB(id int) error
 	TestConnection(projectDB ProjectDB) error
 	DecodeConnectionString(encoded string) (string, error)
+	// GetUserDirectory returns the user directory of the project's default database, or nil when none is configured.
+	GetUserDirectory(projectID int) (*UserDirectory, error)
+	// SetUserDirectory configures (or, with nil, removes) the user directory of a project database.
+	SetUserDirectory(projectDBID int, directory *UserDirectory) error
+}
+
+// UserDirectory maps a users table in a project database, so logins on the project's host
+// are checked against the project's own users instead of ai.users
+type UserDirectory struct {
+	ProjectDBID     int    `json:"project_db_id"`               // Filled in when loaded
+	Table           string `json:"table"`                       // Users table, optionally schema-qualified (schema.table)
+	IDColumn        string `json:"id_column"`                   // Integer primary key
+	EmailColumn     string `json:"email_column"`                // Login email
+	PasswordColumn  string `json:"password_column,omitempty"`   // bcrypt hashes; leave empty for OTP-only logins
+	CreatedAtColumn string `json:"created_at_column,omitempty"` // Optional
+	LastLoginColumn string `json:"last_login_column,omitempty"` // Optional, updated on each login
+	CreateUsers     bool   `json:"create_users"`                // Create accounts for unknown emails on OTP login
+}
+
+// sqlIdentifier matches plain table and column names
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate checks that the table and column names are plain SQL identifiers
+func (d *UserDirectory) Validate() error {
+	if d.Table == "" || d.IDColumn == "" || d.EmailColumn == "" {
+		return errors.New("table, id_column and email_column are required")
+	}
+	for _, part := range strings.Split(d.Table, ".") {
+		if !sqlIdentifier.MatchString(part) {
+			return errors.New("invalid table name: " + d.Table)
+		}
+	}
+	if strings.Count(d.Table, ".") > 1 {
+		return errors.New("invalid table name: " + d.Table)
+	}
+	for _, column := range []string{d.IDColumn, d.EmailColumn, d.PasswordColumn, d.CreatedAtColumn, d.LastLoginColumn} {
+		if column != "" && !sqlIdentifier.MatchString(column) {
+			return errors.New("invalid column name: " + column)
+		}
+	}
+	return nil
 }
 
 // Add other common types/interfaces here...
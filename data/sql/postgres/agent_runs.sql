@@ -0,0 +1,19 @@
+-- name: agent_runs/create
+INSERT INTO ai.agent_runs (user_id, project_id, goal, model, system_prompt_name, system_prompt_scope, system_prompt_version, goal_template_name, goal_template_scope, goal_template_version)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING id
+
+
+-- name: agent_runs/read
+SELECT id, COALESCE(user_id, 0) AS user_id, COALESCE(project_id, 0) AS project_id
+FROM ai.agent_runs
+WHERE id = $1
+
+-- name: agent_runs/list_by_user
+SELECT id, COALESCE(project_id, 0) AS project_id, goal, COALESCE(model, '') AS model, started_at
+FROM ai.agent_runs
+WHERE user_id = $1
+ORDER BY started_at
+
+-- name: agent_runs/anonymize_by_user
+UPDATE ai.agent_runs SET user_id = NULL, goal = '' WHERE user_id = $1
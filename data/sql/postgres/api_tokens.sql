@@ -0,0 +1,27 @@
+-- name: api_tokens/create
+INSERT INTO ai.api_tokens (user_id, name, prefix, token_hash, scopes, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, created_at
+
+-- name: api_tokens/get_by_hash
+-- The email and admin flag come from the user, so deleted users' tokens stop working
+SELECT t.id, t.user_id, u.email, u.is_admin, t.name, t.prefix, t.scopes, t.created_at, t.last_used_at, t.expires_at, t.revoked_at
+FROM ai.api_tokens t
+JOIN ai.users u ON u.id = t.user_id
+WHERE t.token_hash = $1
+
+-- name: api_tokens/list_by_user
+SELECT t.id, t.user_id, u.email, u.is_admin, t.name, t.prefix, t.scopes, t.created_at, t.last_used_at, t.expires_at, t.revoked_at
+FROM ai.api_tokens t
+JOIN ai.users u ON u.id = t.user_id
+WHERE t.user_id = $1 AND t.revoked_at IS NULL
+ORDER BY t.created_at DESC
+
+-- name: api_tokens/revoke
+UPDATE ai.api_tokens SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+
+-- name: api_tokens/touch
+UPDATE ai.api_tokens SET last_used_at = $2 WHERE id = $1
+
+-- name: api_tokens/delete_by_user
+DELETE FROM ai.api_tokens WHERE user_id = $1
@@ -0,0 +1,21 @@
+-- name: audit_log/create
+INSERT INTO ai.audit_log (actor_id, actor_email, user_id, user_email, action, detail, impersonation_id, ip)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING id, created_at
+
+-- name: audit_log/list
+-- Zero filters match every actor or user
+SELECT id, actor_id, actor_email, user_id, user_email, action, detail, impersonation_id, ip, created_at
+FROM ai.audit_log
+WHERE ($1 = 0 OR actor_id = $1) AND ($2 = 0 OR user_id = $2) AND ($3 = '' OR impersonation_id = $3)
+ORDER BY id DESC
+LIMIT $4
+
+-- name: audit_log/anonymize_user
+-- Used when an account ($1, email $2) is deleted: its entries stay for accountability under the
+-- anonymized address ($3), and the IP addresses it acted from are cleared
+UPDATE ai.audit_log
+SET user_email = CASE WHEN user_id = $1 OR lower(user_email) = lower($2) THEN $3 ELSE user_email END,
+    actor_email = CASE WHEN actor_id = $1 OR lower(actor_email) = lower($2) THEN $3 ELSE actor_email END,
+    ip = CASE WHEN actor_id = $1 OR lower(actor_email) = lower($2) THEN '' ELSE ip END
+WHERE user_id = $1 OR actor_id = $1 OR lower(user_email) = lower($2) OR lower(actor_email) = lower($2)
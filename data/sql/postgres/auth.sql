@@ -16,7 +16,7 @@ VALUES ($1, $2, $3, $4, $5)
 RETURNING id
 
 -- name: auth/get_user_by_email
-SELECT id, email, password_hash, is_admin, created_at, last_logged_in FROM ai.users WHERE email = $1
+SELECT id, email, password_hash, is_admin, created_at, last_logged_in, display_name, timezone, locale FROM ai.users WHERE email = $1
 
 -- name: auth/make_admin
 UPDATE ai.users SET is_admin = true WHERE id = $1
@@ -29,3 +29,40 @@ UPDATE ai.users SET password_hash = $1 WHERE id = $2
 
 -- name: auth/verify_password
 SELECT id, email, password_hash, is_admin, created_at, last_logged_in FROM ai.users WHERE email = $1
+
+-- name: auth/get_user_by_id
+SELECT id, email, password_hash, is_admin, created_at, last_logged_in, display_name, timezone, locale FROM ai.users WHERE id = $1
+
+-- name: auth/update_profile
+UPDATE ai.users SET display_name = $2, timezone = $3, locale = $4 WHERE id = $1
+
+-- name: auth/get_avatar
+SELECT image, updated_at FROM ai.user_avatars WHERE user_id = $1
+
+-- name: auth/set_avatar
+INSERT INTO ai.user_avatars (user_id, image, updated_at) VALUES ($1, $2, NOW())
+ON CONFLICT (user_id) DO UPDATE SET image = EXCLUDED.image, updated_at = EXCLUDED.updated_at
+
+-- name: auth/delete_avatar
+DELETE FROM ai.user_avatars WHERE user_id = $1
+
+-- name: auth/is_active
+SELECT is_active FROM ai.users WHERE id = $1
+
+-- name: auth/set_active
+UPDATE ai.users SET is_active = $2, deactivated_at = CASE WHEN $2 THEN NULL ELSE NOW() END
+WHERE id = $1 AND deleted_at IS NULL
+
+-- name: auth/anonymize
+UPDATE ai.users SET email = 'deleted-' || id || '@deleted.invalid', password_hash = '', display_name = '', timezone = '', locale = '',
+    is_admin = false, is_active = false, deactivated_at = COALESCE(deactivated_at, NOW()), deleted_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+
+-- name: auth/list_accounts
+SELECT id, email, is_admin, is_active, created_at, last_logged_in, deactivated_at, deleted_at FROM ai.users ORDER BY id
+
+-- name: auth/get_account
+SELECT id, email, is_admin, is_active, created_at, last_logged_in, deactivated_at, deleted_at FROM ai.users WHERE id = $1
+
+-- name: auth/count_active_admins
+SELECT COUNT(*) FROM ai.users WHERE is_admin = true AND is_active = true
@@ -0,0 +1,43 @@
+-- name: notifications/list_webhooks_by_project
+SELECT id, project_id, url, secret, events, is_active, created_at
+FROM ai.project_webhooks
+WHERE project_id = $1
+ORDER BY id
+
+-- name: notifications/list_active_webhooks_by_project
+SELECT id, project_id, url, secret, events, is_active, created_at
+FROM ai.project_webhooks
+WHERE project_id = $1 AND is_active = TRUE
+ORDER BY id
+
+-- name: notifications/create_webhook
+INSERT INTO ai.project_webhooks (project_id, url, secret, events, created_by)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, created_at
+
+-- name: notifications/delete_webhook
+DELETE FROM ai.project_webhooks WHERE id = $1 AND project_id = $2
+
+-- name: notifications/create_delivery
+INSERT INTO ai.notification_deliveries (run_id, project_id, webhook_id, event, channel, target)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id
+
+-- name: notifications/update_delivery
+UPDATE ai.notification_deliveries
+SET status = $2, attempts = $3, response_code = $4, last_error = $5, updated_at = NOW()
+WHERE id = $1
+
+-- name: notifications/list_deliveries_by_project
+SELECT id, run_id, webhook_id, event, channel, target, status, attempts, response_code, COALESCE(last_error, '') AS last_error, created_at, updated_at
+FROM ai.notification_deliveries
+WHERE project_id = $1
+ORDER BY created_at DESC
+LIMIT $2
+
+-- name: notifications/list_deliveries_by_run
+SELECT id, run_id, webhook_id, event, channel, target, status, attempts, response_code, COALESCE(last_error, '') AS last_error, created_at, updated_at
+FROM ai.notification_deliveries
+WHERE run_id = $1
+ORDER BY created_at DESC
+LIMIT $2
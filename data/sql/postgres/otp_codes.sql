@@ -0,0 +1,26 @@
+-- name: otp_codes/upsert
+INSERT INTO ai.otp_codes (email, code_hash, expires_at, attempts, ip, created_at)
+VALUES ($1, $2, $3, $4, $5, NOW())
+ON CONFLICT (email) DO UPDATE
+SET code_hash = EXCLUDED.code_hash, expires_at = EXCLUDED.expires_at, attempts = EXCLUDED.attempts,
+    ip = EXCLUDED.ip, created_at = NOW()
+
+-- name: otp_codes/get
+SELECT email, code_hash, expires_at, attempts, COALESCE(ip, ''), created_at
+FROM ai.otp_codes
+WHERE email = $1
+
+-- name: otp_codes/increment_attempts
+UPDATE ai.otp_codes SET attempts = attempts + 1 WHERE email = $1 RETURNING attempts
+
+-- name: otp_codes/consume
+DELETE FROM ai.otp_codes WHERE email = $1 AND code_hash = $2
+
+-- name: otp_codes/delete
+DELETE FROM ai.otp_codes WHERE email = $1
+
+-- name: otp_codes/delete_expired
+DELETE FROM ai.otp_codes WHERE expires_at < $1
+
+-- name: otp_codes/delete_for_email
+DELETE FROM ai.otp_codes WHERE lower(email) = lower($1)
@@ -26,4 +26,20 @@ WHERE id = $7;
 
 -- name: DeleteProjectDB
 DELETE FROM ai.project_dbs
-WHERE id = $1; 
\ No newline at end of file
+WHERE id = $1; 
+
+-- name: GetProjectDBProjectID
+SELECT project_id
+FROM ai.project_dbs
+WHERE id = $1;
+
+-- name: GetProjectUserDirectory
+SELECT id, user_directory
+FROM ai.project_dbs
+WHERE project_id = $1 AND is_default AND user_directory IS NOT NULL
+LIMIT 1;
+
+-- name: SetProjectDBUserDirectory
+UPDATE ai.project_dbs
+SET user_directory = $2
+WHERE id = $1;
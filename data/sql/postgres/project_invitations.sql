@@ -0,0 +1,43 @@
+-- name: project_invitations/create
+INSERT INTO ai.project_invitations (project_id, email, role, token_hash, invited_by, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, created_at, sent_at
+
+-- name: project_invitations/get
+SELECT id, project_id, email, role, invited_by, created_at, sent_at, expires_at, accepted_at, accepted_by, revoked_at
+FROM ai.project_invitations
+WHERE id = $1
+
+-- name: project_invitations/get_by_token
+SELECT id, project_id, email, role, invited_by, created_at, sent_at, expires_at, accepted_at, accepted_by, revoked_at
+FROM ai.project_invitations
+WHERE token_hash = $1
+
+-- name: project_invitations/list_pending
+SELECT id, project_id, email, role, invited_by, created_at, sent_at, expires_at, accepted_at, accepted_by, revoked_at
+FROM ai.project_invitations
+WHERE project_id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+ORDER BY created_at DESC
+
+-- name: project_invitations/renew
+UPDATE ai.project_invitations SET token_hash = $2, expires_at = $3, sent_at = NOW()
+WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+
+-- name: project_invitations/accept
+UPDATE ai.project_invitations SET accepted_at = NOW(), accepted_by = $2
+WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+
+-- name: project_invitations/revoke
+UPDATE ai.project_invitations SET revoked_at = NOW()
+WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+
+-- name: project_invitations/revoke_pending_for_email
+UPDATE ai.project_invitations SET revoked_at = NOW()
+WHERE project_id = $1 AND lower(email) = lower($2) AND accepted_at IS NULL AND revoked_at IS NULL
+
+-- name: project_invitations/anonymize_for_email
+-- Used when an account is deleted: the invitations keep their history under the anonymized address ($2)
+-- and those still pending are revoked
+UPDATE ai.project_invitations
+SET email = $2, revoked_at = CASE WHEN accepted_at IS NULL THEN COALESCE(revoked_at, NOW()) ELSE revoked_at END
+WHERE lower(email) = lower($1)
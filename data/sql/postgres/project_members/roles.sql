@@ -0,0 +1,24 @@
+-- name: project_members/read_role
+SELECT role FROM ai.project_members
+WHERE project_id = $1 AND user_id = $2
+
+-- name: project_members/roles_by_user_id
+SELECT project_id, role FROM ai.project_members
+WHERE user_id = $1
+
+-- name: project_members/list_with_roles
+SELECT pm.user_id, u.email, pm.role, pm.created_at
+FROM ai.project_members pm
+JOIN ai.users u ON u.id = pm.user_id
+WHERE pm.project_id = $1
+
+-- name: project_members/set_role
+INSERT INTO ai.project_members (project_id, user_id, role)
+VALUES ($1, $2, $3)
+ON CONFLICT (project_id, user_id) DO UPDATE SET role = EXCLUDED.role
+
+-- name: project_members/lock_owners
+SELECT user_id FROM ai.project_members
+WHERE project_id = $1 AND role = 'owner'
+ORDER BY user_id
+FOR UPDATE
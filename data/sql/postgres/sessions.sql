@@ -0,0 +1,52 @@
+-- name: sessions/create
+INSERT INTO ai.sessions (id, user_id, email, is_admin, refresh_hash, ip, user_agent, created_at, last_seen_at, expires_at, project_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW(), $8, $9)
+
+-- name: sessions/get
+-- The admin flag is read from the user when it still exists, so demotions apply on the next refresh.
+-- Accounts from project user directories (project_id <> 0) are never matched against ai.users.
+SELECT s.id, s.user_id, s.email, COALESCE(u.is_admin, s.is_admin), s.refresh_hash, COALESCE(s.prev_refresh_hash, ''),
+       COALESCE(s.ip, ''), COALESCE(s.user_agent, ''), s.created_at, s.last_seen_at, s.rotated_at, s.expires_at, s.revoked_at, s.project_id
+FROM ai.sessions s
+LEFT JOIN ai.users u ON s.project_id = 0 AND u.id = s.user_id AND u.email = s.email
+WHERE s.id = $1
+
+-- name: sessions/rotate
+UPDATE ai.sessions
+SET prev_refresh_hash = refresh_hash, refresh_hash = $3, rotated_at = NOW(), last_seen_at = NOW(), expires_at = $4, ip = $5
+WHERE id = $1 AND refresh_hash = $2 AND revoked_at IS NULL
+
+-- name: sessions/list_by_user
+SELECT s.id, s.user_id, s.email, COALESCE(u.is_admin, s.is_admin), s.refresh_hash, COALESCE(s.prev_refresh_hash, ''),
+       COALESCE(s.ip, ''), COALESCE(s.user_agent, ''), s.created_at, s.last_seen_at, s.rotated_at, s.expires_at, s.revoked_at, s.project_id
+FROM ai.sessions s
+LEFT JOIN ai.users u ON s.project_id = 0 AND u.id = s.user_id AND u.email = s.email
+WHERE s.user_id = $1 AND s.project_id = $2 AND s.revoked_at IS NULL AND s.expires_at > NOW()
+ORDER BY s.last_seen_at DESC
+
+-- name: sessions/revoke
+UPDATE ai.sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL
+
+-- name: sessions/revoke_user
+UPDATE ai.sessions SET revoked_at = NOW() WHERE user_id = $1 AND project_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+
+-- name: sessions/delete_expired
+-- Revoked sessions are kept for a day so refresh token reuse is still recognised
+DELETE FROM ai.sessions WHERE expires_at < $1 OR revoked_at < $1::timestamptz - INTERVAL '1 day'
+
+-- name: sessions/count_devices
+SELECT COUNT(*) FROM ai.user_devices WHERE user_id = $1
+
+-- name: sessions/remember_device
+-- Returns true when the device was not known yet
+INSERT INTO ai.user_devices (user_id, device_hash, description, first_seen_at, last_seen_at)
+VALUES ($1, $2, $3, NOW(), NOW())
+ON CONFLICT (user_id, device_hash) DO UPDATE SET last_seen_at = NOW()
+RETURNING (xmax = 0)
+
+-- name: sessions/delete_by_user
+-- Used when an ai.users account is deleted; the rows hold its email, IPs and user agents
+DELETE FROM ai.sessions WHERE user_id = $1 AND project_id = 0
+
+-- name: sessions/delete_devices
+DELETE FROM ai.user_devices WHERE user_id = $1
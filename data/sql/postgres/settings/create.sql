@@ -2,3 +2,9 @@
 INSERT INTO ai.settings (key, value, description, scope, scope_id)
 VALUES ($1, $2, $3, $4, $5)
 RETURNING id, key, value, description, scope, scope_id, updated_at
+
+-- name: settings/create_if_absent
+-- Inserts nothing when the key already exists in the scope, so concurrent creators can tell who won
+INSERT INTO ai.settings (key, value, scope, scope_id, updated_at)
+VALUES ($1, $2, $3, $4, NOW())
+ON CONFLICT (key, scope, COALESCE(scope_id, 0)) DO NOTHING
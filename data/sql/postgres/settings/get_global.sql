@@ -1,4 +1,4 @@
 -- name: settings/get_global
-SELECT id, key, value, description, scope, scope_id, updated_at
+SELECT id, key, COALESCE(value, '') AS value, COALESCE(description, '') AS description, scope, scope_id, updated_at
 FROM ai.settings
 WHERE key = $1 AND scope = 'global'
\ No newline at end of file
@@ -1,4 +1,4 @@
 -- name: settings/get_scoped
-SELECT id, key, value, description, scope, scope_id, updated_at
+SELECT id, key, COALESCE(value, '') AS value, COALESCE(description, '') AS description, scope, scope_id, updated_at
 FROM ai.settings
 WHERE key = $1 AND scope = $2 AND scope_id = $3 
\ No newline at end of file
@@ -17,3 +17,9 @@ VALUES ($1, $2, $3, $4, NOW())
 ON CONFLICT (key, scope, COALESCE(scope_id, 0))
 DO UPDATE SET value = $2, updated_at = NOW()
 RETURNING id, key, value, description, scope, scope_id, updated_at
+
+-- name: settings/compare_and_swap
+-- Updates the value only while it is still $5, the value the caller read
+UPDATE ai.settings
+SET value = $4, updated_at = NOW()
+WHERE key = $1 AND scope = $2 AND COALESCE(scope_id, 0) = COALESCE($3, 0) AND COALESCE(value, '') = $5
@@ -0,0 +1,17 @@
+-- name: signing_keys/create
+INSERT INTO ai.signing_keys (kid, algorithm, private_key, created_at)
+VALUES ($1, $2, $3, $4)
+
+-- name: signing_keys/list
+-- Keys that still verify tokens, newest first
+SELECT kid, algorithm, private_key, created_at, retired_at, expires_at
+FROM ai.signing_keys
+WHERE expires_at IS NULL OR expires_at > NOW()
+ORDER BY created_at DESC
+
+-- name: signing_keys/retire_others
+UPDATE ai.signing_keys SET retired_at = $2, expires_at = $3
+WHERE kid <> $1 AND retired_at IS NULL
+
+-- name: signing_keys/delete_expired
+DELETE FROM ai.signing_keys WHERE expires_at < $1
@@ -0,0 +1,31 @@
+-- name: two_factor/get
+SELECT t.secret_enc, t.enabled_at IS NOT NULL, t.last_step,
+       (SELECT COUNT(*) FROM ai.user_recovery_codes c WHERE c.user_id = t.user_id AND c.used_at IS NULL)
+FROM ai.user_totp t
+WHERE t.user_id = $1
+
+-- name: two_factor/save_pending
+-- Only replaces a secret that has not been enabled yet
+INSERT INTO ai.user_totp (user_id, secret_enc, created_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT (user_id) DO UPDATE
+SET secret_enc = EXCLUDED.secret_enc, last_step = 0, created_at = NOW()
+WHERE ai.user_totp.enabled_at IS NULL
+
+-- name: two_factor/enable
+UPDATE ai.user_totp SET enabled_at = NOW(), last_step = $2 WHERE user_id = $1 AND enabled_at IS NULL
+
+-- name: two_factor/use_step
+UPDATE ai.user_totp SET last_step = $2 WHERE user_id = $1 AND last_step < $2
+
+-- name: two_factor/delete_recovery_codes
+DELETE FROM ai.user_recovery_codes WHERE user_id = $1
+
+-- name: two_factor/insert_recovery_code
+INSERT INTO ai.user_recovery_codes (user_id, code_hash, created_at) VALUES ($1, $2, NOW())
+
+-- name: two_factor/use_recovery_code
+UPDATE ai.user_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+
+-- name: two_factor/delete
+DELETE FROM ai.user_totp WHERE user_id = $1
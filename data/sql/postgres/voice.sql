@@ -0,0 +1,42 @@
+-- name: voice/create_conversation
+INSERT INTO ai.voice_conversations (user_id, project_id, persona)
+VALUES ($1, $2, $3)
+RETURNING id
+
+-- name: voice/add_turn
+INSERT INTO ai.voice_turns (conversation_id, role, text, ssml)
+VALUES ($1, $2, $3, $4)
+
+-- name: voice/touch_conversation
+UPDATE ai.voice_conversations SET updated_at = NOW() WHERE id = $1
+
+-- name: voice/read_conversation
+SELECT id, COALESCE(user_id, 0) AS user_id, COALESCE(project_id, 0) AS project_id, COALESCE(persona, '') AS persona, started_at, updated_at
+FROM ai.voice_conversations
+WHERE id = $1
+
+-- name: voice/list_conversations_by_user
+SELECT c.id, COALESCE(c.user_id, 0), COALESCE(c.project_id, 0), COALESCE(c.persona, ''), c.started_at, c.updated_at,
+       (SELECT COUNT(*) FROM ai.voice_turns t WHERE t.conversation_id = c.id) AS turn_count
+FROM ai.voice_conversations c
+WHERE c.user_id = $1
+ORDER BY c.updated_at DESC
+LIMIT $2
+
+-- name: voice/list_conversations_by_project
+SELECT c.id, COALESCE(c.user_id, 0), COALESCE(c.project_id, 0), COALESCE(c.persona, ''), c.started_at, c.updated_at,
+       (SELECT COUNT(*) FROM ai.voice_turns t WHERE t.conversation_id = c.id) AS turn_count
+FROM ai.voice_conversations c
+WHERE c.project_id = $1
+ORDER BY c.updated_at DESC
+LIMIT $2
+
+-- name: voice/list_turns
+SELECT role, text, COALESCE(ssml, '') AS ssml, created_at
+FROM ai.voice_turns
+WHERE conversation_id = $1
+ORDER BY id
+
+-- name: voice/delete_by_user
+-- Their turns go with them (ON DELETE CASCADE)
+DELETE FROM ai.voice_conversations WHERE user_id = $1
@@ -0,0 +1,40 @@
+-- name: webauthn/create_credential
+-- Returns no row when the credential ID is already registered
+INSERT INTO ai.webauthn_credentials (user_id, rp_id, credential_id, public_key, sign_count, transports, name, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+ON CONFLICT (credential_id) DO NOTHING
+RETURNING id, created_at
+
+-- name: webauthn/get_credential
+SELECT id, user_id, rp_id, credential_id, public_key, sign_count, transports, name, created_at, last_used_at
+FROM ai.webauthn_credentials
+WHERE rp_id = $1 AND credential_id = $2
+
+-- name: webauthn/list_credentials
+SELECT id, user_id, rp_id, credential_id, public_key, sign_count, transports, name, created_at, last_used_at
+FROM ai.webauthn_credentials
+WHERE user_id = $1
+ORDER BY id
+
+-- name: webauthn/use_credential
+-- Refuses counters that do not grow, which hints at a cloned authenticator; authenticators without a counter send 0
+UPDATE ai.webauthn_credentials SET sign_count = $2, last_used_at = $3
+WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))
+
+-- name: webauthn/delete_credential
+DELETE FROM ai.webauthn_credentials WHERE user_id = $1 AND id = $2
+
+-- name: webauthn/delete_expired_challenges
+DELETE FROM ai.webauthn_challenges WHERE expires_at < NOW()
+
+-- name: webauthn/save_challenge
+INSERT INTO ai.webauthn_challenges (challenge, ceremony, rp_id, user_id, expires_at)
+VALUES ($1, $2, $3, $4, $5)
+
+-- name: webauthn/take_challenge
+DELETE FROM ai.webauthn_challenges
+WHERE challenge = $1 AND expires_at > NOW()
+RETURNING ceremony, rp_id, user_id, expires_at
+
+-- name: webauthn/delete_by_user
+DELETE FROM ai.webauthn_credentials WHERE user_id = $1
@@ -0,0 +1,242 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// SMTP connection security modes
+const (
+	TLSModeStartTLS = "starttls" // Plain connection upgraded with STARTTLS (usually port 587)
+	TLSModeImplicit = "tls"      // TLS from the start (usually port 465)
+	TLSModeNone     = "none"     // No encryption; only for local relays
+)
+
+// SMTPMailer sends mail through an SMTP server.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string // No authentication when empty
+	Password string
+	From     string
+	TLSMode  string
+	Timeout  time.Duration
+}
+
+// Send delivers the message to the SMTP server.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if m.TLSMode == TLSModeImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.TLSMode == TLSModeStartTLS || m.TLSMode == "" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server %s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(bareAddress(msg.From)); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err := client.Rcpt(bareAddress(to)); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// bareAddress extracts addr from "Name <addr>"
+func bareAddress(address string) string {
+	if start, end := strings.LastIndex(address, "<"), strings.LastIndex(address, ">"); start != -1 && end > start {
+		return address[start+1 : end]
+	}
+	return strings.TrimSpace(address)
+}
+
+// FileMailer writes each message to a file, either as <Dir>/<id>.eml or into a maildir at Dir.
+type FileMailer struct {
+	Dir     string
+	Maildir bool // Write to Dir/tmp and move to Dir/new, as maildir readers expect
+	From    string
+}
+
+// Send writes the message to disk.
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%s.%s", time.Now().Unix(), os.Getpid(), randomHex(6), strings.ReplaceAll(hostname, "/", "_"))
+	if !m.Maildir {
+		if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(m.Dir, name+".eml"), data, 0o644)
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, sub), 0o755); err != nil {
+			return err
+		}
+	}
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(m.Dir, "new", name))
+}
+
+// StdoutMailer prints messages instead of sending them, for local development.
+type StdoutMailer struct {
+	W    io.Writer // Defaults to os.Stdout
+	From string
+}
+
+// Send prints the message headers and plain text body.
+func (m *StdoutMailer) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	if err := msg.validate(); err != nil {
+		return err
+	}
+	w := m.W
+	if w == nil {
+		w = os.Stdout
+	}
+	_, err := fmt.Fprintf(w, "----- mail -----\nFrom: %s\nTo: %s\nSubject: %s\n\n%s\n----------------\n",
+		msg.From, strings.Join(msg.To, ", "), msg.Subject, msg.Text)
+	return err
+}
+
+// NewFromEnv creates a mailer from the environment.
+//
+//	MAIL_BACKEND   smtp, file, maildir or stdout (default smtp when SMTP_HOST is set, otherwise required)
+//	MAIL_FROM      sender address (default SMTP_FROM)
+//	MAIL_DIR       directory for the file and maildir backends (default ./data/outbox)
+//	SMTP_HOST, SMTP_PORT, SMTP_PASSWORD
+//	SMTP_USERNAME  (default "resend" when only SMTP_PASSWORD is set)
+//	SMTP_TLS       starttls, tls or none (default tls on port 465, starttls otherwise)
+func NewFromEnv() (Mailer, error) {
+	from := common.GetEnvOrDefault("MAIL_FROM", common.GetEnv("SMTP_FROM"))
+	backend := strings.ToLower(common.GetEnv("MAIL_BACKEND"))
+	if backend == "" {
+		if common.GetEnv("SMTP_HOST") == "" {
+			// Login links and invitations must not end up in a log by accident
+			return nil, fmt.Errorf("no mail backend configured: set SMTP_HOST, or MAIL_BACKEND to smtp, file, maildir or stdout")
+		}
+		backend = "smtp"
+	}
+
+	switch backend {
+	case "smtp":
+		host := common.GetEnv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mail backend")
+		}
+		port, err := strconv.Atoi(common.GetEnvOrDefault("SMTP_PORT", "587"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PORT: %w", err)
+		}
+		tlsMode := strings.ToLower(common.GetEnv("SMTP_TLS"))
+		if tlsMode == "" {
+			tlsMode = TLSModeStartTLS
+			if port == 465 {
+				tlsMode = TLSModeImplicit
+			}
+		}
+		if tlsMode != TLSModeStartTLS && tlsMode != TLSModeImplicit && tlsMode != TLSModeNone {
+			return nil, fmt.Errorf("invalid SMTP_TLS %q: use starttls, tls or none", tlsMode)
+		}
+		username := common.GetEnv("SMTP_USERNAME")
+		if username == "" && common.GetEnv("SMTP_PASSWORD") != "" {
+			username = "resend" // Earlier versions always authenticated as Resend's API user
+		}
+		return &SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: username,
+			Password: common.GetEnv("SMTP_PASSWORD"),
+			From:     from,
+			TLSMode:  tlsMode,
+		}, nil
+	case "file", "maildir":
+		return &FileMailer{
+			Dir:     common.GetEnvOrDefault("MAIL_DIR", "./data/outbox"),
+			Maildir: backend == "maildir",
+			From:    from,
+		}, nil
+	case "stdout":
+		return &StdoutMailer{From: from}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q: use smtp, file, maildir or stdout", backend)
+	}
+}
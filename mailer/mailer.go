@@ -0,0 +1,180 @@
+// Package mailer delivers outgoing email through a configurable backend (SMTP, files or stdout)
+// and renders messages from text and HTML templates.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an email with a plain text body and an optional HTML alternative.
+type Message struct {
+	From    string // Defaults to the backend's sender
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// MailerFunc adapts a function to the Mailer interface.
+type MailerFunc func(ctx context.Context, msg Message) error
+
+// Send calls f(ctx, msg).
+func (f MailerFunc) Send(ctx context.Context, msg Message) error {
+	return f(ctx, msg)
+}
+
+var (
+	defaultMailer Mailer
+	defaultMu     sync.Mutex
+)
+
+// Default returns the mailer configured from the environment, creating it on first use.
+// If the configuration is missing or invalid, every Send fails with the configuration error.
+func Default() Mailer {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultMailer == nil {
+		m, err := NewFromEnv()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mailer: %v; mail will not be sent\n", err)
+			m = failingMailer(err)
+		}
+		defaultMailer = m
+	}
+	return defaultMailer
+}
+
+// failingMailer returns a mailer that refuses every message with err
+func failingMailer(err error) Mailer {
+	err = fmt.Errorf("mail is not configured: %w", err)
+	return MailerFunc(func(ctx context.Context, msg Message) error {
+		return err
+	})
+}
+
+// SetDefault replaces the mailer returned by Default.
+func SetDefault(m Mailer) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultMailer = m
+}
+
+// Send renders the named template with data and delivers it to one recipient through the default mailer.
+func Send(ctx context.Context, to, template string, data interface{}) error {
+	msg, err := Render(template, data)
+	if err != nil {
+		return err
+	}
+	msg.To = []string{to}
+	return Default().Send(ctx, msg)
+}
+
+// validate rejects messages without recipients and header values that could inject headers
+func (m Message) validate() error {
+	if len(m.To) == 0 {
+		return errors.New("message has no recipients")
+	}
+	for _, value := range append([]string{m.From, m.Subject}, m.To...) {
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("message headers must not contain line breaks")
+		}
+	}
+	return nil
+}
+
+// Bytes formats the message as MIME, using multipart/alternative when there is an HTML body.
+func (m Message) Bytes() ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", m.From)
+	header("To", strings.Join(m.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID(m.From))
+	header("MIME-Version", "1.0")
+
+	if m.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, m.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", parts.Boundary()))
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// writeQuotedPrintable writes content with CRLF line endings in quoted-printable encoding
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(content, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// messageID creates a unique Message-ID in the sender's domain
+func messageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at != -1 {
+		domain = strings.TrimRight(from[at+1:], ">")
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), randomHex(8), domain)
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
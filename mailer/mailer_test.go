@@ -0,0 +1,163 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMessageBytes tests multipart formatting and header injection checks
+func TestMessageBytes(t *testing.T) {
+	msg := Message{From: "App <app@example.com>", To: []string{"user@example.com"}, Subject: "Hello", Text: "Plain body", HTML: "<p>HTML body</p>"}
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("Failed to format message: %v", err)
+	}
+	for _, want := range []string{"Subject: Hello\r\n", "multipart/alternative", "text/plain; charset=utf-8", "Plain body", "<p>HTML body</p>", "@example.com>\r\n"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("Expected message to contain %q:\n%s", want, data)
+		}
+	}
+
+	msg.Subject = "Hello\r\nBcc: victim@example.com"
+	if _, err := msg.Bytes(); err == nil {
+		t.Error("Expected line breaks in headers to be rejected")
+	}
+}
+
+// TestRenderTemplates tests that the shipped templates render subject, text and escaped HTML
+func TestRenderTemplates(t *testing.T) {
+	TemplateDir = "../data/mail"
+	t.Cleanup(func() { TemplateDir = "" })
+
+	msg, err := Render("otp", map[string]string{"AppName": "Acme <Dev>", "Code": "123456", "ExpiresIn": "5 minutes"})
+	if err != nil {
+		t.Fatalf("Failed to render otp template: %v", err)
+	}
+	if msg.Subject != "Your Acme <Dev> login code" {
+		t.Errorf("Unexpected subject %q", msg.Subject)
+	}
+	if !strings.Contains(msg.Text, "Your verification code is: 123456") {
+		t.Errorf("Unexpected text body %q", msg.Text)
+	}
+	if !strings.Contains(msg.HTML, "Acme &lt;Dev&gt;") || !strings.Contains(msg.HTML, "123456") {
+		t.Errorf("Expected escaped HTML body, got %q", msg.HTML)
+	}
+
+	if _, err := Render("../otp", nil); err == nil {
+		t.Error("Expected template names with paths to be rejected")
+	}
+}
+
+// TestDefaultWithoutBackend tests that mail fails rather than going to stdout when no backend is configured
+func TestDefaultWithoutBackend(t *testing.T) {
+	if os.Getenv("MAIL_BACKEND") != "" || os.Getenv("SMTP_HOST") != "" {
+		t.Skip("A mail backend is configured in the environment")
+	}
+	SetDefault(nil)
+	t.Cleanup(func() { SetDefault(nil) })
+
+	if _, err := NewFromEnv(); err == nil {
+		t.Error("Expected NewFromEnv to fail without a backend")
+	}
+	err := Default().Send(context.Background(), Message{To: []string{"user@example.com"}, Subject: "Hi", Text: "Body"})
+	if err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("Expected sending to fail as not configured, got %v", err)
+	}
+}
+
+// TestFileMailerMaildir tests that messages are delivered into the maildir's new directory
+func TestFileMailerMaildir(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir, Maildir: true, From: "app@example.com"}
+	if err := m.Send(context.Background(), Message{To: []string{"user@example.com"}, Subject: "Hi", Text: "Body"}); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	files, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message in new/, got %d", len(files))
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("Expected tmp/ to be empty, got %d files", len(tmp))
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if !bytes.Contains(data, []byte("From: app@example.com")) {
+		t.Errorf("Expected the backend sender, got:\n%s", data)
+	}
+}
+
+// TestSMTPMailer tests delivery and authentication against an in-process SMTP server
+func TestSMTPMailer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var log []string
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 test ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			log = append(log, line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO":
+				reply("250-test")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				reply("235 ok")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					dataLine, _ := r.ReadString('\n')
+					if dataLine == ".\r\n" || dataLine == "" {
+						break
+					}
+					log = append(log, strings.TrimRight(dataLine, "\r\n"))
+				}
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				received <- log
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		received <- log
+	}()
+
+	port, _ := strconv.Atoi(strings.Split(listener.Addr().String(), ":")[1])
+	m := &SMTPMailer{Host: "127.0.0.1", Port: port, Username: "apikey", Password: "secret", From: "App <app@example.com>", TLSMode: TLSModeNone}
+	if err := m.Send(context.Background(), Message{To: []string{"user@example.com"}, Subject: "Hi", Text: "Body"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	session := strings.Join(<-received, "\n")
+	auth := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00apikey\x00secret"))
+	for _, want := range []string{auth, "MAIL FROM:<app@example.com>", "RCPT TO:<user@example.com>", "Subject: Hi"} {
+		if !strings.Contains(session, want) {
+			t.Errorf("Expected SMTP session to contain %q:\n%s", want, session)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// TemplateDir overrides the directory holding the mail templates (default MAIL_TEMPLATE_DIR or ./data/mail).
+// Each message has a <name>.txt template that defines a "subject" block and the plain text body,
+// and optionally a <name>.html template for the HTML body.
+var TemplateDir string
+
+// templateDir returns the directory to load templates from
+func templateDir() string {
+	if TemplateDir != "" {
+		return TemplateDir
+	}
+	return common.GetEnvOrDefault("MAIL_TEMPLATE_DIR", "./data/mail")
+}
+
+// Render builds a message from the named templates. Recipients are left for the caller to set.
+func Render(name string, data interface{}) (Message, error) {
+	var msg Message
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return msg, fmt.Errorf("invalid mail template name %q", name)
+	}
+
+	textPath := filepath.Join(templateDir(), name+".txt")
+	textTpl, err := texttemplate.ParseFiles(textPath)
+	if err != nil {
+		return msg, fmt.Errorf("failed to load mail template %s: %w", name, err)
+	}
+	if textTpl.Lookup("subject") == nil {
+		return msg, fmt.Errorf("mail template %s has no subject block", name)
+	}
+
+	var subject, text bytes.Buffer
+	if err := textTpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return msg, fmt.Errorf("failed to render subject of %s: %w", name, err)
+	}
+	if err := textTpl.ExecuteTemplate(&text, filepath.Base(textPath), data); err != nil {
+		return msg, fmt.Errorf("failed to render mail template %s: %w", name, err)
+	}
+	msg.Subject = strings.Join(strings.Fields(subject.String()), " ")
+	msg.Text = strings.TrimSpace(text.String()) + "\n"
+
+	htmlPath := filepath.Join(templateDir(), name+".html")
+	if _, err := os.Stat(htmlPath); errors.Is(err, os.ErrNotExist) {
+		return msg, nil
+	}
+	htmlTpl, err := htmltemplate.ParseFiles(htmlPath)
+	if err != nil {
+		return msg, fmt.Errorf("failed to load mail template %s.html: %w", name, err)
+	}
+	var html bytes.Buffer
+	if err := htmlTpl.Execute(&html, data); err != nil {
+		return msg, fmt.Errorf("failed to render mail template %s.html: %w", name, err)
+	}
+	msg.HTML = html.String()
+	return msg, nil
+}
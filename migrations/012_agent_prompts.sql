@@ -0,0 +1,22 @@
+-- 012_agent_prompts.sql: Allow per-scope settings and record agent runs
+-- Settings are unique per key, scope and scope id (matches the ON CONFLICT target of the upsert queries)
+ALTER TABLE ai.settings DROP CONSTRAINT IF EXISTS settings_key_scope_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_settings_key_scope_id ON ai.settings (key, scope, COALESCE(scope_id, 0));
+
+-- Agent runs record which prompt versions were used
+CREATE TABLE IF NOT EXISTS ai.agent_runs (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES ai.users(id) ON DELETE SET NULL,
+    project_id INTEGER REFERENCES ai.projects(id) ON DELETE SET NULL,
+    goal TEXT NOT NULL,
+    model TEXT,
+    system_prompt_name TEXT NOT NULL,
+    system_prompt_scope TEXT NOT NULL,
+    system_prompt_version INTEGER NOT NULL DEFAULT 0,
+    goal_template_name TEXT NOT NULL,
+    goal_template_scope TEXT NOT NULL,
+    goal_template_version INTEGER NOT NULL DEFAULT 0,
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_runs_user ON ai.agent_runs(user_id);
@@ -0,0 +1,32 @@
+-- 013_agent_notifications.sql: Project webhooks and notification delivery log for agent runs
+CREATE TABLE IF NOT EXISTS ai.project_webhooks (
+    id SERIAL PRIMARY KEY,
+    project_id INTEGER NOT NULL REFERENCES ai.projects(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL DEFAULT 'finished,error,blocked', -- Comma separated event names
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by INTEGER REFERENCES ai.users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_project_webhooks_project ON ai.project_webhooks(project_id);
+
+CREATE TABLE IF NOT EXISTS ai.notification_deliveries (
+    id SERIAL PRIMARY KEY,
+    run_id INTEGER REFERENCES ai.agent_runs(id) ON DELETE CASCADE,
+    project_id INTEGER REFERENCES ai.projects(id) ON DELETE CASCADE,
+    webhook_id INTEGER REFERENCES ai.project_webhooks(id) ON DELETE SET NULL,
+    event TEXT NOT NULL,
+    channel TEXT NOT NULL CHECK (channel IN ('email', 'webhook')),
+    target TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_code INTEGER,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_run ON ai.notification_deliveries(run_id);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_project ON ai.notification_deliveries(project_id, created_at DESC);
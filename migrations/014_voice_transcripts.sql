@@ -0,0 +1,23 @@
+-- 014_voice_transcripts.sql: Store voice conversations for review
+CREATE TABLE IF NOT EXISTS ai.voice_conversations (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES ai.users(id) ON DELETE CASCADE,
+    project_id INTEGER REFERENCES ai.projects(id) ON DELETE SET NULL,
+    persona TEXT,
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_voice_conversations_user ON ai.voice_conversations(user_id, updated_at DESC);
+CREATE INDEX IF NOT EXISTS idx_voice_conversations_project ON ai.voice_conversations(project_id, updated_at DESC);
+
+CREATE TABLE IF NOT EXISTS ai.voice_turns (
+    id SERIAL PRIMARY KEY,
+    conversation_id INTEGER NOT NULL REFERENCES ai.voice_conversations(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('user', 'assistant')),
+    text TEXT NOT NULL,
+    ssml TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_voice_turns_conversation ON ai.voice_turns(conversation_id, id);
@@ -0,0 +1,11 @@
+-- 015_otp_codes.sql: Store pending OTP codes so logins survive restarts and work across instances
+CREATE TABLE IF NOT EXISTS ai.otp_codes (
+    email TEXT PRIMARY KEY,
+    code_hash TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    ip TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_otp_codes_expires_at ON ai.otp_codes(expires_at);
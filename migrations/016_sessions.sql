@@ -0,0 +1,19 @@
+-- 016_sessions.sql: Persist login sessions so they can be refreshed, listed and revoked
+CREATE TABLE IF NOT EXISTS ai.sessions (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    email TEXT NOT NULL,
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    refresh_hash TEXT NOT NULL,
+    prev_refresh_hash TEXT,
+    ip TEXT,
+    user_agent TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    rotated_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON ai.sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON ai.sessions(expires_at);
@@ -0,0 +1,9 @@
+-- 017_user_devices.sql: Remember the devices users log in from, to alert on logins from new ones
+CREATE TABLE IF NOT EXISTS ai.user_devices (
+    user_id INTEGER NOT NULL,
+    device_hash TEXT NOT NULL,
+    description TEXT,
+    first_seen_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (user_id, device_hash)
+);
@@ -0,0 +1,17 @@
+-- 018_two_factor.sql: TOTP second factor and recovery codes
+CREATE TABLE IF NOT EXISTS ai.user_totp (
+    user_id INTEGER PRIMARY KEY,
+    secret_enc TEXT NOT NULL, -- AES-GCM encrypted base32 secret
+    enabled_at TIMESTAMP WITH TIME ZONE, -- NULL until the first code is verified
+    last_step BIGINT NOT NULL DEFAULT 0, -- Last accepted time step, so codes cannot be replayed
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS ai.user_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (user_id, code_hash)
+);
@@ -0,0 +1,15 @@
+-- 019_api_tokens.sql: Personal access tokens for scripts calling the API with Authorization: Bearer
+CREATE TABLE IF NOT EXISTS ai.api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL, -- Start of the token, shown so users can tell their tokens apart
+    token_hash TEXT NOT NULL UNIQUE, -- SHA-256 of the token; the token itself is only shown once
+    scopes TEXT NOT NULL DEFAULT 'read', -- Comma-separated: read, write, admin
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE, -- NULL for tokens that do not expire
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON ai.api_tokens(user_id);
@@ -0,0 +1,22 @@
+-- 020_project_members.sql: Project membership with roles (owner, admin, editor, viewer)
+CREATE TABLE IF NOT EXISTS ai.project_members (
+    project_id INTEGER NOT NULL REFERENCES ai.projects(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES ai.users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL DEFAULT 'viewer',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (project_id, user_id)
+);
+
+-- Older installs may have created the table by hand without roles
+ALTER TABLE ai.project_members ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'viewer';
+
+ALTER TABLE ai.project_members DROP CONSTRAINT IF EXISTS project_members_role_check;
+ALTER TABLE ai.project_members ADD CONSTRAINT project_members_role_check
+    CHECK (role IN ('owner', 'admin', 'editor', 'viewer'));
+
+CREATE INDEX IF NOT EXISTS idx_project_members_user_id ON ai.project_members(user_id);
+
+-- Creators of existing projects become their owners
+INSERT INTO ai.project_members (project_id, user_id, role)
+SELECT id, created_by, 'owner' FROM ai.projects WHERE created_by IS NOT NULL
+ON CONFLICT (project_id, user_id) DO UPDATE SET role = 'owner';
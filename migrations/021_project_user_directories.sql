@@ -0,0 +1,7 @@
+-- 021_project_user_directories.sql: Project user directories and project-bound sessions
+-- Table and column mapping of the users table in a project database (see common.UserDirectory); NULL when logins use ai.users
+ALTER TABLE ai.project_dbs ADD COLUMN IF NOT EXISTS user_directory JSONB;
+
+-- Project whose user directory holds the session's account; 0 for ai.users accounts
+ALTER TABLE ai.sessions ADD COLUMN IF NOT EXISTS project_id INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_sessions_project_user ON ai.sessions(project_id, user_id);
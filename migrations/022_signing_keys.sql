@@ -0,0 +1,9 @@
+-- 022_signing_keys.sql: Asymmetric keys that sign JWTs, published at /.well-known/jwks.json
+CREATE TABLE IF NOT EXISTS ai.signing_keys (
+    kid TEXT PRIMARY KEY, -- Key ID sent in the JWT header
+    algorithm TEXT NOT NULL, -- EdDSA or RS256
+    private_key TEXT NOT NULL, -- PKCS #8, encrypted with SIGNING_KEY_ENCRYPTION_KEY
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    retired_at TIMESTAMP WITH TIME ZONE, -- No longer signs; NULL for the active key
+    expires_at TIMESTAMP WITH TIME ZONE -- No longer verifies: retired_at plus the grace period
+);
@@ -0,0 +1,17 @@
+-- 023_project_invitations.sql: Invitations to join a project with a role, accepted through an emailed link
+CREATE TABLE IF NOT EXISTS ai.project_invitations (
+    id SERIAL PRIMARY KEY,
+    project_id INTEGER NOT NULL REFERENCES ai.projects(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'editor', 'viewer')),
+    token_hash TEXT NOT NULL UNIQUE, -- SHA-256 of the link token; replaced when the invitation is resent
+    invited_by INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    sent_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    accepted_at TIMESTAMP WITH TIME ZONE,
+    accepted_by INTEGER,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_project_invitations_project_id ON ai.project_invitations(project_id);
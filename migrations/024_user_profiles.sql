@@ -0,0 +1,12 @@
+-- 024_user_profiles.sql: Display name, timezone, locale and uploaded avatars for ai.users accounts
+ALTER TABLE ai.users
+ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT '', -- IANA name; empty uses the browser's
+ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT '';   -- BCP 47 tag; empty uses the browser's
+
+-- Resized PNG avatars; users without one are shown their Gravatar
+CREATE TABLE IF NOT EXISTS ai.user_avatars (
+    user_id INTEGER PRIMARY KEY REFERENCES ai.users(id) ON DELETE CASCADE,
+    image BYTEA NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
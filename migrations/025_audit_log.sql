@@ -0,0 +1,16 @@
+-- 025_audit_log.sql: Audit trail of sensitive actions, starting with admin impersonation
+CREATE TABLE IF NOT EXISTS ai.audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id INTEGER NOT NULL, -- Who acted: the admin, also while impersonating
+    actor_email TEXT NOT NULL,
+    user_id INTEGER NOT NULL DEFAULT 0, -- Whose account was acted on or as
+    user_email TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    impersonation_id TEXT NOT NULL DEFAULT '', -- Groups the requests of one impersonation
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor_id ON ai.audit_log(actor_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_log_user_id ON ai.audit_log(user_id, created_at);
@@ -0,0 +1,3 @@
+-- 026_drop_admin_tokens.sql: Daily admin tokens are replaced by break-glass recovery codes,
+-- which are kept in a local file so they work while the database is down
+DROP TABLE IF EXISTS ai.admin_tokens;
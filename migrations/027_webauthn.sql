@@ -0,0 +1,26 @@
+-- 027_webauthn.sql: Passkeys (WebAuthn credentials) of ai.users accounts and their pending ceremony challenges
+CREATE TABLE IF NOT EXISTS ai.webauthn_credentials (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES ai.users(id) ON DELETE CASCADE,
+    rp_id TEXT NOT NULL, -- Relying party (domain) the credential is scoped to
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL, -- COSE key
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports TEXT NOT NULL DEFAULT '', -- Comma-separated hints such as internal,hybrid
+    name TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON ai.webauthn_credentials(user_id);
+
+-- Challenges are single use: they are deleted when answered
+CREATE TABLE IF NOT EXISTS ai.webauthn_challenges (
+    challenge TEXT PRIMARY KEY,
+    ceremony TEXT NOT NULL, -- webauthn.create or webauthn.get
+    rp_id TEXT NOT NULL,
+    user_id INTEGER NOT NULL DEFAULT 0, -- Registering user; 0 for logins
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_challenges_expires_at ON ai.webauthn_challenges(expires_at);
@@ -0,0 +1,5 @@
+-- 028_user_lifecycle.sql: Deactivation and soft deletion of ai.users accounts
+ALTER TABLE ai.users
+ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT TRUE, -- Inactive accounts cannot log in or use sessions and API tokens
+ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE; -- Deleted accounts are kept anonymized so references stay valid
@@ -0,0 +1,9 @@
+-- Revert 012_agent_prompts.sql
+DROP TABLE IF EXISTS ai.agent_runs;
+DROP INDEX IF EXISTS ai.idx_settings_key_scope_id;
+
+-- The old constraint allows one row per key and scope, so settings of other scope ids cannot be kept
+DELETE FROM ai.settings s
+USING ai.settings keep
+WHERE s.key = keep.key AND s.scope = keep.scope AND s.id > keep.id;
+ALTER TABLE ai.settings ADD CONSTRAINT settings_key_scope_key UNIQUE (key, scope);
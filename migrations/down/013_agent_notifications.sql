@@ -0,0 +1,3 @@
+-- Revert 013_agent_notifications.sql
+DROP TABLE IF EXISTS ai.notification_deliveries;
+DROP TABLE IF EXISTS ai.project_webhooks;
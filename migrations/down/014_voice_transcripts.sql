@@ -0,0 +1,3 @@
+-- Revert 014_voice_transcripts.sql
+DROP TABLE IF EXISTS ai.voice_turns;
+DROP TABLE IF EXISTS ai.voice_conversations;
@@ -0,0 +1,2 @@
+-- Revert 015_otp_codes.sql
+DROP TABLE IF EXISTS ai.otp_codes;
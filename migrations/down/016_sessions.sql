@@ -0,0 +1,2 @@
+-- Revert 016_sessions.sql
+DROP TABLE IF EXISTS ai.sessions;
@@ -0,0 +1,2 @@
+-- Revert 017_user_devices.sql
+DROP TABLE IF EXISTS ai.user_devices;
@@ -0,0 +1,3 @@
+-- Revert 018_two_factor.sql
+DROP TABLE IF EXISTS ai.user_recovery_codes;
+DROP TABLE IF EXISTS ai.user_totp;
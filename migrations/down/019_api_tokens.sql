@@ -0,0 +1,2 @@
+-- Revert 019_api_tokens.sql
+DROP TABLE IF EXISTS ai.api_tokens;
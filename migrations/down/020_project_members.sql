@@ -0,0 +1,2 @@
+-- Revert 020_project_members.sql
+DROP TABLE IF EXISTS ai.project_members;
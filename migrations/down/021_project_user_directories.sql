@@ -0,0 +1,4 @@
+-- Revert 021_project_user_directories.sql
+DROP INDEX IF EXISTS ai.idx_sessions_project_user;
+ALTER TABLE ai.sessions DROP COLUMN IF EXISTS project_id;
+ALTER TABLE ai.project_dbs DROP COLUMN IF EXISTS user_directory;
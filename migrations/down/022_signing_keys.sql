@@ -0,0 +1,2 @@
+-- Revert 022_signing_keys.sql
+DROP TABLE IF EXISTS ai.signing_keys;
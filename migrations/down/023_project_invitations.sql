@@ -0,0 +1,2 @@
+-- Revert 023_project_invitations.sql
+DROP TABLE IF EXISTS ai.project_invitations;
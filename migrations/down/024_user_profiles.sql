@@ -0,0 +1,7 @@
+-- Revert 024_user_profiles.sql
+DROP TABLE IF EXISTS ai.user_avatars;
+
+ALTER TABLE ai.users
+DROP COLUMN IF EXISTS display_name,
+DROP COLUMN IF EXISTS timezone,
+DROP COLUMN IF EXISTS locale;
@@ -0,0 +1,2 @@
+-- Revert 025_audit_log.sql
+DROP TABLE IF EXISTS ai.audit_log;
@@ -0,0 +1,8 @@
+-- Revert 026_drop_admin_tokens.sql
+CREATE TABLE IF NOT EXISTS ai.admin_tokens (
+    token VARCHAR(255) PRIMARY KEY,
+    token_date DATE NOT NULL UNIQUE, -- Ensure only one token per date
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_tokens_date ON ai.admin_tokens (token_date);
@@ -0,0 +1,3 @@
+-- Revert 027_webauthn.sql
+DROP TABLE IF EXISTS ai.webauthn_challenges;
+DROP TABLE IF EXISTS ai.webauthn_credentials;
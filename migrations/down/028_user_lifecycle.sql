@@ -0,0 +1,5 @@
+-- Revert 028_user_lifecycle.sql
+ALTER TABLE ai.users
+DROP COLUMN IF EXISTS deleted_at,
+DROP COLUMN IF EXISTS deactivated_at,
+DROP COLUMN IF EXISTS is_active;
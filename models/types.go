@@ -38,6 +38,7 @@ type PageData struct {
 	Project        interface{}   // Consider a more specific type like *projects.Project
 	AdminEmail     string
 	AppVersion     string
+	CSRFToken      string        // Token of the CSRF cookie, rendered into the page head for scripts and forms
 	Stats          *AdminStats   // Admin dashboard statistics
 	CurrentHost    string        // Add CurrentHost field
 	RecentActivity []interface{} // Recent database activity for admin dashboard
@@ -37,7 +37,7 @@ func CreateProjectsHandler(templates types.TemplateEngineInterface, projectServi
 }
 
 // CreateProjectsAPIHandler creates a handler for the projects API
-func CreateProjectsAPIHandler(templates types.TemplateEngineInterface, projectService ProjectService, projectDBService common.ProjectDBService) http.HandlerFunc {
+func CreateProjectsAPIHandler(templates types.TemplateEngineInterface, projectService ProjectService, projectDBService common.ProjectDBService, userService auth.UserServicer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := auth.GetUserFromContext(r.Context())
 		if user == nil {
@@ -48,6 +48,24 @@ func CreateProjectsAPIHandler(templates types.TemplateEngineInterface, projectSe
 		// Basic routing based on method and path structure
 		path := r.URL.Path
 
+		// Member management: /api/projects/{id}/members[/{userID}]
+		if strings.Contains(path, "/members") {
+			HandleProjectMembersAPI(w, r, userService)
+			return
+		}
+
+		// Invitations: /api/projects/{id}/invitations[/{invitationID}[/resend]]
+		if strings.Contains(path, "/invitations") {
+			HandleProjectInvitationsAPI(w, r, projectService)
+			return
+		}
+
+		// Login user directory: /api/projects/{id}/userdirectory
+		if strings.HasSuffix(path, "/userdirectory") {
+			HandleProjectUserDirectoryAPI(w, r, projectDBService)
+			return
+		}
+
 		// Handle specific /dbconfig path FIRST
 		dbConfigPrefix := "/api/projects/"
 		dbConfigSuffix := "/dbconfig"
@@ -180,8 +198,11 @@ func HandleProjects(w http.ResponseWriter, r *http.Request, templates types.Temp
 		return
 	}
 
-	// Get all projects
+	// Get the projects the user is a member of
 	projects, err := service.List()
+	if err == nil {
+		projects, err = VisibleProjects(r.Context(), user, projects)
+	}
 	if err != nil {
 		log.Printf("Error fetching projects list: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -195,6 +216,7 @@ func HandleProjects(w http.ResponseWriter, r *http.Request, templates types.Temp
 		User:       *user,
 		Projects:   projects,
 		AppVersion: common.GetEnvOrDefault("APP_VERSION", "1.0.0.0"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	// Execute the template
@@ -220,6 +242,7 @@ func HandleIndex(w http.ResponseWriter, r *http.Request, templates types.Templat
 		AppName:    common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
 		PageTitle:  "Welcome to OpenAgent",
 		AppVersion: common.GetEnvOrDefault("APP_VERSION", "1.0.0.0"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	// Try to get project based on host
@@ -273,12 +296,20 @@ func HandleProjectPageRoute(w http.ResponseWriter, r *http.Request, templates ty
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	if allowed, err := Can(r.Context(), user, project.ID, PermView); err != nil || !allowed {
+		if err != nil {
+			log.Printf("Error checking access to project %d: %v", project.ID, err)
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
 	// Prepare page data
 	data := models.PageData{
 		AppName:    common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
 		PageTitle:  project.Name,
 		AppVersion: common.GetEnvOrDefault("APP_VERSION", "1.0.0.0"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
 		Project:    project,
 		User:       user,
 	}
@@ -295,11 +326,17 @@ func HandleProjectPageRoute(w http.ResponseWriter, r *http.Request, templates ty
 // HandleListProjectsAPI handles GET requests to list projects as JSON
 func HandleListProjectsAPI(w http.ResponseWriter, r *http.Request, projectService ProjectService) {
 	projects, err := projectService.List()
+	if err == nil {
+		projects, err = VisibleProjects(r.Context(), auth.GetUserFromContext(r.Context()), projects)
+	}
 	if err != nil {
 		log.Printf("API Error fetching projects: %v", err)
 		common.JSONError(w, "Failed to fetch projects", http.StatusInternalServerError)
 		return
 	}
+	for i, project := range projects {
+		projects[i] = RedactProject(project)
+	}
 	common.JSONResponse(w, projects)
 }
 
@@ -324,6 +361,13 @@ func HandleCreateProjectAPI(w http.ResponseWriter, r *http.Request, projectServi
 	}
 	project.CreatedBy = int64(user.ID)
 	project.IsActive = true // Default to active on creation?
+	if project.Options == nil {
+		project.Options = make(ProjectOptions)
+	}
+	if err := applyAdminOptions(user, project.Options, nil); err != nil {
+		common.JSONError(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
 	newID, err := projectService.Create(&project)
 	if err != nil {
@@ -334,7 +378,7 @@ func HandleCreateProjectAPI(w http.ResponseWriter, r *http.Request, projectServi
 
 	project.ID = newID
 	w.WriteHeader(http.StatusCreated)
-	common.JSONResponse(w, project)
+	common.JSONResponse(w, RedactProject(&project))
 }
 
 // HandleUpdateProjectAPI handles PUT requests to update a project
@@ -353,6 +397,9 @@ func HandleUpdateProjectAPI(w http.ResponseWriter, r *http.Request, projectServi
 		common.JSONError(w, "Invalid project ID in URL", http.StatusBadRequest)
 		return
 	}
+	if !RequirePermission(w, r, projectID, PermManage) {
+		return
+	}
 
 	var projectUpdates Project
 	if err := json.NewDecoder(r.Body).Decode(&projectUpdates); err != nil {
@@ -369,6 +416,24 @@ func HandleUpdateProjectAPI(w http.ResponseWriter, r *http.Request, projectServi
 		return
 	}
 
+	existing, err := projectService.GetByID(projectID)
+	if err != nil {
+		if errors.Is(err, ErrProjectNotFound) {
+			common.JSONError(w, "Project not found", http.StatusNotFound)
+		} else {
+			log.Printf("API Error fetching project %d: %v", projectID, err)
+			common.JSONError(w, "Failed to update project", http.StatusInternalServerError)
+		}
+		return
+	}
+	if projectUpdates.Options == nil {
+		projectUpdates.Options = make(ProjectOptions)
+	}
+	if err := applyAdminOptions(auth.GetUserFromContext(r.Context()), projectUpdates.Options, existing.Options); err != nil {
+		common.JSONError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	err = projectService.Update(&projectUpdates)
 	if err != nil {
 		log.Printf("API Error updating project %d: %v", projectID, err)
@@ -380,7 +445,7 @@ func HandleUpdateProjectAPI(w http.ResponseWriter, r *http.Request, projectServi
 		return
 	}
 
-	common.JSONResponse(w, projectUpdates) // Return updated project
+	common.JSONResponse(w, RedactProject(&projectUpdates)) // Return updated project
 }
 
 // HandleDeleteProjectAPI handles DELETE requests to delete a project
@@ -399,6 +464,9 @@ func HandleDeleteProjectAPI(w http.ResponseWriter, r *http.Request, projectServi
 		common.JSONError(w, "Invalid project ID in URL", http.StatusBadRequest)
 		return
 	}
+	if !RequirePermission(w, r, projectID, PermDelete) {
+		return
+	}
 
 	err = projectService.Delete(projectID)
 	if err != nil {
@@ -445,6 +513,9 @@ func HandleUpdateProjectDBConfigAPI(w http.ResponseWriter, r *http.Request, proj
 		common.JSONError(w, "Invalid project ID in URL", http.StatusBadRequest)
 		return
 	}
+	if !RequirePermission(w, r, projectID, PermManage) {
+		return
+	}
 
 	// Decode request body
 	var req UpdateProjectDBConfigRequest
@@ -0,0 +1,284 @@
+package projects
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/mailer"
+	"github.com/scriptmaster/openagent/types"
+)
+
+// invitationRequest is the body of new invitations
+type invitationRequest struct {
+	Email string `json:"email"`
+	Role  Role   `json:"role"`
+}
+
+// acceptInvitationRequest is the body of invitation acceptances
+type acceptInvitationRequest struct {
+	Token string `json:"token"`
+}
+
+// InvitePageData holds data for the invitation page
+type InvitePageData struct {
+	AppName     string
+	PageTitle   string
+	AppVersion  string
+	CSRFToken   string
+	Token       string
+	Email       string
+	Role        Role
+	ProjectName string
+	Error       string
+}
+
+// parseInvitationsPath splits /api/projects/{id}/invitations[/{invitationID}[/resend]] into its parts.
+// invitationID is 0 for the collection.
+func parseInvitationsPath(path string) (projectID, invitationID int64, resend, ok bool) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/api/projects/"), "/"), "/")
+	if len(parts) < 2 || len(parts) > 4 || parts[1] != "invitations" {
+		return 0, 0, false, false
+	}
+	projectID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false, false
+	}
+	if len(parts) >= 3 {
+		invitationID, err = strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || invitationID <= 0 {
+			return 0, 0, false, false
+		}
+	}
+	if len(parts) == 4 {
+		if parts[3] != "resend" {
+			return 0, 0, false, false
+		}
+		resend = true
+	}
+	return projectID, invitationID, resend, true
+}
+
+// HandleProjectInvitationsAPI manages a project's invitations:
+// GET lists the pending ones, POST {email, role} invites an address, POST /{invitationID}/resend
+// mails a new link and DELETE /{invitationID} revokes one. All of them require managing the project.
+func HandleProjectInvitationsAPI(w http.ResponseWriter, r *http.Request, projectService ProjectService) {
+	projectID, invitationID, resend, ok := parseInvitationsPath(r.URL.Path)
+	if !ok {
+		common.JSONError(w, "Invalid invitations URL", http.StatusBadRequest)
+		return
+	}
+	if !RequirePermission(w, r, projectID, PermManage) {
+		return
+	}
+	user := auth.GetUserFromContext(r.Context())
+
+	switch {
+	case r.Method == http.MethodGet && invitationID == 0:
+		invitations, err := getInvitationStore().ListPending(r.Context(), projectID)
+		if err != nil {
+			log.Printf("Error listing invitations of project %d: %v", projectID, err)
+			common.JSONError(w, "Failed to list invitations", http.StatusInternalServerError)
+			return
+		}
+		if invitations == nil {
+			invitations = []Invitation{}
+		}
+		common.JSONResponse(w, invitations)
+
+	case r.Method == http.MethodPost && invitationID == 0:
+		var req invitationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+			common.JSONError(w, "Email and role are required", http.StatusBadRequest)
+			return
+		}
+		invitation, token, err := InviteMember(r.Context(), user, projectID, req.Email, req.Role)
+		if !writeInvitationError(w, err) {
+			return
+		}
+		log.Printf("User %s invited %s to project %d as %s", user.Email, invitation.Email, projectID, invitation.Role)
+		if !sendInvitation(w, r, projectService, user, invitation, token) {
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		common.JSONResponse(w, invitation)
+
+	case r.Method == http.MethodPost && resend:
+		invitation, token, err := ResendInvitation(r.Context(), user, projectID, invitationID)
+		if !writeInvitationError(w, err) {
+			return
+		}
+		log.Printf("User %s resent the invitation of %s to project %d", user.Email, invitation.Email, projectID)
+		if !sendInvitation(w, r, projectService, user, invitation, token) {
+			return
+		}
+		common.JSONResponse(w, invitation)
+
+	case r.Method == http.MethodDelete && invitationID != 0 && !resend:
+		if !writeInvitationError(w, RevokeInvitation(r.Context(), user, projectID, invitationID)) {
+			return
+		}
+		log.Printf("User %s revoked invitation %d to project %d", user.Email, invitationID, projectID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sendInvitation mails the link of an invitation and reports whether it was sent. The invitation is kept
+// when sending fails, so it can be resent.
+func sendInvitation(w http.ResponseWriter, r *http.Request, projectService ProjectService, inviter *auth.User, invitation *Invitation, token string) bool {
+	baseURL, err := auth.RequestBaseURL(r)
+	if err != nil {
+		log.Printf("Error building the invitation link of %s: %v", invitation.Email, err)
+		common.JSONError(w, "The invitation was saved but no link can be built for this host", http.StatusInternalServerError)
+		return false
+	}
+	link := baseURL + "/invite?token=" + url.QueryEscape(token)
+	if err := sendInvitationEmail(r.Context(), projectService, inviter, invitation, link); err != nil {
+		log.Printf("Error sending the invitation of %s to project %d: %v", invitation.Email, invitation.ProjectID, err)
+		common.JSONError(w, "The invitation was saved but its email could not be sent", http.StatusBadGateway)
+		return false
+	}
+	return true
+}
+
+// sendInvitationEmail mails an invitation link with the "invitation" template
+func sendInvitationEmail(ctx context.Context, projectService ProjectService, inviter *auth.User, invitation *Invitation, link string) error {
+	projectName := fmt.Sprintf("project %d", invitation.ProjectID)
+	if projectService != nil {
+		if project, err := projectService.GetByID(invitation.ProjectID); err == nil && project != nil {
+			projectName = project.Name
+		}
+	}
+	return mailer.Send(ctx, invitation.Email, "invitation", map[string]string{
+		"AppName":     common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
+		"ProjectName": projectName,
+		"Role":        string(invitation.Role),
+		"InvitedBy":   inviter.Email,
+		"Link":        link,
+		"ExpiresIn":   formatInvitationTTL(time.Until(invitation.ExpiresAt)),
+	})
+}
+
+// formatInvitationTTL describes how long an invitation stays valid in whole days or hours
+func formatInvitationTTL(d time.Duration) string {
+	d = d.Round(time.Hour)
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	case d > time.Hour:
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	default:
+		return "1 hour"
+	}
+}
+
+// writeInvitationError maps invitation errors to responses and reports whether err was nil
+func writeInvitationError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrInvitationNotFound):
+		common.JSONError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvitationInvalid):
+		common.JSONError(w, err.Error(), http.StatusGone)
+	case errors.Is(err, ErrInvalidRole), errors.Is(err, ErrInvalidInviteEmail):
+		common.JSONError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrOwnerRequired):
+		common.JSONError(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("Error updating project invitations: %v", err)
+		common.JSONError(w, "Failed to update project invitations", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// CreateInvitePageHandler creates the handler of the page invitation links point to
+func CreateInvitePageHandler(templates types.TemplateEngineInterface, projectService ProjectService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleInvitePage(w, r, templates, projectService)
+	}
+}
+
+// HandleInvitePage shows an invitation and lets the invitee accept it. Opening the link does not
+// accept it, so mail link scanners cannot use it up.
+func HandleInvitePage(w http.ResponseWriter, r *http.Request, templates types.TemplateEngineInterface, projectService ProjectService) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	appName := common.GetEnvOrDefault("APP_NAME", "OpenAgent")
+	data := InvitePageData{
+		AppName:    appName,
+		PageTitle:  "Invitation - " + appName,
+		AppVersion: common.GetEnvOrDefault("APP_VERSION", "1.0.0.0"),
+		CSRFToken:  auth.CSRFToken(r.Context()),
+	}
+
+	token := r.URL.Query().Get("token")
+	invitation, err := LookupInvitation(r.Context(), token)
+	if err != nil {
+		if !errors.Is(err, ErrInvitationInvalid) {
+			log.Printf("Error looking up an invitation: %v", err)
+		}
+		data.Error = ErrInvitationInvalid.Error()
+	} else {
+		data.Token = token
+		data.Email = invitation.Email
+		data.Role = invitation.Role
+		data.ProjectName = fmt.Sprintf("project %d", invitation.ProjectID)
+		if project, err := projectService.GetByID(invitation.ProjectID); err == nil && project != nil {
+			data.ProjectName = project.Name
+		}
+	}
+
+	if err := templates.ExecuteTemplate(w, "invite.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// CreateAcceptInvitationHandler creates the handler that accepts invitations
+func CreateAcceptInvitationHandler(userService auth.UserServicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleAcceptInvitation(w, r, userService)
+	}
+}
+
+// HandleAcceptInvitation accepts an invitation from POST {token}. The invitee then logs in as usual,
+// so accepting never bypasses two-factor authentication.
+func HandleAcceptInvitation(w http.ResponseWriter, r *http.Request, userService auth.UserServicer) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req acceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		auth.SendJSONResponse(w, false, "Invitation token is required", nil, "")
+		return
+	}
+
+	user, invitation, err := AcceptInvitation(r.Context(), userService, req.Token)
+	if errors.Is(err, ErrInvitationInvalid) {
+		auth.SendJSONResponse(w, false, err.Error(), nil, "")
+		return
+	}
+	if err != nil {
+		log.Printf("Error accepting an invitation: %v", err)
+		auth.SendJSONResponse(w, false, "Failed to accept the invitation", nil, "")
+		return
+	}
+	log.Printf("User %s accepted invitation %d to project %d as %s", user.Email, invitation.ID, invitation.ProjectID, invitation.Role)
+	auth.SendJSONResponse(w, true, "Invitation accepted. Log in to continue.", nil, "/login")
+}
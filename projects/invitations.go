@@ -0,0 +1,477 @@
+package projects
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+)
+
+var (
+	// ErrInvitationNotFound is returned for invitations that do not exist or belong to another project
+	ErrInvitationNotFound = errors.New("invitation not found")
+	// ErrInvitationInvalid is returned for invitation links that are unknown, expired, revoked or already used
+	ErrInvitationInvalid = errors.New("this invitation is invalid, has expired or was already used")
+	// ErrInvalidInviteEmail is returned when inviting something that is not an email address
+	ErrInvalidInviteEmail = errors.New("invalid email format")
+)
+
+// Invitation invites an email address to join a project with a role
+type Invitation struct {
+	ID         int64      `json:"id"`
+	ProjectID  int64      `json:"project_id"`
+	Email      string     `json:"email"`
+	Role       Role       `json:"role"`
+	InvitedBy  int        `json:"invited_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	SentAt     time.Time  `json:"sent_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	AcceptedBy int        `json:"accepted_by,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Pending reports whether the invitation can still be accepted
+func (i *Invitation) Pending(now time.Time) bool {
+	return i.AcceptedAt == nil && i.RevokedAt == nil && now.Before(i.ExpiresAt)
+}
+
+// InvitationStore keeps project invitations. Links are looked up by the SHA-256 hash of their token.
+type InvitationStore interface {
+	// Create stores a new invitation and sets its ID and timestamps.
+	Create(ctx context.Context, invitation *Invitation, tokenHash string) error
+	// Get returns an invitation by ID, or nil when it does not exist.
+	Get(ctx context.Context, id int64) (*Invitation, error)
+	// GetByToken returns the invitation a link token hash belongs to, or nil when there is none.
+	GetByToken(ctx context.Context, tokenHash string) (*Invitation, error)
+	// ListPending returns the invitations of a project that were neither accepted nor revoked, newest first.
+	ListPending(ctx context.Context, projectID int64) ([]Invitation, error)
+	// Renew replaces the link token of a pending invitation and extends it, invalidating the previous link.
+	Renew(ctx context.Context, id int64, tokenHash string, expiresAt time.Time) (bool, error)
+	// Accept marks an unexpired pending invitation as accepted by a user and reports whether it was pending.
+	Accept(ctx context.Context, id int64, userID int) (bool, error)
+	// Revoke cancels a pending invitation and reports whether it was pending.
+	Revoke(ctx context.Context, id int64) (bool, error)
+	// RevokePendingForEmail cancels the pending invitations of an email address to a project.
+	RevokePendingForEmail(ctx context.Context, projectID int64, email string) error
+}
+
+// memoryInvitation is an invitation with its token hash
+type memoryInvitation struct {
+	Invitation
+	tokenHash string
+}
+
+// memoryInvitationStore keeps invitations in process memory
+type memoryInvitationStore struct {
+	mu          sync.Mutex
+	nextID      int64
+	invitations map[int64]*memoryInvitation
+}
+
+// NewMemoryInvitationStore creates an in-process invitation store
+func NewMemoryInvitationStore() InvitationStore {
+	return &memoryInvitationStore{invitations: make(map[int64]*memoryInvitation)}
+}
+
+func (s *memoryInvitationStore) Create(ctx context.Context, invitation *Invitation, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	now := time.Now()
+	invitation.ID = s.nextID
+	invitation.CreatedAt = now
+	invitation.SentAt = now
+	s.invitations[invitation.ID] = &memoryInvitation{Invitation: *invitation, tokenHash: tokenHash}
+	return nil
+}
+
+func (s *memoryInvitationStore) Get(ctx context.Context, id int64) (*Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.invitations[id]; ok {
+		invitation := stored.Invitation
+		return &invitation, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryInvitationStore) GetByToken(ctx context.Context, tokenHash string) (*Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range s.invitations {
+		if stored.tokenHash == tokenHash {
+			invitation := stored.Invitation
+			return &invitation, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryInvitationStore) ListPending(ctx context.Context, projectID int64) ([]Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []Invitation
+	for _, stored := range s.invitations {
+		if stored.ProjectID == projectID && stored.AcceptedAt == nil && stored.RevokedAt == nil {
+			list = append(list, stored.Invitation)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list, nil
+}
+
+func (s *memoryInvitationStore) Renew(ctx context.Context, id int64, tokenHash string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.invitations[id]
+	if !ok || stored.AcceptedAt != nil || stored.RevokedAt != nil {
+		return false, nil
+	}
+	stored.tokenHash = tokenHash
+	stored.ExpiresAt = expiresAt
+	stored.SentAt = time.Now()
+	return true, nil
+}
+
+func (s *memoryInvitationStore) Accept(ctx context.Context, id int64, userID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.invitations[id]
+	now := time.Now()
+	if !ok || !stored.Pending(now) {
+		return false, nil
+	}
+	stored.AcceptedAt = &now
+	stored.AcceptedBy = userID
+	return true, nil
+}
+
+func (s *memoryInvitationStore) Revoke(ctx context.Context, id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.invitations[id]
+	if !ok || stored.AcceptedAt != nil || stored.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	stored.RevokedAt = &now
+	return true, nil
+}
+
+func (s *memoryInvitationStore) RevokePendingForEmail(ctx context.Context, projectID int64, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, stored := range s.invitations {
+		if stored.ProjectID == projectID && strings.EqualFold(stored.Email, email) &&
+			stored.AcceptedAt == nil && stored.RevokedAt == nil {
+			stored.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+// postgresInvitationStore keeps invitations in ai.project_invitations
+type postgresInvitationStore struct {
+	db *sql.DB
+}
+
+// NewPostgresInvitationStore creates an invitation store backed by the ai.project_invitations table
+func NewPostgresInvitationStore(db *sql.DB) InvitationStore {
+	return &postgresInvitationStore{db: db}
+}
+
+func (s *postgresInvitationStore) Create(ctx context.Context, invitation *Invitation, tokenHash string) error {
+	return s.db.QueryRowContext(ctx, common.MustGetSQL("project_invitations/create"),
+		invitation.ProjectID, invitation.Email, invitation.Role, tokenHash, invitation.InvitedBy, invitation.ExpiresAt,
+	).Scan(&invitation.ID, &invitation.CreatedAt, &invitation.SentAt)
+}
+
+func (s *postgresInvitationStore) Get(ctx context.Context, id int64) (*Invitation, error) {
+	invitation, err := scanInvitation(s.db.QueryRowContext(ctx, common.MustGetSQL("project_invitations/get"), id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return invitation, err
+}
+
+func (s *postgresInvitationStore) GetByToken(ctx context.Context, tokenHash string) (*Invitation, error) {
+	invitation, err := scanInvitation(s.db.QueryRowContext(ctx, common.MustGetSQL("project_invitations/get_by_token"), tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return invitation, err
+}
+
+func (s *postgresInvitationStore) ListPending(ctx context.Context, projectID int64) ([]Invitation, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("project_invitations/list_pending"), projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Invitation
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *invitation)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresInvitationStore) Renew(ctx context.Context, id int64, tokenHash string, expiresAt time.Time) (bool, error) {
+	return s.update(ctx, "project_invitations/renew", id, tokenHash, expiresAt)
+}
+
+func (s *postgresInvitationStore) Accept(ctx context.Context, id int64, userID int) (bool, error) {
+	return s.update(ctx, "project_invitations/accept", id, userID)
+}
+
+func (s *postgresInvitationStore) Revoke(ctx context.Context, id int64) (bool, error) {
+	return s.update(ctx, "project_invitations/revoke", id)
+}
+
+func (s *postgresInvitationStore) RevokePendingForEmail(ctx context.Context, projectID int64, email string) error {
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("project_invitations/revoke_pending_for_email"), projectID, email)
+	return err
+}
+
+// update runs a named update and reports whether it changed a row
+func (s *postgresInvitationStore) update(ctx context.Context, name string, args ...interface{}) (bool, error) {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL(name), args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// scanInvitation reads a row selected by the project_invitations/get* and list_pending queries
+func scanInvitation(row interface{ Scan(...interface{}) error }) (*Invitation, error) {
+	var invitation Invitation
+	var acceptedAt, revokedAt sql.NullTime
+	var acceptedBy sql.NullInt64
+	err := row.Scan(&invitation.ID, &invitation.ProjectID, &invitation.Email, &invitation.Role, &invitation.InvitedBy,
+		&invitation.CreatedAt, &invitation.SentAt, &invitation.ExpiresAt, &acceptedAt, &acceptedBy, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if acceptedAt.Valid {
+		invitation.AcceptedAt = &acceptedAt.Time
+	}
+	invitation.AcceptedBy = int(acceptedBy.Int64)
+	if revokedAt.Valid {
+		invitation.RevokedAt = &revokedAt.Time
+	}
+	return &invitation, nil
+}
+
+var (
+	invitationStore      = NewMemoryInvitationStore() // Replaced with the Postgres store once the database is up
+	invitationStoreMutex = &sync.Mutex{}
+)
+
+// SetInvitationStore replaces the store used for project invitations
+func SetInvitationStore(store InvitationStore) {
+	invitationStoreMutex.Lock()
+	defer invitationStoreMutex.Unlock()
+	invitationStore = store
+}
+
+// getInvitationStore returns the current invitation store
+func getInvitationStore() InvitationStore {
+	invitationStoreMutex.Lock()
+	defer invitationStoreMutex.Unlock()
+	return invitationStore
+}
+
+// invitationTTL is how long an invitation link stays valid, from INVITATION_TTL (default 7 days)
+func invitationTTL() time.Duration {
+	ttl, err := time.ParseDuration(common.GetEnvOrDefault("INVITATION_TTL", "168h"))
+	if err != nil || ttl <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return ttl
+}
+
+// hashInvitationToken hashes a link token for storage and lookup
+func hashInvitationToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkInvitationRole returns ErrOwnerRequired when someone other than an owner manages an owner invitation
+func checkInvitationRole(ctx context.Context, actor *auth.User, projectID int64, role Role) error {
+	if role != RoleOwner {
+		return nil
+	}
+	actorRole, err := UserRole(ctx, actor, projectID)
+	if err != nil {
+		return err
+	}
+	if actorRole != RoleOwner {
+		return ErrOwnerRequired
+	}
+	return nil
+}
+
+// InviteMember invites an email address to a project on behalf of actor and returns the invitation with
+// the token of its link, which is only available now. Only owners may invite owners. A pending
+// invitation of the same address is replaced.
+func InviteMember(ctx context.Context, actor *auth.User, projectID int64, email string, role Role) (*Invitation, string, error) {
+	email = strings.TrimSpace(email)
+	if !common.IsValidEmail(email) {
+		return nil, "", ErrInvalidInviteEmail
+	}
+	if !role.Valid() {
+		return nil, "", ErrInvalidRole
+	}
+	if err := checkInvitationRole(ctx, actor, projectID, role); err != nil {
+		return nil, "", err
+	}
+
+	store := getInvitationStore()
+	if err := store.RevokePendingForEmail(ctx, projectID, email); err != nil {
+		return nil, "", err
+	}
+	token, err := auth.GenerateSessionToken()
+	if err != nil {
+		return nil, "", err
+	}
+	invitation := &Invitation{
+		ProjectID: projectID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: actor.ID,
+		ExpiresAt: time.Now().Add(invitationTTL()),
+	}
+	if err := store.Create(ctx, invitation, hashInvitationToken(token)); err != nil {
+		return nil, "", err
+	}
+	return invitation, token, nil
+}
+
+// pendingProjectInvitation returns a project's invitation if it is still pending
+func pendingProjectInvitation(ctx context.Context, projectID, id int64) (*Invitation, error) {
+	invitation, err := getInvitationStore().Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if invitation == nil || invitation.ProjectID != projectID || invitation.AcceptedAt != nil || invitation.RevokedAt != nil {
+		return nil, ErrInvitationNotFound
+	}
+	return invitation, nil
+}
+
+// ResendInvitation issues a new link for a pending invitation, which invalidates the previous link and
+// restarts its validity. It returns the renewed invitation and the new token.
+func ResendInvitation(ctx context.Context, actor *auth.User, projectID, id int64) (*Invitation, string, error) {
+	invitation, err := pendingProjectInvitation(ctx, projectID, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkInvitationRole(ctx, actor, projectID, invitation.Role); err != nil {
+		return nil, "", err
+	}
+	token, err := auth.GenerateSessionToken()
+	if err != nil {
+		return nil, "", err
+	}
+	expiresAt := time.Now().Add(invitationTTL())
+	renewed, err := getInvitationStore().Renew(ctx, id, hashInvitationToken(token), expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if !renewed {
+		return nil, "", ErrInvitationNotFound
+	}
+	invitation.ExpiresAt = expiresAt
+	invitation.SentAt = time.Now()
+	return invitation, token, nil
+}
+
+// RevokeInvitation cancels a pending invitation on behalf of actor. Only owners may revoke owner invitations.
+func RevokeInvitation(ctx context.Context, actor *auth.User, projectID, id int64) error {
+	invitation, err := pendingProjectInvitation(ctx, projectID, id)
+	if err != nil {
+		return err
+	}
+	if err := checkInvitationRole(ctx, actor, projectID, invitation.Role); err != nil {
+		return err
+	}
+	revoked, err := getInvitationStore().Revoke(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrInvitationNotFound
+	}
+	return nil
+}
+
+// LookupInvitation returns the pending invitation of a link token, or ErrInvitationInvalid
+func LookupInvitation(ctx context.Context, token string) (*Invitation, error) {
+	if token == "" {
+		return nil, ErrInvitationInvalid
+	}
+	invitation, err := getInvitationStore().GetByToken(ctx, hashInvitationToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if invitation == nil || !invitation.Pending(time.Now()) {
+		return nil, ErrInvitationInvalid
+	}
+	return invitation, nil
+}
+
+// AcceptInvitation accepts the invitation of a link token. The invited address gets an account through
+// userService when it has none, and the membership is attached with the invited role unless the user
+// already has an equal or higher one. Accounts of a project's user directory are not project members,
+// so they only get the account.
+func AcceptInvitation(ctx context.Context, userService auth.UserServicer, token string) (*auth.User, *Invitation, error) {
+	invitation, err := LookupInvitation(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := userService.GetUserByEmail(ctx, invitation.Email)
+	if err != nil || user == nil {
+		user, err = userService.CreateUser(ctx, invitation.Email)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating the invited user: %w", err)
+		}
+		log.Printf("Created user %s from an invitation to project %d", user.Email, invitation.ProjectID)
+	}
+
+	// Mark the invitation first, so a link opened twice at once attaches the membership only once
+	accepted, err := getInvitationStore().Accept(ctx, invitation.ID, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !accepted {
+		return nil, nil, ErrInvitationInvalid
+	}
+
+	if user.ProjectID != 0 {
+		log.Printf("User %s accepted an invitation to project %d as an account of the user directory of project %d",
+			user.Email, invitation.ProjectID, user.ProjectID)
+		return user, invitation, nil
+	}
+	if err := GrantRole(ctx, invitation.ProjectID, user.ID, invitation.Role); err != nil {
+		return nil, nil, err
+	}
+	return user, invitation, nil
+}
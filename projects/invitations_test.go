@@ -0,0 +1,186 @@
+package projects
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/mailer"
+)
+
+// useMemoryInvitationStore installs a fresh invitation store for the duration of the test
+func useMemoryInvitationStore(t *testing.T) InvitationStore {
+	previous := getInvitationStore()
+	store := NewMemoryInvitationStore()
+	SetInvitationStore(store)
+	t.Cleanup(func() { SetInvitationStore(previous) })
+	return store
+}
+
+// inviteeUserService finds users by email and creates the ones it does not know
+type inviteeUserService struct {
+	memberUserService
+	nextID int
+}
+
+func (s *inviteeUserService) CreateUser(ctx context.Context, email string) (*auth.User, error) {
+	s.nextID++
+	user := &auth.User{ID: s.nextID, Email: email}
+	s.users[email] = user
+	return user, nil
+}
+
+// TestInvitationLifecycle tests inviting, resending, accepting and revoking invitations
+func TestInvitationLifecycle(t *testing.T) {
+	members := useMemoryMemberStore(t)
+	useMemoryInvitationStore(t)
+	ctx := context.Background()
+	owner := &auth.User{ID: 1, Email: "owner@example.com"}
+	admin := &auth.User{ID: 2, Email: "admin@example.com"}
+	members.SetRole(ctx, 3, owner.ID, RoleOwner)
+	members.SetRole(ctx, 3, admin.ID, RoleAdmin)
+	users := &inviteeUserService{memberUserService: memberUserService{users: map[string]*auth.User{}}, nextID: 100}
+
+	if _, _, err := InviteMember(ctx, admin, 3, "boss@example.com", RoleOwner); !errors.Is(err, ErrOwnerRequired) {
+		t.Errorf("Expected admins to be refused inviting owners, got %v", err)
+	}
+	if _, _, err := InviteMember(ctx, admin, 3, "not-an-email", RoleViewer); !errors.Is(err, ErrInvalidInviteEmail) {
+		t.Errorf("Expected an invalid email to be refused, got %v", err)
+	}
+
+	invitation, firstToken, err := InviteMember(ctx, admin, 3, "new@example.com", RoleEditor)
+	if err != nil {
+		t.Fatalf("Expected an admin to invite an editor: %v", err)
+	}
+	_, secondToken, err := ResendInvitation(ctx, admin, 3, invitation.ID)
+	if err != nil {
+		t.Fatalf("Failed to resend the invitation: %v", err)
+	}
+	if _, _, err := AcceptInvitation(ctx, users, firstToken); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("Expected the link replaced by a resend to be refused, got %v", err)
+	}
+
+	user, _, err := AcceptInvitation(ctx, users, secondToken)
+	if err != nil {
+		t.Fatalf("Failed to accept the invitation: %v", err)
+	}
+	if user.Email != "new@example.com" || users.users["new@example.com"] == nil {
+		t.Errorf("Expected the invitee to get an account, got %+v", user)
+	}
+	if role, _ := members.Role(ctx, 3, user.ID); role != RoleEditor {
+		t.Errorf("Expected the invitee to become an editor, got %q", role)
+	}
+	if _, _, err := AcceptInvitation(ctx, users, secondToken); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("Expected an invitation to be accepted only once, got %v", err)
+	}
+
+	// Accepting a lower role keeps an existing higher one
+	invitation, token, _ := InviteMember(ctx, owner, 3, admin.Email, RoleViewer)
+	users.users[admin.Email] = admin
+	if _, _, err := AcceptInvitation(ctx, users, token); err != nil {
+		t.Fatalf("Failed to accept the invitation of an existing member: %v", err)
+	}
+	if role, _ := members.Role(ctx, 3, admin.ID); role != RoleAdmin {
+		t.Errorf("Expected the admin to stay an admin, got %q", role)
+	}
+	if err := RevokeInvitation(ctx, owner, 3, invitation.ID); !errors.Is(err, ErrInvitationNotFound) {
+		t.Errorf("Expected accepted invitations not to be revocable, got %v", err)
+	}
+
+	invitation, token, _ = InviteMember(ctx, owner, 3, "later@example.com", RoleViewer)
+	if err := RevokeInvitation(ctx, admin, 4, invitation.ID); !errors.Is(err, ErrInvitationNotFound) {
+		t.Errorf("Expected invitations of other projects not to be found, got %v", err)
+	}
+	if err := RevokeInvitation(ctx, admin, 3, invitation.ID); err != nil {
+		t.Fatalf("Failed to revoke the invitation: %v", err)
+	}
+	if _, err := LookupInvitation(ctx, token); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("Expected a revoked invitation to be refused, got %v", err)
+	}
+}
+
+// TestProjectInvitationsAPI tests inviting through the API, the invitation email and accepting its link
+func TestProjectInvitationsAPI(t *testing.T) {
+	members := useMemoryMemberStore(t)
+	useMemoryInvitationStore(t)
+	ctx := context.Background()
+	owner := &auth.User{ID: 1, Email: "owner@example.com"}
+	viewer := &auth.User{ID: 2, Email: "viewer@example.com"}
+	members.SetRole(ctx, 3, owner.ID, RoleOwner)
+	members.SetRole(ctx, 3, viewer.ID, RoleViewer)
+	users := &inviteeUserService{memberUserService: memberUserService{users: map[string]*auth.User{}}, nextID: 100}
+
+	mailer.TemplateDir = "../data/mail"
+	sent := make(chan mailer.Message, 2)
+	mailer.SetDefault(mailer.MailerFunc(func(ctx context.Context, msg mailer.Message) error {
+		sent <- msg
+		return nil
+	}))
+	t.Cleanup(func() {
+		mailer.TemplateDir = ""
+		mailer.SetDefault(nil)
+	})
+
+	do := func(user *auth.User, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Host = "localhost:8800" // Links may always point at localhost
+		req = req.WithContext(auth.SetUserContext(req.Context(), user))
+		rec := httptest.NewRecorder()
+		HandleProjectInvitationsAPI(rec, req, nil)
+		return rec
+	}
+
+	if rec := do(viewer, http.MethodPost, "/api/projects/3/invitations", `{"email":"new@example.com","role":"viewer"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused inviting, got %d", rec.Code)
+	}
+	rec := do(owner, http.MethodPost, "/api/projects/3/invitations", `{"email":"new@example.com","role":"editor"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the owner to invite, got %d: %s", rec.Code, rec.Body.String())
+	}
+	msg := <-sent
+	if len(msg.To) != 1 || msg.To[0] != "new@example.com" || !strings.Contains(msg.Text, "as editor") {
+		t.Fatalf("Unexpected invitation email: %+v", msg)
+	}
+
+	rec = do(owner, http.MethodGet, "/api/projects/3/invitations", "")
+	var pending []Invitation
+	if err := json.NewDecoder(rec.Body).Decode(&pending); err != nil || len(pending) != 1 {
+		t.Fatalf("Expected one pending invitation, got %v (%v)", pending, err)
+	}
+
+	start := strings.Index(msg.Text, "/invite?token=")
+	if start < 0 {
+		t.Fatalf("Expected an invitation link in the email: %s", msg.Text)
+	}
+	token, err := url.QueryUnescape(strings.Fields(msg.Text[start+len("/invite?token="):])[0])
+	if err != nil {
+		t.Fatalf("Failed to read the link token: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/invite/accept", bytes.NewBufferString(`{"token":"`+token+`"}`))
+	rec = httptest.NewRecorder()
+	HandleAcceptInvitation(rec, req, users)
+	var result struct {
+		Success  bool   `json:"success"`
+		Redirect string `json:"redirect"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil || !result.Success || result.Redirect != "/login" {
+		t.Fatalf("Expected the invitation to be accepted, got %+v (%v)", result, err)
+	}
+	invitee := users.users["new@example.com"]
+	if role, _ := members.Role(ctx, 3, invitee.ID); role != RoleEditor {
+		t.Errorf("Expected the invitee to become an editor, got %q", role)
+	}
+
+	rec = do(owner, http.MethodGet, "/api/projects/3/invitations", "")
+	pending = nil
+	if err := json.NewDecoder(rec.Body).Decode(&pending); err != nil || len(pending) != 0 {
+		t.Errorf("Expected no pending invitations after accepting, got %v (%v)", pending, err)
+	}
+}
@@ -0,0 +1,142 @@
+package projects
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+)
+
+// memberRequest is the body of member additions and role changes
+type memberRequest struct {
+	Email string `json:"email"`
+	Role  Role   `json:"role"`
+}
+
+// parseMembersPath splits /api/projects/{id}/members[/{userID}] into its IDs. userID is 0 for the collection.
+func parseMembersPath(path string) (projectID int64, userID int, ok bool) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/api/projects/"), "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != "members" {
+		return 0, 0, false
+	}
+	projectID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if len(parts) == 3 {
+		userID, err = strconv.Atoi(parts[2])
+		if err != nil || userID <= 0 {
+			return 0, 0, false
+		}
+	}
+	return projectID, userID, true
+}
+
+// HandleProjectMembersAPI manages a project's members:
+// GET lists them, POST {email, role} adds one, PUT /{userID} {role} changes a role and
+// DELETE /{userID} removes one. Members can always remove themselves.
+func HandleProjectMembersAPI(w http.ResponseWriter, r *http.Request, userService auth.UserServicer) {
+	projectID, userID, ok := parseMembersPath(r.URL.Path)
+	if !ok {
+		common.JSONError(w, "Invalid members URL", http.StatusBadRequest)
+		return
+	}
+	user := auth.GetUserFromContext(r.Context())
+
+	switch {
+	case r.Method == http.MethodGet && userID == 0:
+		if !RequirePermission(w, r, projectID, PermView) {
+			return
+		}
+		members, err := getMemberStore().List(r.Context(), projectID)
+		if err != nil {
+			log.Printf("Error listing members of project %d: %v", projectID, err)
+			common.JSONError(w, "Failed to list members", http.StatusInternalServerError)
+			return
+		}
+		if members == nil {
+			members = []Member{}
+		}
+		common.JSONResponse(w, members)
+
+	case r.Method == http.MethodPost && userID == 0:
+		if !RequirePermission(w, r, projectID, PermManage) {
+			return
+		}
+		var req memberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+			common.JSONError(w, "Email and role are required", http.StatusBadRequest)
+			return
+		}
+		member, err := userService.GetUserByEmail(r.Context(), strings.TrimSpace(req.Email))
+		if err != nil || member == nil {
+			common.JSONError(w, "No user with that email", http.StatusNotFound)
+			return
+		}
+		if !writeMemberError(w, SetMemberRole(r.Context(), user, projectID, member.ID, req.Role)) {
+			return
+		}
+		log.Printf("User %s added %s to project %d as %s", user.Email, member.Email, projectID, req.Role)
+		w.WriteHeader(http.StatusCreated)
+		common.JSONResponse(w, Member{ProjectID: projectID, UserID: member.ID, Email: member.Email, Role: req.Role})
+
+	case r.Method == http.MethodPut && userID != 0:
+		if !RequirePermission(w, r, projectID, PermManage) {
+			return
+		}
+		var req memberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			common.JSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		current, err := getMemberStore().Role(r.Context(), projectID, userID)
+		if err != nil || current == "" {
+			writeMemberError(w, ErrNotMember)
+			return
+		}
+		if !writeMemberError(w, SetMemberRole(r.Context(), user, projectID, userID, req.Role)) {
+			return
+		}
+		log.Printf("User %s changed the role of user %d in project %d to %s", user.Email, userID, projectID, req.Role)
+		common.JSONResponse(w, Member{ProjectID: projectID, UserID: userID, Role: req.Role})
+
+	case r.Method == http.MethodDelete && userID != 0:
+		// Leaving needs no permission, but directory account IDs are not ai.users IDs
+		if (userID != user.ID || user.ProjectID != 0) && !RequirePermission(w, r, projectID, PermManage) {
+			return
+		}
+		if !writeMemberError(w, RemoveMember(r.Context(), user, projectID, userID)) {
+			return
+		}
+		log.Printf("User %s removed user %d from project %d", user.Email, userID, projectID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeMemberError maps membership errors to responses and reports whether err was nil
+func writeMemberError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrInvalidRole):
+		common.JSONError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNotMember):
+		common.JSONError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrOwnerRequired), errors.Is(err, ErrManageRequired):
+		common.JSONError(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrLastOwner):
+		common.JSONError(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error updating project members: %v", err)
+		common.JSONError(w, "Failed to update project members", http.StatusInternalServerError)
+	}
+	return false
+}
@@ -0,0 +1,571 @@
+package projects
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+)
+
+// Role is a member's role in a project
+type Role string
+
+// Project roles, from most to least privileged
+const (
+	RoleOwner  Role = "owner"  // Everything, including deleting the project and managing owners
+	RoleAdmin  Role = "admin"  // Settings, database configuration and members other than owners
+	RoleEditor Role = "editor" // Pages, prompts and data
+	RoleViewer Role = "viewer" // Read-only access
+)
+
+// Permission is an action on a project
+type Permission int
+
+const (
+	PermView   Permission = iota // Read the project, its pages and data
+	PermEdit                     // Change pages, prompts and data
+	PermManage                   // Change settings, database configuration and members
+	PermDelete                   // Delete the project and manage owners
+)
+
+var (
+	// ErrNotMember is returned when a user has no role in a project
+	ErrNotMember = errors.New("user is not a member of this project")
+	// ErrLastOwner is returned when a change would leave a project without an owner
+	ErrLastOwner = errors.New("a project must keep at least one owner")
+	// ErrOwnerRequired is returned when someone other than an owner grants or revokes the owner role
+	ErrOwnerRequired = errors.New("only owners can grant or revoke the owner role")
+	// ErrManageRequired is returned when someone without the manage permission removes another member
+	ErrManageRequired = errors.New("only owners and admins can remove other members")
+	// ErrInvalidRole is returned for roles other than owner, admin, editor and viewer
+	ErrInvalidRole = errors.New("role must be owner, admin, editor or viewer")
+)
+
+// rank orders roles by privilege; unknown roles rank below viewer
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 4
+	case RoleAdmin:
+		return 3
+	case RoleEditor:
+		return 2
+	case RoleViewer:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Valid reports whether the role is one of the known roles
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// Allows reports whether the role grants a permission
+func (r Role) Allows(perm Permission) bool {
+	switch perm {
+	case PermView:
+		return r.rank() >= RoleViewer.rank()
+	case PermEdit:
+		return r.rank() >= RoleEditor.rank()
+	case PermManage:
+		return r.rank() >= RoleAdmin.rank()
+	case PermDelete:
+		return r == RoleOwner
+	default:
+		return false
+	}
+}
+
+// Member is a user's membership in a project
+type Member struct {
+	ProjectID int64     `json:"project_id"`
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MemberStore keeps project memberships.
+type MemberStore interface {
+	// Role returns a user's role in a project, or "" when they are not a member.
+	Role(ctx context.Context, projectID int64, userID int) (Role, error)
+	// RolesByUser returns the user's role in each project they are a member of.
+	RolesByUser(ctx context.Context, userID int) (map[int64]Role, error)
+	// List returns the members of a project, owners first.
+	List(ctx context.Context, projectID int64) ([]Member, error)
+	// SetRole adds a member or changes their role. Demoting the last owner fails with ErrLastOwner.
+	SetRole(ctx context.Context, projectID int64, userID int, role Role) error
+	// Remove removes a member and reports whether they were one. Removing the last owner fails with ErrLastOwner.
+	Remove(ctx context.Context, projectID int64, userID int) (bool, error)
+	// RemoveUser removes a user from every project, or from none with ErrLastOwner when they are
+	// the last owner of one.
+	RemoveUser(ctx context.Context, userID int) error
+}
+
+// memoryMemberStore keeps memberships in process memory
+type memoryMemberStore struct {
+	mu      sync.Mutex
+	members map[int64]map[int]Member
+}
+
+// NewMemoryMemberStore creates an in-process membership store
+func NewMemoryMemberStore() MemberStore {
+	return &memoryMemberStore{members: make(map[int64]map[int]Member)}
+}
+
+func (s *memoryMemberStore) Role(ctx context.Context, projectID int64, userID int) (Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.members[projectID][userID].Role, nil
+}
+
+func (s *memoryMemberStore) RolesByUser(ctx context.Context, userID int) (map[int64]Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roles := make(map[int64]Role)
+	for projectID, members := range s.members {
+		if member, ok := members[userID]; ok {
+			roles[projectID] = member.Role
+		}
+	}
+	return roles, nil
+}
+
+func (s *memoryMemberStore) List(ctx context.Context, projectID int64) ([]Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []Member
+	for _, member := range s.members[projectID] {
+		list = append(list, member)
+	}
+	sortMembers(list)
+	return list, nil
+}
+
+func (s *memoryMemberStore) SetRole(ctx context.Context, projectID int64, userID int, role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.members[projectID] == nil {
+		s.members[projectID] = make(map[int]Member)
+	}
+	member, ok := s.members[projectID][userID]
+	if !ok {
+		member = Member{ProjectID: projectID, UserID: userID, CreatedAt: time.Now()}
+	}
+	if member.Role == RoleOwner && role != RoleOwner && s.owners(projectID) <= 1 {
+		return ErrLastOwner
+	}
+	member.Role = role
+	s.members[projectID][userID] = member
+	return nil
+}
+
+func (s *memoryMemberStore) Remove(ctx context.Context, projectID int64, userID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	member, ok := s.members[projectID][userID]
+	if !ok {
+		return false, nil
+	}
+	if member.Role == RoleOwner && s.owners(projectID) <= 1 {
+		return false, ErrLastOwner
+	}
+	delete(s.members[projectID], userID)
+	return true, nil
+}
+
+func (s *memoryMemberStore) RemoveUser(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for projectID, members := range s.members {
+		if members[userID].Role == RoleOwner && s.owners(projectID) <= 1 {
+			return fmt.Errorf("project %d: %w", projectID, ErrLastOwner)
+		}
+	}
+	for _, members := range s.members {
+		delete(members, userID)
+	}
+	return nil
+}
+
+// owners counts the owners of a project; s.mu must be held
+func (s *memoryMemberStore) owners(projectID int64) int {
+	owners := 0
+	for _, member := range s.members[projectID] {
+		if member.Role == RoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+// postgresMemberStore keeps memberships in ai.project_members
+type postgresMemberStore struct {
+	db *sql.DB
+}
+
+// NewPostgresMemberStore creates a membership store backed by the ai.project_members table
+func NewPostgresMemberStore(db *sql.DB) MemberStore {
+	return &postgresMemberStore{db: db}
+}
+
+func (s *postgresMemberStore) Role(ctx context.Context, projectID int64, userID int) (Role, error) {
+	var role Role
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("project_members/read_role"), projectID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func (s *postgresMemberStore) RolesByUser(ctx context.Context, userID int) (map[int64]Role, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("project_members/roles_by_user_id"), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make(map[int64]Role)
+	for rows.Next() {
+		var projectID int64
+		var role Role
+		if err := rows.Scan(&projectID, &role); err != nil {
+			return nil, err
+		}
+		roles[projectID] = role
+	}
+	return roles, rows.Err()
+}
+
+func (s *postgresMemberStore) List(ctx context.Context, projectID int64) ([]Member, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("project_members/list_with_roles"), projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Member
+	for rows.Next() {
+		member := Member{ProjectID: projectID}
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Role, &member.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortMembers(list)
+	return list, nil
+}
+
+func (s *postgresMemberStore) SetRole(ctx context.Context, projectID int64, userID int, role Role) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if role != RoleOwner {
+		if err := ensureAnotherOwner(ctx, tx, projectID, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, common.MustGetSQL("project_members/set_role"), projectID, userID, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresMemberStore) Remove(ctx context.Context, projectID int64, userID int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if err := ensureAnotherOwner(ctx, tx, projectID, userID); err != nil {
+		return false, err
+	}
+	result, err := tx.ExecContext(ctx, common.MustGetSQL("project_members/delete"), projectID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+func (s *postgresMemberStore) RemoveUser(ctx context.Context, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := RemoveUserMembershipsTx(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveUserMembershipsTx removes a user from every project within tx, or returns ErrLastOwner
+// when they are the last owner of one. It is for account deletion, which removes everything
+// about a user in one transaction.
+func RemoveUserMembershipsTx(ctx context.Context, tx *sql.Tx, userID int) error {
+	rows, err := tx.QueryContext(ctx, common.MustGetSQL("project_members/roles_by_user_id"), userID)
+	if err != nil {
+		return err
+	}
+	var owned []int64
+	for rows.Next() {
+		var projectID int64
+		var role Role
+		if err := rows.Scan(&projectID, &role); err != nil {
+			rows.Close()
+			return err
+		}
+		if role == RoleOwner {
+			owned = append(owned, projectID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Lock projects in ID order so concurrent deletions cannot deadlock
+	sort.Slice(owned, func(i, j int) bool { return owned[i] < owned[j] })
+	for _, projectID := range owned {
+		if err := ensureAnotherOwner(ctx, tx, projectID, userID); err != nil {
+			return fmt.Errorf("project %d: %w", projectID, err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, common.MustGetSQL("project_members/delete_by_user"), userID)
+	return err
+}
+
+// ensureAnotherOwner locks the owners of a project until tx ends and returns ErrLastOwner when
+// userID is its only owner. Concurrent changes to the project's owners wait for the lock and then
+// see the owners as changed, so two owners cannot both step down at once.
+func ensureAnotherOwner(ctx context.Context, tx *sql.Tx, projectID int64, userID int) error {
+	rows, err := tx.QueryContext(ctx, common.MustGetSQL("project_members/lock_owners"), projectID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	owner, others := false, 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if id == userID {
+			owner = true
+		} else {
+			others++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if owner && others == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// sortMembers orders members by role, most privileged first, then by email
+func sortMembers(list []Member) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Role.rank() != list[j].Role.rank() {
+			return list[i].Role.rank() > list[j].Role.rank()
+		}
+		return list[i].Email < list[j].Email
+	})
+}
+
+var (
+	memberStore      = NewMemoryMemberStore() // Replaced with the Postgres store once the database is up
+	memberStoreMutex = &sync.Mutex{}
+)
+
+// SetMemberStore replaces the store used for project memberships
+func SetMemberStore(store MemberStore) {
+	memberStoreMutex.Lock()
+	defer memberStoreMutex.Unlock()
+	memberStore = store
+}
+
+// getMemberStore returns the current membership store
+func getMemberStore() MemberStore {
+	memberStoreMutex.Lock()
+	defer memberStoreMutex.Unlock()
+	return memberStore
+}
+
+// UserRole returns the user's role in a project. Instance admins act as owners of every project.
+func UserRole(ctx context.Context, user *auth.User, projectID int64) (Role, error) {
+	if user == nil {
+		return "", nil
+	}
+	if user.IsAdmin {
+		return RoleOwner, nil
+	}
+	// Accounts from a project's user directory are its viewers and have no role elsewhere;
+	// their IDs are not ai.users IDs, so the member store does not apply to them
+	if user.ProjectID != 0 {
+		if user.ProjectID == projectID {
+			return RoleViewer, nil
+		}
+		return "", nil
+	}
+	return getMemberStore().Role(ctx, projectID, user.ID)
+}
+
+// Can reports whether the user may perform an action on a project
+func Can(ctx context.Context, user *auth.User, projectID int64, perm Permission) (bool, error) {
+	role, err := UserRole(ctx, user, projectID)
+	if err != nil {
+		return false, err
+	}
+	return role.Allows(perm), nil
+}
+
+// RequirePermission writes a 403 (or 500) JSON error and returns false unless the user may perform the action
+func RequirePermission(w http.ResponseWriter, r *http.Request, projectID int64, perm Permission) bool {
+	allowed, err := Can(r.Context(), auth.GetUserFromContext(r.Context()), projectID, perm)
+	if err != nil {
+		log.Printf("Error checking permission on project %d: %v", projectID, err)
+		common.JSONError(w, "Failed to check project permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		common.JSONError(w, "Forbidden: insufficient project role", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// VisibleProjects filters a project list down to the projects the user can view
+func VisibleProjects(ctx context.Context, user *auth.User, list []*Project) ([]*Project, error) {
+	if user == nil {
+		return nil, nil
+	}
+	if user.IsAdmin {
+		return list, nil
+	}
+	// A project directory account only sees its own project, see UserRole
+	if user.ProjectID != 0 {
+		visible := []*Project{}
+		for _, project := range list {
+			if project.ID == user.ProjectID {
+				visible = append(visible, project)
+			}
+		}
+		return visible, nil
+	}
+	roles, err := getMemberStore().RolesByUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]*Project, 0, len(roles))
+	for _, project := range list {
+		if roles[project.ID].Allows(PermView) {
+			visible = append(visible, project)
+		}
+	}
+	return visible, nil
+}
+
+// SetMemberRole adds a member or changes their role on behalf of actor. Only owners may grant
+// or revoke the owner role, and the last owner cannot be demoted.
+func SetMemberRole(ctx context.Context, actor *auth.User, projectID int64, userID int, role Role) error {
+	if !role.Valid() {
+		return ErrInvalidRole
+	}
+	actorRole, err := UserRole(ctx, actor, projectID)
+	if err != nil {
+		return err
+	}
+	current, err := getMemberStore().Role(ctx, projectID, userID)
+	if err != nil {
+		return err
+	}
+	if (role == RoleOwner || current == RoleOwner) && actorRole != RoleOwner {
+		return ErrOwnerRequired
+	}
+	// The store refuses to demote the last owner, checking and changing the role atomically
+	return getMemberStore().SetRole(ctx, projectID, userID, role)
+}
+
+// GrantRole gives a user a role in a project unless they already have that role or a higher one.
+// It is for grants made by the system, such as accepted invitations, so no actor is checked.
+func GrantRole(ctx context.Context, projectID int64, userID int, role Role) error {
+	if !role.Valid() {
+		return ErrInvalidRole
+	}
+	store := getMemberStore()
+	current, err := store.Role(ctx, projectID, userID)
+	if err != nil {
+		return err
+	}
+	if current.rank() >= role.rank() {
+		return nil
+	}
+	return store.SetRole(ctx, projectID, userID, role)
+}
+
+// RemoveMember removes a member on behalf of actor. Members may always leave a project; removing
+// someone else requires the manage permission, removing an owner being an owner, and the last owner
+// cannot leave. Project directory accounts are never the member with their ID.
+func RemoveMember(ctx context.Context, actor *auth.User, projectID int64, userID int) error {
+	if actor == nil || actor.ProjectID != 0 || actor.ID != userID {
+		allowed, err := Can(ctx, actor, projectID, PermManage)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return ErrManageRequired
+		}
+	}
+	current, err := getMemberStore().Role(ctx, projectID, userID)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return ErrNotMember
+	}
+	if current == RoleOwner {
+		actorRole, err := UserRole(ctx, actor, projectID)
+		if err != nil {
+			return err
+		}
+		if actorRole != RoleOwner {
+			return ErrOwnerRequired
+		}
+	}
+	// The store refuses to remove the last owner
+	_, err = getMemberStore().Remove(ctx, projectID, userID)
+	return err
+}
+
+// UserMemberships returns the user's role in each project they are a member of
+func UserMemberships(ctx context.Context, userID int) (map[int64]Role, error) {
+	return getMemberStore().RolesByUser(ctx, userID)
+}
+
+// RemoveUserMemberships removes a user from every project in the member store; account deletion
+// uses RemoveUserMembershipsTx instead. It returns ErrLastOwner, and removes nothing, when they are the last owner of a project.
+func RemoveUserMemberships(ctx context.Context, userID int) error {
+	return getMemberStore().RemoveUser(ctx, userID)
+}
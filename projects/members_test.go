@@ -0,0 +1,233 @@
+package projects
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/scriptmaster/openagent/auth"
+)
+
+// useMemoryMemberStore installs a fresh membership store for the duration of the test
+func useMemoryMemberStore(t *testing.T) MemberStore {
+	previous := getMemberStore()
+	store := NewMemoryMemberStore()
+	SetMemberStore(store)
+	t.Cleanup(func() { SetMemberStore(previous) })
+	return store
+}
+
+// memberUserService finds users by email
+type memberUserService struct {
+	auth.UserServicer
+	users map[string]*auth.User
+}
+
+func (s *memberUserService) GetUserByEmail(ctx context.Context, email string) (*auth.User, error) {
+	if user, ok := s.users[email]; ok {
+		return user, nil
+	}
+	return nil, errors.New("user not found")
+}
+
+// TestRolePermissions tests which permissions each role grants
+func TestRolePermissions(t *testing.T) {
+	tests := []struct {
+		role                         Role
+		view, edit, manage, deletion bool
+	}{
+		{RoleOwner, true, true, true, true},
+		{RoleAdmin, true, true, true, false},
+		{RoleEditor, true, true, false, false},
+		{RoleViewer, true, false, false, false},
+		{"", false, false, false, false},
+	}
+	for _, tt := range tests {
+		got := []bool{tt.role.Allows(PermView), tt.role.Allows(PermEdit), tt.role.Allows(PermManage), tt.role.Allows(PermDelete)}
+		want := []bool{tt.view, tt.edit, tt.manage, tt.deletion}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("Role %q: permissions %v, want %v", tt.role, got, want)
+				break
+			}
+		}
+	}
+}
+
+// TestOwnerRules tests that only owners manage owners and that the last owner is kept
+func TestOwnerRules(t *testing.T) {
+	store := useMemoryMemberStore(t)
+	ctx := context.Background()
+	owner := &auth.User{ID: 1, Email: "owner@example.com"}
+	admin := &auth.User{ID: 2, Email: "admin@example.com"}
+	store.SetRole(ctx, 7, owner.ID, RoleOwner)
+	store.SetRole(ctx, 7, admin.ID, RoleAdmin)
+
+	if err := SetMemberRole(ctx, admin, 7, 3, RoleOwner); !errors.Is(err, ErrOwnerRequired) {
+		t.Errorf("Expected admins to be refused granting owner, got %v", err)
+	}
+	if err := SetMemberRole(ctx, admin, 7, owner.ID, RoleViewer); !errors.Is(err, ErrOwnerRequired) {
+		t.Errorf("Expected admins to be refused demoting an owner, got %v", err)
+	}
+	if err := SetMemberRole(ctx, owner, 7, owner.ID, RoleAdmin); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Expected the last owner to be kept, got %v", err)
+	}
+	if err := RemoveMember(ctx, owner, 7, owner.ID); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Expected the last owner to be unable to leave, got %v", err)
+	}
+	if err := SetMemberRole(ctx, admin, 7, 3, "superuser"); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("Expected an unknown role to be refused, got %v", err)
+	}
+
+	if err := SetMemberRole(ctx, owner, 7, admin.ID, RoleOwner); err != nil {
+		t.Fatalf("Expected an owner to promote an admin: %v", err)
+	}
+	if err := RemoveMember(ctx, owner, 7, owner.ID); err != nil {
+		t.Errorf("Expected an owner to leave once another owner exists: %v", err)
+	}
+}
+
+// TestCanAndVisibleProjects tests permission checks and project list filtering for members, strangers and instance admins
+func TestCanAndVisibleProjects(t *testing.T) {
+	store := useMemoryMemberStore(t)
+	ctx := context.Background()
+	viewer := &auth.User{ID: 5}
+	store.SetRole(ctx, 1, viewer.ID, RoleViewer)
+
+	if ok, _ := Can(ctx, viewer, 1, PermView); !ok {
+		t.Error("Expected a viewer to view the project")
+	}
+	if ok, _ := Can(ctx, viewer, 1, PermManage); ok {
+		t.Error("Expected a viewer not to manage the project")
+	}
+	if ok, _ := Can(ctx, viewer, 2, PermView); ok {
+		t.Error("Expected a non-member not to view the project")
+	}
+	if ok, _ := Can(ctx, &auth.User{ID: 9, IsAdmin: true}, 2, PermDelete); !ok {
+		t.Error("Expected instance admins to be allowed everything")
+	}
+
+	visible, err := VisibleProjects(ctx, viewer, []*Project{{ID: 1}, {ID: 2}})
+	if err != nil || len(visible) != 1 || visible[0].ID != 1 {
+		t.Errorf("Expected only project 1 to be visible, got %v (%v)", visible, err)
+	}
+}
+
+// TestProjectMembersAPI tests adding, changing and removing members through the API
+func TestProjectMembersAPI(t *testing.T) {
+	store := useMemoryMemberStore(t)
+	ctx := context.Background()
+	owner := &auth.User{ID: 1, Email: "owner@example.com"}
+	editor := &auth.User{ID: 2, Email: "editor@example.com"}
+	store.SetRole(ctx, 3, owner.ID, RoleOwner)
+	users := &memberUserService{users: map[string]*auth.User{editor.Email: editor}}
+
+	do := func(user *auth.User, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req = req.WithContext(auth.SetUserContext(req.Context(), user))
+		rec := httptest.NewRecorder()
+		HandleProjectMembersAPI(rec, req, users)
+		return rec
+	}
+
+	if rec := do(owner, http.MethodPost, "/api/projects/3/members", `{"email":"editor@example.com","role":"editor"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the owner to add a member, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if role, _ := store.Role(ctx, 3, editor.ID); role != RoleEditor {
+		t.Fatalf("Expected the new member to be an editor, got %q", role)
+	}
+	if rec := do(editor, http.MethodPut, "/api/projects/3/members/2", `{"role":"admin"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected an editor to be refused changing roles, got %d", rec.Code)
+	}
+	if rec := do(editor, http.MethodGet, "/api/projects/3/members", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected a member to list members, got %d", rec.Code)
+	}
+	if rec := do(&auth.User{ID: 8}, http.MethodGet, "/api/projects/3/members", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a stranger to be refused, got %d", rec.Code)
+	}
+	if rec := do(editor, http.MethodDelete, "/api/projects/3/members/2", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected a member to leave the project, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(&auth.User{ID: 1, ProjectID: 9}, http.MethodDelete, "/api/projects/3/members/1", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a directory account to be refused removing the ai.users account with its ID, got %d", rec.Code)
+	}
+	if rec := do(owner, http.MethodDelete, "/api/projects/3/members/1", ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected the last owner to be kept, got %d", rec.Code)
+	}
+}
+
+// TestDirectoryUserRole tests that accounts from a project's user directory only view their own project
+func TestDirectoryUserRole(t *testing.T) {
+	store := useMemoryMemberStore(t)
+	ctx := context.Background()
+	user := &auth.User{ID: 5, ProjectID: 3}
+	store.SetRole(ctx, 4, user.ID, RoleOwner) // An ai.users account with the same ID
+
+	if role, _ := UserRole(ctx, user, 3); role != RoleViewer {
+		t.Errorf("Expected a viewer of its own project, got %q", role)
+	}
+	if role, _ := UserRole(ctx, user, 4); role != "" {
+		t.Errorf("Expected no role in other projects, got %q", role)
+	}
+	visible, _ := VisibleProjects(ctx, user, []*Project{{ID: 3}, {ID: 4}})
+	if len(visible) != 1 || visible[0].ID != 3 {
+		t.Errorf("Expected only its own project to be visible, got %v", visible)
+	}
+	if err := RemoveMember(ctx, user, 4, user.ID); !errors.Is(err, ErrManageRequired) {
+		t.Errorf("Expected the directory account to be refused removing the ai.users account, got %v", err)
+	}
+	if role, _ := store.Role(ctx, 4, user.ID); role != RoleOwner {
+		t.Errorf("Expected the ai.users account to stay owner, got %q", role)
+	}
+}
+
+// TestRemoveUserMemberships tests that a deleted account leaves every project unless it is a last owner
+func TestRemoveUserMemberships(t *testing.T) {
+	store := useMemoryMemberStore(t)
+	ctx := context.Background()
+	store.SetRole(ctx, 1, 10, RoleOwner)
+	store.SetRole(ctx, 2, 10, RoleEditor)
+	store.SetRole(ctx, 2, 11, RoleOwner)
+
+	if err := RemoveUserMemberships(ctx, 10); !errors.Is(err, ErrLastOwner) {
+		t.Fatalf("Expected the last owner of project 1 to be kept, got %v", err)
+	}
+	if roles, _ := UserMemberships(ctx, 10); len(roles) != 2 {
+		t.Errorf("Expected no membership to be removed after a refusal, got %v", roles)
+	}
+
+	store.SetRole(ctx, 1, 11, RoleOwner)
+	if err := RemoveUserMemberships(ctx, 10); err != nil {
+		t.Fatalf("Expected the memberships to be removed: %v", err)
+	}
+	if roles, _ := UserMemberships(ctx, 10); len(roles) != 0 {
+		t.Errorf("Expected no memberships left, got %v", roles)
+	}
+	if role, _ := store.Role(ctx, 2, 11); role != RoleOwner {
+		t.Errorf("Expected other members to be kept, got %q", role)
+	}
+}
+
+// TestMemberStoreKeepsLastOwner tests that the store itself refuses to demote or remove the last owner
+func TestMemberStoreKeepsLastOwner(t *testing.T) {
+	store := useMemoryMemberStore(t)
+	ctx := context.Background()
+	store.SetRole(ctx, 5, 1, RoleOwner)
+	store.SetRole(ctx, 5, 2, RoleOwner)
+
+	if err := store.SetRole(ctx, 5, 1, RoleAdmin); err != nil {
+		t.Fatalf("Expected one of two owners to be demoted: %v", err)
+	}
+	if err := store.SetRole(ctx, 5, 2, RoleAdmin); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Expected the last owner to be kept, got %v", err)
+	}
+	if removed, err := store.Remove(ctx, 5, 2); removed || !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Expected the last owner not to be removed, got %v, %v", removed, err)
+	}
+	if removed, err := store.Remove(ctx, 5, 1); !removed || err != nil {
+		t.Errorf("Expected the demoted owner to be removed, got %v, %v", removed, err)
+	}
+}
@@ -0,0 +1,161 @@
+package projects
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/scriptmaster/openagent/auth"
+)
+
+const (
+	// OptionOIDCProviders is the project option holding the project's own OpenID Connect identity providers
+	OptionOIDCProviders = "oidc_providers"
+	// OptionLDAP is the project option holding the project's own LDAP directory
+	OptionLDAP = "ldap"
+)
+
+// redactedSecret replaces secrets in the project options returned by the API.
+// Sending it back in an update keeps the stored secret.
+const redactedSecret = "********"
+
+// ErrAdminOption is returned when someone other than an instance administrator changes an admin option
+var ErrAdminOption = errors.New("only instance administrators can change this option")
+
+// adminOptions decide who can log in and as which account, and which servers the instance connects
+// to, so only instance administrators may set them. The listed fields hold secrets and are redacted in API responses.
+var adminOptions = map[string][]string{
+	OptionOIDCProviders: {"client_secret"},
+	OptionLDAP:          {"bind_password"},
+}
+
+// RedactProject returns a copy of project whose options have their secrets redacted
+func RedactProject(project *Project) *Project {
+	if project == nil {
+		return nil
+	}
+	redacted := *project
+	if project.Options != nil {
+		redacted.Options = make(ProjectOptions, len(project.Options))
+		for name, value := range project.Options {
+			if fields, ok := adminOptions[name]; ok {
+				value = redactSecrets(value, fields)
+			}
+			redacted.Options[name] = value
+		}
+	}
+	return &redacted
+}
+
+// applyAdminOptions checks the admin options in options, the options of a project being created
+// (existing nil) or updated. Others than instance administrators may only send them back unchanged,
+// as returned by the API, or leave them out; either keeps the stored value. Redacted secrets sent
+// back by an administrator are restored from existing.
+func applyAdminOptions(user *auth.User, options, existing ProjectOptions) error {
+	for name, fields := range adminOptions {
+		current := existing[name]
+		value, sent := options[name]
+		if user != nil && user.IsAdmin {
+			if sent {
+				options[name] = restoreSecrets(value, current, fields)
+			}
+			continue
+		}
+		if sent && !sameOption(value, redactSecrets(current, fields)) {
+			return fmt.Errorf("%w: %s", ErrAdminOption, name)
+		}
+		if current != nil {
+			options[name] = current
+		} else {
+			delete(options, name)
+		}
+	}
+	return nil
+}
+
+// sameOption reports whether two option values encode to the same JSON
+func sameOption(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aJSON) == string(bJSON)
+}
+
+// redactSecrets returns a copy of an option value with the non-empty fields replaced by redactedSecret
+func redactSecrets(value interface{}, fields []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if isSecretField(key, fields) && field != nil && field != "" {
+				redacted[key] = redactedSecret
+			} else {
+				redacted[key] = redactSecrets(field, fields)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = redactSecrets(item, fields)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
+
+// restoreSecrets replaces redactedSecret in an option value by the secret stored in current.
+// List items are matched by their "id", or by position when they have none.
+func restoreSecrets(value, current interface{}, fields []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		stored, _ := current.(map[string]interface{})
+		for key, field := range v {
+			switch {
+			case isSecretField(key, fields) && field == redactedSecret:
+				if secret, ok := stored[key]; ok {
+					v[key] = secret
+				} else {
+					delete(v, key)
+				}
+			default:
+				v[key] = restoreSecrets(field, stored[key], fields)
+			}
+		}
+		return v
+	case []interface{}:
+		stored, _ := current.([]interface{})
+		for i, item := range v {
+			v[i] = restoreSecrets(item, matchingItem(item, stored, i), fields)
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+// matchingItem returns the stored list item with the same "id" as item, or the one at position i
+func matchingItem(item interface{}, stored []interface{}, i int) interface{} {
+	if m, ok := item.(map[string]interface{}); ok && m["id"] != nil {
+		for _, candidate := range stored {
+			if c, ok := candidate.(map[string]interface{}); ok && c["id"] == m["id"] {
+				return c
+			}
+		}
+		return nil
+	}
+	if i < len(stored) {
+		return stored[i]
+	}
+	return nil
+}
+
+// isSecretField reports whether key is one of the secret fields
+func isSecretField(key string, fields []string) bool {
+	for _, field := range fields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package projects
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/scriptmaster/openagent/auth"
+)
+
+// TestAdminOptions tests that only instance administrators change identity providers and directories,
+// and that their secrets are redacted in responses and kept when the redacted value is sent back
+func TestAdminOptions(t *testing.T) {
+	stored := ProjectOptions{
+		"theme": "dark",
+		OptionOIDCProviders: []interface{}{
+			map[string]interface{}{"id": "corp", "client_id": "app", "client_secret": "s3cret"},
+		},
+		OptionLDAP: map[string]interface{}{"url": "ldaps://ldap.example.com", "bind_password": "b1nd"},
+	}
+	project := &Project{ID: 3, Options: stored}
+
+	redacted := RedactProject(project)
+	providers := redacted.Options[OptionOIDCProviders].([]interface{})
+	if secret := providers[0].(map[string]interface{})["client_secret"]; secret != redactedSecret {
+		t.Errorf("Expected the client secret to be redacted, got %v", secret)
+	}
+	if secret := redacted.Options[OptionLDAP].(map[string]interface{})["bind_password"]; secret != redactedSecret {
+		t.Errorf("Expected the bind password to be redacted, got %v", secret)
+	}
+	if stored[OptionOIDCProviders].([]interface{})[0].(map[string]interface{})["client_secret"] != "s3cret" {
+		t.Fatal("Expected redaction to leave the stored project unchanged")
+	}
+
+	member := &auth.User{ID: 7}
+	unchanged := ProjectOptions{"theme": "light", OptionOIDCProviders: redacted.Options[OptionOIDCProviders]}
+	if err := applyAdminOptions(member, unchanged, stored); err != nil {
+		t.Errorf("Expected a member to send the redacted providers back, got %v", err)
+	}
+	if !sameOption(unchanged[OptionOIDCProviders], stored[OptionOIDCProviders]) {
+		t.Errorf("Expected the stored providers to be kept, got %v", unchanged[OptionOIDCProviders])
+	}
+	omitted := ProjectOptions{}
+	if err := applyAdminOptions(member, omitted, stored); err != nil || omitted[OptionOIDCProviders] == nil {
+		t.Errorf("Expected leaving the providers out to keep them, got %v, %v", omitted, err)
+	}
+
+	takeover := []interface{}{map[string]interface{}{"id": "evil", "issuer": "https://idp.attacker.example"}}
+	if err := applyAdminOptions(member, ProjectOptions{OptionOIDCProviders: takeover}, stored); !errors.Is(err, ErrAdminOption) {
+		t.Errorf("Expected a member to be refused changing the providers, got %v", err)
+	}
+	if err := applyAdminOptions(member, ProjectOptions{OptionOIDCProviders: takeover}, nil); !errors.Is(err, ErrAdminOption) {
+		t.Errorf("Expected a member to be refused creating a project with providers, got %v", err)
+	}
+	directory := map[string]interface{}{"url": "ldap://10.0.0.5", "allow_plaintext": true, "base_dn": "dc=attacker"}
+	if err := applyAdminOptions(member, ProjectOptions{OptionLDAP: directory}, stored); !errors.Is(err, ErrAdminOption) {
+		t.Errorf("Expected a member to be refused changing the directory, got %v", err)
+	}
+
+	admin := &auth.User{ID: 1, IsAdmin: true}
+	update := ProjectOptions{OptionOIDCProviders: []interface{}{
+		map[string]interface{}{"id": "corp", "client_id": "app2", "client_secret": redactedSecret},
+	}}
+	if err := applyAdminOptions(admin, update, stored); err != nil {
+		t.Fatalf("Expected an administrator to change the providers, got %v", err)
+	}
+	provider := update[OptionOIDCProviders].([]interface{})[0].(map[string]interface{})
+	if provider["client_id"] != "app2" || provider["client_secret"] != "s3cret" {
+		t.Errorf("Expected the new client id with the stored secret, got %v", provider)
+	}
+}
@@ -29,5 +29,9 @@ func RegisterProjectRoutes(router *http.ServeMux, templates types.TemplateEngine
 	// --- HTML Page Routes ---
 	// Handle the main /projects page (renders HTML)
 	router.Handle("/projects", auth.AuthMiddleware(http.HandlerFunc(CreateProjectsHandler(templates, projectService, userService))))
-	router.Handle("/api/projects/", auth.AuthMiddleware(http.HandlerFunc(CreateProjectsAPIHandler(templates, projectService, projectDBService))))
+	router.Handle("/api/projects/", auth.AuthMiddleware(http.HandlerFunc(CreateProjectsAPIHandler(templates, projectService, projectDBService, userService))))
+
+	// Invitation links are opened before the invitee has an account
+	router.HandleFunc("/invite", CreateInvitePageHandler(templates, projectService))
+	router.HandleFunc("/invite/accept", CreateAcceptInvitationHandler(userService))
 }
@@ -1,6 +1,7 @@
 package projects
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -63,7 +64,18 @@ func (s *projectService) Create(project *Project) (int64, error) {
 		return 0, errors.New("domain is already in use")
 	}
 
-	return s.repo.Create(project)
+	id, err := s.repo.Create(project)
+	if err != nil {
+		return 0, err
+	}
+
+	// The creator owns the project
+	if project.CreatedBy != 0 {
+		if err := getMemberStore().SetRole(context.Background(), id, int(project.CreatedBy), RoleOwner); err != nil {
+			log.Printf("WARN: Failed to make user %d the owner of project %d: %v", project.CreatedBy, id, err)
+		}
+	}
+	return id, nil
 }
 
 // GetByID implements ProjectService.GetByID
@@ -73,6 +73,7 @@ type ProjectsPageData struct {
 	User       auth.User
 	Projects   []*Project // Changed from interface{}
 	AppVersion string
+	CSRFToken  string
 }
 
 // ProjectService defines the interface for project operations
@@ -0,0 +1,94 @@
+package projects
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// HandleProjectUserDirectoryAPI manages the user directory of a project at /api/projects/{id}/userdirectory:
+// GET returns it (null when logins use ai.users), PUT {project_db_id, table, ...} maps a users table in
+// the project's default database and DELETE switches logins back to ai.users.
+func HandleProjectUserDirectoryAPI(w http.ResponseWriter, r *http.Request, projectDBService common.ProjectDBService) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/projects/"), "/userdirectory")
+	projectID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		common.JSONError(w, "Invalid project ID in URL", http.StatusBadRequest)
+		return
+	}
+	if !RequirePermission(w, r, projectID, PermManage) {
+		return
+	}
+	if projectDBService == nil {
+		common.JSONError(w, "Database service not available", http.StatusInternalServerError)
+		return
+	}
+
+	current, err := projectDBService.GetUserDirectory(int(projectID))
+	if err != nil {
+		log.Printf("Error loading the user directory of project %d: %v", projectID, err)
+		common.JSONError(w, "Failed to load the user directory", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		common.JSONResponse(w, current)
+
+	case http.MethodPut:
+		var directory common.UserDirectory
+		if err := json.NewDecoder(r.Body).Decode(&directory); err != nil {
+			common.JSONError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := directory.Validate(); err != nil {
+			common.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		projectDB, err := projectDBService.GetProjectDB(directory.ProjectDBID)
+		if err != nil {
+			common.JSONError(w, "Project database not found", http.StatusNotFound)
+			return
+		}
+		if projectDB.ProjectID != int(projectID) {
+			common.JSONError(w, "ProjectDB record does not belong to the specified project", http.StatusForbidden)
+			return
+		}
+		if !projectDB.IsDefault {
+			common.JSONError(w, "The user directory must be in the project's default database", http.StatusBadRequest)
+			return
+		}
+		if current != nil && current.ProjectDBID != projectDB.ID {
+			if err := projectDBService.SetUserDirectory(current.ProjectDBID, nil); err != nil {
+				log.Printf("Error clearing the user directory of project DB %d: %v", current.ProjectDBID, err)
+				common.JSONError(w, "Failed to update the user directory", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := projectDBService.SetUserDirectory(projectDB.ID, &directory); err != nil {
+			log.Printf("Error setting the user directory of project %d: %v", projectID, err)
+			common.JSONError(w, "Failed to update the user directory", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User directory of project %d set to %s on project DB %d", projectID, directory.Table, projectDB.ID)
+		common.JSONResponse(w, directory)
+
+	case http.MethodDelete:
+		if current != nil {
+			if err := projectDBService.SetUserDirectory(current.ProjectDBID, nil); err != nil {
+				log.Printf("Error removing the user directory of project %d: %v", projectID, err)
+				common.JSONError(w, "Failed to remove the user directory", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User directory of project %d removed", projectID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
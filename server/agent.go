@@ -14,6 +14,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/scriptmaster/openagent/auth"
 )
 
 // Configuration constants (can be overridden by environment variables)
@@ -32,13 +34,14 @@ const (
 type AgentState string
 
 const (
-	StateIdle         AgentState = "Idle"
-	StateThinking     AgentState = "Thinking..."
-	StateExecuting    AgentState = "Executing Command..."
-	StateAwaitingStep AgentState = "Awaiting Next Step"
-	StateFinished     AgentState = "Finished"
-	StateBlocked      AgentState = "Command Blocked (Safety)"
-	StateError        AgentState = "Error"
+	StateIdle             AgentState = "Idle"
+	StateThinking         AgentState = "Thinking..."
+	StateExecuting        AgentState = "Executing Command..."
+	StateAwaitingStep     AgentState = "Awaiting Next Step"
+	StateAwaitingApproval AgentState = "Awaiting Approval" // A proposed command waits for the next step (AGENT_REQUIRE_APPROVAL=1)
+	StateFinished         AgentState = "Finished"
+	StateBlocked          AgentState = "Command Blocked (Safety)"
+	StateError            AgentState = "Error"
 )
 
 // --- Agent Definition ---
@@ -55,6 +58,44 @@ type Agent struct {
 	State         AgentState
 	LastOutput    string
 	LastError     string
+
+	// Model generates the assistant's next action. Defaults to Ollama at OllamaURL.
+	Model ModelClient
+	// WorkDir is where commands run and the only place writes are allowed. Defaults to dataDir.
+	WorkDir string
+	// SystemPrompt is the template for the system message. Defaults to defaultSystemPrompt.
+	SystemPrompt string
+	// Prompts records which library prompt versions this run uses.
+	Prompts AgentPromptRefs
+	// RunID is the ai.agent_runs row for this run, 0 when it was not recorded.
+	RunID int64
+	// RequireApproval holds each proposed command in StateAwaitingApproval until the next step runs it.
+	RequireApproval bool
+	// PendingAction is the command waiting for approval.
+	PendingAction string
+	// Notifier receives state change events; UserEmail and ProjectID address them.
+	Notifier  *Notifier
+	UserEmail string
+	ProjectID int
+}
+
+// ModelClient produces a completion for the agent's prompt.
+type ModelClient interface {
+	Generate(ctx context.Context, model, prompt string) (string, error)
+}
+
+// ollamaClient talks to an Ollama server's /api/generate endpoint.
+type ollamaClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewOllamaClient creates a ModelClient backed by an Ollama server.
+func NewOllamaClient(baseURL string, httpClient *http.Client) ModelClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: requestTimeout}
+	}
+	return &ollamaClient{baseURL: baseURL, httpClient: httpClient}
 }
 
 type Message struct {
@@ -148,35 +189,48 @@ func GetAgentState() map[string]interface{} {
 		"goal":          globalAgent.Goal,
 		"lastOutput":    globalAgent.LastOutput,
 		"lastError":     globalAgent.LastError,
+		"prompts":       globalAgent.Prompts,
+		"runId":         globalAgent.RunID,
+		"pendingAction": globalAgent.PendingAction,
 	}
 }
 
+// workDir returns the directory the agent is confined to.
+func (a *Agent) workDir() string {
+	if a.WorkDir != "" {
+		return a.WorkDir
+	}
+	return dataDir
+}
+
+// model returns the configured ModelClient, falling back to Ollama.
+func (a *Agent) model() ModelClient {
+	if a.Model == nil {
+		a.Model = NewOllamaClient(a.OllamaURL, a.HttpClient)
+	}
+	return a.Model
+}
+
 func (a *Agent) buildPrompt() string {
 	var promptBuilder strings.Builder
 	for _, msg := range a.History {
 		promptBuilder.WriteString(fmt.Sprintf("[%s]\n%s\n\n", strings.ToUpper(msg.Role), msg.Content))
 	}
-	promptBuilder.WriteString("[ASSISTANT]\nWhat is the next single command to execute within the '/app/data' directory or the final answer? Respond ONLY with 'COMMAND: <command>' OR 'FINAL_ANSWER: <answer>'.")
+	promptBuilder.WriteString(fmt.Sprintf("[ASSISTANT]\nWhat is the next single command to execute within the '%s' directory or the final answer? Respond ONLY with 'COMMAND: <command>' OR 'FINAL_ANSWER: <answer>'.", a.workDir()))
 	return promptBuilder.String()
 }
 
 func (a *Agent) buildSystemPrompt() string {
-	// Updated prompt to mention the working directory constraint
-	return fmt.Sprintf(`You are an autonomous AI agent running inside a restricted Docker container. Your goal is: %s
-You can execute shell commands on the Linux system within the container to achieve the goal.
-IMPORTANT: All file operations and commands that create output should target the '/app/data' directory. Do NOT attempt to write outside this directory. For example, use 'ls /app/data', 'mkdir /app/data/newdir', 'echo "hello" > /app/data/file.txt'.
-Dangerous commands (like rm, dd, mkfs, shutdown, direct redirection overwrite > outside /app/data) are blocked. Use pipes | carefully.
-Think step-by-step. Plan your actions.
-Based on the history and the goal, decide the single next best shell command to execute.
-Respond ONLY in one of the following two formats:
-1. To execute a command: COMMAND: <command_to_execute> (Ensure paths are within /app/data where appropriate)
-2. To provide the final answer: FINAL_ANSWER: <your_final_answer>
-
-Do NOT provide explanations, apologies, or any text other than the chosen format.
-If a command is blocked, analyze the error and try a different, safe approach within '/app/data'.
-Use 'tee /app/data/...' or '>> /app/data/...' for writing files safely. Avoid '>' if possible, especially outside /app/data.
-If the goal is achieved, provide the FINAL_ANSWER.
-Current Date/Time: %s`, a.Goal, time.Now().Format(time.RFC3339))
+	body := a.SystemPrompt
+	if body == "" {
+		body = defaultSystemPrompt
+	}
+	rendered, _ := RenderPromptTemplate(body, map[string]string{
+		"goal":     a.Goal,
+		"workdir":  a.workDir(),
+		"datetime": time.Now().Format(time.RFC3339),
+	})
+	return rendered
 }
 
 func (a *Agent) addToHistory(role, content string) {
@@ -217,10 +271,15 @@ var forbiddenCommandPrefixes = []string{
 	"> /etc", "> /dev", "> /bin", "> /sbin", "> /usr", "> /root", "> /var", "> /tmp", "> /run",
 	"| sh", "| bash", "| zsh",
 }
-var allowedWritePrefix = dataDir + "/" // Allow writing inside the data directory
 
-// isCommandSafe performs basic checks. NOT FOOLPROOF.
+// isCommandSafe performs basic checks against the default data directory. NOT FOOLPROOF.
 func isCommandSafe(commandStr string) (bool, string) {
+	return isCommandSafeIn(commandStr, dataDir)
+}
+
+// isCommandSafeIn performs the same checks for an arbitrary working directory.
+func isCommandSafeIn(commandStr, workDir string) (bool, string) {
+	allowedWritePrefix := workDir + "/" // Allow writing inside the working directory
 	trimmedCmd := strings.TrimSpace(commandStr)
 	lowerCmd := strings.ToLower(trimmedCmd)
 
@@ -239,8 +298,8 @@ func isCommandSafe(commandStr string) (bool, string) {
 			// Check if a field looks like an absolute path or relative path starting with '/' or './' or '../'
 			// And it's NOT within the allowed data directory
 			if strings.Contains(field, "/") && !strings.HasPrefix(field, allowedWritePrefix) && field != ">" && field != ">>" && field != "|" && field != "&" {
-				// Allow paths relative to current dir IF current dir is /app/data (or /app, needs check)
-				// For simplicity, let's just block absolute paths outside /app/data for now
+				// Allow paths relative to current dir IF current dir is workDir (or /app, needs check)
+				// For simplicity, let's just block absolute paths outside workDir for now
 				if strings.HasPrefix(field, "/") {
 					isPipeTarget := false
 					pipeParts := strings.Split(trimmedCmd, "|")
@@ -250,21 +309,21 @@ func isCommandSafe(commandStr string) (bool, string) {
 
 					// More refinement needed here. Let's block direct writes outside allowed prefix.
 					if (strings.Contains(trimmedCmd, " > "+field) || strings.Contains(trimmedCmd, " >> "+field) || strings.HasPrefix(trimmedCmd, "touch "+field) || strings.HasPrefix(trimmedCmd, "mkdir "+field)) && !isPipeTarget {
-						return false, fmt.Sprintf("Command blocked: Attempting file operation on '%s' which is outside the allowed '%s' directory.", field, dataDir)
+						return false, fmt.Sprintf("Command blocked: Attempting file operation on '%s' which is outside the allowed '%s' directory.", field, workDir)
 					}
 				}
 			}
 		}
 	}
 
-	// Allow 'cd /app/data' but not 'cd /' or 'cd /etc' etc.
+	// Allow 'cd <workDir>' but not 'cd /' or 'cd /etc' etc.
 	if strings.HasPrefix(lowerCmd, "cd ") {
 		targetDir := strings.TrimSpace(strings.TrimPrefix(lowerCmd, "cd "))
-		if targetDir != dataDir && !strings.HasPrefix(targetDir, dataDir+"/") && targetDir != "." && targetDir != ".." {
-			// Allow relative cd inside dataDir - complex to check robustly here.
-			// Safest bet is to perhaps ONLY allow `cd /app/data`.
-			if targetDir != "/app/data" {
-				return false, fmt.Sprintf("Command blocked: 'cd' is only allowed to '%s'. Attempted: '%s'", dataDir, targetDir)
+		if targetDir != workDir && !strings.HasPrefix(targetDir, workDir+"/") && targetDir != "." && targetDir != ".." {
+			// Allow relative cd inside workDir - complex to check robustly here.
+			// Safest bet is to perhaps ONLY allow `cd` into the working directory.
+			if targetDir != workDir {
+				return false, fmt.Sprintf("Command blocked: 'cd' is only allowed to '%s'. Attempted: '%s'", workDir, targetDir)
 			}
 		}
 	}
@@ -275,69 +334,115 @@ func isCommandSafe(commandStr string) (bool, string) {
 // --- Agent Step Logic ---
 
 func (a *Agent) Step() {
+	if !a.beginStep() {
+		return
+	}
+
+	// Run think/execute in a separate goroutine to avoid blocking status updates
+	go a.runStep()
+}
+
+// beginStep checks whether a step may run and moves the agent to StateThinking.
+func (a *Agent) beginStep() bool {
 	a.Lock() // Lock the agent instance
+	defer a.Unlock()
 	// Check state conditions (same as before)
 	if a.State == StateFinished || a.State == StateBlocked || a.State == StateError || a.State == StateThinking || a.State == StateExecuting {
 		log.Printf("Agent step requested but agent not in AwaitingStep state (current: %s).", a.State)
-		a.Unlock()
-		return
+		return false
 	}
-	if a.Iteration >= a.MaxIterations {
+	if a.PendingAction == "" && a.Iteration >= a.MaxIterations {
 		log.Printf("Agent reached max iterations (%d).\n", a.MaxIterations)
 		a.State = StateFinished
 		a.LastOutput = "Stopped: Reached maximum iteration limit."
-		a.Unlock()
-		return
+		a.notifyState()
+		return false
 	}
 
-	a.Iteration++
+	// Approving a pending command finishes the iteration that proposed it
+	if a.PendingAction == "" {
+		a.Iteration++
+	}
 	a.LastError = ""
 	log.Printf("--- Agent Step: Iteration %d ---", a.Iteration)
 	a.State = StateThinking
-	a.Unlock() // *Unlock* before potentially long-running think/execute
+	return true
+}
 
-	// Run think/execute in a separate goroutine to avoid blocking status updates
-	go func() {
-		// Re-lock within the goroutine to modify agent state
-		a.Lock()
-		// Ensure state was still Thinking when we re-acquired lock
-		if a.State != StateThinking {
-			log.Printf("Agent state changed unexpectedly before thinkInternal started (State: %s)", a.State)
-			a.Unlock()
-			return
-		}
-		action, err := a.thinkInternal() // Handles history update
+// runStep performs one think/execute cycle started by beginStep.
+func (a *Agent) runStep() {
+	// Re-lock to modify agent state
+	a.Lock()
+	defer a.Unlock()
+	// Ensure state was still Thinking when we re-acquired lock
+	if a.State != StateThinking {
+		log.Printf("Agent state changed unexpectedly before thinkInternal started (State: %s)", a.State)
+		return
+	}
+	action := a.PendingAction
+	a.PendingAction = ""
+	if action == "" {
+		var err error
+		action, err = a.thinkInternal() // Handles history update
 		if err != nil {
 			log.Printf("Error during thinking: %v", err)
 			a.State = StateError
 			a.LastError = fmt.Sprintf("Thinking error: %v", err)
 			a.addToHistory("system", fmt.Sprintf("System Error during thinking phase: %v. Please analyze and proceed.", err))
-			a.Unlock()
+			a.notifyState()
+			return
+		}
+		if a.RequireApproval && strings.HasPrefix(action, "COMMAND:") {
+			a.PendingAction = action
+			a.State = StateAwaitingApproval
+			a.LastOutput = "Waiting for approval to run: " + strings.TrimSpace(strings.TrimPrefix(action, "COMMAND:"))
+			log.Println("Agent is awaiting approval of a command.")
+			a.notifyState()
 			return
 		}
+	}
 
-		// Now execute
-		a.State = StateExecuting
-		observation, isFinal, blockReason := a.executeInternal(action) // Handles history update for result
+	// Now execute
+	a.State = StateExecuting
+	observation, isFinal, blockReason := a.executeInternal(action) // Handles history update for result
 
-		// Update state based on execution outcome
-		if blockReason != "" {
-			log.Printf("Command blocked: %s", blockReason)
-			a.State = StateBlocked
-			a.LastError = blockReason
-			// History already updated in executeInternal for blocked commands
+	// Update state based on execution outcome
+	if blockReason != "" {
+		log.Printf("Command blocked: %s", blockReason)
+		a.State = StateBlocked
+		a.LastError = blockReason
+		// History already updated in executeInternal for blocked commands
+	} else {
+		a.LastOutput = observation
+		if isFinal {
+			log.Println("Agent received final answer.")
+			a.State = StateFinished
 		} else {
-			a.LastOutput = observation
-			if isFinal {
-				log.Println("Agent received final answer.")
-				a.State = StateFinished
-			} else {
-				a.State = StateAwaitingStep
-				log.Println("Agent is awaiting the next step.")
-			}
+			a.State = StateAwaitingStep
+			log.Println("Agent is awaiting the next step.")
 		}
-		a.Unlock() // Unlock after state update
-	}()
+	}
+	a.notifyState()
+}
+
+// notifyState sends the notification for the current state, if it has one (requires agent lock held)
+func (a *Agent) notifyState() {
+	event := eventForState(a.State)
+	if a.Notifier == nil || event == "" {
+		return
+	}
+	a.Notifier.Notify(AgentEvent{
+		Event:      event,
+		RunID:      a.RunID,
+		ProjectID:  a.ProjectID,
+		UserEmail:  a.UserEmail,
+		Goal:       a.Goal,
+		State:      a.State,
+		Iteration:  a.Iteration,
+		LastOutput: a.LastOutput,
+		LastError:  a.LastError,
+		Timestamp:  time.Now(),
+	})
 }
 
 // thinkInternal (requires agent lock held)
@@ -354,43 +459,13 @@ func (a *Agent) thinkInternal() (string, error) {
 	}
 
 	fullPromptString := a.buildPrompt()
-	requestPayload := OllamaRequest{
-		Model:   a.ModelName,
-		Prompt:  fullPromptString,
-		Stream:  false,
-		Options: map[string]interface{}{"temperature": 0.5},
-	}
-	jsonData, err := json.Marshal(requestPayload)
-	// ... (Ollama request/response handling - same as before) ...
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	response, err := a.model().Generate(ctx, a.ModelName, fullPromptString)
 	if err != nil {
-		return "", fmt.Errorf("error marshalling ollama request: %w", err)
+		return "", err
 	}
-	req, err := http.NewRequest("POST", a.OllamaURL+"/api/generate", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("error creating ollama request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := a.HttpClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("error sending request to ollama: %w", err)
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading ollama response body: %w", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("ollama request failed with status %d: %s", resp.StatusCode, string(body))
-	}
-	var ollamaResp OllamaResponse
-	err = json.Unmarshal(body, &ollamaResp)
-	if err != nil {
-		log.Printf("Raw Ollama Response on Unmarshal Error:\n%s\n", string(body))
-		return "", fmt.Errorf("error unmarshalling ollama response: %w. Body: %s", err, string(body))
-	}
-	assistantResponse := strings.TrimSpace(ollamaResp.Response)
-	log.Printf("Ollama Response Received.") // Don't log full response here by default
+	assistantResponse := strings.TrimSpace(response)
 
 	// Add assistant's *intended* action to history
 	a.addToHistory("assistant", assistantResponse)
@@ -416,20 +491,20 @@ func (a *Agent) executeInternal(action string) (string, bool, string) {
 			return errorMsg, false, ""
 		}
 
-		safe, reason := isCommandSafe(commandStr)
+		safe, reason := isCommandSafeIn(commandStr, a.workDir())
 		if !safe {
 			log.Printf("Safety Check Failed: %s (Command: %s)", reason, commandStr)
 			// Add info about blocking to history for the LLM to see
-			a.addToHistory("user", fmt.Sprintf("Command '%s' was blocked by safety filter: %s. Propose a different, safe command within '/app/data'.", commandStr, reason))
+			a.addToHistory("user", fmt.Sprintf("Command '%s' was blocked by safety filter: %s. Propose a different, safe command within '%s'.", commandStr, reason, a.workDir()))
 			return fmt.Sprintf("Command blocked by safety filter: %s", reason), false, reason
 		}
 
-		log.Printf("Executing safe command: %s (in dir: %s)", commandStr, dataDir)
+		log.Printf("Executing safe command: %s (in dir: %s)", commandStr, a.workDir())
 		ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
 		defer cancel()
 
 		cmd := exec.CommandContext(ctx, "sh", "-c", commandStr)
-		cmd.Dir = dataDir // *** Execute command within the data directory ***
+		cmd.Dir = a.workDir() // *** Execute command within the data directory ***
 		var stdout, stderr bytes.Buffer
 		cmd.Stdout = &stdout
 		cmd.Stderr = &stderr
@@ -463,6 +538,46 @@ func (a *Agent) executeInternal(action string) (string, bool, string) {
 	return errorMsg, false, ""
 }
 
+// Generate sends the prompt to Ollama and returns the raw response text.
+func (c *ollamaClient) Generate(ctx context.Context, model, prompt string) (string, error) {
+	requestPayload := OllamaRequest{
+		Model:   model,
+		Prompt:  prompt,
+		Stream:  false,
+		Options: map[string]interface{}{"temperature": 0.5},
+	}
+	jsonData, err := json.Marshal(requestPayload)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling ollama request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/generate", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("error creating ollama request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending request to ollama: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading ollama response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ollama request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	var ollamaResp OllamaResponse
+	err = json.Unmarshal(body, &ollamaResp)
+	if err != nil {
+		log.Printf("Raw Ollama Response on Unmarshal Error:\n%s\n", string(body))
+		return "", fmt.Errorf("error unmarshalling ollama response: %w. Body: %s", err, string(body))
+	}
+	log.Printf("Ollama Response Received.") // Don't log full response here by default
+	return ollamaResp.Response, nil
+}
+
 // --- Web Server Handlers ---
 
 // Global template variable
@@ -498,6 +613,8 @@ func HandleAgent(w http.ResponseWriter, r *http.Request) {
 }
 
 // HandleStart initializes the agent with a new goal.
+// Optional form fields: system_prompt and goal_template pick library templates by name,
+// and var_<name> fields fill the goal template's {{variables}}.
 func HandleStart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -508,22 +625,58 @@ func HandleStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	goal := r.FormValue("goal")
-	if goal == "" {
+	goalTemplateName := r.FormValue("goal_template")
+	if goal == "" && goalTemplateName == "" {
 		http.Error(w, "Bad Request: Goal cannot be empty", http.StatusBadRequest)
 		return
 	}
 
 	prompt := r.FormValue("prompt") // Get optional prompt
 
+	// Resolve templates for the current user and project
+	scope := promptScopeFromRequest(r)
+	library := NewPromptLibrary(GetDB())
+	systemTpl, err := library.Resolve(PromptKindSystem, r.FormValue("system_prompt"), scope)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: system prompt: %v", err), http.StatusBadRequest)
+		return
+	}
+	goalTpl, err := library.Resolve(PromptKindGoal, goalTemplateName, scope)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: goal template: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	vars := map[string]string{}
+	for key, values := range r.Form {
+		if name, ok := strings.CutPrefix(key, "var_"); ok && len(values) > 0 {
+			vars[name] = values[0]
+		}
+	}
+	if _, missing := RenderPromptTemplate(goalTpl.Body, mergePromptVars(vars, goal, dataDir)); len(missing) > 0 {
+		http.Error(w, fmt.Sprintf("Bad Request: missing template variables: %s", strings.Join(missing, ", ")), http.StatusBadRequest)
+		return
+	}
+	initialUserPrompt := renderGoalPrompt(goalTpl.Body, goal, prompt, dataDir, vars)
+	if goal == "" {
+		// The template itself describes the goal
+		goal = initialUserPrompt
+	}
+
 	ollamaURL := getEnv("OLLAMA_URL", defaultOllamaURL)
 	modelName := getEnv("OLLAMA_MODEL", defaultModel)
 	InitializeAgent(goal, ollamaURL, modelName)
 
 	// Add initial user prompt to history
 	globalAgent.Lock()
-	initialUserPrompt := fmt.Sprintf("My goal is: %s. What is the first safe shell command I should execute within the '%s' directory?", goal, dataDir)
-	if prompt != "" {
-		initialUserPrompt = fmt.Sprintf("%s\nAdditional context: %s", initialUserPrompt, prompt)
+	globalAgent.SystemPrompt = systemTpl.Body
+	globalAgent.Prompts = AgentPromptRefs{System: systemTpl.Ref(), Goal: goalTpl.Ref()}
+	globalAgent.RunID = recordAgentRun(GetDB(), scope, goal, modelName, globalAgent.Prompts)
+	globalAgent.Notifier = NewNotifier(GetDB())
+	globalAgent.RequireApproval = os.Getenv("AGENT_REQUIRE_APPROVAL") == "1"
+	globalAgent.ProjectID = scope.ProjectID
+	if user := auth.GetUserFromContext(r.Context()); user != nil {
+		globalAgent.UserEmail = user.Email
 	}
 	globalAgent.addToHistory("user", initialUserPrompt)
 	globalAgent.State = StateAwaitingStep
@@ -533,6 +686,31 @@ func HandleStart(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(GetAgentState())
 }
 
+// buildInitialUserPrompt builds the first user message of a run from the default goal template.
+func buildInitialUserPrompt(goal, prompt, workDir string) string {
+	return renderGoalPrompt(defaultGoalTemplate, goal, prompt, workDir, nil)
+}
+
+// renderGoalPrompt renders a goal template, appending the optional extra prompt.
+func renderGoalPrompt(body, goal, prompt, workDir string, vars map[string]string) string {
+	initialUserPrompt, _ := RenderPromptTemplate(body, mergePromptVars(vars, goal, workDir))
+	if prompt != "" {
+		initialUserPrompt = fmt.Sprintf("%s\nAdditional context: %s", initialUserPrompt, prompt)
+	}
+	return initialUserPrompt
+}
+
+// mergePromptVars adds the built-in goal and workdir variables to user supplied ones.
+func mergePromptVars(vars map[string]string, goal, workDir string) map[string]string {
+	values := map[string]string{}
+	for k, v := range vars {
+		values[k] = v
+	}
+	values["goal"] = goal
+	values["workdir"] = workDir
+	return values
+}
+
 // HandleNextStep triggers the agent to perform its next thinking/execution cycle.
 func HandleNextStep(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
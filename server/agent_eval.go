@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EvalScenario describes one agent evaluation loaded from YAML.
+type EvalScenario struct {
+	Name       string            `yaml:"name" json:"name"`
+	Goal       string            `yaml:"goal" json:"goal"`
+	Prompt     string            `yaml:"prompt,omitempty" json:"prompt,omitempty"`
+	MaxSteps   int               `yaml:"max_steps,omitempty" json:"max_steps,omitempty"`
+	Fixtures   map[string]string `yaml:"fixtures,omitempty" json:"fixtures,omitempty"`     // Relative path -> file content
+	Transcript []string          `yaml:"transcript,omitempty" json:"transcript,omitempty"` // Scripted model responses, in order
+	// SystemPrompt and GoalTemplate override the built-in templates; Variables fill the goal template.
+	SystemPrompt string            `yaml:"system_prompt,omitempty" json:"system_prompt,omitempty"`
+	GoalTemplate string            `yaml:"goal_template,omitempty" json:"goal_template,omitempty"`
+	Variables    map[string]string `yaml:"variables,omitempty" json:"variables,omitempty"`
+	// ContinueAfterBlock lets the agent keep going after a blocked command instead of stopping.
+	ContinueAfterBlock bool          `yaml:"continue_after_block,omitempty" json:"continue_after_block,omitempty"`
+	Assert             EvalAssertion `yaml:"assert" json:"assert"`
+
+	// Source is the file the scenario was loaded from.
+	Source string `yaml:"-" json:"source,omitempty"`
+}
+
+// EvalAssertion holds the checks applied once a scenario run ends.
+type EvalAssertion struct {
+	State               string            `yaml:"state,omitempty" json:"state,omitempty"` // Expected final AgentState, e.g. "Finished"
+	FinalAnswerContains []string          `yaml:"final_answer_contains,omitempty" json:"final_answer_contains,omitempty"`
+	FinalAnswerMatches  string            `yaml:"final_answer_matches,omitempty" json:"final_answer_matches,omitempty"`
+	FilesExist          []string          `yaml:"files_exist,omitempty" json:"files_exist,omitempty"`
+	FilesAbsent         []string          `yaml:"files_absent,omitempty" json:"files_absent,omitempty"`
+	FileContains        map[string]string `yaml:"file_contains,omitempty" json:"file_contains,omitempty"`
+	BlockedCommands     []string          `yaml:"blocked_commands,omitempty" json:"blocked_commands,omitempty"` // Substrings of commands that must be blocked
+	NoBlockedCommands   bool              `yaml:"no_blocked_commands,omitempty" json:"no_blocked_commands,omitempty"`
+	MaxSteps            int               `yaml:"max_steps,omitempty" json:"max_steps,omitempty"`
+}
+
+// EvalOptions configures an evaluation run.
+type EvalOptions struct {
+	// Model is used for scenarios without a scripted transcript. Those scenarios fail when it is nil.
+	Model     ModelClient
+	ModelName string
+	// SystemPrompt replaces the built-in system prompt for scenarios that do not set their own.
+	SystemPrompt string
+	// KeepWorkspace leaves each scenario's temporary workspace on disk for inspection.
+	KeepWorkspace bool
+}
+
+// EvalResult is the outcome of a single scenario.
+type EvalResult struct {
+	Name            string        `json:"name"`
+	Passed          bool          `json:"passed"`
+	Steps           int           `json:"steps"`
+	State           AgentState    `json:"state"`
+	FinalAnswer     string        `json:"final_answer,omitempty"`
+	BlockedCommands []string      `json:"blocked_commands,omitempty"`
+	Failures        []string      `json:"failures,omitempty"`
+	Workspace       string        `json:"workspace,omitempty"`
+	Duration        time.Duration `json:"duration"`
+}
+
+// EvalReport aggregates the results of a run.
+type EvalReport struct {
+	Results    []EvalResult `json:"results"`
+	Total      int          `json:"total"`
+	Passed     int          `json:"passed"`
+	PassRate   float64      `json:"pass_rate"`
+	TotalSteps int          `json:"total_steps"`
+	AvgSteps   float64      `json:"avg_steps"`
+}
+
+// ScriptedModel replays a fixed list of responses, one per call.
+type ScriptedModel struct {
+	mu        sync.Mutex
+	Responses []string
+	next      int
+}
+
+// Generate returns the next scripted response.
+func (m *ScriptedModel) Generate(ctx context.Context, model, prompt string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.next >= len(m.Responses) {
+		return "", fmt.Errorf("scripted transcript exhausted after %d responses", len(m.Responses))
+	}
+	response := m.Responses[m.next]
+	m.next++
+	return response, nil
+}
+
+// LoadEvalScenarios reads scenarios from YAML files. Directories are scanned for *.yaml and *.yml files.
+// A file may hold a single scenario or a list of scenarios.
+func LoadEvalScenarios(paths ...string) ([]EvalScenario, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			ext := strings.ToLower(filepath.Ext(p))
+			if !fi.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", path, err)
+		}
+	}
+	sort.Strings(files)
+
+	var scenarios []EvalScenario
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scenario file %s: %w", file, err)
+		}
+
+		var batch []EvalScenario
+		if err := yaml.Unmarshal(content, &batch); err != nil {
+			var single EvalScenario
+			if err := yaml.Unmarshal(content, &single); err != nil {
+				return nil, fmt.Errorf("failed to parse scenario file %s: %w", file, err)
+			}
+			batch = []EvalScenario{single}
+		}
+
+		for i := range batch {
+			batch[i].Source = file
+			if batch[i].Name == "" {
+				batch[i].Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+				if len(batch) > 1 {
+					batch[i].Name = fmt.Sprintf("%s#%d", batch[i].Name, i+1)
+				}
+			}
+			if strings.TrimSpace(batch[i].Goal) == "" {
+				return nil, fmt.Errorf("scenario %s in %s has no goal", batch[i].Name, file)
+			}
+			scenarios = append(scenarios, batch[i])
+		}
+	}
+	return scenarios, nil
+}
+
+// RunEval runs every scenario and aggregates pass rate and step counts.
+func RunEval(ctx context.Context, scenarios []EvalScenario, opts EvalOptions) EvalReport {
+	report := EvalReport{Results: make([]EvalResult, 0, len(scenarios))}
+	for _, scenario := range scenarios {
+		if ctx.Err() != nil {
+			break
+		}
+		result := RunEvalScenario(ctx, scenario, opts)
+		report.Results = append(report.Results, result)
+		report.Total++
+		report.TotalSteps += result.Steps
+		if result.Passed {
+			report.Passed++
+		}
+	}
+	if report.Total > 0 {
+		report.PassRate = float64(report.Passed) / float64(report.Total)
+		report.AvgSteps = float64(report.TotalSteps) / float64(report.Total)
+	}
+	return report
+}
+
+// RunEvalScenario runs one scenario in a fresh temporary workspace and checks its assertions.
+func RunEvalScenario(ctx context.Context, scenario EvalScenario, opts EvalOptions) EvalResult {
+	start := time.Now()
+	result := EvalResult{Name: scenario.Name}
+
+	fail := func(format string, args ...interface{}) EvalResult {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+		result.Duration = time.Since(start)
+		return result
+	}
+
+	model := opts.Model
+	if len(scenario.Transcript) > 0 {
+		model = &ScriptedModel{Responses: scenario.Transcript}
+	}
+	if model == nil {
+		return fail("no transcript and no live model configured")
+	}
+
+	workspace, err := os.MkdirTemp("", "agent-eval-")
+	if err != nil {
+		return fail("failed to create workspace: %v", err)
+	}
+	// Resolve symlinks so the safety check sees the same path the shell reports
+	if resolved, err := filepath.EvalSymlinks(workspace); err == nil {
+		workspace = resolved
+	}
+	if opts.KeepWorkspace {
+		result.Workspace = workspace
+	} else {
+		defer os.RemoveAll(workspace)
+	}
+
+	for name, content := range scenario.Fixtures {
+		path, err := evalPath(workspace, name)
+		if err != nil {
+			return fail("fixture %s: %v", name, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fail("fixture %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return fail("fixture %s: %v", name, err)
+		}
+	}
+
+	maxSteps := scenario.MaxSteps
+	if maxSteps <= 0 {
+		maxSteps = maxIterations
+	}
+	systemPrompt := scenario.SystemPrompt
+	if systemPrompt == "" {
+		systemPrompt = opts.SystemPrompt
+	}
+	goalTemplate := scenario.GoalTemplate
+	if goalTemplate == "" {
+		goalTemplate = defaultGoalTemplate
+	}
+
+	agent := &Agent{
+		ModelName:     opts.ModelName,
+		Goal:          scenario.Goal,
+		History:       make([]Message, 0),
+		MaxIterations: maxSteps,
+		HttpClient:    &http.Client{Timeout: requestTimeout},
+		State:         StateAwaitingStep,
+		Model:         model,
+		WorkDir:       workspace,
+		SystemPrompt:  systemPrompt,
+	}
+	agent.addToHistory("user", renderGoalPrompt(goalTemplate, scenario.Goal, scenario.Prompt, workspace, scenario.Variables))
+
+	for ctx.Err() == nil && agent.beginStep() {
+		agent.runStep()
+		if agent.State == StateBlocked {
+			if action := agent.lastAssistantMessage(); action != "" {
+				result.BlockedCommands = append(result.BlockedCommands, strings.TrimSpace(strings.TrimPrefix(action, "COMMAND:")))
+			}
+			if scenario.ContinueAfterBlock {
+				agent.State = StateAwaitingStep
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		result.Failures = append(result.Failures, fmt.Sprintf("run cancelled: %v", ctx.Err()))
+	}
+
+	result.Steps = agent.Iteration
+	result.State = agent.State
+	if agent.State == StateFinished {
+		result.FinalAnswer = agent.LastOutput
+	}
+	result.Failures = append(result.Failures, checkEvalAssertions(scenario.Assert, result, workspace)...)
+	if agent.State == StateError && scenario.Assert.State != string(StateError) {
+		result.Failures = append(result.Failures, fmt.Sprintf("agent error: %s", agent.LastError))
+	}
+	result.Passed = len(result.Failures) == 0
+	result.Duration = time.Since(start)
+	return result
+}
+
+// lastAssistantMessage returns the most recent assistant action in the history.
+func (a *Agent) lastAssistantMessage() string {
+	for i := len(a.History) - 1; i >= 0; i-- {
+		if a.History[i].Role == "assistant" {
+			return a.History[i].Content
+		}
+	}
+	return ""
+}
+
+// checkEvalAssertions compares a finished run with the scenario's expectations.
+func checkEvalAssertions(assert EvalAssertion, result EvalResult, workspace string) []string {
+	var failures []string
+
+	if assert.State != "" && string(result.State) != assert.State {
+		failures = append(failures, fmt.Sprintf("expected state %q, got %q", assert.State, result.State))
+	}
+	for _, want := range assert.FinalAnswerContains {
+		if !strings.Contains(result.FinalAnswer, want) {
+			failures = append(failures, fmt.Sprintf("final answer does not contain %q", want))
+		}
+	}
+	if assert.FinalAnswerMatches != "" {
+		re, err := regexp.Compile(assert.FinalAnswerMatches)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("invalid final_answer_matches pattern: %v", err))
+		} else if !re.MatchString(result.FinalAnswer) {
+			failures = append(failures, fmt.Sprintf("final answer does not match %q", assert.FinalAnswerMatches))
+		}
+	}
+	for _, name := range assert.FilesExist {
+		path, err := evalPath(workspace, name)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("files_exist %s: %v", name, err))
+		} else if _, err := os.Stat(path); err != nil {
+			failures = append(failures, fmt.Sprintf("expected file %s to exist", name))
+		}
+	}
+	for _, name := range assert.FilesAbsent {
+		path, err := evalPath(workspace, name)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("files_absent %s: %v", name, err))
+		} else if _, err := os.Stat(path); err == nil {
+			failures = append(failures, fmt.Sprintf("expected file %s to be absent", name))
+		}
+	}
+	for name, want := range assert.FileContains {
+		path, err := evalPath(workspace, name)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("file_contains %s: %v", name, err))
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("could not read %s: %v", name, err))
+		} else if !strings.Contains(string(content), want) {
+			failures = append(failures, fmt.Sprintf("file %s does not contain %q", name, want))
+		}
+	}
+	for _, want := range assert.BlockedCommands {
+		found := false
+		for _, blocked := range result.BlockedCommands {
+			if strings.Contains(blocked, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			failures = append(failures, fmt.Sprintf("expected a command containing %q to be blocked", want))
+		}
+	}
+	if assert.NoBlockedCommands && len(result.BlockedCommands) > 0 {
+		failures = append(failures, fmt.Sprintf("expected no blocked commands, got %v", result.BlockedCommands))
+	}
+	if assert.MaxSteps > 0 && result.Steps > assert.MaxSteps {
+		failures = append(failures, fmt.Sprintf("took %d steps, expected at most %d", result.Steps, assert.MaxSteps))
+	}
+	return failures
+}
+
+// evalPath resolves a scenario-relative path inside the workspace.
+func evalPath(workspace, name string) (string, error) {
+	path := filepath.Join(workspace, filepath.FromSlash(name))
+	if path != workspace && !strings.HasPrefix(path, workspace+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes the workspace")
+	}
+	return path, nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+// TestEvalScenarios runs the bundled scripted scenarios end to end
+func TestEvalScenarios(t *testing.T) {
+	scenarios, err := LoadEvalScenarios("../data/evals")
+	if err != nil {
+		t.Fatalf("Failed to load scenarios: %v", err)
+	}
+	if len(scenarios) == 0 {
+		t.Fatal("Expected bundled scenarios in data/evals")
+	}
+
+	report := RunEval(context.Background(), scenarios, EvalOptions{})
+	for _, result := range report.Results {
+		if !result.Passed {
+			t.Errorf("Scenario %s failed: %v", result.Name, result.Failures)
+		}
+	}
+	if report.Total != len(scenarios) || report.PassRate != 1 {
+		t.Errorf("Expected all %d scenarios to pass, got %d/%d", len(scenarios), report.Passed, report.Total)
+	}
+}
+
+// TestEvalAssertionsDetectFailures checks that a wrong answer and a missing block are reported
+func TestEvalAssertionsDetectFailures(t *testing.T) {
+	scenario := EvalScenario{
+		Name:       "wrong-answer",
+		Goal:       "Say hello",
+		Transcript: []string{"FINAL_ANSWER: goodbye"},
+		Assert: EvalAssertion{
+			FinalAnswerContains: []string{"hello"},
+			BlockedCommands:     []string{"rm "},
+			FilesExist:          []string{"missing.txt"},
+		},
+	}
+
+	result := RunEvalScenario(context.Background(), scenario, EvalOptions{})
+	if result.Passed {
+		t.Fatal("Expected scenario to fail")
+	}
+	if len(result.Failures) != 3 {
+		t.Errorf("Expected 3 failures, got %d: %v", len(result.Failures), result.Failures)
+	}
+	if result.Steps != 1 {
+		t.Errorf("Expected 1 step, got %d", result.Steps)
+	}
+}
+
+// TestEvalWithoutModel checks that unscripted scenarios need a live model
+func TestEvalWithoutModel(t *testing.T) {
+	result := RunEvalScenario(context.Background(), EvalScenario{Name: "live", Goal: "anything"}, EvalOptions{})
+	if result.Passed {
+		t.Error("Expected scenario without transcript or model to fail")
+	}
+}
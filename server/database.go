@@ -2,8 +2,8 @@ package server
 
 import (
 	"context"
-	"crypto/sha1"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -15,7 +15,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/scriptmaster/openagent/auth"
 	"github.com/scriptmaster/openagent/common"
 	"github.com/scriptmaster/openagent/models"
@@ -311,15 +310,6 @@ func InitDB() (*sql.DB, error) {
 
 	log.Printf("\t → \t → 3.1 Database '%s' completely initialized.", targetDbName) // Consolidated message
 
-	// -------------------------------------------
-	log.Println("\t → 4. Checking/Creating Admin Token...")
-	// --- Check/Create Admin Token ---
-	_, tokenErr := CheckOrCreateAdminToken(sqlDB)
-	if tokenErr != nil {
-		log.Printf("WARNING: Failed to check/create admin token: %v", tokenErr)
-	}
-	// -------------------------------------------
-
 	return dbInstance, nil
 }
 
@@ -449,78 +439,50 @@ func NewUserService(db *sql.DB, pdbService common.ProjectDBService, dataService
 	}
 }
 
-// getDBForUserOp determines the correct database connection (*sql.DB) to use for a user operation.
-// For authentication operations, it always uses the main application database.
-// For other user operations, it checks the context for a project and uses the project's default database if available.
-func (s *UserService) getDBForUserOp(ctx context.Context) (*sql.DB, error) {
-	project := projects.GetProjectFromContext(ctx)
-	if project == nil {
-		return s.db, nil // No project, use default DB
-	}
-
-	// Project context exists, find its default database connection
-	projectDBs, err := s.pdbService.GetProjectDBs(int(project.ID))
+// GetUserByEmail retrieves a user by email from the project's user directory when the request's host
+// has one, otherwise from ai.users.
+func (s *UserService) GetUserByEmail(ctx context.Context, email string) (*auth.User, error) {
+	directory, err := s.projectDirectory(ctx)
 	if err != nil {
-		log.Printf("Error getting project DBs for project %d: %v", project.ID, err)
-		// Fallback to default DB for non-auth operations
-		return s.db, nil
-	}
-
-	var defaultProjectDBID int = 0
-	for _, pdb := range projectDBs {
-		if pdb.IsDefault {
-			defaultProjectDBID = pdb.ID
-			break
-		}
+		return nil, err
 	}
-
-	if defaultProjectDBID == 0 {
-		log.Printf("No default database configured for project %d, using main application database", project.ID)
-		// Fallback to default DB
-		return s.db, nil
+	if directory != nil {
+		return directory.getByEmail(ctx, email)
 	}
-
-	// Get the connection using DataAccessService
-	conn, err := s.dataService.getConnection(ctx, defaultProjectDBID)
-	if err != nil {
-		log.Printf("Error getting connection for project %d DB %d: %v, falling back to main database", project.ID, defaultProjectDBID, err)
-		// Fallback to default DB
-		return s.db, nil
-	}
-
-	return conn, nil
-}
-
-// getDBForAuthOp always returns the main application database for authentication operations
-func (s *UserService) getDBForAuthOp(ctx context.Context) (*sql.DB, error) {
-	return s.db, nil
+	return scanProfileUser(s.db.QueryRowContext(ctx, common.MustGetSQL("auth/get_user_by_email"), email))
 }
 
-// GetUserByEmail retrieves a user by email from the appropriate database (default or project).
-func (s *UserService) GetUserByEmail(ctx context.Context, email string) (*auth.User, error) {
-	dbConn, err := s.getDBForUserOp(ctx)
+// GetUserByID retrieves a user by ID from the project's user directory when the request's host
+// has one, otherwise from ai.users.
+func (s *UserService) GetUserByID(ctx context.Context, userID int) (*auth.User, error) {
+	directory, err := s.projectDirectory(ctx)
 	if err != nil {
-		return nil, err // Error getting the correct DB connection
+		return nil, err
 	}
+	if directory != nil {
+		return directory.getByID(ctx, userID)
+	}
+	return scanProfileUser(s.db.QueryRowContext(ctx, common.MustGetSQL("auth/get_user_by_id"), userID))
+}
 
-	// TODO: Define user table schema (e.g., ai.users or public.users?)
-	// Assuming ai.users for now, may need adjustment based on project DB schema.
-	query := `SELECT id, email, password_hash, is_admin, created_at, last_logged_in FROM ai.users WHERE email = $1`
-	row := dbConn.QueryRowContext(ctx, query, email)
-
+// scanProfileUser reads an ai.users row selected with its profile columns
+func scanProfileUser(row *sql.Row) (*auth.User, error) {
 	var user auth.User
 	var lastLoggedIn sql.NullTime
-	err = row.Scan(
+	err := row.Scan(
 		&user.ID,
 		&user.Email,
 		&user.PasswordHash,
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&lastLoggedIn,
+		&user.DisplayName,
+		&user.Timezone,
+		&user.Locale,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found") // Consistent error message
+			return nil, errUserNotFound // Consistent error message
 		}
 		return nil, err // Other potential errors
 	}
@@ -530,23 +492,30 @@ func (s *UserService) GetUserByEmail(ctx context.Context, email string) (*auth.U
 	return &user, nil
 }
 
-// CreateUser creates a new user in the appropriate database.
+// CreateUser creates a new user in the project's user directory, or in ai.users for hosts without one.
 func (s *UserService) CreateUser(ctx context.Context, email string) (*auth.User, error) {
-	dbConn, err := s.getDBForUserOp(ctx)
-	if err != nil {
-		return nil, err // Error getting the correct DB connection
-	}
-
 	// Basic email validation
-	if !common.IsValidEmail(email) { // Assuming a validation function exists
+	if !common.IsValidEmail(email) {
 		return nil, errors.New("invalid email format")
 	}
 
-	// For first-time user creation via OTP, password hash is initially empty or random.
-	// The VerifyPassword path should handle password setting.
-	// Let's store an empty hash initially.
-	passwordHash := "" // Or generate a secure random unusable hash?
-	isAdmin := false   // Default to non-admin
+	directory, err := s.projectDirectory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if directory != nil {
+		user, err := directory.create(ctx, email)
+		if err != nil {
+			log.Printf("Error creating user %s in the directory of project %d: %v", email, directory.projectID, err)
+			return nil, err
+		}
+		return user, nil
+	}
+
+	// For first-time user creation via OTP, password hash is initially empty.
+	// The VerifyPassword path treats an empty hash as invalid credentials.
+	passwordHash := ""
+	isAdmin := false // Default to non-admin
 
 	// Special case: If no project context AND no admin exists yet, make the first user admin.
 	project := projects.GetProjectFromContext(ctx)
@@ -563,13 +532,12 @@ func (s *UserService) CreateUser(ctx context.Context, email string) (*auth.User,
 		}
 	}
 
-	// TODO: Adjust table name if needed for project DBs
 	query := `
 		INSERT INTO ai.users (email, password_hash, is_admin, created_at, last_logged_in)
 		VALUES ($1, $2, $3, NOW(), NOW())
 		RETURNING id, email, password_hash, is_admin, created_at, last_logged_in
 	`
-	row := dbConn.QueryRowContext(ctx, query, email, passwordHash, isAdmin)
+	row := s.db.QueryRowContext(ctx, query, email, passwordHash, isAdmin)
 
 	var user auth.User
 	var lastLoggedIn sql.NullTime
@@ -595,60 +563,67 @@ func (s *UserService) CreateUser(ctx context.Context, email string) (*auth.User,
 	return &user, nil
 }
 
-// UpdateUserLastLogin updates the last_logged_in timestamp for a user in the appropriate database.
+// UpdateUserLastLogin updates the last login time of a user in the project's user directory or ai.users.
 func (s *UserService) UpdateUserLastLogin(ctx context.Context, userID int) error {
-	dbConn, err := s.getDBForUserOp(ctx)
+	directory, err := s.projectDirectory(ctx)
 	if err != nil {
-		// Log the error but don't necessarily fail the login operation
-		log.Printf("Error getting DB for UpdateUserLastLogin (userID: %d): %v. Skipping update.", userID, err)
+		// Log the error but don't fail the login operation
+		log.Printf("Error getting user directory for UpdateUserLastLogin (userID: %d): %v. Skipping update.", userID, err)
 		return nil
 	}
-
-	query := common.MustGetSQL("auth/update_last_login")
-	_, err = dbConn.ExecContext(ctx, query, userID)
+	if directory != nil {
+		err = directory.touch(ctx, userID)
+	} else {
+		_, err = s.db.ExecContext(ctx, common.MustGetSQL("auth/update_last_login"), userID)
+	}
 	if err != nil {
 		log.Printf("Error updating last login for user %d: %v", userID, err)
 		// Don't fail the calling operation (e.g., login) just because this failed.
-		return nil
 	}
 	return nil
 }
 
-// VerifyPassword finds a user by email and verifies their password hash.
-// This always uses the main application database for authentication.
+// VerifyPassword finds a user by email and verifies their password hash, against the project's
+// user directory when the request's host has one, otherwise against ai.users.
 func (s *UserService) VerifyPassword(ctx context.Context, email, password string) (*auth.User, error) {
-	// Always use main application database for authentication
-	dbConn, err := s.getDBForAuthOp(ctx)
+	directory, err := s.projectDirectory(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// Query user from main application database using SQL file
-	var user auth.User
-	var lastLoggedIn sql.NullTime
-	query := common.MustGetSQL("auth/verify_password")
-	err = dbConn.QueryRowContext(ctx, query, email).Scan(
-		&user.ID,
-		&user.Email,
-		&user.PasswordHash,
-		&user.IsAdmin,
-		&user.CreatedAt,
-		&lastLoggedIn,
-	)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+	var user *auth.User
+	if directory != nil {
+		if user, err = directory.getByEmail(ctx, email); err != nil {
+			if err == errUserNotFound {
+				return nil, err
+			}
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+	} else {
+		user = &auth.User{}
+		var lastLoggedIn sql.NullTime
+		err = s.db.QueryRowContext(ctx, common.MustGetSQL("auth/verify_password"), email).Scan(
+			&user.ID,
+			&user.Email,
+			&user.PasswordHash,
+			&user.IsAdmin,
+			&user.CreatedAt,
+			&lastLoggedIn,
+		)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, errUserNotFound
+			}
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if lastLoggedIn.Valid {
+			user.LastLoggedIn = lastLoggedIn.Time
 		}
-		return nil, fmt.Errorf("database error: %w", err)
-	}
-	if lastLoggedIn.Valid {
-		user.LastLoggedIn = lastLoggedIn.Time
 	}
 
 	if user.PasswordHash == "" {
-		// Handle case where user was created via OTP and hasn't set a password yet?
-		// Or just treat it as invalid password.
-		return nil, errors.New("invalid credentials") // Or a more specific error
+		// Users created via OTP have no password until they set one
+		return nil, errors.New("invalid credentials")
 	}
 
 	// Use bcrypt comparison (assuming bcrypt was used for hashing)
@@ -656,7 +631,7 @@ func (s *UserService) VerifyPassword(ctx context.Context, email, password string
 		return nil, errors.New("invalid credentials")
 	}
 
-	return &user, nil // Password matches
+	return user, nil // Password matches
 }
 
 // CheckIfAdminExists checks if any user with is_admin = true exists in the *default* database.
@@ -674,20 +649,23 @@ func (s *UserService) CheckIfAdminExists(ctx context.Context) (bool, error) {
 	return exists, nil
 }
 
-// UpdatePasswordHash updates the user's password hash in the appropriate database.
+// UpdatePasswordHash updates the user's password hash in the project's user directory or ai.users.
 func (s *UserService) UpdatePasswordHash(ctx context.Context, userID int, newHash string) error {
-	dbConn, err := s.getDBForUserOp(ctx)
+	if newHash == "" {
+		return errors.New("cannot update password to an empty hash")
+	}
+
+	directory, err := s.projectDirectory(ctx)
 	if err != nil {
-		log.Printf("Error getting DB for UpdatePasswordHash (userID: %d): %v", userID, err)
+		log.Printf("Error getting user directory for UpdatePasswordHash (userID: %d): %v", userID, err)
 		return err
 	}
-
-	if newHash == "" {
-		return errors.New("cannot update password to an empty hash")
+	if directory != nil {
+		return directory.setPasswordHash(ctx, userID, newHash)
 	}
 
 	query := common.MustGetSQL("auth/update_password_hash")
-	result, err := dbConn.ExecContext(ctx, query, newHash, userID)
+	result, err := s.db.ExecContext(ctx, query, newHash, userID)
 	if err != nil {
 		log.Printf("Error updating password hash for user %d: %v", userID, err)
 		return fmt.Errorf("database error updating password: %w", err)
@@ -700,6 +678,64 @@ func (s *UserService) UpdatePasswordHash(ctx context.Context, userID int, newHas
 	return nil
 }
 
+// UpdateProfile updates the display name, timezone and locale of an ai.users account. Accounts of a
+// project's user directory have no profile fields.
+func (s *UserService) UpdateProfile(ctx context.Context, userID int, profile auth.Profile) error {
+	if err := s.requireDefaultUsers(ctx); err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("auth/update_profile"),
+		userID, profile.DisplayName, profile.Timezone, profile.Locale)
+	if err != nil {
+		return fmt.Errorf("database error updating profile: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("user with ID %d not found", userID)
+	}
+	return nil
+}
+
+// GetAvatar returns the uploaded avatar of an ai.users account, or nil when it has none.
+func (s *UserService) GetAvatar(ctx context.Context, userID int) (*auth.Avatar, error) {
+	if err := s.requireDefaultUsers(ctx); err != nil {
+		return nil, err
+	}
+	var avatar auth.Avatar
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("auth/get_avatar"), userID).Scan(&avatar.Image, &avatar.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &avatar, nil
+}
+
+// SetAvatar stores the avatar of an ai.users account, or removes it when avatar is nil.
+func (s *UserService) SetAvatar(ctx context.Context, userID int, avatar *auth.Avatar) error {
+	if err := s.requireDefaultUsers(ctx); err != nil {
+		return err
+	}
+	if avatar == nil {
+		_, err := s.db.ExecContext(ctx, common.MustGetSQL("auth/delete_avatar"), userID)
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, common.MustGetSQL("auth/set_avatar"), userID, avatar.Image)
+	return err
+}
+
+// requireDefaultUsers refuses profile changes on hosts whose logins use a project's user directory
+func (s *UserService) requireDefaultUsers(ctx context.Context) error {
+	directory, err := s.projectDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	if directory != nil {
+		return errors.New("profiles are not available for project accounts")
+	}
+	return nil
+}
+
 // --- Deprecated / Needs Review ---
 
 // GetOrCreateUser combines GetUserByEmail and CreateUser. Needs context.
@@ -916,7 +952,7 @@ func (s *DirectDataService) getConnection(ctx context.Context, projectDBID int)
 	// Get project DB info
 	var projectDB ProjectDB
 	query := `
-		SELECT id, project_id, name, description, db_type, connection_string, schema_name, is_default, created_at 
+		SELECT id, project_id, name, COALESCE(description, ''), db_type, connection_string, schema_name, is_default, created_at 
 		FROM ai.project_dbs 
 		WHERE id = $1
 	`
@@ -1174,6 +1210,21 @@ func (s *SettingsService) GetAllSettings() ([]Setting, error) {
 	if err != nil {
 		return nil, err
 	}
+	return scanSettings(rows)
+}
+
+// ListSettingsByPrefix retrieves all settings whose key starts with prefix, in every scope
+func (s *SettingsService) ListSettingsByPrefix(prefix string) ([]Setting, error) {
+	query := common.MustGetSQL("settings/list_by_key_prefix")
+	rows, err := s.db.Query(query, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return scanSettings(rows)
+}
+
+// scanSettings reads settings rows and closes them
+func scanSettings(rows *sql.Rows) ([]Setting, error) {
 	defer rows.Close()
 
 	var settings []Setting
@@ -1190,7 +1241,7 @@ func (s *SettingsService) GetAllSettings() ([]Setting, error) {
 		}
 		settings = append(settings, setting)
 	}
-	return settings, nil
+	return settings, rows.Err()
 }
 
 // NewDatabaseMetadataService creates a new DatabaseMetadataService
@@ -1207,7 +1258,7 @@ func (s *DatabaseMetadataService) ListDatabaseTables(ctx context.Context, projec
 	managedTables := make(map[string]ManagedTable)
 
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, name, schema_name, description, initialized, read_only
+		SELECT id, name, schema_name, COALESCE(description, ''), initialized, read_only
 		FROM ai.managed_tables
 		WHERE project_id = $1 AND project_db_id = $2
 	`, projectID, projectDBID)
@@ -1229,7 +1280,7 @@ func (s *DatabaseMetadataService) ListDatabaseTables(ctx context.Context, projec
 	// Get the project DB info
 	var projectDB ProjectDB
 	err = s.db.QueryRowContext(ctx, `
-		SELECT id, project_id, name, description, db_type, connection_string, schema_name, is_default
+		SELECT id, project_id, name, COALESCE(description, ''), db_type, connection_string, schema_name, is_default
 		FROM ai.project_dbs
 		WHERE id = $1
 	`, projectDBID).Scan(
@@ -1331,9 +1382,9 @@ func (s *DatabaseMetadataService) GetTableColumns(ctx context.Context, projectDB
 	managedColumns := make(map[string]ManagedColumn)
 	if tableID > 0 {
 		rows, err := s.db.QueryContext(ctx, `
-			SELECT id, name, display_name, data_type, ordinal, visible 
+			SELECT id, table_id, name, display_name, type, ordinal, visible 
 			FROM ai.managed_columns 
-			WHERE managed_table_id = $1
+			WHERE table_id = $1
 			ORDER BY ordinal
 		`, tableID)
 		if err != nil {
@@ -1344,7 +1395,7 @@ func (s *DatabaseMetadataService) GetTableColumns(ctx context.Context, projectDB
 		for rows.Next() {
 			var c ManagedColumn
 			var displayName sql.NullString
-			if err := rows.Scan(&c.ID, &c.ManagedTableID, &c.Name, &displayName, &c.DataType, &c.Ordinal, &c.Visible); err != nil {
+			if err := rows.Scan(&c.ID, &c.ManagedTableID, &c.Name, &displayName, &c.ColumnType, &c.Ordinal, &c.Visible); err != nil {
 				return nil, err
 			}
 			if displayName.Valid {
@@ -1618,59 +1669,6 @@ func (s *dbService) DecodeConnectionString(encoded string) (string, error) {
 	return common.DecodeConnectionString(encoded)
 }
 
-// CheckOrCreateAdminToken checks for an admin token for today and creates one if it doesn't exist.
-// Token format: UUID-ADMIN-TOKEN-SHA1-HASHED-TIMESTAMP
-func CheckOrCreateAdminToken(db *sql.DB) (string, error) {
-	today := time.Now().UTC().Format("2006-01-02")
-
-	// First, check if a token already exists for today
-	existingToken, err := GetAdminTokenForDate(db, today)
-	if err != nil {
-		return "", fmt.Errorf("failed to check existing admin token: %w", err)
-	}
-
-	if existingToken != "" {
-		log.Printf("\t → \t → Admin token for today (%s):\n\n%s\n\n", today, existingToken)
-		return existingToken, nil
-	}
-
-	// No token exists for today, create a new one
-	newToken, err := generateAdminToken()
-	if err != nil {
-		return "", fmt.Errorf("failed to generate admin token: %w", err)
-	}
-
-	// Store the new token in the database
-	insertQuery := common.MustGetSQL("InsertAdminToken")
-	_, err = db.Exec(insertQuery, newToken, today)
-	if err != nil {
-		return "", fmt.Errorf("failed to store admin token: %w", err)
-	}
-
-	log.Printf("Generated new admin token for today (%s): %s", today, newToken)
-	return newToken, nil
-}
-
-// generateAdminToken creates a new admin token with the format: UUID-ADMIN-TOKEN-SHA1-HASHED-TIMESTAMP
-func generateAdminToken() (string, error) {
-	// Generate a UUID
-	tokenUUID := uuid.New().String()
-
-	// Get current timestamp
-	timestamp := time.Now().UTC().Unix()
-
-	// Create the timestamp string and hash it with SHA1
-	timestampStr := fmt.Sprintf("%d", timestamp)
-	hasher := sha1.New()
-	hasher.Write([]byte(timestampStr))
-	hashedTimestamp := fmt.Sprintf("%x", hasher.Sum(nil))
-
-	// Construct the token: UUID-ADMIN-TOKEN-SHA1-HASHED-TIMESTAMP
-	token := fmt.Sprintf("%s-ADMIN-TOKEN-%s", tokenUUID, hashedTimestamp)
-
-	return token, nil
-}
-
 func (s *dbService) UpdateProjectDB(id int, name, description, dbType, connectionString, schemaName string, isDefault bool) error {
 	// return UpdateProjectDB(s.db, id, name, description, dbType, connectionString, schemaName, isDefault) // REMOVED - Implementation needed
 	// TODO: Implement SQL query to update ProjectDB
@@ -1698,31 +1696,52 @@ func (s *dbService) DeleteProjectDB(id int) error {
 	return nil
 }
 
-func (s *dbService) TestConnection(projectDB common.ProjectDB) error {
-	// ... existing code ...
-	return nil
-}
-
-// GetAdminTokenForDate retrieves the admin token for a specific date.
-func GetAdminTokenForDate(db *sql.DB, dateStr string) (string, error) {
-	// Validate date format
-	if _, err := time.Parse("2006-01-02", dateStr); err != nil {
-		return "", fmt.Errorf("invalid date format, expected YYYY-MM-DD: %w", err)
+// GetUserDirectory returns the user directory configured on the project's default database, or nil
+func (s *dbService) GetUserDirectory(projectID int) (*common.UserDirectory, error) {
+	var projectDBID int
+	var raw []byte
+	err := s.db.QueryRow(common.MustGetSQL("GetProjectUserDirectory"), projectID).Scan(&projectDBID, &raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-
-	// Query the database for the token
-	getTokenQuery := common.MustGetSQL("GetAdminTokenForDateCheck")
-	var token string
-	err := db.QueryRow(getTokenQuery, dateStr).Scan(&token)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// No token found for this date
-			return "", nil
+		return nil, fmt.Errorf("failed to get user directory of project %d: %w", projectID, err)
+	}
+	var directory common.UserDirectory
+	if err := json.Unmarshal(raw, &directory); err != nil {
+		return nil, fmt.Errorf("invalid user directory on project DB %d: %w", projectDBID, err)
+	}
+	if err := directory.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid user directory on project DB %d: %w", projectDBID, err)
+	}
+	directory.ProjectDBID = projectDBID
+	return &directory, nil
+}
+
+// SetUserDirectory stores the user directory mapping of a project database; nil removes it
+func (s *dbService) SetUserDirectory(projectDBID int, directory *common.UserDirectory) error {
+	var raw interface{} // NULL unless a directory is given
+	if directory != nil {
+		if err := directory.Validate(); err != nil {
+			return err
 		}
-		return "", fmt.Errorf("failed to query admin token for date %s: %w", dateStr, err)
+		stored := *directory
+		stored.ProjectDBID = 0
+		encoded, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		raw = string(encoded)
+	}
+	if _, err := s.db.Exec(common.MustGetSQL("SetProjectDBUserDirectory"), projectDBID, raw); err != nil {
+		return fmt.Errorf("failed to update user directory of project DB %d: %w", projectDBID, err)
 	}
+	return nil
+}
 
-	return token, nil
+func (s *dbService) TestConnection(projectDB common.ProjectDB) error {
+	// ... existing code ...
+	return nil
 }
 
 // GetAdminStats fetches statistics for the admin dashboard
@@ -1770,17 +1789,19 @@ func GetAdminStats(db *sql.DB) (*models.AdminStats, error) {
 }
 
 // MakeUserAdmin grants admin privileges to a user.
+// Accounts from project user directories cannot become instance admins.
 func (s *UserService) MakeUserAdmin(ctx context.Context, userID int) error {
-	dbConn, err := s.getDBForUserOp(ctx)
+	directory, err := s.projectDirectory(ctx)
 	if err != nil {
-		// Log error but maybe don't fail the operation if default DB works?
-		// For now, return error if we can't get the intended DB.
-		log.Printf("Error getting DB for MakeUserAdmin (userID: %d): %v", userID, err)
+		log.Printf("Error getting user directory for MakeUserAdmin (userID: %d): %v", userID, err)
 		return err
 	}
+	if directory != nil {
+		return errors.New("project accounts cannot be made admins")
+	}
 
 	query := common.MustGetSQL("auth/make_admin")
-	result, err := dbConn.ExecContext(ctx, query, userID)
+	result, err := s.db.ExecContext(ctx, query, userID)
 	if err != nil {
 		log.Printf("Error making user %d admin: %v", userID, err)
 		return fmt.Errorf("database error updating admin status: %w", err)
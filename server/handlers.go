@@ -40,6 +40,7 @@ func HandleDashboard(w http.ResponseWriter, r *http.Request, projectService proj
 				PageTitle:  "Dashboard",
 				User:       user,
 				AppVersion: appVersion,
+				CSRFToken:  auth.CSRFToken(r.Context()),
 			},
 			ProjectCount: 0,
 		}
@@ -50,8 +51,11 @@ func HandleDashboard(w http.ResponseWriter, r *http.Request, projectService proj
 		return
 	}
 
-	// Fetch projects to get the count
+	// Fetch the user's projects to get the count
 	projectList, err := projectService.List()
+	if err == nil {
+		projectList, err = projects.VisibleProjects(r.Context(), user, projectList)
+	}
 	if err != nil {
 		log.Printf("Error fetching project list for dashboard: %v", err)
 		// Render dashboard but maybe show an error getting count?
@@ -65,6 +69,7 @@ func HandleDashboard(w http.ResponseWriter, r *http.Request, projectService proj
 			PageTitle:  "Dashboard",
 			User:       user,
 			AppVersion: appVersion, // Use global appVersion loaded in routes
+			CSRFToken:  auth.CSRFToken(r.Context()),
 		},
 		ProjectCount: len(projectList),
 	}
@@ -127,6 +132,7 @@ func HandleTestPage(w http.ResponseWriter, r *http.Request) {
 		AppName:    common.GetEnv("APP_NAME"),
 		PageTitle:  "Test Page",
 		AppVersion: AppVersion,
+		CSRFToken:  auth.CSRFToken(r.Context()),
 	}
 
 	err := globalTemplates.ExecuteTemplate(w, "test.html", data)
@@ -154,6 +160,7 @@ func HandleConfigPage(w http.ResponseWriter, r *http.Request) {
 		PageTitle:  "System Configuration",
 		User:       user, // Pass user info if available
 		AppVersion: AppVersion,
+		CSRFToken:  auth.CSRFToken(r.Context()),
 		// Add any specific flags or data needed for config page
 		// e.g., pass the current host?
 		CurrentHost: strings.Split(r.Host, ":")[0],
@@ -169,7 +176,7 @@ func HandleConfigPage(w http.ResponseWriter, r *http.Request) {
 
 // ConfigSubmitRequest defines the structure for the config form submission
 type ConfigSubmitRequest struct {
-	AdminToken    string   `json:"admin_token"`
+	RecoveryCode  string   `json:"recovery_code"` // From `openagent maintenance recovery-code`
 	ProjectName   string   `json:"project_name"`
 	ProjectDesc   string   `json:"project_desc"`
 	PrimaryHost   string   `json:"primary_host"`
@@ -193,26 +200,23 @@ func HandleConfigSubmit(w http.ResponseWriter, r *http.Request, userService auth
 	}
 
 	// --- Validation ---
-	if req.AdminToken == "" || req.ProjectName == "" || req.PrimaryHost == "" || req.AdminEmail == "" || req.AdminPassword == "" {
-		common.JSONError(w, "Missing required fields (Token, Project Name, Primary Host, Admin Email, Admin Password)", http.StatusBadRequest)
+	if req.RecoveryCode == "" || req.ProjectName == "" || req.PrimaryHost == "" || req.AdminEmail == "" || req.AdminPassword == "" {
+		common.JSONError(w, "Missing required fields (Recovery Code, Project Name, Primary Host, Admin Email, Admin Password)", http.StatusBadRequest)
 		return
 	}
-
-	// --- Verify Admin Token ---
-	db := GetDB() // Assuming GetDB() retrieves the initialized *sql.DB
-	if db == nil {
+	if GetDB() == nil {
 		common.JSONError(w, "Database connection not available", http.StatusInternalServerError)
 		return
 	}
-	today := time.Now().UTC().Format("2006-01-02")
-	validToken, err := GetAdminTokenForDate(db, today)
-	if err != nil {
-		log.Printf("Error retrieving admin token for validation: %v", err)
-		common.JSONError(w, "Error validating setup token", http.StatusInternalServerError)
-		return
-	}
-	if validToken == "" || req.AdminToken != validToken {
-		common.JSONError(w, "Invalid or expired setup token", http.StatusForbidden)
+
+	// --- Redeem the break-glass recovery code ---
+	if _, err := auth.RedeemBreakGlassCode(r.Context(), req.RecoveryCode, auth.ClientIP(r)); err != nil {
+		if err == auth.ErrBreakGlassCodeInvalid {
+			common.JSONError(w, "Invalid, expired or already used recovery code", http.StatusForbidden)
+			return
+		}
+		log.Printf("Error redeeming recovery code: %v", err)
+		common.JSONError(w, "Error validating recovery code", http.StatusInternalServerError)
 		return
 	}
 
@@ -300,6 +304,7 @@ func Handle404(w http.ResponseWriter, r *http.Request) {
 	pageData := models.PageData{
 		AppName:    "OpenAgent",
 		AppVersion: AppVersion,
+		CSRFToken:  auth.CSRFToken(r.Context()),
 		PageTitle:  "Page Not Found",
 		User:       nil,
 	}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// projectLDAP uses the directory in the request's project options, falling back to the instance
+// directory from LDAP_CONFIG. Group roles of a project directory are project roles.
+type projectLDAP struct{}
+
+// NewProjectLDAP returns an LDAP source that includes per-project directories
+func NewProjectLDAP() auth.LDAPSource {
+	return projectLDAP{}
+}
+
+func (projectLDAP) LDAPConfig(r *http.Request) (*auth.LDAPConfig, error) {
+	project := projects.GetProjectFromContext(r.Context())
+	if project == nil || project.Options[projects.OptionLDAP] == nil {
+		return auth.InstanceLDAPConfig()
+	}
+	// Options come back from JSONB as generic maps, so round-trip them into the config type
+	raw, err := json.Marshal(project.Options[projects.OptionLDAP])
+	if err != nil {
+		return nil, err
+	}
+	var config auth.LDAPConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("invalid %s in project %d options: %w", projects.OptionLDAP, project.ID, err)
+	}
+	return &config, nil
+}
+
+func (projectLDAP) ApplyLDAPRoles(r *http.Request, userService auth.UserServicer, user *auth.User, roles []string) error {
+	project := projects.GetProjectFromContext(r.Context())
+	if project == nil || project.Options[projects.OptionLDAP] == nil {
+		return auth.ApplyInstanceLDAPRoles(r.Context(), userService, user, roles)
+	}
+	if user.ProjectID != 0 {
+		return nil // User directory accounts belong to their project without memberships
+	}
+	for _, role := range roles {
+		if !projects.Role(role).Valid() {
+			log.Printf("WARN: Ignoring unknown role %q in the directory group roles of project %d", role, project.ID)
+			continue
+		}
+		if err := projects.GrantRole(r.Context(), project.ID, user.ID, projects.Role(role)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,8 +6,9 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/scriptmaster/openagent/admin"    // For maintenance redirect
-	"github.com/scriptmaster/openagent/auth"     // For GetUserFromSession to pass to config page
+	"github.com/scriptmaster/openagent/admin" // For maintenance redirect
+	"github.com/scriptmaster/openagent/auth"  // For GetUserFromSession to pass to config page
+	"github.com/scriptmaster/openagent/common"
 	"github.com/scriptmaster/openagent/projects" // Assuming ProjectService is here
 	// For Handle404 or similar
 )
@@ -38,22 +39,7 @@ func HostProjectMiddleware(next http.Handler, projectService projects.ProjectSer
 			}
 		}
 
-		host := r.Host // Default to the Host header from the request (e.g., "localhost:8800", "myproject.com")
-
-		// Check if the request is likely coming from behind a proxy (e.g., Nginx)
-		// by looking for the X-Forwarded-For header.
-		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-			// If X-Forwarded-For is present, it indicates a proxy.
-			// In such cases, the original host requested by the client is typically found in X-Forwarded-Host.
-			if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
-				host = forwardedHost
-			}
-			// If X-Forwarded-Host is not present, but X-Forwarded-For is,
-			// we stick with the initial r.Host. X-Forwarded-For itself contains client IP, not the host domain.
-			// The presence of X-Forwarded-For serves as the check for being behind a proxy.
-		}
-		// Clean the host? Remove port? Depends on how domains are stored. Assuming stored without port for now.
-		host = strings.Split(host, ":")[0]
+		host := requestHost(r)
 
 		// Use projectService if it's not nil
 		var project *projects.Project
@@ -90,3 +76,48 @@ func HostProjectMiddleware(next http.Handler, projectService projects.ProjectSer
 		}
 	})
 }
+
+// requestHost returns the host the client asked for, without the port. X-Forwarded-Host is only
+// trusted when TRUST_PROXY_HEADERS=1, as any client could otherwise pick the project serving it.
+func requestHost(r *http.Request) string {
+	host := r.Host // Default to the Host header from the request (e.g., "localhost:8800", "myproject.com")
+	if common.GetEnv("TRUST_PROXY_HEADERS") == "1" {
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0]) // The first proxy saw the client's host
+		}
+	}
+	// Domains are stored without the port
+	return strings.Split(host, ":")[0]
+}
+
+// ProjectContextMiddleware adds the project serving the request's host to the context, and marks
+// requests to hosts whose project has its own user directory so their sessions are bound to it.
+// It never blocks a request: hosts without a project are served without one.
+func ProjectContextMiddleware(next http.Handler, projectService projects.ProjectService, userService *UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if projectService == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := requestHost(r)
+		project, err := projectService.GetByDomain(host)
+		if err != nil || project == nil {
+			if err != nil && err != projects.ErrProjectNotFound {
+				log.Printf("Error fetching project by domain '%s': %v", host, err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := projects.SetProjectContext(r.Context(), project)
+		if userService != nil {
+			directory, err := userService.pdbService.GetUserDirectory(int(project.ID))
+			if err != nil {
+				log.Printf("Error loading the user directory of project %d: %v", project.ID, err)
+			} else if directory != nil {
+				ctx = auth.SetAccountProjectID(ctx, project.ID)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestRequestHostIgnoresForwardedHost tests that clients cannot pick a project with X-Forwarded-Host
+// unless proxy headers are trusted
+func TestRequestHostIgnoresForwardedHost(t *testing.T) {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "1" {
+		t.Skip("Proxy headers are trusted in this environment")
+	}
+	req := httptest.NewRequest("GET", "http://public.example:8800/login", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header.Set("X-Forwarded-Host", "victim.example")
+	if host := requestHost(req); host != "public.example" {
+		t.Errorf("Expected the Host header without its port, got %q", host)
+	}
+}
@@ -0,0 +1,655 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultNLSQLMaxRows = 100
+	maxNLSQLRows        = 1000
+	defaultNLSQLTimeout = 10 * time.Second
+)
+
+// ErrNoQueryableTables is returned when a project database has no initialized managed tables
+var ErrNoQueryableTables = errors.New("no managed tables are available to query")
+
+// ErrUnsafeSQL wraps read-only validation failures for generated SQL
+var ErrUnsafeSQL = errors.New("generated SQL is not allowed")
+
+// ErrNLSQLRoleRequired is returned for PostgreSQL project databases when NLSQL_DB_ROLE is not set
+var ErrNLSQLRoleRequired = errors.New("NLSQL_DB_ROLE must name a restricted role to query PostgreSQL databases")
+
+// SchemaTable describes a managed table as shown to the model.
+type SchemaTable struct {
+	Schema        string
+	Name          string
+	Description   string
+	Columns       []SchemaColumn
+	HiddenColumns []string // Never shown to the model and rejected in generated SQL
+}
+
+// SchemaColumn describes a visible column of a managed table.
+type SchemaColumn struct {
+	Name        string
+	DisplayName string
+	Type        string
+}
+
+// NLQueryResult is the answer to a natural-language question.
+type NLQueryResult struct {
+	Question  string                   `json:"question"`
+	SQL       string                   `json:"sql"`
+	Columns   []string                 `json:"columns"`
+	Rows      []map[string]interface{} `json:"rows"`
+	RowCount  int                      `json:"row_count"`
+	Truncated bool                     `json:"truncated"` // More rows matched than the limit allowed
+}
+
+// NLSQLService turns questions about a project database into read-only SQL and runs it.
+type NLSQLService struct {
+	metadata  *DatabaseMetadataService
+	data      DataAccessService
+	model     ModelClient
+	modelName string
+	MaxRows   int
+	Timeout   time.Duration
+	Role      string // PostgreSQL role queries run as, with SELECT on the managed tables only; required there
+}
+
+// NewNLSQLService creates an NLSQLService. Limits default to NLSQL_MAX_ROWS and NLSQL_TIMEOUT_SECONDS,
+// the role to NLSQL_DB_ROLE.
+func NewNLSQLService(metadata *DatabaseMetadataService, data DataAccessService, model ModelClient, modelName string) *NLSQLService {
+	maxRows, err := strconv.Atoi(getEnv("NLSQL_MAX_ROWS", ""))
+	if err != nil || maxRows <= 0 || maxRows > maxNLSQLRows {
+		maxRows = defaultNLSQLMaxRows
+	}
+	timeout := defaultNLSQLTimeout
+	if seconds, err := strconv.Atoi(getEnv("NLSQL_TIMEOUT_SECONDS", "")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	return &NLSQLService{
+		metadata:  metadata,
+		data:      data,
+		model:     model,
+		modelName: modelName,
+		MaxRows:   maxRows,
+		Timeout:   timeout,
+		Role:      getEnv("NLSQL_DB_ROLE", ""),
+	}
+}
+
+// Ask builds a schema prompt for the project database, asks the model for a SELECT,
+// validates it and runs it in a read-only transaction. limit is capped at MaxRows.
+// On validation or execution errors the generated SQL is still returned.
+func (s *NLSQLService) Ask(ctx context.Context, projectID, projectDBID int, question string, limit int) (NLQueryResult, error) {
+	result := NLQueryResult{Question: strings.TrimSpace(question)}
+	if result.Question == "" {
+		return result, errors.New("question cannot be empty")
+	}
+	if limit <= 0 || limit > s.MaxRows {
+		limit = s.MaxRows
+	}
+
+	tables, err := s.Schema(ctx, projectID, projectDBID)
+	if err != nil {
+		return result, err
+	}
+	if len(tables) == 0 {
+		return result, ErrNoQueryableTables
+	}
+
+	response, err := s.model.Generate(ctx, s.modelName, BuildSchemaPrompt(tables, result.Question))
+	if err != nil {
+		return result, fmt.Errorf("model error: %w", err)
+	}
+	result.SQL = extractSQL(response)
+	if err := ValidateReadOnlySQL(result.SQL, tables); err != nil {
+		return result, err
+	}
+
+	result.Columns, result.Rows, result.Truncated, err = s.run(ctx, projectDBID, result.SQL, limit)
+	if err != nil {
+		return result, fmt.Errorf("query failed: %w", err)
+	}
+	result.RowCount = len(result.Rows)
+	return result, nil
+}
+
+// Schema returns the initialized managed tables of a project database with their visible columns
+func (s *NLSQLService) Schema(ctx context.Context, projectID, projectDBID int) ([]SchemaTable, error) {
+	metadata, err := s.metadata.ListDatabaseTables(ctx, projectID, projectDBID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	var tables []SchemaTable
+	for _, table := range metadata {
+		if !table.IsManaged || !table.Initialized {
+			continue
+		}
+		columns, err := s.metadata.GetTableColumns(ctx, projectDBID, table.ManagedTableID, table.SchemaName, table.TableName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list columns of %s.%s: %w", table.SchemaName, table.TableName, err)
+		}
+
+		schemaTable := SchemaTable{Schema: table.SchemaName, Name: table.TableName, Description: table.Description}
+		for _, column := range columns {
+			if !column.Visible {
+				schemaTable.HiddenColumns = append(schemaTable.HiddenColumns, column.ColumnName)
+				continue
+			}
+			schemaTable.Columns = append(schemaTable.Columns, SchemaColumn{
+				Name:        column.ColumnName,
+				DisplayName: column.DisplayName,
+				Type:        column.DataType,
+			})
+		}
+		if len(schemaTable.Columns) > 0 {
+			tables = append(tables, schemaTable)
+		}
+	}
+	return tables, nil
+}
+
+// run executes a validated query in a read-only transaction with a row limit and statement timeout
+func (s *NLSQLService) run(ctx context.Context, projectDBID int, query string, limit int) ([]string, []map[string]interface{}, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	conn, err := s.data.getConnection(ctx, projectDBID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	// The validator is not the only boundary: on PostgreSQL the database enforces what may be read
+	if _, ok := conn.Driver().(*pq.Driver); ok && s.Role == "" {
+		return nil, nil, false, ErrNLSQLRoleRequired
+	}
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer tx.Rollback() // Never commit anything the query did
+
+	// Fetch one extra row to tell whether the result was truncated
+	wrapped := fmt.Sprintf("SELECT * FROM (%s) AS nl_query LIMIT %d", query, limit+1)
+	switch conn.Driver().(type) {
+	case *pq.Driver:
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", s.Timeout.Milliseconds())); err != nil {
+			return nil, nil, false, err
+		}
+		if _, err := tx.ExecContext(ctx, "SET LOCAL ROLE "+pq.QuoteIdentifier(s.Role)); err != nil {
+			return nil, nil, false, fmt.Errorf("failed to switch to role %s: %w", s.Role, err)
+		}
+	case *mysql.MySQLDriver:
+		wrapped = fmt.Sprintf("SELECT /*+ MAX_EXECUTION_TIME(%d) */ * FROM (%s) AS nl_query LIMIT %d", s.Timeout.Milliseconds(), query, limit+1)
+	}
+	// Other drivers rely on ctx's deadline to cancel the query
+
+	rows, err := tx.QueryContext(ctx, wrapped)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	result := []map[string]interface{}{}
+	truncated := false
+	for rows.Next() {
+		if len(result) == limit {
+			truncated = true
+			break
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, nil, false, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[col] = string(b)
+			} else {
+				row[col] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+	return columns, result, truncated, rows.Err()
+}
+
+// BuildSchemaPrompt describes the tables and their visible columns and asks for a single SELECT
+func BuildSchemaPrompt(tables []SchemaTable, question string) string {
+	var promptBuilder strings.Builder
+	promptBuilder.WriteString("[SYSTEM]\nYou translate questions into a single read-only PostgreSQL SELECT statement.\n")
+	promptBuilder.WriteString("Only use the tables and columns listed below; other tables and columns do not exist.\n")
+	promptBuilder.WriteString("Always qualify tables with their schema and name every column; * and whole-row references are refused.\n")
+	promptBuilder.WriteString("Use the display names as column aliases where it helps readability. Only call common aggregate, text, number and date functions.\n")
+	promptBuilder.WriteString("Respond with the SQL only, without explanation. Never modify data.\n\n")
+	promptBuilder.WriteString("Tables:\n")
+	for _, table := range tables {
+		promptBuilder.WriteString(fmt.Sprintf("%s.%s", table.Schema, table.Name))
+		if table.Description != "" {
+			promptBuilder.WriteString(" -- " + table.Description)
+		}
+		promptBuilder.WriteString("\n")
+		for _, column := range table.Columns {
+			promptBuilder.WriteString(fmt.Sprintf("  - %s (%s)", column.Name, column.Type))
+			if column.DisplayName != "" && column.DisplayName != column.Name {
+				promptBuilder.WriteString(fmt.Sprintf(": %q", column.DisplayName))
+			}
+			promptBuilder.WriteString("\n")
+		}
+	}
+	promptBuilder.WriteString(fmt.Sprintf("\n[USER]\n%s\n\n[ASSISTANT]\n", question))
+	return promptBuilder.String()
+}
+
+// extractSQL pulls the statement out of a model response, removing code fences and trailing semicolons
+func extractSQL(response string) string {
+	text := strings.TrimSpace(response)
+	if start := strings.Index(text, "```"); start != -1 {
+		text = text[start+3:]
+		if newline := strings.Index(text, "\n"); newline != -1 && !strings.ContainsAny(text[:newline], " \t") {
+			text = text[newline+1:] // Drop the language tag
+		}
+		if end := strings.Index(text, "```"); end != -1 {
+			text = text[:end]
+		}
+	}
+	text = strings.TrimSpace(text)
+	for strings.HasSuffix(text, ";") {
+		text = strings.TrimSpace(strings.TrimSuffix(text, ";"))
+	}
+	return text
+}
+
+// sqlKeywordsNotAllowed write data or change state. Statements can only start with SELECT or WITH,
+// so these catch data-modifying CTEs, SELECT INTO and similar constructs. TABLE name reads a
+// whole table, hidden columns included.
+var sqlKeywordsNotAllowed = map[string]bool{
+	"insert": true, "update": true, "delete": true, "merge": true, "into": true,
+	"drop": true, "alter": true, "create": true, "truncate": true,
+	"grant": true, "revoke": true, "copy": true, "call": true, "execute": true,
+	"table": true,
+}
+
+// sqlFunctionsAllowed are the functions a query may call: aggregates, window functions and functions
+// over single values. Anything else is refused, as functions like to_jsonb, table_to_xml or pg_read_file
+// read whole rows, other tables or the server itself.
+var sqlFunctionsAllowed = map[string]bool{
+	// Aggregates and window functions
+	"count": true, "sum": true, "avg": true, "min": true, "max": true, "stddev": true, "variance": true,
+	"string_agg": true, "array_agg": true, "bool_and": true, "bool_or": true,
+	"percentile_cont": true, "percentile_disc": true, "mode": true,
+	"row_number": true, "rank": true, "dense_rank": true, "percent_rank": true, "cume_dist": true,
+	"ntile": true, "lag": true, "lead": true, "first_value": true, "last_value": true,
+	// Conditionals and casts
+	"coalesce": true, "nullif": true, "greatest": true, "least": true, "cast": true, "ifnull": true, "if": true,
+	// Numbers
+	"abs": true, "round": true, "ceil": true, "ceiling": true, "floor": true, "trunc": true, "mod": true,
+	"power": true, "sqrt": true,
+	// Text
+	"lower": true, "upper": true, "length": true, "char_length": true, "trim": true, "ltrim": true,
+	"rtrim": true, "btrim": true, "substring": true, "substr": true, "left": true, "right": true,
+	"concat": true, "concat_ws": true, "replace": true, "position": true, "strpos": true,
+	"split_part": true, "lpad": true, "rpad": true, "initcap": true,
+	// Dates
+	"now": true, "date_trunc": true, "date_part": true, "extract": true, "age": true, "make_date": true,
+	"to_char": true, "to_date": true, "to_timestamp": true, "to_number": true,
+	"date": true, "date_format": true, "datediff": true, "year": true, "month": true, "day": true,
+	// Set-returning
+	"generate_series": true,
+}
+
+// sqlNonFunctionWords are keywords that may be followed by a parenthesis without calling a function
+var sqlNonFunctionWords = map[string]bool{
+	"select": true, "from": true, "where": true, "and": true, "or": true, "not": true, "in": true,
+	"exists": true, "any": true, "some": true, "all": true, "as": true, "on": true, "using": true,
+	"join": true, "lateral": true, "over": true, "filter": true, "group": true, "by": true,
+	"having": true, "when": true, "then": true, "else": true, "case": true, "between": true,
+	"like": true, "ilike": true, "is": true, "distinct": true, "union": true, "intersect": true,
+	"except": true, "values": true, "array": true, "with": true, "recursive": true, "limit": true,
+	"offset": true, "rollup": true, "cube": true, "sets": true,
+}
+
+// sqlFunctionsWithFrom take FROM as an argument separator, as in extract(year FROM created_at)
+var sqlFunctionsWithFrom = map[string]bool{
+	"extract": true, "substring": true, "trim": true, "position": true, "overlay": true,
+}
+
+// sqlToken is a lexical token of a SQL statement
+type sqlToken struct {
+	text   string // Lower-cased unless quoted
+	quoted bool   // Quoted identifier
+	kind   byte   // 'w' word, 's' string literal, 'p' punctuation
+}
+
+// tokenizeSQL splits a statement into words, string literals and punctuation, dropping comments.
+// Backslashes and prefixed literals such as E'...' are refused: PostgreSQL escape strings and MySQL
+// read backslash escapes, so the database would split the statement differently than this does.
+func tokenizeSQL(query string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			// MySQL only starts a comment at "-- " and reads "--1" as minus minus one
+			if i+2 < len(runes) && !unicode.IsSpace(runes[i+2]) {
+				return nil, errors.New("-- must be followed by a space")
+			}
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			if i+2 < len(runes) && (runes[i+2] == '!' || runes[i+2] == '+') {
+				return nil, errors.New("MySQL executable comments and optimizer hints are not allowed")
+			}
+			j := i + 2
+			for j+1 < len(runes) && !(runes[j] == '*' && runes[j+1] == '/') {
+				j++
+			}
+			if j+1 >= len(runes) {
+				return nil, errors.New("unterminated comment")
+			}
+			i = j + 2
+		case r == '\\':
+			return nil, errors.New("backslashes are not allowed")
+		case r == '#':
+			return nil, errors.New("# is a comment in MySQL and not allowed")
+		case r == '\'':
+			if i > 0 && (unicode.IsLetter(runes[i-1]) || unicode.IsDigit(runes[i-1]) || runes[i-1] == '&' || runes[i-1] == '_') {
+				return nil, errors.New("prefixed string literals such as E'...' are not allowed")
+			}
+			j := i + 1
+			for ; j < len(runes); j++ {
+				if runes[j] == '\\' {
+					return nil, errors.New("backslashes are not allowed in string literals")
+				}
+				if runes[j] == '\'' {
+					if j+1 < len(runes) && runes[j+1] == '\'' {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated string literal")
+			}
+			tokens = append(tokens, sqlToken{text: string(runes[i+1 : j]), kind: 's'})
+			i = j + 1
+		case r == '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != '"' {
+				if runes[j] == '\\' {
+					return nil, errors.New("backslashes are not allowed in quoted identifiers")
+				}
+				j++
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated quoted identifier")
+			}
+			tokens = append(tokens, sqlToken{text: string(runes[i+1 : j]), quoted: true, kind: 'w'})
+			i = j + 1
+		case r == '$' && i+1 < len(runes) && (runes[i+1] == '$' || unicode.IsLetter(runes[i+1])):
+			return nil, errors.New("dollar-quoted strings are not allowed")
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '$') {
+				j++
+			}
+			tokens = append(tokens, sqlToken{text: strings.ToLower(string(runes[i:j])), kind: 'w'})
+			i = j
+		default:
+			tokens = append(tokens, sqlToken{text: string(r), kind: 'p'})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// ValidateReadOnlySQL checks that query is a single SELECT (or WITH ... SELECT) that only reads
+// the named visible columns of the given tables and calls only allowed functions. * and whole-row
+// references such as to_jsonb(t) are refused as they would include hidden columns.
+// It is a guard on top of the read-only transaction the query runs in, not a replacement for it.
+func ValidateReadOnlySQL(query string, tables []SchemaTable) error {
+	tokens, err := tokenizeSQL(query)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsafeSQL, err)
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("%w: empty statement", ErrUnsafeSQL)
+	}
+	if first := tokens[0]; first.kind != 'w' || (first.text != "select" && first.text != "with") {
+		return fmt.Errorf("%w: only SELECT statements are allowed", ErrUnsafeSQL)
+	}
+
+	allowedTables := make(map[string]bool)
+	visible := make(map[string]bool)
+	hidden := make(map[string]bool)
+	for _, table := range tables {
+		allowedTables[strings.ToLower(table.Schema+"."+table.Name)] = true
+		allowedTables[strings.ToLower(table.Name)] = true
+		for _, column := range table.Columns {
+			visible[strings.ToLower(column.Name)] = true
+		}
+		for _, column := range table.HiddenColumns {
+			hidden[strings.ToLower(column)] = true
+		}
+	}
+	relations := sqlRelations{defined: make(map[int]bool), names: make(map[string]bool), schemas: make(map[string]bool)}
+
+	// Names defined by WITH name AS (...) may be used like tables
+	for i := 0; i+2 < len(tokens); i++ {
+		if tokens[i].kind == 'w' && tokens[i+1].text == "as" && tokens[i+2].text == "(" {
+			allowedTables[tokens[i].text] = true
+			relations.define(i, tokens[i].text)
+		}
+	}
+
+	for i, token := range tokens {
+		switch {
+		case token.kind == 'p' && token.text == ";":
+			return fmt.Errorf("%w: only a single statement is allowed", ErrUnsafeSQL)
+		case token.kind == 'p' && token.text == "*" && isSQLWildcard(tokens, i):
+			return fmt.Errorf("%w: * is not allowed, name the columns instead", ErrUnsafeSQL)
+		case token.kind != 'w':
+			continue
+		case !token.quoted && sqlKeywordsNotAllowed[token.text]:
+			return fmt.Errorf("%w: %s is not allowed", ErrUnsafeSQL, strings.ToUpper(token.text))
+		case hidden[strings.ToLower(token.text)] && !visible[strings.ToLower(token.text)]:
+			return fmt.Errorf("%w: column %s is not available", ErrUnsafeSQL, token.text)
+		case !token.quoted && token.text == "from" && (i > 0 && tokens[i-1].text == "distinct" || functionFrom(tokens, i)):
+			continue // IS DISTINCT FROM and extract(... FROM ...) take no tables
+		case !token.quoted && (token.text == "from" || token.text == "join"):
+			if err := checkTableRefs(tokens, i+1, allowedTables, &relations); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Tables and aliases can be used before the FROM clause defining them, so these checks need every relation
+	for i, token := range tokens {
+		if token.kind != 'w' || relations.defined[i] {
+			continue
+		}
+		if i+1 < len(tokens) && tokens[i+1].text == "(" {
+			if isSQLFunctionCall(tokens, i) && !sqlFunctionsAllowed[token.text] {
+				return fmt.Errorf("%w: function %s is not allowed", ErrUnsafeSQL, token.text)
+			}
+			continue
+		}
+		qualifier := i+1 < len(tokens) && tokens[i+1].text == "."
+		qualified := i > 1 && tokens[i-1].text == "." && !relations.schemas[tokens[i-2].text]
+		if relations.names[token.text] && !qualifier && !qualified && !visible[strings.ToLower(token.text)] {
+			return fmt.Errorf("%w: whole-row reference %s is not allowed, name the columns instead", ErrUnsafeSQL, token.text)
+		}
+	}
+	return nil
+}
+
+// sqlRelations are the tables, subqueries and aliases the FROM clauses of a statement define
+type sqlRelations struct {
+	defined map[int]bool    // Positions of the tokens defining a relation or its alias
+	names   map[string]bool // Names that stand for a whole row when used on their own
+	schemas map[string]bool // Schemas qualifying table names, as in public.orders
+}
+
+// define records the token at position i as defining the relation name
+func (r *sqlRelations) define(i int, name string) {
+	r.defined[i] = true
+	r.names[name] = true
+}
+
+// checkTableRefs checks the comma-separated table references following FROM or JOIN at tokens[start]
+// and records the relations they define. Subqueries are skipped here; their own FROM clauses are
+// checked when the caller reaches them.
+func checkTableRefs(tokens []sqlToken, start int, allowed map[string]bool, relations *sqlRelations) error {
+	for i := start; i < len(tokens); {
+		for i < len(tokens) && tokens[i].kind == 'w' && !tokens[i].quoted && (tokens[i].text == "lateral" || tokens[i].text == "only") {
+			i++
+		}
+		if i >= len(tokens) {
+			return nil
+		}
+
+		rows := true // Whether the reference yields rows rather than single values
+		switch {
+		case tokens[i].text == "(":
+			i = skipParens(tokens, i)
+		case tokens[i].kind == 'w':
+			first, name := i, tokens[i].text
+			i++
+			if i+1 < len(tokens) && tokens[i].text == "." && tokens[i+1].kind == 'w' {
+				name += "." + tokens[i+1].text
+				i += 2
+			}
+			if i < len(tokens) && tokens[i].text == "(" {
+				// Set-returning function such as generate_series; checked against the function allowlist
+				rows = false
+				i = skipParens(tokens, i)
+			} else if !allowed[strings.ToLower(name)] {
+				return fmt.Errorf("%w: table %s is not available", ErrUnsafeSQL, name)
+			} else {
+				if i-first > 1 {
+					relations.defined[first] = true
+					relations.schemas[tokens[first].text] = true
+				}
+				relations.define(i-1, tokens[i-1].text)
+			}
+		default:
+			return nil
+		}
+
+		// Record an optional alias (with column list) and continue after a comma
+		for i < len(tokens) && tokens[i].text != "," {
+			switch {
+			case tokens[i].text == "(":
+				i = skipParens(tokens, i)
+			case tokens[i].text == ")" || (tokens[i].kind == 'w' && !tokens[i].quoted && sqlClauseWords[tokens[i].text]):
+				return nil
+			default:
+				if tokens[i].kind == 'w' && (tokens[i].quoted || tokens[i].text != "as") {
+					relations.defined[i] = true
+					if rows {
+						relations.names[tokens[i].text] = true
+					}
+				}
+				i++
+			}
+		}
+		i++ // Skip the comma
+	}
+	return nil
+}
+
+// isSQLWildcard reports whether the * at tokens[i] selects every column rather than multiplying.
+// count(*) is allowed as it reads no values.
+func isSQLWildcard(tokens []sqlToken, i int) bool {
+	if i == 0 {
+		return true
+	}
+	switch previous := tokens[i-1]; {
+	case previous.kind == 'p' && previous.text == "(":
+		return !(i >= 2 && tokens[i-2].text == "count" && i+1 < len(tokens) && tokens[i+1].text == ")")
+	case previous.kind == 'p':
+		return previous.text == "," || previous.text == "."
+	default:
+		return !previous.quoted && (previous.text == "select" || previous.text == "distinct" || previous.text == "all")
+	}
+}
+
+// isSQLFunctionCall reports whether the word at tokens[i], followed by a parenthesis, calls a function.
+// Keywords such as IN or OVER and type names such as numeric(10, 2) in casts do not.
+func isSQLFunctionCall(tokens []sqlToken, i int) bool {
+	if !tokens[i].quoted && sqlNonFunctionWords[tokens[i].text] {
+		return false
+	}
+	if i > 0 && (tokens[i-1].text == ":" || (!tokens[i-1].quoted && tokens[i-1].text == "as")) {
+		return false
+	}
+	return true
+}
+
+// functionFrom reports whether the FROM at tokens[i] separates the arguments of a function such as extract
+func functionFrom(tokens []sqlToken, i int) bool {
+	depth := 0
+	for j := i - 1; j > 0; j-- {
+		switch tokens[j].text {
+		case ")":
+			depth++
+		case "(":
+			if depth == 0 {
+				return sqlFunctionsWithFrom[tokens[j-1].text]
+			}
+			depth--
+		}
+	}
+	return false
+}
+
+// skipParens returns the index just after the parenthesis opened at tokens[open]
+func skipParens(tokens []sqlToken, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// sqlClauseWords end a FROM list
+var sqlClauseWords = map[string]bool{
+	"where": true, "group": true, "having": true, "order": true, "limit": true, "offset": true,
+	"union": true, "intersect": true, "except": true, "join": true, "inner": true, "left": true,
+	"right": true, "full": true, "cross": true, "natural": true, "on": true, "using": true,
+	"window": true, "fetch": true, "for": true, "select": true,
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// AskDataRequest is the body for a natural-language question about a project database
+type AskDataRequest struct {
+	ProjectDBID int    `json:"project_db_id"`
+	Question    string `json:"question"`
+	Limit       int    `json:"limit,omitempty"` // Capped at NLSQL_MAX_ROWS
+}
+
+// NewNLSQLServiceFromEnv creates an NLSQLService using the Ollama settings shared with the agent
+func NewNLSQLServiceFromEnv(db *sql.DB) *NLSQLService {
+	dataService := NewDirectDataService(db)
+	ollamaURL := getEnv("OLLAMA_URL", defaultOllamaURL)
+	modelName := getEnv("NLSQL_MODEL", getEnv("OLLAMA_MODEL", defaultModel))
+	return NewNLSQLService(NewDatabaseMetadataService(db, dataService), dataService, NewOllamaClient(ollamaURL, nil), modelName)
+}
+
+// CreateAskDataHandler creates a handler for natural-language questions about project data
+func CreateAskDataHandler(nlsql *NLSQLService, projectService projects.ProjectService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleAskData(w, r, GetDB(), nlsql, projectService)
+	}
+}
+
+// HandleAskData answers a question about a project database with the generated SQL and its results.
+// Any member of the project may query its databases.
+func HandleAskData(w http.ResponseWriter, r *http.Request, db *sql.DB, nlsql *NLSQLService, projectService projects.ProjectService) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if db == nil {
+		common.JSONError(w, "Service unavailable: Database not configured or connection failed.", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req AskDataRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		common.JSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ProjectDBID == 0 {
+		common.JSONError(w, "project_db_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var projectID int
+	err := db.QueryRowContext(r.Context(), common.MustGetSQL("GetProjectDBProjectID"), req.ProjectDBID).Scan(&projectID)
+	if err == sql.ErrNoRows {
+		common.JSONError(w, "Project database not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading project database %d: %v", req.ProjectDBID, err)
+		common.JSONError(w, "Failed to load project database", http.StatusInternalServerError)
+		return
+	}
+	if !projectAllows(r.Context(), user, projectID, projects.PermView) {
+		common.JSONError(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	result, err := nlsql.Ask(r.Context(), projectID, req.ProjectDBID, req.Question, req.Limit)
+	if err != nil {
+		log.Printf("Question about project database %d by %s failed: %v (SQL: %s)", req.ProjectDBID, user.Email, err, result.SQL)
+		status := http.StatusInternalServerError
+		switch {
+		case result.Question == "":
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrNoQueryableTables):
+			status = http.StatusConflict
+		case errors.Is(err, ErrUnsafeSQL):
+			status = http.StatusUnprocessableEntity
+		case errors.Is(err, ErrNLSQLRoleRequired):
+			status = http.StatusServiceUnavailable
+		case result.SQL != "":
+			status = http.StatusBadRequest // The generated query failed to run
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "sql": result.SQL})
+		return
+	}
+	log.Printf("Question about project database %d by %s returned %d rows", req.ProjectDBID, user.Email, result.RowCount)
+	common.JSONResponse(w, result)
+}
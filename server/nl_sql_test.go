@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nlsqlTestTables is a schema with one hidden column
+var nlsqlTestTables = []SchemaTable{
+	{
+		Schema:      "public",
+		Name:        "orders",
+		Description: "Customer orders",
+		Columns: []SchemaColumn{
+			{Name: "id", DisplayName: "id", Type: "integer"},
+			{Name: "total", DisplayName: "Order Total", Type: "numeric"},
+			{Name: "customer_id", DisplayName: "Customer", Type: "integer"},
+		},
+		HiddenColumns: []string{"card_number"},
+	},
+	{
+		Schema:  "public",
+		Name:    "customers",
+		Columns: []SchemaColumn{{Name: "id", Type: "integer"}, {Name: "name", DisplayName: "Name", Type: "text"}},
+	},
+}
+
+// TestValidateReadOnlySQL tests that only single read-only SELECTs over the managed tables pass
+func TestValidateReadOnlySQL(t *testing.T) {
+	allowed := []string{
+		"SELECT id, total AS \"Order Total\" FROM public.orders WHERE total > 100 ORDER BY total DESC",
+		"select c.name, sum(o.total) from public.orders o join public.customers c on c.id = o.customer_id group by c.name",
+		"WITH big AS (SELECT id FROM orders WHERE total > 1000) SELECT count(*) FROM big",
+		"SELECT orders.id, customers.name FROM public.orders, public.customers WHERE orders.customer_id = customers.id",
+		"SELECT name FROM customers WHERE name = 'drop table; insert into'",
+		"SELECT sub.id FROM (SELECT id FROM orders) sub -- comment with delete",
+		"SELECT g FROM generate_series(1, 3) g",
+		"SELECT total * 2, extract(year FROM now()), cast(total AS numeric(10, 2)) FROM orders WHERE id IN (1, 2)",
+	}
+	for _, query := range allowed {
+		if err := ValidateReadOnlySQL(query, nlsqlTestTables); err != nil {
+			t.Errorf("Expected %q to be allowed, got %v", query, err)
+		}
+	}
+
+	rejected := []string{
+		"",
+		"DELETE FROM orders",
+		"SELECT 1; DROP TABLE orders",
+		"SELECT * INTO copy FROM orders",
+		"WITH gone AS (DELETE FROM orders RETURNING *) SELECT * FROM gone",
+		"SELECT card_number FROM orders",
+		"SELECT usename FROM pg_catalog.pg_user",
+		"SELECT x.a FROM (SELECT 1 AS a) x, pg_shadow",
+		"SELECT orders.id FROM orders JOIN users ON true",
+		"SELECT pg_sleep(60)",
+		"SELECT * FROM public.orders",
+		"SELECT o.* FROM public.orders o",
+		"SELECT to_jsonb(o) FROM public.orders o",
+		"SELECT array_agg(o) FROM public.orders o",
+		"SELECT public.orders FROM public.orders",
+		"SELECT table_to_xml('public.orders', true, false, '')",
+		"SELECT database_to_xml(true, false, '')",
+		"SELECT id FROM orders WHERE id IN (TABLE ai.users)",
+		"SELECT id FROM orders WHERE total > (SELECT count(*) FROM secrets)",
+		"SELECT $$text$$",
+		"SELECT 'unterminated",
+		// The database would read these differently than the validator does
+		`SELECT E'\' AS a, ' AS b, secret, pg_read_file('/etc/passwd') AS c FROM public.users WHERE E'\' ' <> 'x'`,
+		`SELECT id FROM orders WHERE 'x\' <> ' AND 1 = 0 UNION SELECT card_number FROM orders -- '`,
+		`SELECT "id\" FROM orders`,
+		"SELECT U&'d\0061t' FROM orders",
+		"SELECT id /*! , card_number */ FROM orders",
+		"SELECT id, 1 --1, card_number\nFROM orders",
+		"SELECT id # '\n, card_number FROM orders -- '",
+	}
+	for _, query := range rejected {
+		if err := ValidateReadOnlySQL(query, nlsqlTestTables); !errors.Is(err, ErrUnsafeSQL) {
+			t.Errorf("Expected %q to be rejected, got %v", query, err)
+		}
+	}
+}
+
+// TestBuildSchemaPrompt tests that the prompt lists display names and leaves out hidden columns
+func TestBuildSchemaPrompt(t *testing.T) {
+	prompt := BuildSchemaPrompt(nlsqlTestTables, "What is the biggest order?")
+
+	for _, want := range []string{"public.orders -- Customer orders", "total (numeric): \"Order Total\"", "public.customers", "What is the biggest order?"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("Expected prompt to contain %q:\n%s", want, prompt)
+		}
+	}
+	if strings.Contains(prompt, "card_number") {
+		t.Errorf("Expected hidden column to be left out of the prompt:\n%s", prompt)
+	}
+}
+
+// TestExtractSQL tests that code fences and trailing semicolons are removed from model responses
+func TestExtractSQL(t *testing.T) {
+	cases := map[string]string{
+		"SELECT 1;":                               "SELECT 1",
+		"```sql\nSELECT id FROM orders;\n```":     "SELECT id FROM orders",
+		"Here you go:\n```\nSELECT 2\n```\nDone.": "SELECT 2",
+	}
+	for response, want := range cases {
+		if got := extractSQL(response); got != want {
+			t.Errorf("extractSQL(%q) = %q, want %q", response, got, want)
+		}
+	}
+}
+
+// fixedConnection serves one database connection to the NL-to-SQL service
+type fixedConnection struct {
+	db *sql.DB
+}
+
+func (c fixedConnection) getConnection(ctx context.Context, projectDBID int) (*sql.DB, error) {
+	return c.db, nil
+}
+
+// TestNLSQLRequiresRole tests that PostgreSQL databases are not queried without NLSQL_DB_ROLE
+func TestNLSQLRequiresRole(t *testing.T) {
+	// Nothing listens there: the role is checked before connecting
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	nlsql := &NLSQLService{data: fixedConnection{db: db}, Timeout: time.Second}
+
+	if _, _, _, err := nlsql.run(context.Background(), 1, "SELECT id FROM orders", 10); !errors.Is(err, ErrNLSQLRoleRequired) {
+		t.Errorf("Expected queries without a role to be refused, got %v", err)
+	}
+	nlsql.Role = "nlsql_reader"
+	if _, _, _, err := nlsql.run(context.Background(), 1, "SELECT id FROM orders", 10); errors.Is(err, ErrNLSQLRoleRequired) {
+		t.Error("Expected queries with a role to go to the database")
+	}
+}
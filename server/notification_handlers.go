@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// CreateWebhookRequest is the body for registering a project webhook
+type CreateWebhookRequest struct {
+	ProjectID int      `json:"project_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"` // Generated when empty
+}
+
+// CreateWebhooksAPIHandler creates a handler for the project webhooks API
+func CreateWebhooksAPIHandler(projectService projects.ProjectService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleWebhooksAPI(w, r, GetDB(), projectService)
+	}
+}
+
+// CreateDeliveriesAPIHandler creates a handler for the notification delivery log API
+func CreateDeliveriesAPIHandler(projectService projects.ProjectService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleDeliveriesAPI(w, r, GetDB(), projectService)
+	}
+}
+
+// HandleWebhooksAPI lists (GET), creates (POST) and deletes (DELETE) a project's webhooks.
+// Only project admins and owners may manage them.
+func HandleWebhooksAPI(w http.ResponseWriter, r *http.Request, db *sql.DB, projectService projects.ProjectService) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if db == nil {
+		common.JSONError(w, "Service unavailable: Database not configured or connection failed.", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		projectID, _ := strconv.Atoi(r.URL.Query().Get("project_id"))
+		if projectID == 0 || !projectAllows(r.Context(), user, projectID, projects.PermManage) {
+			common.JSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		hooks, err := listProjectWebhooks(db, projectID, false)
+		if err != nil {
+			log.Printf("Error listing webhooks for project %d: %v", projectID, err)
+			common.JSONError(w, "Failed to list webhooks", http.StatusInternalServerError)
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = "" // Secrets are only shown once, on creation
+		}
+		if hooks == nil {
+			hooks = []ProjectWebhook{}
+		}
+		common.JSONResponse(w, hooks)
+
+	case http.MethodPost:
+		var req CreateWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			common.JSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.ProjectID == 0 || !projectAllows(r.Context(), user, req.ProjectID, projects.PermManage) {
+			common.JSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := validateWebhookURL(r.Context(), req.URL); err != nil {
+			common.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Events) == 0 {
+			req.Events = []string{EventRunFinished, EventRunError, EventRunBlocked}
+		}
+		for _, event := range req.Events {
+			if !validWebhookEvents[event] {
+				common.JSONError(w, "Unknown event: "+event, http.StatusBadRequest)
+				return
+			}
+		}
+		sort.Strings(req.Events)
+		if req.Secret == "" {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				common.JSONError(w, "Failed to generate webhook secret", http.StatusInternalServerError)
+				return
+			}
+			req.Secret = hex.EncodeToString(secret)
+		}
+
+		hook := ProjectWebhook{ProjectID: req.ProjectID, URL: req.URL, Secret: req.Secret, Events: req.Events, IsActive: true}
+		err := db.QueryRow(common.MustGetSQL("notifications/create_webhook"),
+			req.ProjectID, req.URL, req.Secret, strings.Join(req.Events, ","), user.ID).Scan(&hook.ID, &hook.CreatedAt)
+		if err != nil {
+			log.Printf("Error creating webhook for project %d: %v", req.ProjectID, err)
+			common.JSONError(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Webhook %d created for project %d by %s", hook.ID, hook.ProjectID, user.Email)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hook)
+
+	case http.MethodDelete:
+		projectID, _ := strconv.Atoi(r.URL.Query().Get("project_id"))
+		webhookID, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		if projectID == 0 || !projectAllows(r.Context(), user, projectID, projects.PermManage) {
+			common.JSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		result, err := db.Exec(common.MustGetSQL("notifications/delete_webhook"), webhookID, projectID)
+		if err != nil {
+			log.Printf("Error deleting webhook %d: %v", webhookID, err)
+			common.JSONError(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			common.JSONError(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		common.JSONResponse(w, map[string]bool{"success": true})
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleDeliveriesAPI returns the notification delivery log for a project (?project_id=)
+// or a single run (?run_id=). Project logs need project management rights; run logs belong to the run's user.
+// Runs are owned by ai.users IDs, so project directory accounts only see a run's log through its project.
+func HandleDeliveriesAPI(w http.ResponseWriter, r *http.Request, db *sql.DB, projectService projects.ProjectService) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if db == nil {
+		common.JSONError(w, "Service unavailable: Database not configured or connection failed.", http.StatusServiceUnavailable)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	var rows *sql.Rows
+	var err error
+	if runID, _ := strconv.ParseInt(r.URL.Query().Get("run_id"), 10, 64); runID != 0 {
+		var ownerID, projectID int
+		err = db.QueryRow(common.MustGetSQL("agent_runs/read"), runID).Scan(&runID, &ownerID, &projectID)
+		if err == sql.ErrNoRows {
+			common.JSONError(w, "Run not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error loading agent run %d: %v", runID, err)
+			common.JSONError(w, "Failed to load run", http.StatusInternalServerError)
+			return
+		}
+		if !ownerOrManager(r.Context(), user, ownerID, projectID) {
+			common.JSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		rows, err = db.Query(common.MustGetSQL("notifications/list_deliveries_by_run"), runID, limit)
+	} else {
+		projectID, _ := strconv.Atoi(r.URL.Query().Get("project_id"))
+		if projectID == 0 || !projectAllows(r.Context(), user, projectID, projects.PermManage) {
+			common.JSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		rows, err = db.Query(common.MustGetSQL("notifications/list_deliveries_by_project"), projectID, limit)
+	}
+	if err != nil {
+		log.Printf("Error listing notification deliveries: %v", err)
+		common.JSONError(w, "Failed to list deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []NotificationDelivery{}
+	for rows.Next() {
+		var d NotificationDelivery
+		if err := rows.Scan(&d.ID, &d.RunID, &d.WebhookID, &d.Event, &d.Channel, &d.Target, &d.Status,
+			&d.Attempts, &d.ResponseCode, &d.LastError, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			log.Printf("Error scanning notification delivery: %v", err)
+			common.JSONError(w, "Failed to list deliveries", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	common.JSONResponse(w, deliveries)
+}
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/mailer"
+)
+
+// Agent notification events
+const (
+	EventRunFinished    = "finished"
+	EventRunError       = "error"
+	EventRunBlocked     = "blocked"
+	EventApprovalNeeded = "approval_needed" // A command waits for the user's approval (AGENT_REQUIRE_APPROVAL)
+)
+
+// Webhook request headers
+const (
+	WebhookSignatureHeader = "X-OpenAgent-Signature"
+	WebhookTimestampHeader = "X-OpenAgent-Timestamp"
+	WebhookEventHeader     = "X-OpenAgent-Event"
+	WebhookDeliveryHeader  = "X-OpenAgent-Delivery"
+)
+
+const (
+	defaultNotifyAttempts = 5
+	defaultNotifyBackoff  = 2 * time.Second
+	webhookTimeout        = 10 * time.Second
+)
+
+// AgentEvent is the payload sent when a run changes state.
+type AgentEvent struct {
+	Event      string     `json:"event"`
+	RunID      int64      `json:"run_id"`
+	ProjectID  int        `json:"project_id,omitempty"`
+	UserEmail  string     `json:"-"`
+	Goal       string     `json:"goal"`
+	State      AgentState `json:"state"`
+	Iteration  int        `json:"iteration"`
+	LastOutput string     `json:"last_output,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	Timestamp  time.Time  `json:"timestamp"`
+}
+
+// ProjectWebhook is a webhook configured for a project.
+type ProjectWebhook struct {
+	ID        int       `json:"id"`
+	ProjectID int       `json:"project_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	IsActive  bool      `json:"is_active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NotificationDelivery is one row of the delivery log.
+type NotificationDelivery struct {
+	ID           int       `json:"id"`
+	RunID        *int64    `json:"run_id,omitempty"`
+	WebhookID    *int      `json:"webhook_id,omitempty"`
+	Event        string    `json:"event"`
+	Channel      string    `json:"channel"`
+	Target       string    `json:"target"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	ResponseCode *int      `json:"response_code,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Subscribes reports whether the webhook wants an event.
+func (h ProjectWebhook) Subscribes(event string) bool {
+	for _, e := range h.Events {
+		if e == event || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Notifier delivers agent events by email and project webhooks, retrying failures and logging every delivery.
+type Notifier struct {
+	db          *sql.DB
+	client      *http.Client
+	mail        mailer.Mailer
+	emailEvents map[string]bool
+	maxAttempts int
+	backoff     time.Duration
+	wg          sync.WaitGroup
+}
+
+// NewNotifier creates a Notifier. Email events come from AGENT_NOTIFY_EMAIL_EVENTS
+// (comma separated, default "finished,error,blocked"); retries from AGENT_NOTIFY_ATTEMPTS.
+func NewNotifier(db *sql.DB) *Notifier {
+	attempts, err := strconv.Atoi(common.GetEnvOrDefault("AGENT_NOTIFY_ATTEMPTS", strconv.Itoa(defaultNotifyAttempts)))
+	if err != nil || attempts < 1 {
+		attempts = defaultNotifyAttempts
+	}
+	return &Notifier{
+		db:          db,
+		client:      newWebhookClient(),
+		mail:        mailer.Default(),
+		emailEvents: parseEventList(common.GetEnvOrDefault("AGENT_NOTIFY_EMAIL_EVENTS", "finished,error,blocked")),
+		maxAttempts: attempts,
+		backoff:     defaultNotifyBackoff,
+	}
+}
+
+// Notify delivers the event in the background.
+func (n *Notifier) Notify(event AgentEvent) {
+	if n == nil {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		if event.UserEmail != "" && n.emailEvents[event.Event] {
+			n.wg.Add(1)
+			go func() {
+				defer n.wg.Done()
+				n.deliverEmail(event)
+			}()
+		}
+		for _, hook := range n.webhooksFor(event) {
+			hook := hook
+			n.wg.Add(1)
+			go func() {
+				defer n.wg.Done()
+				n.deliverWebhook(hook, event)
+			}()
+		}
+	}()
+}
+
+// Wait blocks until all pending deliveries have finished.
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+// webhooksFor loads the project's active webhooks subscribed to the event
+func (n *Notifier) webhooksFor(event AgentEvent) []ProjectWebhook {
+	if n.db == nil || event.ProjectID == 0 {
+		return nil
+	}
+	hooks, err := listProjectWebhooks(n.db, event.ProjectID, true)
+	if err != nil {
+		log.Printf("Failed to load webhooks for project %d: %v", event.ProjectID, err)
+		return nil
+	}
+	var subscribed []ProjectWebhook
+	for _, hook := range hooks {
+		if hook.Subscribes(event.Event) {
+			subscribed = append(subscribed, hook)
+		}
+	}
+	return subscribed
+}
+
+// deliverEmail sends the event to the user who started the run
+func (n *Notifier) deliverEmail(event AgentEvent) {
+	deliveryID := n.logDelivery(event, nil, "email", event.UserEmail)
+	msg, err := mailer.Render("agent_event", map[string]interface{}{
+		"AppName":   common.GetEnvOrDefault("APP_NAME", "OpenAgent"),
+		"EventName": strings.ReplaceAll(event.Event, "_", " "),
+		"Event":     event,
+	})
+	if err != nil {
+		n.finishDelivery(deliveryID, 0, 0, err)
+		return
+	}
+	msg.To = []string{event.UserEmail}
+
+	n.retry(deliveryID, func() (int, bool, error) {
+		return 0, true, n.mail.Send(context.Background(), msg)
+	})
+}
+
+// deliverWebhook posts the signed event to a project webhook
+func (n *Notifier) deliverWebhook(hook ProjectWebhook, event AgentEvent) {
+	webhookID := hook.ID
+	deliveryID := n.logDelivery(event, &webhookID, "webhook", hook.URL)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		n.finishDelivery(deliveryID, 0, 0, err)
+		return
+	}
+
+	n.retry(deliveryID, func() (int, bool, error) {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+		if err != nil {
+			return 0, false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(WebhookEventHeader, event.Event)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(deliveryID, 10))
+		req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(hook.Secret, timestamp, payload))
+
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return 0, true, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp.StatusCode, false, nil
+		}
+		// Only server errors and rate limits are worth retrying
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return resp.StatusCode, retryable, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	})
+}
+
+// retry runs attempt with exponential backoff until it succeeds, fails permanently or runs out of attempts
+func (n *Notifier) retry(deliveryID int64, attempt func() (code int, retryable bool, err error)) {
+	var code int
+	var err error
+	var retryable bool
+	attempts := 0
+	for attempts < n.maxAttempts {
+		attempts++
+		code, retryable, err = attempt()
+		if err == nil || !retryable {
+			break
+		}
+		n.updateDelivery(deliveryID, "pending", attempts, code, err)
+		if attempts < n.maxAttempts {
+			time.Sleep(n.backoff * time.Duration(1<<(attempts-1)))
+		}
+	}
+	n.finishDelivery(deliveryID, attempts, code, err)
+}
+
+// SignWebhookPayload returns the signature header value: sha256=HMAC(secret, timestamp + "." + payload)
+func SignWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// logDelivery inserts a pending delivery row. Returns 0 when there is no database.
+func (n *Notifier) logDelivery(event AgentEvent, webhookID *int, channel, target string) int64 {
+	if n.db == nil {
+		return 0
+	}
+	var runID, projectID sql.NullInt64
+	if event.RunID != 0 {
+		runID = sql.NullInt64{Int64: event.RunID, Valid: true}
+	}
+	if event.ProjectID != 0 {
+		projectID = sql.NullInt64{Int64: int64(event.ProjectID), Valid: true}
+	}
+	var id int64
+	err := n.db.QueryRow(common.MustGetSQL("notifications/create_delivery"),
+		runID, projectID, webhookID, event.Event, channel, target).Scan(&id)
+	if err != nil {
+		log.Printf("Failed to log %s notification to %s: %v", channel, target, err)
+		return 0
+	}
+	return id
+}
+
+// finishDelivery records the final outcome of a delivery
+func (n *Notifier) finishDelivery(deliveryID int64, attempts, code int, err error) {
+	status := "delivered"
+	if err != nil {
+		status = "failed"
+		log.Printf("Notification delivery %d failed after %d attempts: %v", deliveryID, attempts, err)
+	}
+	n.updateDelivery(deliveryID, status, attempts, code, err)
+}
+
+// updateDelivery updates the delivery log row
+func (n *Notifier) updateDelivery(deliveryID int64, status string, attempts, code int, err error) {
+	if n.db == nil || deliveryID == 0 {
+		return
+	}
+	var responseCode sql.NullInt64
+	if code != 0 {
+		responseCode = sql.NullInt64{Int64: int64(code), Valid: true}
+	}
+	var lastError sql.NullString
+	if err != nil {
+		lastError = sql.NullString{String: err.Error(), Valid: true}
+	}
+	if _, dbErr := n.db.Exec(common.MustGetSQL("notifications/update_delivery"), deliveryID, status, attempts, responseCode, lastError); dbErr != nil {
+		log.Printf("Failed to update notification delivery %d: %v", deliveryID, dbErr)
+	}
+}
+
+// eventForState maps an agent state to the notification event it triggers, if any
+func eventForState(state AgentState) string {
+	switch state {
+	case StateFinished:
+		return EventRunFinished
+	case StateError:
+		return EventRunError
+	case StateBlocked:
+		return EventRunBlocked
+	case StateAwaitingApproval:
+		return EventApprovalNeeded
+	}
+	return ""
+}
+
+// errPrivateWebhookTarget is returned for webhooks that would reach the server's own network
+var errPrivateWebhookTarget = errors.New("webhook URL must not point to a loopback, private or link-local address")
+
+// allowPrivateWebhooks reports whether AGENT_WEBHOOK_ALLOW_PRIVATE=1 lets webhooks reach internal addresses
+func allowPrivateWebhooks() bool {
+	return common.GetEnv("AGENT_WEBHOOK_ALLOW_PRIVATE") == "1"
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), private in practice but not to net.IP
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicWebhookIP reports whether an address may receive webhooks
+func publicWebhookIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || sharedAddressSpace.Contains(ip))
+}
+
+// validateWebhookURL checks that a webhook URL is absolute http(s) and that its host only resolves to public addresses
+func validateWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	if allowPrivateWebhooks() {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("cannot resolve webhook host %s", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !publicWebhookIP(addr.IP) {
+			return errPrivateWebhookTarget
+		}
+	}
+	return nil
+}
+
+// newWebhookClient returns the client webhooks are delivered with. Its connections check the address
+// after DNS resolution, so a host re-pointed at an internal address after the webhook was saved, or a
+// redirect to one, is refused too. Proxies are not used since they would hide the target address.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivateWebhooks() {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicWebhookIP(ip) {
+				return errPrivateWebhookTarget
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+// parseEventList parses a comma separated list of event names
+func parseEventList(events string) map[string]bool {
+	set := map[string]bool{}
+	for _, e := range strings.Split(events, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			set[e] = true
+		}
+	}
+	return set
+}
+
+// validWebhookEvents lists the events a webhook can subscribe to
+var validWebhookEvents = map[string]bool{
+	EventRunFinished: true, EventRunError: true, EventRunBlocked: true, EventApprovalNeeded: true, "*": true,
+}
+
+// listProjectWebhooks loads a project's webhooks
+func listProjectWebhooks(db *sql.DB, projectID int, activeOnly bool) ([]ProjectWebhook, error) {
+	queryName := "notifications/list_webhooks_by_project"
+	if activeOnly {
+		queryName = "notifications/list_active_webhooks_by_project"
+	}
+	rows, err := db.Query(common.MustGetSQL(queryName), projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []ProjectWebhook
+	for rows.Next() {
+		var hook ProjectWebhook
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.ProjectID, &hook.URL, &hook.Secret, &events, &hook.IsActive, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		for e := range parseEventList(events) {
+			hook.Events = append(hook.Events, e)
+		}
+		sort.Strings(hook.Events)
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
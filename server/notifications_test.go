@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/mailer"
+)
+
+// TestWebhookDeliveryRetriesAndSigns tests that webhooks are signed and retried on server errors
+func TestWebhookDeliveryRetriesAndSigns(t *testing.T) {
+	var calls int32
+	var lastSignature, lastTimestamp string
+	var lastBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		lastSignature = r.Header.Get(WebhookSignatureHeader)
+		lastTimestamp = r.Header.Get(WebhookTimestampHeader)
+		lastBody, _ = io.ReadAll(r.Body)
+		if r.Header.Get(WebhookEventHeader) != EventRunFinished {
+			t.Errorf("Unexpected event header: %s", r.Header.Get(WebhookEventHeader))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	n := &Notifier{client: server.Client(), maxAttempts: 5, backoff: time.Millisecond}
+	hook := ProjectWebhook{ID: 1, URL: server.URL, Secret: "s3cret", Events: []string{EventRunFinished}}
+	n.deliverWebhook(hook, AgentEvent{Event: EventRunFinished, Goal: "demo", State: StateFinished})
+
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", got)
+	}
+	if want := SignWebhookPayload("s3cret", lastTimestamp, lastBody); lastSignature != want {
+		t.Errorf("Signature mismatch: got %s, want %s", lastSignature, want)
+	}
+}
+
+// TestWebhookDeliveryStopsOnClientError tests that 4xx responses are not retried
+func TestWebhookDeliveryStopsOnClientError(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+
+	n := &Notifier{client: server.Client(), maxAttempts: 5, backoff: time.Millisecond}
+	n.deliverWebhook(ProjectWebhook{URL: server.URL, Secret: "x"}, AgentEvent{Event: EventRunError})
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected a single attempt, got %d", got)
+	}
+}
+
+// TestAgentNotifiesOnStateChange tests that finishing a run sends an email notification
+func TestAgentNotifiesOnStateChange(t *testing.T) {
+	mailer.TemplateDir = "../data/mail"
+	t.Cleanup(func() { mailer.TemplateDir = "" })
+
+	var sent []string
+	attempts := 0
+	n := &Notifier{
+		maxAttempts: 3,
+		backoff:     time.Millisecond,
+		emailEvents: parseEventList("finished,error"),
+		mail: mailer.MailerFunc(func(ctx context.Context, msg mailer.Message) error {
+			attempts++
+			if attempts == 1 {
+				return errors.New("smtp unavailable")
+			}
+			sent = append(sent, msg.To[0]+": "+msg.Subject)
+			return nil
+		}),
+	}
+
+	agent := &Agent{
+		Goal:          "say hi",
+		MaxIterations: 3,
+		State:         StateAwaitingStep,
+		Model:         &ScriptedModel{Responses: []string{"FINAL_ANSWER: hi"}},
+		WorkDir:       t.TempDir(),
+		Notifier:      n,
+		UserEmail:     "user@example.com",
+	}
+	if !agent.beginStep() {
+		t.Fatal("Expected step to start")
+	}
+	agent.runStep()
+	n.Wait()
+
+	if agent.State != StateFinished {
+		t.Fatalf("Expected Finished, got %s", agent.State)
+	}
+	if len(sent) != 1 || attempts != 2 || sent[0] != "user@example.com: [OpenAgent] Agent run finished" {
+		t.Errorf("Expected one email after one retry, got %v (%d attempts)", sent, attempts)
+	}
+}
+
+// TestApprovalNeededOnlyForPendingCommands tests that approval_needed fires when a command awaits approval, not on every step
+func TestApprovalNeededOnlyForPendingCommands(t *testing.T) {
+	if event := eventForState(StateAwaitingStep); event != "" {
+		t.Errorf("Expected no event between steps, got %q", event)
+	}
+
+	agent := &Agent{
+		Goal:            "list files",
+		MaxIterations:   3,
+		State:           StateAwaitingStep,
+		Model:           &ScriptedModel{Responses: []string{"COMMAND: ls", "FINAL_ANSWER: done"}},
+		WorkDir:         t.TempDir(),
+		RequireApproval: true,
+	}
+	if !agent.beginStep() {
+		t.Fatal("Expected step to start")
+	}
+	agent.runStep()
+	if agent.State != StateAwaitingApproval || agent.PendingAction != "COMMAND: ls" || eventForState(agent.State) != EventApprovalNeeded {
+		t.Fatalf("Expected the command to await approval, got %s with %q", agent.State, agent.PendingAction)
+	}
+
+	// The next step runs the approved command within the same iteration
+	if !agent.beginStep() {
+		t.Fatal("Expected the approval step to start")
+	}
+	agent.runStep()
+	if agent.State != StateAwaitingStep || agent.PendingAction != "" || agent.Iteration != 1 {
+		t.Errorf("Expected the command to run in iteration 1, got %s, %q, iteration %d", agent.State, agent.PendingAction, agent.Iteration)
+	}
+}
+
+// TestWebhookTargetsMustBePublic tests that webhooks to internal addresses are refused when saved and when delivered
+func TestWebhookTargetsMustBePublic(t *testing.T) {
+	for _, raw := range []string{"http://127.0.0.1/hook", "http://10.0.0.5/hook", "http://169.254.169.254/latest", "http://[::1]/hook", "http://100.64.1.1/", "ftp://example.com/"} {
+		if err := validateWebhookURL(context.Background(), raw); err == nil {
+			t.Errorf("Expected %s to be refused", raw)
+		}
+	}
+	if err := validateWebhookURL(context.Background(), "https://203.0.113.10/hook"); err != nil {
+		t.Errorf("Expected a public address to be accepted: %v", err)
+	}
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+	n := &Notifier{client: newWebhookClient(), maxAttempts: 1, backoff: time.Millisecond}
+	n.deliverWebhook(ProjectWebhook{URL: server.URL, Secret: "x"}, AgentEvent{Event: EventRunFinished})
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected the delivery to a loopback address to be refused, got %d requests", got)
+	}
+}
+
+// TestRunDeliveriesOwnership tests that a run's delivery log belongs to its ai.users owner,
+// not to a project directory account with the same ID
+func TestRunDeliveriesOwnership(t *testing.T) {
+	ctx := context.Background()
+	if !ownerOrManager(ctx, &auth.User{ID: 4}, 4, 0) {
+		t.Error("Expected the run's owner to see its deliveries")
+	}
+	if ownerOrManager(ctx, &auth.User{ID: 4, ProjectID: 9}, 4, 0) {
+		t.Error("Expected a directory account with the owner's ID to be refused")
+	}
+	if ownerOrManager(ctx, &auth.User{ID: 5}, 4, 0) {
+		t.Error("Expected another user to be refused")
+	}
+	if !ownerOrManager(ctx, &auth.User{ID: 5, IsAdmin: true}, 4, 0) {
+		t.Error("Expected instance admins to see any run's deliveries")
+	}
+}
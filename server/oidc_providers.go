@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// projectOIDCProviders offers the instance providers from OIDC_PROVIDERS plus those configured in
+// the request's project options; a project provider replaces an instance provider with the same ID.
+// Only instance administrators can set the option, as its providers log in to any ai.users account.
+type projectOIDCProviders struct{}
+
+// NewProjectOIDCProviders returns a provider source that includes per-project identity providers
+func NewProjectOIDCProviders() auth.OIDCProviderSource {
+	return projectOIDCProviders{}
+}
+
+func (projectOIDCProviders) OIDCProviders(r *http.Request) ([]auth.OIDCProviderConfig, error) {
+	providers, err := auth.InstanceOIDCProviders()
+	if err != nil {
+		return nil, err
+	}
+
+	project := projects.GetProjectFromContext(r.Context())
+	if project == nil || project.Options[projects.OptionOIDCProviders] == nil {
+		return providers, nil
+	}
+	// Options come back from JSONB as generic maps, so round-trip them into the config type
+	raw, err := json.Marshal(project.Options[projects.OptionOIDCProviders])
+	if err != nil {
+		return nil, err
+	}
+	var projectProviders []auth.OIDCProviderConfig
+	if err := json.Unmarshal(raw, &projectProviders); err != nil {
+		return nil, fmt.Errorf("invalid %s in project %d options: %w", projects.OptionOIDCProviders, project.ID, err)
+	}
+
+	merged := make([]auth.OIDCProviderConfig, 0, len(providers)+len(projectProviders))
+	for _, provider := range providers {
+		if !hasOIDCProvider(projectProviders, provider.ID) {
+			merged = append(merged, provider)
+		}
+	}
+	return append(merged, projectProviders...), nil
+}
+
+// hasOIDCProvider reports whether a provider with the ID is in the list
+func hasOIDCProvider(providers []auth.OIDCProviderConfig, id string) bool {
+	for _, provider := range providers {
+		if provider.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// TestProjectOIDCProviders tests that project providers are added to, and override, the instance providers
+func TestProjectOIDCProviders(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", `[{"id":"google","name":"Google","issuer":"https://accounts.google.com","client_id":"instance"},{"id":"corp","issuer":"https://old.example","client_id":"instance"}]`)
+	source := NewProjectOIDCProviders()
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/providers", nil)
+	providers, err := source.OIDCProviders(req)
+	if err != nil || len(providers) != 2 {
+		t.Fatalf("Expected the two instance providers without a project, got %+v, %v", providers, err)
+	}
+
+	project := &projects.Project{ID: 5, Options: projects.ProjectOptions{
+		"oidc_providers": []interface{}{
+			map[string]interface{}{"id": "corp", "name": "Corp SSO", "issuer": "https://sso.corp.example", "client_id": "project"},
+			map[string]interface{}{"id": "okta", "issuer": "https://corp.okta.com", "client_id": "project"},
+		},
+	}}
+	req = req.WithContext(projects.SetProjectContext(req.Context(), project))
+	providers, err = source.OIDCProviders(req)
+	if err != nil || len(providers) != 3 {
+		t.Fatalf("Expected google plus the two project providers, got %+v, %v", providers, err)
+	}
+	for _, provider := range providers {
+		if provider.ID == "corp" && (provider.Issuer != "https://sso.corp.example" || provider.ClientID != "project") {
+			t.Errorf("Expected the project's corp provider to replace the instance one, got %+v", provider)
+		}
+	}
+}
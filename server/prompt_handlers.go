@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// SavePromptRequest is the body for creating or updating a prompt template
+type SavePromptRequest struct {
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Body        string `json:"body"`
+	Description string `json:"description"`
+	Scope       string `json:"scope"`                // system, project or user
+	ProjectID   int    `json:"project_id,omitempty"` // Required for project scope
+}
+
+// CreatePromptsAPIHandler creates a handler for the prompt library API
+func CreatePromptsAPIHandler(projectService projects.ProjectService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandlePromptsAPI(w, r, NewPromptLibrary(GetDB()), projectService)
+	}
+}
+
+// HandlePromptsAPI lists (GET), saves (POST) and deletes (DELETE) prompt templates.
+// System templates are managed by admins, project templates by the project's editors, admins and owners,
+// and user templates by the user themselves.
+func HandlePromptsAPI(w http.ResponseWriter, r *http.Request, library *PromptLibrary, projectService projects.ProjectService) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		scope := PromptScope{UserID: instanceUserID(user)}
+		if projectID, _ := strconv.Atoi(r.URL.Query().Get("project_id")); projectID != 0 {
+			if !projectAllows(r.Context(), user, projectID, projects.PermView) {
+				common.JSONError(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			scope.ProjectID = projectID
+		} else if project := projects.GetProjectFromContext(r.Context()); project != nil {
+			scope.ProjectID = int(project.ID)
+		}
+		templates, err := library.List(r.URL.Query().Get("kind"), scope)
+		if err != nil {
+			common.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		common.JSONResponse(w, templates)
+
+	case http.MethodPost:
+		var req SavePromptRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			common.JSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		scopeID, status, msg := promptScopeID(r.Context(), user, req.Scope, req.ProjectID)
+		if status != 0 {
+			common.JSONError(w, msg, status)
+			return
+		}
+		tpl, err := library.Save(PromptTemplate{
+			Kind:        req.Kind,
+			Name:        req.Name,
+			Body:        req.Body,
+			Description: req.Description,
+			Scope:       req.Scope,
+			ScopeID:     scopeID,
+		}, user.ID)
+		if err == ErrPromptConflict {
+			common.JSONError(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			common.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Prompt %s/%s saved in %s scope by %s (version %d)", tpl.Kind, tpl.Name, tpl.Scope, user.Email, tpl.Version)
+		common.JSONResponse(w, tpl)
+
+	case http.MethodDelete:
+		query := r.URL.Query()
+		projectID, _ := strconv.Atoi(query.Get("project_id"))
+		scopeID, status, msg := promptScopeID(r.Context(), user, query.Get("scope"), projectID)
+		if status != 0 {
+			common.JSONError(w, msg, status)
+			return
+		}
+		err := library.Delete(query.Get("kind"), query.Get("name"), query.Get("scope"), scopeID)
+		if err == ErrPromptNotFound {
+			common.JSONError(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			common.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		common.JSONResponse(w, map[string]bool{"success": true})
+
+	default:
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// promptScopeID checks the user may write to scope and returns its scope id.
+// A non-zero status means the request must be rejected with msg.
+func promptScopeID(ctx context.Context, user *auth.User, scope string, projectID int) (*int, int, string) {
+	switch scope {
+	case "system":
+		if !user.IsAdmin {
+			return nil, http.StatusForbidden, "Only admins can manage system prompts"
+		}
+		return nil, 0, ""
+	case "project":
+		if projectID == 0 {
+			return nil, http.StatusBadRequest, "project_id is required for project prompts"
+		}
+		if !projectAllows(ctx, user, projectID, projects.PermEdit) {
+			return nil, http.StatusForbidden, "Only project editors, admins and owners can manage project prompts"
+		}
+		return &projectID, 0, ""
+	case "user":
+		id := instanceUserID(user)
+		if id == 0 {
+			return nil, http.StatusForbidden, "Not available for project accounts"
+		}
+		return &id, 0, ""
+	default:
+		return nil, http.StatusBadRequest, "scope must be system, project or user"
+	}
+}
+
+// projectAllows reports whether the user's role in the project grants the permission.
+// Instance admins are allowed everything.
+func projectAllows(ctx context.Context, user *auth.User, projectID int, perm projects.Permission) bool {
+	allowed, err := projects.Can(ctx, user, int64(projectID), perm)
+	if err != nil {
+		log.Printf("Error checking permission on project %d for %s: %v", projectID, user.Email, err)
+		return false
+	}
+	return allowed
+}
+
+// instanceUserID returns the user's ai.users ID, or 0 for a project directory account.
+// Directory account IDs come from the project's own users table and may equal an unrelated ai.users ID,
+// so they must never be used to find rows owned by a user.
+func instanceUserID(user *auth.User) int {
+	if user == nil || user.ProjectID != 0 {
+		return 0
+	}
+	return user.ID
+}
+
+// ownerOrManager reports whether the user may review a record owned by ownerID in projectID:
+// its ai.users owner, a manager of its project or an instance admin.
+func ownerOrManager(ctx context.Context, user *auth.User, ownerID, projectID int) bool {
+	if userID := instanceUserID(user); userID != 0 && ownerID == userID {
+		return true
+	}
+	return user.IsAdmin || (projectID != 0 && projectAllows(ctx, user, projectID, projects.PermManage))
+}
+
+// requireInstanceAccount returns the logged-in user when it is an ai.users account and writes the error response otherwise
+func requireInstanceAccount(w http.ResponseWriter, r *http.Request) (*auth.User, bool) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if user.ProjectID != 0 {
+		common.JSONError(w, "Not available for project accounts", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// promptScopeFromRequest builds the lookup scope for the logged-in user and current project.
+// An explicit project_id is only honoured for users allowed to manage that project's prompts.
+func promptScopeFromRequest(r *http.Request) PromptScope {
+	var scope PromptScope
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		return scope
+	}
+	scope.UserID = instanceUserID(user)
+
+	if project := projects.GetProjectFromContext(r.Context()); project != nil {
+		scope.ProjectID = int(project.ID)
+	} else if projectID, _ := strconv.Atoi(r.FormValue("project_id")); projectID != 0 {
+		if projectAllows(r.Context(), user, projectID, projects.PermView) {
+			scope.ProjectID = projectID
+		}
+	}
+	return scope
+}
+
+// recordAgentRun stores which prompt versions a run uses. Returns 0 when the run could not be recorded.
+func recordAgentRun(db *sql.DB, scope PromptScope, goal, model string, refs AgentPromptRefs) int64 {
+	if db == nil {
+		return 0
+	}
+	var userID, projectID sql.NullInt64
+	if scope.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(scope.UserID), Valid: true}
+	}
+	if scope.ProjectID != 0 {
+		projectID = sql.NullInt64{Int64: int64(scope.ProjectID), Valid: true}
+	}
+
+	var runID int64
+	err := db.QueryRow(common.MustGetSQL("agent_runs/create"),
+		userID, projectID, goal, model,
+		refs.System.Name, refs.System.Scope, refs.System.Version,
+		refs.Goal.Name, refs.Goal.Scope, refs.Goal.Version,
+	).Scan(&runID)
+	if err != nil {
+		log.Printf("Failed to record agent run: %v", err)
+		return 0
+	}
+	log.Printf("Agent run %d started with system prompt %s v%d and goal template %s v%d",
+		runID, refs.System.Name, refs.System.Version, refs.Goal.Name, refs.Goal.Version)
+	return runID
+}
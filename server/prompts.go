@@ -0,0 +1,398 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// Prompt kinds stored in the prompt library
+const (
+	PromptKindSystem = "system" // System message for the agent
+	PromptKindGoal   = "goal"   // First user message of a run
+
+	DefaultPromptName = "default"
+	promptKeyPrefix   = "agent.prompt."
+	promptScopeBuilt  = "builtin"
+)
+
+// defaultSystemPrompt is the built-in system prompt. Variables: goal, workdir, datetime.
+const defaultSystemPrompt = `You are an autonomous AI agent running inside a restricted Docker container. Your goal is: {{goal}}
+You can execute shell commands on the Linux system within the container to achieve the goal.
+IMPORTANT: All file operations and commands that create output should target the '{{workdir}}' directory. Do NOT attempt to write outside this directory. For example, use 'ls {{workdir}}', 'mkdir {{workdir}}/newdir', 'echo "hello" > {{workdir}}/file.txt'.
+Dangerous commands (like rm, dd, mkfs, shutdown, direct redirection overwrite > outside {{workdir}}) are blocked. Use pipes | carefully.
+Think step-by-step. Plan your actions.
+Based on the history and the goal, decide the single next best shell command to execute.
+Respond ONLY in one of the following two formats:
+1. To execute a command: COMMAND: <command_to_execute> (Ensure paths are within {{workdir}} where appropriate)
+2. To provide the final answer: FINAL_ANSWER: <your_final_answer>
+
+Do NOT provide explanations, apologies, or any text other than the chosen format.
+If a command is blocked, analyze the error and try a different, safe approach within '{{workdir}}'.
+Use 'tee {{workdir}}/...' or '>> {{workdir}}/...' for writing files safely. Avoid '>' if possible, especially outside {{workdir}}.
+If the goal is achieved, provide the FINAL_ANSWER.
+Current Date/Time: {{datetime}}`
+
+// defaultGoalTemplate is the built-in first user message. Variables: goal, workdir.
+const defaultGoalTemplate = `My goal is: {{goal}}. What is the first safe shell command I should execute within the '{{workdir}}' directory?`
+
+// ErrPromptNotFound is returned when no template matches a kind and name
+var ErrPromptNotFound = errors.New("prompt template not found")
+
+// ErrPromptConflict is returned when a template was changed by someone else while it was being saved
+var ErrPromptConflict = errors.New("prompt template was changed by someone else; reload it and try again")
+
+var (
+	promptVarPattern  = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+	promptNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+// PromptTemplate is a named system prompt or goal template.
+type PromptTemplate struct {
+	Kind        string   `json:"kind"`
+	Name        string   `json:"name"`
+	Body        string   `json:"body"`
+	Description string   `json:"description,omitempty"`
+	Version     int      `json:"version"`
+	Scope       string   `json:"scope"` // system, project, user or builtin
+	ScopeID     *int     `json:"scope_id,omitempty"`
+	UpdatedBy   int      `json:"updated_by,omitempty"`
+	UpdatedAt   string   `json:"updated_at,omitempty"`
+	Variables   []string `json:"variables"`
+}
+
+// promptValue is the JSON stored in ai.settings.value for a template
+type promptValue struct {
+	Body        string `json:"body"`
+	Description string `json:"description,omitempty"`
+	Version     int    `json:"version"`
+	UpdatedBy   int    `json:"updated_by,omitempty"`
+}
+
+// PromptScope identifies the user and project a lookup is made for. Zero values mean none.
+type PromptScope struct {
+	UserID    int
+	ProjectID int
+}
+
+// AgentPromptRef records which template version a run used.
+type AgentPromptRef struct {
+	Name    string `json:"name"`
+	Scope   string `json:"scope"`
+	ScopeID *int   `json:"scope_id,omitempty"`
+	Version int    `json:"version"`
+}
+
+// AgentPromptRefs holds the system prompt and goal template a run used.
+type AgentPromptRefs struct {
+	System AgentPromptRef `json:"system"`
+	Goal   AgentPromptRef `json:"goal"`
+}
+
+// Ref returns the reference recorded for a run.
+func (t PromptTemplate) Ref() AgentPromptRef {
+	return AgentPromptRef{Name: t.Name, Scope: t.Scope, ScopeID: t.ScopeID, Version: t.Version}
+}
+
+// PromptLibrary stores prompt templates in the settings table.
+type PromptLibrary struct {
+	settings *SettingsService
+}
+
+// NewPromptLibrary creates a PromptLibrary. With a nil db only the built-in templates are available.
+func NewPromptLibrary(db *sql.DB) *PromptLibrary {
+	if db == nil {
+		return &PromptLibrary{}
+	}
+	return &PromptLibrary{settings: NewSettingsService(db)}
+}
+
+// RenderPromptTemplate replaces {{variables}} in body. Unknown variables are left empty and reported.
+func RenderPromptTemplate(body string, vars map[string]string) (string, []string) {
+	var missing []string
+	seen := map[string]bool{}
+	rendered := promptVarPattern.ReplaceAllStringFunc(body, func(match string) string {
+		name := promptVarPattern.FindStringSubmatch(match)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		if !seen[name] {
+			seen[name] = true
+			missing = append(missing, name)
+		}
+		return ""
+	})
+	return rendered, missing
+}
+
+// PromptVariables lists the distinct variables used in a template body, in order of appearance.
+func PromptVariables(body string) []string {
+	vars := []string{}
+	seen := map[string]bool{}
+	for _, match := range promptVarPattern.FindAllStringSubmatch(body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			vars = append(vars, match[1])
+		}
+	}
+	return vars
+}
+
+// builtinPrompt returns the built-in template for a kind
+func builtinPrompt(kind string) PromptTemplate {
+	body, description := defaultSystemPrompt, "Built-in system prompt"
+	if kind == PromptKindGoal {
+		body, description = defaultGoalTemplate, "Built-in goal template"
+	}
+	return PromptTemplate{
+		Kind:        kind,
+		Name:        DefaultPromptName,
+		Body:        body,
+		Description: description,
+		Scope:       promptScopeBuilt,
+		Variables:   PromptVariables(body),
+	}
+}
+
+// promptKey builds the settings key for a template
+func promptKey(kind, name string) string {
+	return promptKeyPrefix + kind + "." + name
+}
+
+// validatePromptKind checks the kind is one the library knows
+func validatePromptKind(kind string) error {
+	if kind != PromptKindSystem && kind != PromptKindGoal {
+		return fmt.Errorf("invalid prompt kind %q (expected %q or %q)", kind, PromptKindSystem, PromptKindGoal)
+	}
+	return nil
+}
+
+// promptScopeCandidate is one settings scope searched during Resolve
+type promptScopeCandidate struct {
+	scope string
+	id    *int
+}
+
+// scopeCandidates lists the scopes to search, most specific first
+func (s PromptScope) scopeCandidates() []promptScopeCandidate {
+	var candidates []promptScopeCandidate
+	if s.UserID != 0 {
+		id := s.UserID
+		candidates = append(candidates, promptScopeCandidate{"user", &id})
+	}
+	if s.ProjectID != 0 {
+		id := s.ProjectID
+		candidates = append(candidates, promptScopeCandidate{"project", &id})
+	}
+	return append(candidates, promptScopeCandidate{"system", nil})
+}
+
+// Resolve finds the template visible to scope, preferring user over project over system over built-in.
+// An empty name resolves to the default template.
+func (l *PromptLibrary) Resolve(kind, name string, scope PromptScope) (PromptTemplate, error) {
+	if err := validatePromptKind(kind); err != nil {
+		return PromptTemplate{}, err
+	}
+	if name == "" {
+		name = DefaultPromptName
+	}
+
+	if l.settings != nil {
+		for _, candidate := range scope.scopeCandidates() {
+			setting, err := l.settings.GetSetting(promptKey(kind, name), candidate.scope, candidate.id)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return PromptTemplate{}, fmt.Errorf("failed to load prompt %s/%s: %w", kind, name, err)
+			}
+			return promptFromSetting(kind, name, setting)
+		}
+	}
+
+	if name == DefaultPromptName {
+		return builtinPrompt(kind), nil
+	}
+	return PromptTemplate{}, ErrPromptNotFound
+}
+
+// List returns the templates visible to scope. When several scopes define the same name, the most specific wins.
+func (l *PromptLibrary) List(kind string, scope PromptScope) ([]PromptTemplate, error) {
+	kinds := []string{PromptKindSystem, PromptKindGoal}
+	if kind != "" {
+		if err := validatePromptKind(kind); err != nil {
+			return nil, err
+		}
+		kinds = []string{kind}
+	}
+
+	byKey := map[string]PromptTemplate{}
+	rank := map[string]int{}
+	for _, k := range kinds {
+		byKey[k+"."+DefaultPromptName] = builtinPrompt(k)
+		rank[k+"."+DefaultPromptName] = 0
+	}
+
+	if l.settings != nil {
+		settings, err := l.settings.ListSettingsByPrefix(promptKeyPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list prompts: %w", err)
+		}
+		for _, setting := range settings {
+			k, name, ok := strings.Cut(strings.TrimPrefix(setting.Key, promptKeyPrefix), ".")
+			if !ok || validatePromptKind(k) != nil || (kind != "" && k != kind) {
+				continue
+			}
+			r := promptScopeRank(setting, scope)
+			if r == 0 || r <= rank[k+"."+name] {
+				continue
+			}
+			tpl, err := promptFromSetting(k, name, setting)
+			if err != nil {
+				return nil, err
+			}
+			byKey[k+"."+name] = tpl
+			rank[k+"."+name] = r
+		}
+	}
+
+	templates := make([]PromptTemplate, 0, len(byKey))
+	for _, tpl := range byKey {
+		templates = append(templates, tpl)
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Kind != templates[j].Kind {
+			return templates[i].Kind < templates[j].Kind
+		}
+		return templates[i].Name < templates[j].Name
+	})
+	return templates, nil
+}
+
+// promptScopeRank orders settings by how specific they are to scope. 0 means not visible.
+func promptScopeRank(setting Setting, scope PromptScope) int {
+	switch setting.Scope {
+	case "system":
+		return 1
+	case "project":
+		if setting.ScopeID != nil && scope.ProjectID != 0 && *setting.ScopeID == scope.ProjectID {
+			return 2
+		}
+	case "user":
+		if setting.ScopeID != nil && scope.UserID != 0 && *setting.ScopeID == scope.UserID {
+			return 3
+		}
+	}
+	return 0
+}
+
+// Save creates or updates a template in its scope and bumps its version.
+// It returns ErrPromptConflict when the template changed while it was being saved.
+func (l *PromptLibrary) Save(tpl PromptTemplate, updatedBy int) (PromptTemplate, error) {
+	if l.settings == nil {
+		return PromptTemplate{}, errors.New("prompt library requires a database")
+	}
+	if err := validatePromptKind(tpl.Kind); err != nil {
+		return PromptTemplate{}, err
+	}
+	if !promptNamePattern.MatchString(tpl.Name) {
+		return PromptTemplate{}, fmt.Errorf("invalid prompt name %q: use lowercase letters, digits, '-' or '_'", tpl.Name)
+	}
+	if strings.TrimSpace(tpl.Body) == "" {
+		return PromptTemplate{}, errors.New("prompt body cannot be empty")
+	}
+	if tpl.Scope != "system" && tpl.Scope != "project" && tpl.Scope != "user" {
+		return PromptTemplate{}, fmt.Errorf("invalid prompt scope %q", tpl.Scope)
+	}
+	if tpl.Scope == "system" {
+		tpl.ScopeID = nil
+	} else if tpl.ScopeID == nil {
+		return PromptTemplate{}, fmt.Errorf("%s scoped prompts need a scope id", tpl.Scope)
+	}
+
+	key := promptKey(tpl.Kind, tpl.Name)
+	version := 1
+	existing, err := l.settings.GetSetting(key, tpl.Scope, tpl.ScopeID)
+	found := err == nil
+	if found {
+		if current, err := promptFromSetting(tpl.Kind, tpl.Name, existing); err == nil {
+			version = current.Version + 1
+		}
+	} else if err != sql.ErrNoRows {
+		return PromptTemplate{}, fmt.Errorf("failed to load prompt %s/%s: %w", tpl.Kind, tpl.Name, err)
+	}
+
+	value, err := json.Marshal(promptValue{
+		Body:        tpl.Body,
+		Description: tpl.Description,
+		Version:     version,
+		UpdatedBy:   updatedBy,
+	})
+	if err != nil {
+		return PromptTemplate{}, err
+	}
+	// Only write over the value read above, so two concurrent saves cannot both claim the same version
+	var result sql.Result
+	if found {
+		result, err = l.settings.db.Exec(common.MustGetSQL("settings/compare_and_swap"), key, tpl.Scope, tpl.ScopeID, string(value), existing.Value)
+	} else {
+		result, err = l.settings.db.Exec(common.MustGetSQL("settings/create_if_absent"), key, string(value), tpl.Scope, tpl.ScopeID)
+	}
+	if err != nil {
+		return PromptTemplate{}, fmt.Errorf("failed to save prompt %s/%s: %w", tpl.Kind, tpl.Name, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return PromptTemplate{}, ErrPromptConflict
+	}
+
+	tpl.Version = version
+	tpl.UpdatedBy = updatedBy
+	tpl.UpdatedAt = time.Now().Format(time.RFC3339)
+	tpl.Variables = PromptVariables(tpl.Body)
+	return tpl, nil
+}
+
+// Delete removes a template from a scope
+func (l *PromptLibrary) Delete(kind, name, scope string, scopeID *int) error {
+	if l.settings == nil {
+		return errors.New("prompt library requires a database")
+	}
+	if err := validatePromptKind(kind); err != nil {
+		return err
+	}
+	result, err := l.settings.db.Exec(common.MustGetSQL("settings/delete_by_key_and_scope"), promptKey(kind, name), scope, scopeID)
+	if err != nil {
+		return fmt.Errorf("failed to delete prompt %s/%s: %w", kind, name, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrPromptNotFound
+	}
+	return nil
+}
+
+// promptFromSetting decodes a settings row into a template
+func promptFromSetting(kind, name string, setting Setting) (PromptTemplate, error) {
+	var value promptValue
+	if err := json.Unmarshal([]byte(setting.Value), &value); err != nil {
+		return PromptTemplate{}, fmt.Errorf("invalid prompt %s/%s in settings: %w", kind, name, err)
+	}
+	return PromptTemplate{
+		Kind:        kind,
+		Name:        name,
+		Body:        value.Body,
+		Description: value.Description,
+		Version:     value.Version,
+		Scope:       setting.Scope,
+		ScopeID:     setting.ScopeID,
+		UpdatedBy:   value.UpdatedBy,
+		UpdatedAt:   setting.UpdatedAt,
+		Variables:   PromptVariables(value.Body),
+	}, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/scriptmaster/openagent/auth"
+)
+
+// TestRenderPromptTemplate tests variable substitution and missing variable reporting
+func TestRenderPromptTemplate(t *testing.T) {
+	rendered, missing := RenderPromptTemplate("Count lines in {{file}} and write {{ output }}, not {{other}} or {{other}}", map[string]string{
+		"file":   "input.txt",
+		"output": "report.txt",
+	})
+
+	if rendered != "Count lines in input.txt and write report.txt, not  or " {
+		t.Errorf("Unexpected rendered template: %q", rendered)
+	}
+	if !reflect.DeepEqual(missing, []string{"other"}) {
+		t.Errorf("Expected missing [other], got %v", missing)
+	}
+
+	if vars := PromptVariables(defaultGoalTemplate); !reflect.DeepEqual(vars, []string{"goal", "workdir"}) {
+		t.Errorf("Expected goal template variables [goal workdir], got %v", vars)
+	}
+}
+
+// TestPromptLibraryBuiltins tests that the library falls back to built-in templates without a database
+func TestPromptLibraryBuiltins(t *testing.T) {
+	library := NewPromptLibrary(nil)
+
+	tpl, err := library.Resolve(PromptKindSystem, "", PromptScope{UserID: 1})
+	if err != nil {
+		t.Fatalf("Failed to resolve default system prompt: %v", err)
+	}
+	if tpl.Scope != "builtin" || tpl.Version != 0 || tpl.Body != defaultSystemPrompt {
+		t.Errorf("Expected built-in system prompt, got scope %s version %d", tpl.Scope, tpl.Version)
+	}
+
+	if _, err := library.Resolve(PromptKindGoal, "missing", PromptScope{}); err != ErrPromptNotFound {
+		t.Errorf("Expected ErrPromptNotFound, got %v", err)
+	}
+	if _, err := library.Resolve("bogus", "", PromptScope{}); err == nil {
+		t.Error("Expected an error for an unknown prompt kind")
+	}
+
+	templates, err := library.List("", PromptScope{})
+	if err != nil {
+		t.Fatalf("Failed to list prompts: %v", err)
+	}
+	if len(templates) != 2 || templates[0].Kind != PromptKindGoal || templates[1].Kind != PromptKindSystem {
+		t.Errorf("Expected built-in goal and system templates, got %+v", templates)
+	}
+}
+
+// TestAgentUsesSystemPromptTemplate tests that the agent renders its configured system prompt
+func TestAgentUsesSystemPromptTemplate(t *testing.T) {
+	agent := &Agent{Goal: "tidy up", WorkDir: "/work", SystemPrompt: "Goal={{goal}} Dir={{workdir}}"}
+	if got := agent.buildSystemPrompt(); got != "Goal=tidy up Dir=/work" {
+		t.Errorf("Unexpected system prompt: %q", got)
+	}
+
+	agent.SystemPrompt = ""
+	if got := agent.buildSystemPrompt(); !strings.Contains(got, "Your goal is: tidy up") || !strings.Contains(got, "'/work'") {
+		t.Errorf("Default system prompt not rendered: %q", got)
+	}
+}
+
+// TestPromptScopeDirectoryAccounts tests that project directory accounts never read or write
+// the user prompts of the ai.users account with the same ID
+func TestPromptScopeDirectoryAccounts(t *testing.T) {
+	directory := &auth.User{ID: 1, Email: "eve@example.com", ProjectID: 9}
+
+	if _, status, _ := promptScopeID(context.Background(), directory, "user", 0); status != http.StatusForbidden {
+		t.Errorf("Expected user prompts to be refused to a directory account, got status %d", status)
+	}
+	if id, status, _ := promptScopeID(context.Background(), &auth.User{ID: 1}, "user", 0); status != 0 || id == nil || *id != 1 {
+		t.Errorf("Expected the instance account's user scope, got %v (status %d)", id, status)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/prompts", nil)
+	req = req.WithContext(auth.SetUserContext(req.Context(), directory))
+	if scope := promptScopeFromRequest(req); scope.UserID != 0 {
+		t.Errorf("Expected no user scope for a directory account, got user %d", scope.UserID)
+	}
+}
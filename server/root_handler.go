@@ -103,6 +103,7 @@ func HandleIndexPage(w http.ResponseWriter, r *http.Request) {
 	templateData := map[string]interface{}{
 		"AppName":    "OpenAgent",
 		"AppVersion": AppVersion,
+		"CSRFToken":  auth.CSRFToken(r.Context()),
 		"User":       user,
 	}
 
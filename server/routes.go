@@ -9,7 +9,7 @@ import (
 )
 
 // RegisterRoutes sets up all the application routes
-func RegisterRoutes(router *http.ServeMux, userService auth.UserServicer, salt string) {
+func RegisterRoutes(router *http.ServeMux, userService auth.UserServicer) {
 	db := GetDB()
 	services := GetServices(db)
 
@@ -29,12 +29,34 @@ func RegisterRoutes(router *http.ServeMux, userService auth.UserServicer, salt s
 	// Order: auth, projects, admin
 	auth.RegisterAuthRoutes(router, globalTemplates, userService)
 	projects.RegisterProjectRoutes(router, globalTemplates, userService, services.DB, services.PDBService)
-	admin.RegisterAdminRoutes(router, globalTemplates, auth.IsMaintenanceAuthenticated, UpdateDatabaseConfig, InitDB, salt, GetDB, GetAdminStats)
+	admin.RegisterAdminRoutes(router, globalTemplates, auth.IsMaintenanceAuthenticated, UpdateDatabaseConfig, InitDB, GetDB, GetAdminStats)
 
 	// Protected routes
 	router.Handle("/dashboard", auth.AuthMiddleware(http.HandlerFunc(CreateDashboardHandler(services.ProjectService))))
 	router.Handle("/voice", auth.AuthMiddleware(http.HandlerFunc(CreateVoiceHandler())))
 	router.Handle("/agent", auth.AuthMiddleware(http.HandlerFunc(CreateAgentHandler())))
+	router.Handle("/start", auth.AuthMiddleware(http.HandlerFunc(HandleStart)))
+	router.Handle("/next", auth.AuthMiddleware(http.HandlerFunc(HandleNextStep)))
+	router.Handle("/status", auth.AuthMiddleware(http.HandlerFunc(HandleStatus)))
+	router.Handle("/api/agent/prompts", auth.AuthMiddleware(http.HandlerFunc(CreatePromptsAPIHandler(services.ProjectService))))
+	router.Handle("/api/agent/webhooks", auth.AuthMiddleware(http.HandlerFunc(CreateWebhooksAPIHandler(services.ProjectService))))
+	router.Handle("/api/agent/deliveries", auth.AuthMiddleware(http.HandlerFunc(CreateDeliveriesAPIHandler(services.ProjectService))))
+
+	// Account lifecycle for administrators
+	if db != nil {
+		accounts := NewAccountService(db)
+		router.Handle("/admin/users", auth.AuthMiddleware(auth.IsAdminMiddleware(CreateAccountsHandler(accounts))))
+		router.Handle("/admin/users/deactivate", auth.AuthMiddleware(auth.IsAdminMiddleware(CreateAccountActionHandler(accounts, "deactivate"))))
+		router.Handle("/admin/users/reactivate", auth.AuthMiddleware(auth.IsAdminMiddleware(CreateAccountActionHandler(accounts, "reactivate"))))
+		router.Handle("/admin/users/delete", auth.AuthMiddleware(auth.IsAdminMiddleware(CreateAccountActionHandler(accounts, "delete"))))
+		router.Handle("/admin/users/export", auth.AuthMiddleware(auth.IsAdminMiddleware(CreateAccountExportHandler(accounts))))
+	}
+
+	voice := NewVoiceServiceFromEnv(db)
+	router.Handle("/api/voice/turn", auth.AuthMiddleware(http.HandlerFunc(CreateVoiceAPIHandler(voice))))
+	router.Handle("/api/voice/reset", auth.AuthMiddleware(http.HandlerFunc(CreateVoiceResetHandler(voice))))
+	router.Handle("/api/voice/conversations", auth.AuthMiddleware(http.HandlerFunc(CreateVoiceTranscriptsHandler(services.ProjectService))))
+	router.Handle("/api/data/ask", auth.AuthMiddleware(http.HandlerFunc(CreateAskDataHandler(NewNLSQLServiceFromEnv(db), services.ProjectService))))
 
 	// Public routes
 	router.HandleFunc("/version", CreateVersionHandler())
@@ -12,8 +12,9 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/joho/godotenv" // Keep godotenv for loading .env
 
-	// Keep auth for UserService
+	"github.com/scriptmaster/openagent/auth"
 	"github.com/scriptmaster/openagent/common" // Updated import path
+	"github.com/scriptmaster/openagent/projects"
 )
 
 // Application version - hardcoded for deployment tracking
@@ -71,6 +72,28 @@ func StartServer() error {
 		log.Println("Continuing server start in maintenance mode...")
 	}
 
+	// Keep OTP codes, sessions, 2FA enrolments, passkeys, API tokens, signing keys, the audit log, project roles and invitations in the database so they survive restarts and work across instances
+	if db != nil {
+		auth.SetOTPStore(auth.NewPostgresOTPStore(db))
+		auth.SetSessionStore(auth.NewPostgresSessionStore(db))
+		auth.SetTwoFactorStore(auth.NewPostgresTwoFactorStore(db))
+		auth.SetWebAuthnStore(auth.NewPostgresWebAuthnStore(db))
+		auth.SetAPITokenStore(auth.NewPostgresAPITokenStore(db))
+		auth.SetSigningKeyStore(auth.NewPostgresSigningKeyStore(db))
+		auth.SetAuditStore(auth.NewPostgresAuditStore(db))
+		projects.SetMemberStore(projects.NewPostgresMemberStore(db))
+		projects.SetInvitationStore(projects.NewPostgresInvitationStore(db))
+		auth.SetTwoFactorPolicy(NewSettingsTwoFactorPolicy(NewSettingsService(db)))
+		auth.SetAccountStatusSource(NewAccountService(db)) // Refuse deactivated and deleted accounts
+	}
+	auth.SetOIDCProviderSource(NewProjectOIDCProviders())
+	auth.SetLDAPSource(NewProjectLDAP())
+	auth.SetWebAuthnRPSource(NewProjectWebAuthn())
+	auth.SetTrustedHostSource(NewProjectHosts())
+	auth.StartOTPSweeper(time.Minute)
+	auth.StartSessionSweeper(time.Hour)
+	auth.StartSigningKeyRotation(time.Hour)
+
 	// Initialize the 3 services
 	pdbService := NewProjectDBService(db)
 	dataService := NewDirectDataService(db)
@@ -86,7 +109,7 @@ func StartServer() error {
 	   }
 	*/
 
-	// Load session salt (used by auth middleware/routes)
+	// Check the session salt
 	salt := common.GetEnvOrDefault("SESSION_SALT", "DEFAULT-SALT-72815ECE-99A4-45FD-98C0-38D9EE04813F")
 	if salt == "DEFAULT-SALT-72815ECE-99A4-45FD-98C0-38D9EE04813F" {
 		log.Println("WARNING: Using default insecure session salt. Set SESSION_SALT environment variable.")
@@ -100,9 +123,9 @@ func StartServer() error {
 
 	log.Printf("\t → 6. Registering Routes")
 	// Register all routes (uses RegisterRoutes from the server package)
-	// Pass the initialized userService and salt.
+	// Pass the initialized userService.
 	// Other services (db, templates, projectService, etc.) will be initialized *within* RegisterRoutes.
-	RegisterRoutes(router, userService, salt)
+	RegisterRoutes(router, userService)
 
 	// Start file watching for development if DEBUG_FILE_WATCH is enabled
 	if common.GetEnvOrDefault("DEBUG_FILE_WATCH", "0") == "1" {
@@ -114,7 +137,15 @@ func StartServer() error {
 	log.Printf("--- Server (Version %s) Starting ---", AppVersion)
 	log.Println("Server starting on " + startAddress)
 
-	if err := http.ListenAndServe(startAddress, router); err != nil {
+	// Resolve the host's project before any handler runs, so logins go to its user directory
+	var handler http.Handler = router
+	if db != nil {
+		handler = ProjectContextMiddleware(router, GetServices(db).ProjectService, userService)
+	}
+	// Refuse cross-site form posts and requests riding on the session cookie
+	handler = auth.CSRFMiddleware(handler)
+
+	if err := http.ListenAndServe(startAddress, handler); err != nil {
 		return err
 	}
 
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// projectHosts trusts the domain of the request's project for links. ProjectContextMiddleware only
+// puts a project in the context when the host is one of its domains.
+type projectHosts struct{}
+
+// NewProjectHosts returns a trusted host source accepting project domains
+func NewProjectHosts() auth.TrustedHostSource {
+	return projectHosts{}
+}
+
+func (projectHosts) TrustedHost(r *http.Request, host string) bool {
+	project := projects.GetProjectFromContext(r.Context())
+	return project != nil && strings.EqualFold(project.Domain, host)
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+)
+
+// requireAdminTwoFactorKey is the system setting that makes 2FA mandatory for admins
+const requireAdminTwoFactorKey = "auth.require_admin_2fa"
+
+// settingsTwoFactorPolicy stores the admin 2FA requirement as a system setting,
+// falling back to AUTH_REQUIRE_ADMIN_2FA until an admin changes it
+type settingsTwoFactorPolicy struct {
+	settings *SettingsService
+}
+
+// NewSettingsTwoFactorPolicy returns a two-factor policy backed by system settings
+func NewSettingsTwoFactorPolicy(settings *SettingsService) auth.TwoFactorPolicy {
+	return &settingsTwoFactorPolicy{settings: settings}
+}
+
+func (p *settingsTwoFactorPolicy) AdminTwoFactorRequired(ctx context.Context) (bool, error) {
+	setting, err := p.settings.GetSetting(requireAdminTwoFactorKey, "system", nil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return common.GetEnv("AUTH_REQUIRE_ADMIN_2FA") == "1", nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(setting.Value)
+}
+
+func (p *settingsTwoFactorPolicy) SetAdminTwoFactorRequired(ctx context.Context, required bool) error {
+	return p.settings.UpdateSetting(requireAdminTwoFactorKey, strconv.FormatBool(required), "system", nil)
+}
@@ -140,6 +140,7 @@ type PageData struct {
 	PageTitle   string
 	User        *auth.User // Use pointer from auth package
 	AppVersion  string
+	CSRFToken   string
 	CurrentHost string
 	Error       string
 }
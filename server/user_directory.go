@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// errUserNotFound is returned by the user lookups; handlers compare its message
+var errUserNotFound = errors.New("user not found")
+
+// projectUserDirectory reads and writes accounts in a project's own users table
+type projectUserDirectory struct {
+	db        *sql.DB
+	projectID int64
+	mapping   common.UserDirectory
+	dialect   sqlDialect
+}
+
+// sqlDialect writes the driver-specific parts of the directory's SQL. The zero value is PostgreSQL.
+type sqlDialect struct {
+	mysql bool
+}
+
+// dialectOf returns the dialect of a connection's driver
+func dialectOf(db *sql.DB) sqlDialect {
+	_, isMySQL := db.Driver().(*mysql.MySQLDriver)
+	return sqlDialect{mysql: isMySQL}
+}
+
+// quote quotes an identifier
+func (d sqlDialect) quote(name string) string {
+	if d.mysql {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return pq.QuoteIdentifier(name)
+}
+
+// param returns the placeholder of the nth query argument, counting from 1
+func (d sqlDialect) param(n int) string {
+	if d.mysql {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// nullTime returns a NULL typed as a timestamp
+func (d sqlDialect) nullTime() string {
+	if d.mysql {
+		return "CAST(NULL AS DATETIME)"
+	}
+	return "NULL::timestamptz"
+}
+
+// isDuplicate reports whether err is a unique constraint violation
+func (d sqlDialect) isDuplicate(err error) bool {
+	var pqErr *pq.Error
+	var mysqlErr *mysql.MySQLError
+	return (errors.As(err, &pqErr) && pqErr.Code == "23505") || (errors.As(err, &mysqlErr) && mysqlErr.Number == 1062)
+}
+
+// projectDirectory returns the user directory of the request's project, or nil when the host
+// has no project or the project's logins use ai.users
+func (s *UserService) projectDirectory(ctx context.Context) (*projectUserDirectory, error) {
+	project := projects.GetProjectFromContext(ctx)
+	if project == nil {
+		return nil, nil
+	}
+	mapping, err := s.pdbService.GetUserDirectory(int(project.ID))
+	if err != nil || mapping == nil {
+		return nil, err
+	}
+	conn, err := s.dataService.getConnection(ctx, mapping.ProjectDBID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the user directory of project %d: %w", project.ID, err)
+	}
+	return &projectUserDirectory{db: conn, projectID: project.ID, mapping: *mapping, dialect: dialectOf(conn)}, nil
+}
+
+// table returns the quoted, optionally schema-qualified table name
+func (d *projectUserDirectory) table() string {
+	parts := strings.Split(d.mapping.Table, ".")
+	for i, part := range parts {
+		parts[i] = d.dialect.quote(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// columns returns the select list matching scanUser; optional columns fall back to constants
+func (d *projectUserDirectory) columns() string {
+	quote := d.dialect.quote
+	password, createdAt, lastLogin := "''", "NOW()", d.dialect.nullTime()
+	if d.mapping.PasswordColumn != "" {
+		password = "COALESCE(" + quote(d.mapping.PasswordColumn) + ", '')"
+	}
+	if d.mapping.CreatedAtColumn != "" {
+		createdAt = quote(d.mapping.CreatedAtColumn)
+	}
+	if d.mapping.LastLoginColumn != "" {
+		lastLogin = quote(d.mapping.LastLoginColumn)
+	}
+	return fmt.Sprintf("%s, %s, %s, %s, %s",
+		quote(d.mapping.IDColumn), quote(d.mapping.EmailColumn), password, createdAt, lastLogin)
+}
+
+// scanUser reads a row selected with columns. Directory users are never instance admins.
+func (d *projectUserDirectory) scanUser(row *sql.Row) (*auth.User, error) {
+	user := auth.User{ProjectID: d.projectID}
+	var lastLoggedIn sql.NullTime
+	if err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt, &lastLoggedIn); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errUserNotFound
+		}
+		return nil, err
+	}
+	if lastLoggedIn.Valid {
+		user.LastLoggedIn = lastLoggedIn.Time
+	}
+	return &user, nil
+}
+
+// getByEmail looks an account up by email
+func (d *projectUserDirectory) getByEmail(ctx context.Context, email string) (*auth.User, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s", d.columns(), d.table(), d.dialect.quote(d.mapping.EmailColumn), d.dialect.param(1))
+	return d.scanUser(d.db.QueryRowContext(ctx, query, email))
+}
+
+// getByID looks an account up by ID
+func (d *projectUserDirectory) getByID(ctx context.Context, userID int) (*auth.User, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s", d.columns(), d.table(), d.dialect.quote(d.mapping.IDColumn), d.dialect.param(1))
+	return d.scanUser(d.db.QueryRowContext(ctx, query, userID))
+}
+
+// create adds an account for an email, when the directory allows sign-ups
+func (d *projectUserDirectory) create(ctx context.Context, email string) (*auth.User, error) {
+	if !d.mapping.CreateUsers {
+		return nil, errors.New("this project does not allow new accounts")
+	}
+	columns, values := []string{d.dialect.quote(d.mapping.EmailColumn)}, []string{d.dialect.param(1)}
+	if d.mapping.CreatedAtColumn != "" {
+		columns, values = append(columns, d.dialect.quote(d.mapping.CreatedAtColumn)), append(values, "NOW()")
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", d.table(), strings.Join(columns, ", "), strings.Join(values, ", "))
+
+	var user *auth.User
+	var err error
+	if d.dialect.mysql {
+		// MySQL has no RETURNING; read the new row back by its email
+		if _, err = d.db.ExecContext(ctx, query, email); err == nil {
+			user, err = d.getByEmail(ctx, email)
+		}
+	} else {
+		user, err = d.scanUser(d.db.QueryRowContext(ctx, query+" RETURNING "+d.columns(), email))
+	}
+	if d.dialect.isDuplicate(err) {
+		return nil, fmt.Errorf("email already exists")
+	}
+	return user, err
+}
+
+// touch records a login when the directory has a last login column
+func (d *projectUserDirectory) touch(ctx context.Context, userID int) error {
+	if d.mapping.LastLoginColumn == "" {
+		return nil
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s = NOW() WHERE %s = %s",
+		d.table(), d.dialect.quote(d.mapping.LastLoginColumn), d.dialect.quote(d.mapping.IDColumn), d.dialect.param(1))
+	_, err := d.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+// setPasswordHash stores a new bcrypt hash
+func (d *projectUserDirectory) setPasswordHash(ctx context.Context, userID int, hash string) error {
+	if d.mapping.PasswordColumn == "" {
+		return errors.New("this project's accounts do not have passwords")
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s = %s",
+		d.table(), d.dialect.quote(d.mapping.PasswordColumn), d.dialect.param(1), d.dialect.quote(d.mapping.IDColumn), d.dialect.param(2))
+	result, err := d.db.ExecContext(ctx, query, hash, userID)
+	if err != nil {
+		return fmt.Errorf("database error updating password: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("user with ID %d not found", userID)
+	}
+	return nil
+}
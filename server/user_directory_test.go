@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+// TestUserDirectoryValidate tests that only plain identifiers are accepted as table and column names
+func TestUserDirectoryValidate(t *testing.T) {
+	tests := []struct {
+		directory common.UserDirectory
+		valid     bool
+	}{
+		{common.UserDirectory{Table: "app.users", IDColumn: "id", EmailColumn: "email"}, true},
+		{common.UserDirectory{Table: "users", IDColumn: "id", EmailColumn: "email", PasswordColumn: "password_hash"}, true},
+		{common.UserDirectory{Table: "users", IDColumn: "id"}, false},
+		{common.UserDirectory{Table: "a.b.users", IDColumn: "id", EmailColumn: "email"}, false},
+		{common.UserDirectory{Table: "users; DROP TABLE x", IDColumn: "id", EmailColumn: "email"}, false},
+		{common.UserDirectory{Table: "users", IDColumn: "id", EmailColumn: `email"`}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.directory.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", tt.directory, err, tt.valid)
+		}
+	}
+}
+
+// TestUserDirectoryColumns tests the quoted table name and the select list, with and without optional columns
+func TestUserDirectoryColumns(t *testing.T) {
+	directory := &projectUserDirectory{mapping: common.UserDirectory{Table: "app.users", IDColumn: "id", EmailColumn: "email"}}
+	if got := directory.table(); got != `"app"."users"` {
+		t.Errorf("table() = %s", got)
+	}
+	if got, want := directory.columns(), `"id", "email", '', NOW(), NULL::timestamptz`; got != want {
+		t.Errorf("columns() = %s, want %s", got, want)
+	}
+
+	directory.mapping.PasswordColumn, directory.mapping.LastLoginColumn = "pw", "seen_at"
+	if got, want := directory.columns(), `"id", "email", COALESCE("pw", ''), NOW(), "seen_at"`; got != want {
+		t.Errorf("columns() = %s, want %s", got, want)
+	}
+}
+
+// TestUserDirectoryMySQL tests that directories in MySQL databases get MySQL quoting and placeholders
+func TestUserDirectoryMySQL(t *testing.T) {
+	dialect := sqlDialect{mysql: true}
+	directory := &projectUserDirectory{dialect: dialect, mapping: common.UserDirectory{Table: "app.users", IDColumn: "id", EmailColumn: "e`mail"}}
+	if got := directory.table(); got != "`app`.`users`" {
+		t.Errorf("table() = %s", got)
+	}
+	if got, want := directory.columns(), "`id`, `e``mail`, '', NOW(), CAST(NULL AS DATETIME)"; got != want {
+		t.Errorf("columns() = %s, want %s", got, want)
+	}
+	if dialect.param(2) != "?" || (sqlDialect{}).param(2) != "$2" {
+		t.Errorf("Expected ? for MySQL and $2 for PostgreSQL, got %s and %s", dialect.param(2), (sqlDialect{}).param(2))
+	}
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+var (
+	// ErrLastAdmin is returned when a change would leave no active administrator
+	ErrLastAdmin = errors.New("the last active administrator cannot be deactivated or deleted")
+	// ErrOwnAccount is returned when an administrator deactivates or deletes their own account
+	ErrOwnAccount = errors.New("administrators cannot deactivate or delete their own account")
+	// ErrAccountDeleted is returned when changing an account that has been deleted
+	ErrAccountDeleted = errors.New("this account has been deleted")
+)
+
+// AccountSummary is an ai.users account as listed to administrators
+type AccountSummary struct {
+	ID            int        `json:"id"`
+	Email         string     `json:"email"`
+	IsAdmin       bool       `json:"is_admin"`
+	IsActive      bool       `json:"is_active"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LastLoggedIn  *time.Time `json:"last_logged_in,omitempty"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+// AgentRunExport is an agent run in a user data export
+type AgentRunExport struct {
+	ID        int       `json:"id"`
+	ProjectID int       `json:"project_id,omitempty"`
+	Goal      string    `json:"goal"`
+	Model     string    `json:"model,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// MembershipExport is a project membership in a user data export
+type MembershipExport struct {
+	ProjectID int64         `json:"project_id"`
+	Role      projects.Role `json:"role"`
+}
+
+// UserExport is everything kept about a user, as handed to them on request
+type UserExport struct {
+	ExportedAt  time.Time          `json:"exported_at"`
+	Account     AccountSummary     `json:"account"`
+	Profile     auth.Profile       `json:"profile"`
+	Sessions    []auth.Session     `json:"sessions"`
+	AgentRuns   []AgentRunExport   `json:"agent_runs"`
+	Memberships []MembershipExport `json:"memberships"`
+}
+
+// AccountService deactivates, deletes and exports ai.users accounts. It is also the
+// auth.AccountStatusSource, so deactivated accounts are refused at login and in AuthMiddleware.
+type AccountService struct {
+	db *sql.DB
+}
+
+// NewAccountService creates an account service over ai.users
+func NewAccountService(db *sql.DB) *AccountService {
+	return &AccountService{db: db}
+}
+
+// AccountActive reports whether an account may be used. Project directory accounts have no
+// account status here and are always active; an ai.users account that no longer exists is not.
+func (s *AccountService) AccountActive(ctx context.Context, user *auth.User) (bool, error) {
+	if user.ProjectID != 0 {
+		return true, nil
+	}
+	var active bool
+	err := s.db.QueryRowContext(ctx, common.MustGetSQL("auth/is_active"), user.ID).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
+
+// ListAccounts returns every ai.users account, including deactivated and deleted ones
+func (s *AccountService) ListAccounts(ctx context.Context) ([]AccountSummary, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("auth/list_accounts"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []AccountSummary{}
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, *account)
+	}
+	return accounts, rows.Err()
+}
+
+// GetAccount returns an ai.users account
+func (s *AccountService) GetAccount(ctx context.Context, userID int) (*AccountSummary, error) {
+	account, err := scanAccount(s.db.QueryRowContext(ctx, common.MustGetSQL("auth/get_account"), userID))
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	return account, err
+}
+
+// scanAccount reads an account selected by auth/list_accounts or auth/get_account
+func scanAccount(row interface{ Scan(...interface{}) error }) (*AccountSummary, error) {
+	var account AccountSummary
+	var lastLoggedIn, deactivatedAt, deletedAt sql.NullTime
+	if err := row.Scan(&account.ID, &account.Email, &account.IsAdmin, &account.IsActive, &account.CreatedAt,
+		&lastLoggedIn, &deactivatedAt, &deletedAt); err != nil {
+		return nil, err
+	}
+	account.LastLoggedIn = nullTimePtr(lastLoggedIn)
+	account.DeactivatedAt = nullTimePtr(deactivatedAt)
+	account.DeletedAt = nullTimePtr(deletedAt)
+	return &account, nil
+}
+
+// nullTimePtr returns the time of a nullable column, or nil for NULL
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// DeactivateUser stops an account from logging in and ends its sessions. Its API tokens,
+// passkeys and data are kept, and are usable again once the account is reactivated.
+func (s *AccountService) DeactivateUser(ctx context.Context, actor *auth.User, userID int) (*AccountSummary, error) {
+	account, err := s.changeableAccount(ctx, actor, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setActive(ctx, userID, false); err != nil {
+		return nil, err
+	}
+	if _, err := auth.RevokeUserSessions(ctx, 0, userID); err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	s.audit(ctx, actor, account, auth.AuditUserDeactivate)
+	return s.GetAccount(ctx, userID)
+}
+
+// ReactivateUser lets a deactivated account log in again. Deleted accounts cannot be reactivated.
+func (s *AccountService) ReactivateUser(ctx context.Context, actor *auth.User, userID int) (*AccountSummary, error) {
+	account, err := s.GetAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if account.DeletedAt != nil {
+		return nil, ErrAccountDeleted
+	}
+	if err := s.setActive(ctx, userID, true); err != nil {
+		return nil, err
+	}
+	s.audit(ctx, actor, account, auth.AuditUserReactivate)
+	return s.GetAccount(ctx, userID)
+}
+
+// setActive sets the account status of an account that has not been deleted
+func (s *AccountService) setActive(ctx context.Context, userID int, active bool) error {
+	result, err := s.db.ExecContext(ctx, common.MustGetSQL("auth/set_active"), userID, active)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrAccountDeleted
+	}
+	return nil
+}
+
+// DeleteUser honors a deletion request. The account row is kept so agent runs, audit entries and
+// other references stay valid, but it is anonymized: its email, password and profile are erased,
+// its credentials, devices, avatar, voice conversations, pending login codes and project memberships
+// removed, the invitations sent to its email anonymized and the goals of its agent runs cleared.
+// Audit entries are kept as the record of who did what, under the anonymized email and without its IPs.
+// Everything happens in one transaction, which fails while the user is the last owner of a project.
+func (s *AccountService) DeleteUser(ctx context.Context, actor *auth.User, userID int) error {
+	account, err := s.changeableAccount(ctx, actor, userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := projects.RemoveUserMembershipsTx(ctx, tx, userID); err != nil {
+		return err
+	}
+	// Anonymizing also deactivates the account, so nothing can log in once this commits
+	if _, err := tx.ExecContext(ctx, common.MustGetSQL("auth/anonymize"), userID); err != nil {
+		return fmt.Errorf("failed to anonymize account: %w", err)
+	}
+	deleted, err := scanAccount(tx.QueryRowContext(ctx, common.MustGetSQL("auth/get_account"), userID))
+	if err != nil {
+		return fmt.Errorf("failed to read anonymized account: %w", err)
+	}
+	steps := []struct {
+		query string
+		args  []interface{}
+		what  string
+	}{
+		{"sessions/delete_by_user", []interface{}{userID}, "sessions"},
+		{"sessions/delete_devices", []interface{}{userID}, "devices"},
+		{"api_tokens/delete_by_user", []interface{}{userID}, "API tokens"},
+		{"webauthn/delete_by_user", []interface{}{userID}, "passkeys"},
+		{"two_factor/delete_recovery_codes", []interface{}{userID}, "recovery codes"},
+		{"two_factor/delete", []interface{}{userID}, "two-factor enrolment"},
+		{"auth/delete_avatar", []interface{}{userID}, "avatar"},
+		{"voice/delete_by_user", []interface{}{userID}, "voice conversations"},
+		{"otp_codes/delete_for_email", []interface{}{account.Email}, "login codes"},
+		{"project_invitations/anonymize_for_email", []interface{}{account.Email, deleted.Email}, "invitations"},
+		{"agent_runs/anonymize_by_user", []interface{}{userID}, "agent runs"},
+		{"audit_log/anonymize_user", []interface{}{userID, account.Email, deleted.Email}, "audit log entries"},
+	}
+	for _, step := range steps {
+		if _, err := tx.ExecContext(ctx, common.MustGetSQL(step.query), step.args...); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", step.what, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// The credential stores may keep state outside the database; the account is already inactive,
+	// so a failure here leaves nothing usable behind
+	if err := auth.DeleteAccountCredentials(ctx, userID); err != nil {
+		log.Printf("WARN: Failed to clear cached credentials of deleted user %d: %v", userID, err)
+	}
+	s.audit(ctx, actor, deleted, auth.AuditUserDelete)
+	return nil
+}
+
+// changeableAccount returns an account that actor may deactivate or delete
+func (s *AccountService) changeableAccount(ctx context.Context, actor *auth.User, userID int) (*AccountSummary, error) {
+	if actor != nil && actor.ID == userID {
+		return nil, ErrOwnAccount
+	}
+	account, err := s.GetAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if account.DeletedAt != nil {
+		return nil, ErrAccountDeleted
+	}
+	if account.IsAdmin && account.IsActive {
+		var admins int
+		if err := s.db.QueryRowContext(ctx, common.MustGetSQL("auth/count_active_admins")).Scan(&admins); err != nil {
+			return nil, err
+		}
+		if admins <= 1 {
+			return nil, ErrLastAdmin
+		}
+	}
+	return account, nil
+}
+
+// ExportUserData collects everything kept about a user: their account, profile, sessions,
+// agent runs and project memberships
+func (s *AccountService) ExportUserData(ctx context.Context, actor *auth.User, userID int) (*UserExport, error) {
+	account, err := s.GetAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	export := &UserExport{ExportedAt: time.Now().UTC(), Account: *account}
+
+	user, err := scanProfileUser(s.db.QueryRowContext(ctx, common.MustGetSQL("auth/get_user_by_id"), userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile: %w", err)
+	}
+	export.Profile = auth.Profile{DisplayName: user.DisplayName, Timezone: user.Timezone, Locale: user.Locale}
+
+	if export.Sessions, err = auth.ListUserSessions(ctx, 0, userID); err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	if export.Sessions == nil {
+		export.Sessions = []auth.Session{}
+	}
+
+	if export.AgentRuns, err = s.agentRuns(ctx, userID); err != nil {
+		return nil, fmt.Errorf("failed to list agent runs: %w", err)
+	}
+
+	roles, err := projects.UserMemberships(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list memberships: %w", err)
+	}
+	export.Memberships = []MembershipExport{}
+	for projectID, role := range roles {
+		export.Memberships = append(export.Memberships, MembershipExport{ProjectID: projectID, Role: role})
+	}
+	sort.Slice(export.Memberships, func(i, j int) bool {
+		return export.Memberships[i].ProjectID < export.Memberships[j].ProjectID
+	})
+
+	s.audit(ctx, actor, account, auth.AuditUserExport)
+	return export, nil
+}
+
+// agentRuns lists the agent runs a user started
+func (s *AccountService) agentRuns(ctx context.Context, userID int) ([]AgentRunExport, error) {
+	rows, err := s.db.QueryContext(ctx, common.MustGetSQL("agent_runs/list_by_user"), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []AgentRunExport{}
+	for rows.Next() {
+		var run AgentRunExport
+		if err := rows.Scan(&run.ID, &run.ProjectID, &run.Goal, &run.Model, &run.StartedAt); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// audit records a lifecycle action. Actions from the command line have no actor and are recorded as "cli".
+func (s *AccountService) audit(ctx context.Context, actor *auth.User, account *AccountSummary, action string) {
+	entry := auth.AuditEntry{
+		ActorEmail: "cli",
+		UserID:     account.ID,
+		UserEmail:  account.Email,
+		Action:     action,
+	}
+	if actor != nil {
+		entry.ActorID = actor.ID
+		entry.ActorEmail = actor.Email
+	}
+	auth.RecordAudit(ctx, entry)
+	log.Printf("%s: %s user %d (%s)", entry.ActorEmail, action, account.ID, account.Email)
+}
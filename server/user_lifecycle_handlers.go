@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// AccountActionRequest is the body of the account deactivate, reactivate and delete endpoints
+type AccountActionRequest struct {
+	UserID int `json:"user_id"`
+}
+
+// CreateAccountsHandler creates the handler listing ai.users accounts for administrators (GET)
+func CreateAccountsHandler(accounts *AccountService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		list, err := accounts.ListAccounts(r.Context())
+		if err != nil {
+			log.Printf("Error listing accounts: %v", err)
+			common.JSONError(w, "Failed to list users", http.StatusInternalServerError)
+			return
+		}
+		common.JSONResponse(w, list)
+	}
+}
+
+// CreateAccountActionHandler creates the handler of one account lifecycle action (POST {user_id}):
+// "deactivate", "reactivate" or "delete"
+func CreateAccountActionHandler(accounts *AccountService, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req AccountActionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID <= 0 {
+			common.JSONError(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+		admin := auth.GetUserFromContext(r.Context())
+
+		var account *AccountSummary
+		var err error
+		switch action {
+		case "deactivate":
+			account, err = accounts.DeactivateUser(r.Context(), admin, req.UserID)
+		case "reactivate":
+			account, err = accounts.ReactivateUser(r.Context(), admin, req.UserID)
+		case "delete":
+			err = accounts.DeleteUser(r.Context(), admin, req.UserID)
+		}
+		if err != nil {
+			log.Printf("Admin %s could not %s user %d: %v", admin.Email, action, req.UserID, err)
+			common.JSONError(w, accountErrorMessage(err), accountErrorStatus(err))
+			return
+		}
+		common.JSONResponse(w, map[string]interface{}{"message": "User " + action + "d", "user": account})
+	}
+}
+
+// CreateAccountExportHandler creates the handler downloading a user's data as JSON (GET ?id=)
+func CreateAccountExportHandler(accounts *AccountService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || userID <= 0 {
+			common.JSONError(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		export, err := accounts.ExportUserData(r.Context(), auth.GetUserFromContext(r.Context()), userID)
+		if err != nil {
+			log.Printf("Error exporting data of user %d: %v", userID, err)
+			common.JSONError(w, accountErrorMessage(err), accountErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.json"`, userID))
+		common.JSONResponse(w, export)
+	}
+}
+
+// accountErrorStatus returns the HTTP status of an account service error
+func accountErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrLastAdmin), errors.Is(err, ErrOwnAccount), errors.Is(err, ErrAccountDeleted),
+		errors.Is(err, projects.ErrLastOwner):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// accountErrorMessage returns the message shown for an account service error
+func accountErrorMessage(err error) string {
+	if accountErrorStatus(err) == http.StatusInternalServerError {
+		return "Failed to update the user"
+	}
+	return err.Error()
+}
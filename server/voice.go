@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scriptmaster/openagent/common"
+)
+
+const (
+	voicePersonaKey       = "voice.persona"
+	voiceHistoryTurns     = 20               // Turns included in the model prompt
+	voiceConversationIdle = 30 * time.Minute // Idle conversations are forgotten after this
+	voiceMaxTurnLength    = 2000             // Longest accepted user turn, in characters
+)
+
+// defaultVoicePersona is used when neither the project nor the system defines one
+const defaultVoicePersona = "You are a friendly, concise voice assistant."
+
+// voiceInstructions are appended to every persona so replies work well when spoken
+const voiceInstructions = `Your replies are read aloud by a speech synthesizer.
+Answer in plain conversational sentences. Keep replies short (one to three sentences unless asked for more).
+Do not use markdown, bullet points, code blocks, emojis or URLs.`
+
+// ErrEmptyTurn is returned when a voice turn has no text
+var ErrEmptyTurn = errors.New("turn text cannot be empty")
+
+// VoiceTurn is one utterance in a voice conversation.
+type VoiceTurn struct {
+	Role      string    `json:"role"` // user or assistant
+	Text      string    `json:"text"`
+	SSML      string    `json:"ssml,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// VoiceReply is the answer to a user turn.
+type VoiceReply struct {
+	ConversationID int64  `json:"conversation_id"`
+	Text           string `json:"text"`
+	SSML           string `json:"ssml"`
+}
+
+// VoiceConversation summarises a stored conversation.
+type VoiceConversation struct {
+	ID        int64       `json:"id"`
+	UserID    int         `json:"user_id"`
+	ProjectID int         `json:"project_id,omitempty"`
+	Persona   string      `json:"persona,omitempty"`
+	StartedAt time.Time   `json:"started_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	TurnCount int         `json:"turn_count,omitempty"`
+	Turns     []VoiceTurn `json:"turns,omitempty"`
+}
+
+// voiceSession is the in-memory state of a user's active conversation
+type voiceSession struct {
+	mu             sync.Mutex
+	conversationID int64
+	persona        string
+	turns          []VoiceTurn
+	lastActive     time.Time
+}
+
+// VoiceService keeps per-user voice conversations and answers them with the configured model.
+type VoiceService struct {
+	db        *sql.DB
+	model     ModelClient
+	modelName string
+
+	mu       sync.Mutex
+	sessions map[string]*voiceSession
+	nextID   int64 // Conversation ids when there is no database
+}
+
+// NewVoiceService creates a VoiceService. Transcripts are only stored when db is not nil.
+func NewVoiceService(db *sql.DB, model ModelClient, modelName string) *VoiceService {
+	return &VoiceService{
+		db:        db,
+		model:     model,
+		modelName: modelName,
+		sessions:  make(map[string]*voiceSession),
+	}
+}
+
+// voiceSessionKey identifies a user's conversation within a project
+func voiceSessionKey(userID, projectID int) string {
+	return fmt.Sprintf("%d:%d", userID, projectID)
+}
+
+// truncateRunes shortens text to at most max characters without splitting a UTF-8 sequence
+func truncateRunes(text string, max int) string {
+	count := 0
+	for i := range text {
+		if count == max {
+			return text[:i]
+		}
+		count++
+	}
+	return text
+}
+
+// Respond adds a user turn to the conversation and returns the assistant's reply.
+func (s *VoiceService) Respond(ctx context.Context, userID, projectID int, text string) (VoiceReply, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return VoiceReply{}, ErrEmptyTurn
+	}
+	text = truncateRunes(text, voiceMaxTurnLength)
+
+	session, err := s.session(userID, projectID)
+	if err != nil {
+		return VoiceReply{}, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	userTurn := VoiceTurn{Role: "user", Text: text, CreatedAt: time.Now()}
+	prompt := buildVoicePrompt(session.persona, append(session.turns, userTurn))
+	response, err := s.model.Generate(ctx, s.modelName, prompt)
+	if err != nil {
+		return VoiceReply{}, fmt.Errorf("voice model error: %w", err)
+	}
+
+	replyText := cleanSpokenText(response)
+	assistantTurn := VoiceTurn{Role: "assistant", Text: replyText, SSML: BuildSSML(replyText), CreatedAt: time.Now()}
+	session.turns = append(session.turns, userTurn, assistantTurn)
+	if len(session.turns) > voiceHistoryTurns {
+		session.turns = session.turns[len(session.turns)-voiceHistoryTurns:]
+	}
+	session.lastActive = time.Now()
+	s.storeTurns(session.conversationID, userTurn, assistantTurn)
+
+	return VoiceReply{ConversationID: session.conversationID, Text: replyText, SSML: assistantTurn.SSML}, nil
+}
+
+// Reset forgets the user's active conversation so the next turn starts a new one.
+func (s *VoiceService) Reset(userID, projectID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, voiceSessionKey(userID, projectID))
+}
+
+// session returns the active conversation, starting a new one when there is none or it went idle
+func (s *VoiceService) session(userID, projectID int) (*voiceSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop idle conversations
+	for key, session := range s.sessions {
+		if time.Since(session.lastActive) > voiceConversationIdle {
+			delete(s.sessions, key)
+		}
+	}
+
+	key := voiceSessionKey(userID, projectID)
+	if session, ok := s.sessions[key]; ok {
+		return session, nil
+	}
+
+	persona := s.persona(projectID)
+	session := &voiceSession{persona: persona, lastActive: time.Now()}
+	if s.db != nil {
+		var user, project sql.NullInt64
+		if userID != 0 {
+			user = sql.NullInt64{Int64: int64(userID), Valid: true}
+		}
+		if projectID != 0 {
+			project = sql.NullInt64{Int64: int64(projectID), Valid: true}
+		}
+		if err := s.db.QueryRow(common.MustGetSQL("voice/create_conversation"), user, project, persona).Scan(&session.conversationID); err != nil {
+			return nil, fmt.Errorf("failed to start voice conversation: %w", err)
+		}
+	} else {
+		s.nextID++
+		session.conversationID = s.nextID
+	}
+	s.sessions[key] = session
+	return session, nil
+}
+
+// persona loads the voice persona for a project, falling back to the system setting and then the default
+func (s *VoiceService) persona(projectID int) string {
+	if s.db == nil {
+		return defaultVoicePersona
+	}
+	settings := NewSettingsService(s.db)
+	if projectID != 0 {
+		if setting, err := settings.GetSetting(voicePersonaKey, "project", &projectID); err == nil && strings.TrimSpace(setting.Value) != "" {
+			return setting.Value
+		}
+	}
+	if setting, err := settings.GetSetting(voicePersonaKey, "system", nil); err == nil && strings.TrimSpace(setting.Value) != "" {
+		return setting.Value
+	}
+	return defaultVoicePersona
+}
+
+// storeTurns appends turns to the stored transcript
+func (s *VoiceService) storeTurns(conversationID int64, turns ...VoiceTurn) {
+	if s.db == nil {
+		return
+	}
+	for _, turn := range turns {
+		if _, err := s.db.Exec(common.MustGetSQL("voice/add_turn"), conversationID, turn.Role, turn.Text, turn.SSML); err != nil {
+			log.Printf("Failed to store voice turn for conversation %d: %v", conversationID, err)
+			return
+		}
+	}
+	if _, err := s.db.Exec(common.MustGetSQL("voice/touch_conversation"), conversationID); err != nil {
+		log.Printf("Failed to update voice conversation %d: %v", conversationID, err)
+	}
+}
+
+// buildVoicePrompt formats the persona and recent turns for the model
+func buildVoicePrompt(persona string, turns []VoiceTurn) string {
+	var promptBuilder strings.Builder
+	promptBuilder.WriteString(fmt.Sprintf("[SYSTEM]\n%s\n%s\n\n", persona, voiceInstructions))
+	if len(turns) > voiceHistoryTurns {
+		turns = turns[len(turns)-voiceHistoryTurns:]
+	}
+	for _, turn := range turns {
+		promptBuilder.WriteString(fmt.Sprintf("[%s]\n%s\n\n", strings.ToUpper(turn.Role), turn.Text))
+	}
+	promptBuilder.WriteString("[ASSISTANT]\n")
+	return promptBuilder.String()
+}
+
+var (
+	markdownNoise    = regexp.MustCompile("(?m)^\\s*(#+|[-*•]|\\d+\\.)\\s+|[*_`~]+")
+	sentenceBoundary = regexp.MustCompile(`([.!?])\s+`)
+	blankLines       = regexp.MustCompile(`\n\s*\n`)
+)
+
+// cleanSpokenText strips role prefixes and markdown the model may still produce
+func cleanSpokenText(text string) string {
+	text = strings.TrimSpace(text)
+	text = strings.TrimPrefix(text, "[ASSISTANT]")
+	text = markdownNoise.ReplaceAllString(text, "")
+	return strings.TrimSpace(text)
+}
+
+// BuildSSML wraps reply text in SSML, with a paragraph per block and a sentence per sentence.
+func BuildSSML(text string) string {
+	var b strings.Builder
+	b.WriteString("<speak>")
+	for _, paragraph := range blankLines.Split(strings.TrimSpace(text), -1) {
+		paragraph = strings.Join(strings.Fields(paragraph), " ")
+		if paragraph == "" {
+			continue
+		}
+		b.WriteString("<p>")
+		for _, sentence := range strings.Split(sentenceBoundary.ReplaceAllString(paragraph, "$1\n"), "\n") {
+			if sentence = strings.TrimSpace(sentence); sentence != "" {
+				b.WriteString("<s>")
+				b.WriteString(html.EscapeString(sentence))
+				b.WriteString("</s>")
+			}
+		}
+		b.WriteString("</p>")
+	}
+	b.WriteString("</speak>")
+	return b.String()
+}
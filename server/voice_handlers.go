@@ -0,0 +1,190 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/common"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// VoiceTurnRequest is the body for a transcribed voice turn
+type VoiceTurnRequest struct {
+	Text string `json:"text"`
+}
+
+// CreateVoiceAPIHandler creates a handler for voice turns backed by the configured model
+func CreateVoiceAPIHandler(voice *VoiceService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleVoiceTurn(w, r, voice)
+	}
+}
+
+// CreateVoiceResetHandler creates a handler that ends the user's active voice conversation
+func CreateVoiceResetHandler(voice *VoiceService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleVoiceReset(w, r, voice)
+	}
+}
+
+// CreateVoiceTranscriptsHandler creates a handler for reviewing stored voice transcripts
+func CreateVoiceTranscriptsHandler(projectService projects.ProjectService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		HandleVoiceTranscripts(w, r, GetDB(), projectService)
+	}
+}
+
+// NewVoiceServiceFromEnv creates a VoiceService using the Ollama settings shared with the agent
+func NewVoiceServiceFromEnv(db *sql.DB) *VoiceService {
+	ollamaURL := getEnv("OLLAMA_URL", defaultOllamaURL)
+	modelName := getEnv("VOICE_MODEL", getEnv("OLLAMA_MODEL", defaultModel))
+	return NewVoiceService(db, NewOllamaClient(ollamaURL, nil), modelName)
+}
+
+// HandleVoiceTurn answers a transcribed user turn with text and SSML.
+// The persona comes from the current project (or ?project_id= for project managers).
+// Conversations are keyed by ai.users ID, so project directory accounts cannot hold one.
+func HandleVoiceTurn(w http.ResponseWriter, r *http.Request, voice *VoiceService) {
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req VoiceTurnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		common.JSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	scope := promptScopeFromRequest(r)
+	reply, err := voice.Respond(r.Context(), user.ID, scope.ProjectID, req.Text)
+	if errors.Is(err, ErrEmptyTurn) {
+		common.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Voice turn failed for %s: %v", user.Email, err)
+		common.JSONError(w, "Failed to generate a reply", http.StatusBadGateway)
+		return
+	}
+	common.JSONResponse(w, reply)
+}
+
+// HandleVoiceReset ends the user's active voice conversation
+func HandleVoiceReset(w http.ResponseWriter, r *http.Request, voice *VoiceService) {
+	user, ok := requireInstanceAccount(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	voice.Reset(user.ID, promptScopeFromRequest(r).ProjectID)
+	common.JSONResponse(w, map[string]bool{"success": true})
+}
+
+// HandleVoiceTranscripts lists stored voice conversations, or returns one with its turns (?id=).
+// Users see their own conversations; project admins and owners can review a project's (?project_id=).
+// Project directory accounts own no conversations and can only use ?project_id=.
+func HandleVoiceTranscripts(w http.ResponseWriter, r *http.Request, db *sql.DB, projectService projects.ProjectService) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		common.JSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		common.JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if db == nil {
+		common.JSONError(w, "Service unavailable: Database not configured or connection failed.", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	if id, _ := strconv.ParseInt(query.Get("id"), 10, 64); id != 0 {
+		var c VoiceConversation
+		err := db.QueryRow(common.MustGetSQL("voice/read_conversation"), id).
+			Scan(&c.ID, &c.UserID, &c.ProjectID, &c.Persona, &c.StartedAt, &c.UpdatedAt)
+		if err == sql.ErrNoRows {
+			common.JSONError(w, "Conversation not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error loading voice conversation %d: %v", id, err)
+			common.JSONError(w, "Failed to load conversation", http.StatusInternalServerError)
+			return
+		}
+		if !ownerOrManager(r.Context(), user, c.UserID, c.ProjectID) {
+			common.JSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		rows, err := db.Query(common.MustGetSQL("voice/list_turns"), id)
+		if err != nil {
+			log.Printf("Error loading voice turns for conversation %d: %v", id, err)
+			common.JSONError(w, "Failed to load conversation", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		c.Turns = []VoiceTurn{}
+		for rows.Next() {
+			var turn VoiceTurn
+			if err := rows.Scan(&turn.Role, &turn.Text, &turn.SSML, &turn.CreatedAt); err != nil {
+				log.Printf("Error scanning voice turn: %v", err)
+				common.JSONError(w, "Failed to load conversation", http.StatusInternalServerError)
+				return
+			}
+			c.Turns = append(c.Turns, turn)
+		}
+		c.TurnCount = len(c.Turns)
+		common.JSONResponse(w, c)
+		return
+	}
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	var rows *sql.Rows
+	var err error
+	if projectID, _ := strconv.Atoi(query.Get("project_id")); projectID != 0 {
+		if !projectAllows(r.Context(), user, projectID, projects.PermManage) {
+			common.JSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		rows, err = db.Query(common.MustGetSQL("voice/list_conversations_by_project"), projectID, limit)
+	} else if userID := instanceUserID(user); userID != 0 {
+		rows, err = db.Query(common.MustGetSQL("voice/list_conversations_by_user"), userID, limit)
+	} else {
+		common.JSONError(w, "Not available for project accounts", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing voice conversations: %v", err)
+		common.JSONError(w, "Failed to list conversations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	conversations := []VoiceConversation{}
+	for rows.Next() {
+		var c VoiceConversation
+		if err := rows.Scan(&c.ID, &c.UserID, &c.ProjectID, &c.Persona, &c.StartedAt, &c.UpdatedAt, &c.TurnCount); err != nil {
+			log.Printf("Error scanning voice conversation: %v", err)
+			common.JSONError(w, "Failed to list conversations", http.StatusInternalServerError)
+			return
+		}
+		conversations = append(conversations, c)
+	}
+	common.JSONResponse(w, conversations)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/scriptmaster/openagent/auth"
+)
+
+// promptRecorder is a ModelClient that records prompts and answers with a fixed reply
+type promptRecorder struct {
+	reply   string
+	prompts []string
+}
+
+func (m *promptRecorder) Generate(ctx context.Context, model, prompt string) (string, error) {
+	m.prompts = append(m.prompts, prompt)
+	return m.reply, nil
+}
+
+// TestBuildSSML tests that replies are split into paragraphs and sentences and escaped
+func TestBuildSSML(t *testing.T) {
+	got := BuildSSML("Use <b> & \"quotes\". Done!\n\nSecond   paragraph?")
+	want := "<speak><p><s>Use &lt;b&gt; &amp; &#34;quotes&#34;.</s><s>Done!</s></p><p><s>Second paragraph?</s></p></speak>"
+	if got != want {
+		t.Errorf("Unexpected SSML:\n got %s\nwant %s", got, want)
+	}
+
+	if got := BuildSSML(""); got != "<speak></speak>" {
+		t.Errorf("Expected empty speak element, got %s", got)
+	}
+}
+
+// TestVoiceConversation tests that turns share per-user state and reset starts a new conversation
+func TestVoiceConversation(t *testing.T) {
+	model := &promptRecorder{reply: "**Sure.** Here you go."}
+	voice := NewVoiceService(nil, model, "test-model")
+	ctx := context.Background()
+
+	first, err := voice.Respond(ctx, 1, 0, "What's the weather?")
+	if err != nil {
+		t.Fatalf("First turn failed: %v", err)
+	}
+	if first.Text != "Sure. Here you go." {
+		t.Errorf("Expected markdown to be stripped, got %q", first.Text)
+	}
+	if first.SSML != "<speak><p><s>Sure.</s><s>Here you go.</s></p></speak>" {
+		t.Errorf("Unexpected SSML: %s", first.SSML)
+	}
+	if !strings.Contains(model.prompts[0], defaultVoicePersona) {
+		t.Errorf("Expected prompt to include the default persona, got %q", model.prompts[0])
+	}
+
+	second, err := voice.Respond(ctx, 1, 0, "And tomorrow?")
+	if err != nil {
+		t.Fatalf("Second turn failed: %v", err)
+	}
+	if second.ConversationID != first.ConversationID {
+		t.Errorf("Expected the same conversation, got %d and %d", first.ConversationID, second.ConversationID)
+	}
+	if !strings.Contains(model.prompts[1], "What's the weather?") || !strings.Contains(model.prompts[1], "And tomorrow?") {
+		t.Errorf("Expected prompt to include earlier turns, got %q", model.prompts[1])
+	}
+
+	other, err := voice.Respond(ctx, 2, 0, "Hello")
+	if err != nil {
+		t.Fatalf("Other user's turn failed: %v", err)
+	}
+	if other.ConversationID == first.ConversationID || strings.Contains(model.prompts[2], "weather") {
+		t.Error("Expected users not to share conversation state")
+	}
+
+	voice.Reset(1, 0)
+	fresh, err := voice.Respond(ctx, 1, 0, "Start over")
+	if err != nil {
+		t.Fatalf("Turn after reset failed: %v", err)
+	}
+	if fresh.ConversationID == first.ConversationID || strings.Contains(model.prompts[3], "weather") {
+		t.Error("Expected reset to start a new conversation")
+	}
+
+	if _, err := voice.Respond(ctx, 1, 0, "   "); err != ErrEmptyTurn {
+		t.Errorf("Expected ErrEmptyTurn, got %v", err)
+	}
+}
+
+// TestTruncateRunes tests that long turns are cut on character boundaries
+func TestTruncateRunes(t *testing.T) {
+	if got := truncateRunes("héllo", 2); got != "hé" {
+		t.Errorf("Expected %q, got %q", "hé", got)
+	}
+	if got := truncateRunes("日本語", 5); got != "日本語" {
+		t.Errorf("Expected short text to be kept, got %q", got)
+	}
+	long := strings.Repeat("é", voiceMaxTurnLength+10)
+	if got := truncateRunes(long, voiceMaxTurnLength); !utf8.ValidString(got) || utf8.RuneCountInString(got) != voiceMaxTurnLength {
+		t.Errorf("Expected %d valid characters, got %d (valid %v)", voiceMaxTurnLength, utf8.RuneCountInString(got), utf8.ValidString(got))
+	}
+}
+
+// TestVoiceDirectoryAccounts tests that a project directory account never uses the voice state
+// or transcripts of the ai.users account with the same ID
+func TestVoiceDirectoryAccounts(t *testing.T) {
+	voice := NewVoiceService(nil, &promptRecorder{reply: "Hello."}, "test-model")
+	// Nothing listens there: directory accounts are refused before any query
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	do := func(user *auth.User, handler http.HandlerFunc, method, path, body string) int {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req = req.WithContext(auth.SetUserContext(req.Context(), user))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	turn := func(w http.ResponseWriter, r *http.Request) { HandleVoiceTurn(w, r, voice) }
+	reset := func(w http.ResponseWriter, r *http.Request) { HandleVoiceReset(w, r, voice) }
+	transcripts := func(w http.ResponseWriter, r *http.Request) { HandleVoiceTranscripts(w, r, db, nil) }
+
+	member := &auth.User{ID: 1, Email: "ada@example.com"}
+	directory := &auth.User{ID: 1, Email: "eve@example.com", ProjectID: 9}
+
+	if code := do(member, turn, http.MethodPost, "/api/voice", `{"text":"Hi"}`); code != http.StatusOK {
+		t.Fatalf("Expected the instance account's turn to succeed, got %d", code)
+	}
+	if code := do(directory, turn, http.MethodPost, "/api/voice", `{"text":"What did I say?"}`); code != http.StatusForbidden {
+		t.Errorf("Expected a directory account's turn to be refused, got %d", code)
+	}
+	if code := do(directory, reset, http.MethodPost, "/api/voice/reset", ""); code != http.StatusForbidden {
+		t.Errorf("Expected a directory account's reset to be refused, got %d", code)
+	}
+	if code := do(directory, transcripts, http.MethodGet, "/api/voice/transcripts", ""); code != http.StatusForbidden {
+		t.Errorf("Expected a directory account's own transcript list to be refused, got %d", code)
+	}
+
+	if !ownerOrManager(context.Background(), member, 1, 0) {
+		t.Error("Expected the instance account to own its conversation")
+	}
+	if ownerOrManager(context.Background(), directory, 1, 0) {
+		t.Error("Expected a directory account not to own the instance account's conversation")
+	}
+}
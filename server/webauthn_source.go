@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/scriptmaster/openagent/auth"
+	"github.com/scriptmaster/openagent/projects"
+)
+
+// webauthnOption is the project option overriding the project's passkey relying party
+const webauthnOption = "webauthn"
+
+// projectWebAuthn scopes passkeys to the domain of the request's project, named after the project.
+// The "webauthn" project option can set another rp_id (a parent domain), rp_name and origins.
+type projectWebAuthn struct{}
+
+// NewProjectWebAuthn returns a relying party source that follows project domains
+func NewProjectWebAuthn() auth.WebAuthnRPSource {
+	return projectWebAuthn{}
+}
+
+func (projectWebAuthn) RelyingParty(r *http.Request) (*auth.RelyingParty, error) {
+	project := projects.GetProjectFromContext(r.Context())
+	if project == nil {
+		return auth.InstanceRelyingParty(r), nil
+	}
+	rp := auth.RelyingParty{Name: project.Name}
+	if project.Options[webauthnOption] != nil {
+		// Options come back from JSONB as generic maps, so round-trip them into the config type
+		raw, err := json.Marshal(project.Options[webauthnOption])
+		if err != nil {
+			return nil, err
+		}
+		var override auth.RelyingParty
+		if err := json.Unmarshal(raw, &override); err != nil {
+			return nil, fmt.Errorf("invalid %s in project %d options: %w", webauthnOption, project.ID, err)
+		}
+		if override.ID != "" {
+			rp.ID = override.ID
+		}
+		if override.Name != "" {
+			rp.Name = override.Name
+		}
+		rp.Origins = override.Origins
+	}
+	return auth.RequestRelyingParty(r, rp), nil
+}
@@ -0,0 +1,60 @@
+// Sends the CSRF token with same-origin state-changing requests, see auth.CSRFMiddleware.
+// fetch() and XMLHttpRequest get the X-CSRF-Token header; posted forms get a csrf_token field.
+(function () {
+    var safe = /^(GET|HEAD|OPTIONS|TRACE)$/i;
+
+    // The page head carries the token as a meta tag; the cookie covers pages rendered without it
+    function token() {
+        var meta = document.querySelector('meta[name="csrf-token"]');
+        if (meta && meta.content) {
+            return meta.content;
+        }
+        var match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+        return match ? decodeURIComponent(match[1]) : '';
+    }
+
+    function sameOrigin(url) {
+        return new URL(url, window.location.href).origin === window.location.origin;
+    }
+
+    var originalFetch = window.fetch;
+    window.fetch = function (input, init) {
+        init = init || {};
+        var method = init.method || (input instanceof Request ? input.method : 'GET');
+        var url = input instanceof Request ? input.url : String(input);
+        if (!safe.test(method) && sameOrigin(url) && token()) {
+            var headers = new Headers(init.headers || (input instanceof Request ? input.headers : undefined));
+            headers.set('X-CSRF-Token', token());
+            init = Object.assign({}, init, { headers: headers });
+        }
+        return originalFetch.call(this, input, init);
+    };
+
+    var originalOpen = XMLHttpRequest.prototype.open;
+    var originalSend = XMLHttpRequest.prototype.send;
+    XMLHttpRequest.prototype.open = function (method, url) {
+        this._csrf = !safe.test(method) && sameOrigin(url);
+        return originalOpen.apply(this, arguments);
+    };
+    XMLHttpRequest.prototype.send = function () {
+        if (this._csrf && token()) {
+            this.setRequestHeader('X-CSRF-Token', token());
+        }
+        return originalSend.apply(this, arguments);
+    };
+
+    document.addEventListener('submit', function (event) {
+        var form = event.target;
+        if (!(form instanceof HTMLFormElement) || safe.test(form.method) || !sameOrigin(form.action)) {
+            return;
+        }
+        var field = form.querySelector('input[name="csrf_token"]');
+        if (!field) {
+            field = document.createElement('input');
+            field.type = 'hidden';
+            field.name = 'csrf_token';
+            form.appendChild(field);
+        }
+        field.value = token();
+    }, true);
+})();
@@ -0,0 +1,116 @@
+// Passkey (WebAuthn) helpers, see auth/webauthn.go. The server sends and receives WebAuthn's
+// JSON forms, with binary fields as base64url; these convert them to and from ArrayBuffers.
+window.Passkeys = (function () {
+    function toBuffer(value) {
+        var base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+        var binary = atob(base64 + '==='.slice((base64.length + 3) % 4));
+        var bytes = new Uint8Array(binary.length);
+        for (var i = 0; i < binary.length; i++) bytes[i] = binary.charCodeAt(i);
+        return bytes.buffer;
+    }
+
+    function fromBuffer(buffer) {
+        if (!buffer) return undefined;
+        var bytes = new Uint8Array(buffer);
+        var binary = '';
+        for (var i = 0; i < bytes.length; i++) binary += String.fromCharCode(bytes[i]);
+        return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+
+    function descriptors(list) {
+        return (list || []).map(function (c) { return Object.assign({}, c, { id: toBuffer(c.id) }); });
+    }
+
+    function postJSON(url, body) {
+        return fetch(url, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body || {})
+        }).then(function (response) {
+            return response.json().then(function (data) {
+                if (!response.ok) throw new Error(data.error || data.message || 'Request failed');
+                return data;
+            });
+        });
+    }
+
+    function supported() {
+        return !!(window.PublicKeyCredential && navigator.credentials);
+    }
+
+    // Whether the browser can offer passkeys in autofill (conditional UI)
+    function conditionalSupported() {
+        if (!supported() || !PublicKeyCredential.isConditionalMediationAvailable) return Promise.resolve(false);
+        return PublicKeyCredential.isConditionalMediationAvailable().catch(function () { return false; });
+    }
+
+    // Creates a passkey with the options from /api/profile/passkeys/options and returns it in JSON form
+    function create(options) {
+        var publicKey = Object.assign({}, options.publicKey, {
+            challenge: toBuffer(options.publicKey.challenge),
+            user: Object.assign({}, options.publicKey.user, { id: toBuffer(options.publicKey.user.id) }),
+            excludeCredentials: descriptors(options.publicKey.excludeCredentials)
+        });
+        return navigator.credentials.create({ publicKey: publicKey }).then(function (credential) {
+            return {
+                id: credential.id,
+                rawId: fromBuffer(credential.rawId),
+                type: credential.type,
+                response: {
+                    clientDataJSON: fromBuffer(credential.response.clientDataJSON),
+                    attestationObject: fromBuffer(credential.response.attestationObject),
+                    transports: credential.response.getTransports ? credential.response.getTransports() : []
+                }
+            };
+        });
+    }
+
+    // Gets an assertion with the options from /auth/passkey/options and returns it in JSON form.
+    // With mediation 'conditional' the browser waits until the user picks a passkey from autofill.
+    function get(options, mediation, signal) {
+        var publicKey = Object.assign({}, options.publicKey, {
+            challenge: toBuffer(options.publicKey.challenge),
+            allowCredentials: descriptors(options.publicKey.allowCredentials)
+        });
+        var request = { publicKey: publicKey, signal: signal };
+        if (mediation) request.mediation = mediation;
+        return navigator.credentials.get(request).then(function (credential) {
+            return {
+                id: credential.id,
+                rawId: fromBuffer(credential.rawId),
+                type: credential.type,
+                response: {
+                    clientDataJSON: fromBuffer(credential.response.clientDataJSON),
+                    authenticatorData: fromBuffer(credential.response.authenticatorData),
+                    signature: fromBuffer(credential.response.signature),
+                    userHandle: fromBuffer(credential.response.userHandle)
+                }
+            };
+        });
+    }
+
+    // Runs a passkey login and resolves with the login response, which names where to go next
+    function login(mediation, signal) {
+        return postJSON('/auth/passkey/options').then(function (options) {
+            return get(options, mediation, signal);
+        }).then(function (credential) {
+            return postJSON('/auth/passkey/login', { credential: credential });
+        });
+    }
+
+    // Registers a new passkey for the logged-in user under the given name
+    function register(name) {
+        return postJSON('/api/profile/passkeys/options').then(function (options) {
+            return create(options);
+        }).then(function (credential) {
+            return postJSON('/api/profile/passkeys', { name: name, credential: credential });
+        });
+    }
+
+    return {
+        supported: supported,
+        conditionalSupported: conditionalSupported,
+        login: login,
+        register: register
+    };
+})();
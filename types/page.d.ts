@@ -15,6 +15,11 @@ declare interface AuthUser {
     ID:           number;
 	Email:        string;
 	IsAdmin:      boolean;
-	MemberSince:  Date; // CreatedAt
+	CreatedAt:    Date; // Member since
 	LastLoggedIn: Date;
+	DisplayName:  string; // Empty when the user has not set one
+	Timezone:     string; // IANA name; empty uses the browser's
+	Locale:       string; // BCP 47 tag; empty uses the browser's
+	AvatarURL:    string; // Uploaded avatar or Gravatar
+	Impersonator: AuthUser | null; // Admin acting as this user
 }